@@ -70,19 +70,12 @@ func main() {
 	apiDoneChannel := make(chan bool)
 
 	// create the OLT device
-	olt := devices.CreateOLT(
-		options.OltID,
-		options.NumNniPerOlt,
-		options.NumPonPerOlt,
-		options.NumOnuPerPon,
-		options.STag,
-		options.CTagInit,
-		&oltDoneChannel,
-		&apiDoneChannel,
-		true, // this parameter is not important in the BBR Case
-		true, // this parameter is not important in the BBR Case
-		true,
-	)
+	// NOTE these parameters are not important in the BBR Case
+	options.Auth = true
+	options.Dhcp = true
+	options.RebootDelay = 0
+	devices.SetOnuWorkers(options.OnuWorkers)
+	olt := devices.CreateOLT(options.BBSimCliOptions, &oltDoneChannel, &apiDoneChannel, true)
 	oltMock := bbrdevices.OltMock{
 		Olt:           olt,
 		TargetOnus:    options.NumPonPerOlt * options.NumOnuPerPon,
@@ -37,21 +37,22 @@ import (
 	"google.golang.org/grpc/reflection"
 )
 
-func startApiServer(channel chan bool, group *sync.WaitGroup) {
-	// TODO make configurable
-	address := "0.0.0.0:50070"
-	log.Debugf("APIServer listening on: %v", address)
+func startApiServer(channel chan bool, group *sync.WaitGroup, address string, restAddress string, addresses *common.ListenAddresses) {
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("APIServer failed to listen: %v", err)
 	}
+	address = common.ListenerAddress(address, lis)
+	log.Infof("APIServer listening on: %v", address)
+	addresses.Add("api", address)
+
 	grpcServer := grpc.NewServer()
 	bbsim.RegisterBBSimServer(grpcServer, api.BBSimServer{})
 
 	reflection.Register(grpcServer)
 
 	go grpcServer.Serve(lis)
-	go startApiRestServer(channel, group, address)
+	go startApiRestServer(channel, group, address, restAddress, addresses)
 
 	select {
 	case <-channel:
@@ -64,14 +65,11 @@ func startApiServer(channel chan bool, group *sync.WaitGroup) {
 }
 
 // startApiRestServer method starts the REST server (grpc gateway) for BBSim.
-func startApiRestServer(channel chan bool, group *sync.WaitGroup, grpcAddress string) {
+func startApiRestServer(channel chan bool, group *sync.WaitGroup, grpcAddress string, address string, addresses *common.ListenAddresses) {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// TODO make configurable
-	address := "0.0.0.0:50071"
-
 	mux := runtime.NewServeMux()
 	opts := []grpc.DialOption{grpc.WithInsecure()}
 
@@ -80,11 +78,18 @@ func startApiRestServer(channel chan bool, group *sync.WaitGroup, grpcAddress st
 		return
 	}
 
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("REST API server failed to listen: %v", err)
+	}
+	address = common.ListenerAddress(address, lis)
+	addresses.Add("restApi", address)
+
 	s := &http.Server{Addr: address, Handler: mux}
 
 	go func() {
 		log.Infof("REST API server listening on %s ...", address)
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.Serve(lis); err != nil && err != http.ErrServerClosed {
 			log.Errorf("Could not start API server: %v", err)
 			return
 		}
@@ -100,23 +105,22 @@ func startApiRestServer(channel chan bool, group *sync.WaitGroup, grpcAddress st
 }
 
 // This server aims to provide compatibility with the previous BBSim version. It is deprecated and will be removed in the future.
-func startLegacyApiServer(channel chan bool, group *sync.WaitGroup) {
-	// TODO make configurable
-	grpcAddress := "0.0.0.0:50072"
-	restAddress := "0.0.0.0:50073"
-
-	log.Debugf("Legacy APIServer listening on: %v", grpcAddress)
+func startLegacyApiServer(channel chan bool, group *sync.WaitGroup, grpcAddress string, restAddress string, addresses *common.ListenAddresses) {
 	listener, err := net.Listen("tcp", grpcAddress)
 	if err != nil {
 		log.Fatalf("Legacy APIServer failed to listen: %v", err)
 		return
 	}
+	grpcAddress = common.ListenerAddress(grpcAddress, listener)
+	log.Infof("Legacy APIServer listening on: %v", grpcAddress)
+	addresses.Add("legacyApi", grpcAddress)
+
 	apiserver := grpc.NewServer()
 	legacy.RegisterBBSimServiceServer(apiserver, api.BBSimLegacyServer{})
 
 	go apiserver.Serve(listener)
 	// Start rest gateway for BBSim server
-	go api.StartRestGatewayService(channel, group, grpcAddress, restAddress)
+	go api.StartRestGatewayService(channel, group, grpcAddress, restAddress, addresses)
 
 	select {
 	case <-channel:
@@ -147,14 +151,18 @@ func main() {
 
 	log.WithFields(log.Fields{
 		"OltID":        options.OltID,
+		"NumOlts":      options.NumOlts,
 		"NumNniPerOlt": options.NumNniPerOlt,
 		"NumPonPerOlt": options.NumPonPerOlt,
 		"NumOnuPerPon": options.NumOnuPerPon,
-		"TotalOnus":    options.NumPonPerOlt * options.NumOnuPerPon,
+		"TotalOnus":    options.NumOlts * options.NumPonPerOlt * options.NumOnuPerPon,
 		"Auth":         options.Auth,
 		"Dhcp":         options.Dhcp,
+		"OnuWorkers":   options.OnuWorkers,
 	}).Info("BroadBand Simulator is on")
 
+	devices.SetOnuWorkers(options.OnuWorkers)
+
 	// control channels, they are only closed when the goroutine needs to be terminated
 	oltDoneChannel := make(chan bool)
 	apiDoneChannel := make(chan bool)
@@ -171,25 +179,25 @@ func main() {
 	}()
 
 	wg := sync.WaitGroup{}
-	wg.Add(5)
-
-	olt := devices.CreateOLT(
-		options.OltID,
-		options.NumNniPerOlt,
-		options.NumPonPerOlt,
-		options.NumOnuPerPon,
-		options.STag,
-		options.CTagInit,
-		&oltDoneChannel,
-		&apiDoneChannel,
-		options.Auth,
-		options.Dhcp,
-		false,
-	)
-	go devices.StartOlt(olt, &wg)
-	log.Debugf("Created OLT with id: %d", options.OltID)
-	go startApiServer(apiDoneChannel, &wg)
-	go startLegacyApiServer(apiDoneChannel, &wg)
+	wg.Add(4 + options.NumOlts)
+	addresses := common.NewListenAddresses(options.AddressesFile, 4+options.NumOlts)
+
+	for i := 0; i < options.NumOlts; i++ {
+		// every OLT has its own ID and gRPC server
+		oltOptions := *options
+		oltOptions.OltID = options.OltID + i
+		address, err := common.AddressWithPortOffset(options.OltAddress, i)
+		if err != nil {
+			log.Fatalf("Invalid OLT address %s: %v", options.OltAddress, err)
+		}
+		oltOptions.OltAddress = address
+
+		olt := devices.CreateOLT(&oltOptions, &oltDoneChannel, &apiDoneChannel, false)
+		go devices.StartOlt(olt, &wg, addresses)
+		log.Debugf("Created OLT with id: %d", oltOptions.OltID)
+	}
+	go startApiServer(apiDoneChannel, &wg, options.ApiAddress, options.RestApiAddress, addresses)
+	go startLegacyApiServer(apiDoneChannel, &wg, options.LegacyApiAddress, options.LegacyRestApiAddress, addresses)
 
 	log.Debugf("Started APIService")
 
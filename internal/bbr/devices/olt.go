@@ -211,7 +211,7 @@ func (o *OltMock) handleOnuIndication(client openolt.OpenoltClient, onuInd *open
 		}).Fatal("Cannot find ONU")
 	}
 
-	go onu.ProcessOnuMessages(nil, client)
+	go onu.ProcessOnuMessages(context.Background(), nil, client)
 
 	go func() {
 
@@ -280,7 +280,7 @@ func (o *OltMock) handleOmciIndication(client openolt.OpenoltClient, omciInd *op
 			OmciInd: omciInd,
 		},
 	}
-	onu.Channel <- msg
+	onu.Enqueue(msg)
 }
 
 func (o *OltMock) handlePktIndication(client openolt.OpenoltClient, pktIndication *openolt.PacketIndication) {
@@ -332,7 +332,7 @@ func (o *OltMock) handlePktIndication(client openolt.OpenoltClient, pktIndicatio
 			},
 		}
 		// NOTE we send it on the ONU channel so that is handled as all the others packets in a separate thread
-		onu.Channel <- msg
+		onu.Enqueue(msg)
 	} else {
 		// TODO a very similar construct is used in many places,
 		// abstract this in an OLT method
@@ -363,7 +363,7 @@ func (o *OltMock) handlePktIndication(client openolt.OpenoltClient, pktIndicatio
 				Type:   pktType,
 			},
 		}
-		onu.Channel <- msg
+		onu.Enqueue(msg)
 	}
 }
 
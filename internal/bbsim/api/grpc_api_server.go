@@ -18,11 +18,15 @@ package api
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/opencord/bbsim/api/bbsim"
 	"github.com/opencord/bbsim/internal/bbsim/devices"
 	"github.com/opencord/bbsim/internal/common"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var logger = log.WithFields(log.Fields{
@@ -49,8 +53,41 @@ func (s BBSimServer) Version(ctx context.Context, req *bbsim.Empty) (*bbsim.Vers
 	}, nil
 }
 
-func (s BBSimServer) GetOlt(ctx context.Context, req *bbsim.Empty) (*bbsim.Olt, error) {
-	olt := devices.GetOLT()
+// getOlt returns the OLT with the given ID, or a NotFound error.
+// NOTE the requests that omit the ID (eg: GET /v1/olt or bbsimctl without --olt) have it set to 0,
+// if there's no OLT 0 they refer to the first one, so that a BBSim started with -olt_id 5 can be used as before
+func getOlt(oltId int32) (*devices.OltDevice, error) {
+	olt, err := devices.GetOLTById(int(oltId))
+	if err != nil && oltId == 0 {
+		if first := devices.GetOLT(); first != nil {
+			return first, nil
+		}
+	}
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return olt, nil
+}
+
+func (s BBSimServer) GetOlts(ctx context.Context, req *bbsim.Empty) (*bbsim.Olts, error) {
+	olts := bbsim.Olts{
+		Items: []*bbsim.Olt{},
+	}
+	for _, olt := range devices.GetOLTs() {
+		olts.Items = append(olts.Items, oltToProto(olt))
+	}
+	return &olts, nil
+}
+
+func (s BBSimServer) GetOlt(ctx context.Context, req *bbsim.OltRequest) (*bbsim.Olt, error) {
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.Olt{}, err
+	}
+	return oltToProto(olt), nil
+}
+
+func oltToProto(olt *devices.OltDevice) *bbsim.Olt {
 	nnis := []*bbsim.NNIPort{}
 	pons := []*bbsim.PONPort{}
 
@@ -77,8 +114,9 @@ func (s BBSimServer) GetOlt(ctx context.Context, req *bbsim.Empty) (*bbsim.Olt,
 		InternalState: olt.InternalState.Current(),
 		NNIPorts:      nnis,
 		PONPorts:      pons,
+		Address:       olt.Address(),
 	}
-	return &res, nil
+	return &res
 }
 
 func (s BBSimServer) SetLogLevel(ctx context.Context, req *bbsim.LogLevel) (*bbsim.LogLevel, error) {
@@ -90,3 +128,28 @@ func (s BBSimServer) SetLogLevel(ctx context.Context, req *bbsim.LogLevel) (*bbs
 		Caller: log.StandardLogger().ReportCaller,
 	}, nil
 }
+
+func (s BBSimServer) SetHeartbeatFailure(ctx context.Context, req *bbsim.HeartbeatFailure) (*bbsim.Response, error) {
+	logger.WithFields(log.Fields{
+		"OltId":    req.OltID,
+		"Mode":     req.Mode,
+		"Duration": req.Duration,
+	}).Infof("Received request to set the OLT heartbeat failure")
+
+	mode := devices.HeartbeatFail
+	if req.Mode == bbsim.HeartbeatFailure_HANG {
+		mode = devices.HeartbeatHang
+	}
+
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.Response{StatusCode: int32(codes.NotFound), Message: err.Error()}, err
+	}
+	olt.SetHeartbeatFailure(mode, time.Duration(req.Duration)*time.Second)
+
+	res := &bbsim.Response{
+		StatusCode: int32(codes.OK),
+		Message:    fmt.Sprintf("OLT heartbeat set to %s for %d seconds.", req.Mode, req.Duration),
+	}
+	return res, nil
+}
@@ -18,12 +18,14 @@ package api
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"sync"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/opencord/bbsim/api/legacy"
 	"github.com/opencord/bbsim/internal/bbsim/devices"
+	"github.com/opencord/bbsim/internal/common"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -117,7 +119,7 @@ func (s BBSimLegacyServer) ONUStatus(ctx context.Context, in *legacy.ONURequest)
 	// Get status of all ONUs
 	olt := devices.GetOLT()
 	for _, p := range olt.Pons {
-		for _, o := range p.Onus {
+		for _, o := range p.GetOnus() {
 			onuInfo.Onus = append(onuInfo.Onus, copyONUInfo(o))
 		}
 	}
@@ -167,14 +169,23 @@ func (s BBSimLegacyServer) PerformDeviceAction(ctx context.Context, in *legacy.D
 
 // GetFlows returns all flows or flows for specified ONU
 func (s BBSimLegacyServer) GetFlows(ctx context.Context, in *legacy.ONUInfo) (*legacy.Flows, error) {
-	logger.Info("GetFlow request received")
-	logger.Error("Not implemented")
+	logger.Trace("GetFlows request received")
+	olt := devices.GetOLT()
+
+	if in.OnuSerial == "" {
+		return &legacy.Flows{Flows: olt.Flows.GetAll()}, nil
+	}
+
+	onu, err := olt.FindOnuBySn(in.OnuSerial)
+	if err != nil {
+		return &legacy.Flows{}, status.Errorf(codes.NotFound, "Unable to retrieve ONU %s", in.OnuSerial)
+	}
 
-	return &legacy.Flows{}, nil
+	return &legacy.Flows{Flows: olt.Flows.GetOnuFlows(onu.PonPortID, onu.ID)}, nil
 }
 
 // StartRestGatewayService method starts REST server for BBSim.
-func StartRestGatewayService(channel chan bool, group *sync.WaitGroup, grpcAddress string, hostandport string) {
+func StartRestGatewayService(channel chan bool, group *sync.WaitGroup, grpcAddress string, hostandport string, addresses *common.ListenAddresses) {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -185,15 +196,22 @@ func StartRestGatewayService(channel chan bool, group *sync.WaitGroup, grpcAddre
 	// Register REST endpoints
 	err := legacy.RegisterBBSimServiceHandlerFromEndpoint(ctx, mux, grpcAddress, opts)
 	if err != nil {
-		logger.Error("%v", err)
+		logger.Errorf("%v", err)
 		return
 	}
 
+	lis, err := net.Listen("tcp", hostandport)
+	if err != nil {
+		logger.Fatalf("Legacy REST API server failed to listen: %v", err)
+	}
+	hostandport = common.ListenerAddress(hostandport, lis)
+	addresses.Add("legacyRestApi", hostandport)
+
 	s := &http.Server{Addr: hostandport, Handler: mux}
 
 	go func() {
 		logger.Infof("legacy REST API server listening on %s ...", hostandport)
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.Serve(lis); err != nil && err != http.ErrServerClosed {
 			logger.Errorf("Could not start legacy API server: %v", err)
 			return
 		}
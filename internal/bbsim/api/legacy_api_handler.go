@@ -61,7 +61,7 @@ func (s BBSimLegacyServer) handleONUStatusRequest(in *api.ONUInfo) (*api.ONUs, e
 			onuInfo.Onus = append(onuInfo.Onus, copyONUInfo(onu))
 		} else { // Get status of all ONUs
 			for _, p := range olt.Pons {
-				for _, o := range p.Onus {
+				for _, o := range p.GetOnus() {
 					onuInfo.Onus = append(onuInfo.Onus, copyONUInfo(o))
 				}
 			}
@@ -123,7 +123,7 @@ func getOpenoltSerialNumber(SerialNumber string) (*openolt.SerialNumber, error)
 	var SerialNumberLength = 12
 
 	if len(SerialNumber) != SerialNumberLength {
-		logger.Error("Invalid serial number %s", SerialNumber)
+		logger.Errorf("Invalid serial number %s", SerialNumber)
 		return nil, errors.New("invalid serial number")
 	}
 	// First four characters are vendorId
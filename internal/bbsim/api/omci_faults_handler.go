@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	me "github.com/cboling/omci/generated"
+	"github.com/opencord/bbsim/api/bbsim"
+	"github.com/opencord/bbsim/internal/bbsim/devices"
+	"github.com/opencord/bbsim/internal/common"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var delayDistributions = map[bbsim.OmciFaults_Distribution]string{
+	bbsim.OmciFaults_FIXED:       common.OmciDelayFixed,
+	bbsim.OmciFaults_UNIFORM:     common.OmciDelayUniform,
+	bbsim.OmciFaults_EXPONENTIAL: common.OmciDelayExponential,
+}
+
+func omciFaultsToProto(faults common.OmciFaults) *bbsim.OmciFaults {
+	res := &bbsim.OmciFaults{
+		DropRate:      faults.DropRate,
+		Delay:         uint32(faults.Delay / time.Millisecond),
+		MaxDelay:      uint32(faults.MaxDelay / time.Millisecond),
+		ErrorRate:     faults.ErrorRate,
+		Result:        bbsim.OmciFaults_Result(faults.Result),
+		DuplicateRate: faults.DuplicateRate,
+		ReorderRate:   faults.ReorderRate,
+		Silent:        faults.Silent,
+	}
+	for d, v := range delayDistributions {
+		if v == faults.Distribution {
+			res.Distribution = d
+		}
+	}
+	return res
+}
+
+func omciFaultsFromProto(req *bbsim.OmciFaults) (common.OmciFaults, error) {
+	if _, ok := bbsim.OmciFaults_Result_name[int32(req.Result)]; !ok {
+		return common.OmciFaults{}, fmt.Errorf("unknown-omci-result-%d", req.Result)
+	}
+	distribution, ok := delayDistributions[req.Distribution]
+	if !ok {
+		return common.OmciFaults{}, fmt.Errorf("unknown-omci-delay-distribution-%d", req.Distribution)
+	}
+	faults := common.OmciFaults{
+		DropRate:      req.DropRate,
+		Delay:         time.Duration(req.Delay) * time.Millisecond,
+		MaxDelay:      time.Duration(req.MaxDelay) * time.Millisecond,
+		Distribution:  distribution,
+		ErrorRate:     req.ErrorRate,
+		Result:        me.Results(req.Result),
+		DuplicateRate: req.DuplicateRate,
+		ReorderRate:   req.ReorderRate,
+		Silent:        req.Silent,
+	}
+	return faults, faults.Validate()
+}
+
+// getOnu returns the ONU with the given serial number, nil if the serial number is empty
+func getOnu(oltId int32, serialNumber string) (*devices.Onu, error) {
+	if serialNumber == "" {
+		return nil, nil
+	}
+	olt, err := getOlt(oltId)
+	if err != nil {
+		return nil, err
+	}
+	onu, err := olt.FindOnuBySn(serialNumber)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return onu, nil
+}
+
+// GetOmciFaults returns the OMCI faults injected in an ONU or, if no serial number is given, the global ones
+func (s BBSimServer) GetOmciFaults(ctx context.Context, req *bbsim.ONURequest) (*bbsim.OmciFaults, error) {
+	onu, err := getOnu(req.OltID, req.SerialNumber)
+	if err != nil {
+		return &bbsim.OmciFaults{}, err
+	}
+	if onu == nil {
+		res := omciFaultsToProto(devices.GlobalOmciFaults())
+		res.Global = true
+		return res, nil
+	}
+
+	faults, global := onu.OmciFaults()
+	res := omciFaultsToProto(faults)
+	res.SerialNumber = req.SerialNumber
+	res.OltID = req.OltID
+	res.Global = global
+	return res, nil
+}
+
+// SetOmciFaults sets the OMCI faults injected in an ONU or, if no serial number is given, the global ones
+func (s BBSimServer) SetOmciFaults(ctx context.Context, req *bbsim.OmciFaults) (*bbsim.Response, error) {
+	res := &bbsim.Response{}
+
+	logger.WithFields(log.Fields{
+		"OltId":  req.OltID,
+		"OnuSn":  req.SerialNumber,
+		"Faults": req,
+	}).Infof("Received request to set the OMCI faults")
+
+	faults, err := omciFaultsFromProto(req)
+	if err != nil {
+		res.StatusCode = int32(codes.InvalidArgument)
+		res.Message = err.Error()
+		return res, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	onu, err := getOnu(req.OltID, req.SerialNumber)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
+	if onu == nil {
+		devices.SetGlobalOmciFaults(faults)
+		res.Message = "Global OMCI faults set."
+	} else {
+		onu.SetOmciFaults(&faults)
+		res.Message = fmt.Sprintf("ONU %s OMCI faults set.", req.SerialNumber)
+	}
+
+	res.StatusCode = int32(codes.OK)
+	return res, nil
+}
+
+// ClearOmciFaults removes the OMCI faults of an ONU, so that the global ones apply to it,
+// or if no serial number is given it clears the global ones
+func (s BBSimServer) ClearOmciFaults(ctx context.Context, req *bbsim.ONURequest) (*bbsim.Response, error) {
+	res := &bbsim.Response{}
+
+	logger.WithFields(log.Fields{
+		"OltId": req.OltID,
+		"OnuSn": req.SerialNumber,
+	}).Infof("Received request to clear the OMCI faults")
+
+	onu, err := getOnu(req.OltID, req.SerialNumber)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
+	if onu == nil {
+		devices.SetGlobalOmciFaults(common.OmciFaults{})
+		res.Message = "Global OMCI faults cleared."
+	} else {
+		onu.SetOmciFaults(nil)
+		res.Message = fmt.Sprintf("ONU %s OMCI faults cleared, the global ones apply.", req.SerialNumber)
+	}
+
+	res.StatusCode = int32(codes.OK)
+	return res, nil
+}
@@ -21,37 +21,34 @@ import (
 	"fmt"
 	"github.com/opencord/bbsim/api/bbsim"
 	"github.com/opencord/bbsim/internal/bbsim/devices"
+	"github.com/opencord/bbsim/internal/bbsim/responders/omcisim"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func (s BBSimServer) GetONUs(ctx context.Context, req *bbsim.Empty) (*bbsim.ONUs, error) {
-	olt := devices.GetOLT()
+func (s BBSimServer) GetONUs(ctx context.Context, req *bbsim.OltRequest) (*bbsim.ONUs, error) {
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.ONUs{}, err
+	}
 	onus := bbsim.ONUs{
 		Items: []*bbsim.ONU{},
 	}
 
 	for _, pon := range olt.Pons {
-		for _, o := range pon.Onus {
-			onu := bbsim.ONU{
-				ID:            int32(o.ID),
-				SerialNumber:  o.Sn(),
-				OperState:     o.OperState.Current(),
-				InternalState: o.InternalState.Current(),
-				PonPortID:     int32(o.PonPortID),
-				STag:          int32(o.STag),
-				CTag:          int32(o.CTag),
-				HwAddress:     o.HwAddress.String(),
-				PortNo:        int32(o.PortNo),
-			}
-			onus.Items = append(onus.Items, &onu)
+		for _, o := range pon.GetOnus() {
+			onus.Items = append(onus.Items, onuToProto(o))
 		}
 	}
 	return &onus, nil
 }
 
 func (s BBSimServer) GetONU(ctx context.Context, req *bbsim.ONURequest) (*bbsim.ONU, error) {
-	olt := devices.GetOLT()
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.ONU{}, err
+	}
 
 	onu, err := olt.FindOnuBySn(req.SerialNumber)
 
@@ -60,6 +57,11 @@ func (s BBSimServer) GetONU(ctx context.Context, req *bbsim.ONURequest) (*bbsim.
 		return &res, err
 	}
 
+	return onuToProto(onu), nil
+}
+
+// onuToProto converts an ONU and its UNIs, the PortNo of the ONU is the one of the first UNI
+func onuToProto(onu *devices.Onu) *bbsim.ONU {
 	res := bbsim.ONU{
 		ID:            int32(onu.ID),
 		SerialNumber:  onu.Sn(),
@@ -69,9 +71,59 @@ func (s BBSimServer) GetONU(ctx context.Context, req *bbsim.ONURequest) (*bbsim.
 		STag:          int32(onu.STag),
 		CTag:          int32(onu.CTag),
 		HwAddress:     onu.HwAddress.String(),
-		PortNo:        int32(onu.PortNo),
+		PortNo:        int32(onu.Unis[0].PortNo),
+		Unis:          []*bbsim.UNI{},
+		MibTemplate:   onu.MibTemplate,
 	}
-	return &res, nil
+	for _, uni := range onu.Unis {
+		res.Unis = append(res.Unis, &bbsim.UNI{
+			ID:            int32(uni.ID),
+			HwAddress:     uni.HwAddress.String(),
+			PortNo:        int32(uni.PortNo),
+			CTag:          int32(uni.CTag),
+			InternalState: onu.UniState(uni).Current(),
+		})
+	}
+	return &res
+}
+
+// GetFlows returns the flows installed on the OLT, or only the ones of an ONU if a SerialNumber is provided
+func (s BBSimServer) GetFlows(ctx context.Context, req *bbsim.ONURequest) (*bbsim.Flows, error) {
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.Flows{}, err
+	}
+
+	if req.SerialNumber == "" {
+		flows := olt.Flows.GetAll()
+		return &bbsim.Flows{FlowCount: uint32(len(flows)), Flows: flows}, nil
+	}
+
+	onu, err := olt.FindOnuBySn(req.SerialNumber)
+	if err != nil {
+		return &bbsim.Flows{}, status.Error(codes.NotFound, err.Error())
+	}
+
+	flows := olt.Flows.GetOnuFlows(onu.PonPortID, onu.ID)
+	return &bbsim.Flows{FlowCount: uint32(len(flows)), Flows: flows}, nil
+}
+
+// GetTechProfile returns the TrafficSchedulers and TrafficQueues VOLTHA created on an ONU
+func (s BBSimServer) GetTechProfile(ctx context.Context, req *bbsim.ONURequest) (*bbsim.TechProfile, error) {
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.TechProfile{}, err
+	}
+
+	onu, err := olt.FindOnuBySn(req.SerialNumber)
+	if err != nil {
+		return &bbsim.TechProfile{}, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &bbsim.TechProfile{
+		TrafficSchedulers: onu.TechProfile.GetSchedulers(onu.PonPortID, onu.ID),
+		TrafficQueues:     onu.TechProfile.GetQueues(onu.PonPortID, onu.ID),
+	}, nil
 }
 
 func (s BBSimServer) ShutdownONU(ctx context.Context, req *bbsim.ONURequest) (*bbsim.Response, error) {
@@ -84,10 +136,16 @@ func (s BBSimServer) ShutdownONU(ctx context.Context, req *bbsim.ONURequest) (*b
 	res := &bbsim.Response{}
 
 	logger.WithFields(log.Fields{
+		"OltId": req.OltID,
 		"OnuSn": req.SerialNumber,
 	}).Infof("Received request to shutdown ONU")
 
-	olt := devices.GetOLT()
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
 
 	onu, err := olt.FindOnuBySn(req.SerialNumber)
 
@@ -106,9 +164,9 @@ func (s BBSimServer) ShutdownONU(ctx context.Context, req *bbsim.ONURequest) (*b
 		},
 	}
 
-	onu.Channel <- dyingGasp
+	onu.Enqueue(dyingGasp)
 
-	if err := onu.InternalState.Event("disable"); err != nil {
+	if err := onu.InternalStateEvent("disable"); err != nil {
 		logger.WithFields(log.Fields{
 			"OnuId":  onu.ID,
 			"IntfId": onu.PonPortID,
@@ -129,10 +187,16 @@ func (s BBSimServer) PoweronONU(ctx context.Context, req *bbsim.ONURequest) (*bb
 	res := &bbsim.Response{}
 
 	logger.WithFields(log.Fields{
+		"OltId": req.OltID,
 		"OnuSn": req.SerialNumber,
 	}).Infof("Received request to poweron ONU")
 
-	olt := devices.GetOLT()
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
 
 	onu, err := olt.FindOnuBySn(req.SerialNumber)
 
@@ -142,7 +206,7 @@ func (s BBSimServer) PoweronONU(ctx context.Context, req *bbsim.ONURequest) (*bb
 		return res, err
 	}
 
-	if err := onu.InternalState.Event("enable"); err != nil {
+	if err := onu.InternalStateEvent("enable"); err != nil {
 		logger.WithFields(log.Fields{
 			"OnuId":  onu.ID,
 			"IntfId": onu.PonPortID,
@@ -163,10 +227,16 @@ func (s BBSimServer) RestartEapol(ctx context.Context, req *bbsim.ONURequest) (*
 	res := &bbsim.Response{}
 
 	logger.WithFields(log.Fields{
+		"OltId": req.OltID,
 		"OnuSn": req.SerialNumber,
 	}).Infof("Received request to restart authentication ONU")
 
-	olt := devices.GetOLT()
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
 
 	onu, err := olt.FindOnuBySn(req.SerialNumber)
 
@@ -176,7 +246,7 @@ func (s BBSimServer) RestartEapol(ctx context.Context, req *bbsim.ONURequest) (*
 		return res, err
 	}
 
-	if err := onu.InternalState.Event("start_auth"); err != nil {
+	if err := onu.InternalStateEvent("start_auth"); err != nil {
 		logger.WithFields(log.Fields{
 			"OnuId":  onu.ID,
 			"IntfId": onu.PonPortID,
@@ -197,10 +267,16 @@ func (s BBSimServer) RestartDhcp(ctx context.Context, req *bbsim.ONURequest) (*b
 	res := &bbsim.Response{}
 
 	logger.WithFields(log.Fields{
+		"OltId": req.OltID,
 		"OnuSn": req.SerialNumber,
 	}).Infof("Received request to restart DHCP on ONU")
 
-	olt := devices.GetOLT()
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
 
 	onu, err := olt.FindOnuBySn(req.SerialNumber)
 
@@ -210,7 +286,7 @@ func (s BBSimServer) RestartDhcp(ctx context.Context, req *bbsim.ONURequest) (*b
 		return res, err
 	}
 
-	if err := onu.InternalState.Event("start_dhcp"); err != nil {
+	if err := onu.InternalStateEvent("start_dhcp"); err != nil {
 		logger.WithFields(log.Fields{
 			"OnuId":  onu.ID,
 			"IntfId": onu.PonPortID,
@@ -226,3 +302,148 @@ func (s BBSimServer) RestartDhcp(ctx context.Context, req *bbsim.ONURequest) (*b
 
 	return res, nil
 }
+
+// AddONU connects a new ONU to a PON, it is discovered by VOLTHA if the PON is enabled
+func (s BBSimServer) AddONU(ctx context.Context, req *bbsim.AddONURequest) (*bbsim.ONU, error) {
+	logger.WithFields(log.Fields{
+		"OltId":  req.OltID,
+		"IntfId": req.PonPortID,
+		"OnuSn":  req.SerialNumber,
+		"STag":   req.STag,
+		"CTag":   req.CTag,
+	}).Infof("Received request to add ONU")
+
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.ONU{}, err
+	}
+
+	if _, err := olt.GetPonById(uint32(req.PonPortID)); err != nil {
+		return &bbsim.ONU{}, status.Error(codes.NotFound, err.Error())
+	}
+
+	onu, err := olt.AddOnu(uint32(req.PonPortID), req.SerialNumber, int(req.STag), int(req.CTag))
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"IntfId": req.PonPortID,
+			"OnuSn":  req.SerialNumber,
+		}).Errorf("Cannot add ONU: %s", err.Error())
+		return &bbsim.ONU{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return onuToProto(onu), nil
+}
+
+// RemoveONU disconnects an ONU from its PON, as if the fiber was pulled out for good
+func (s BBSimServer) RemoveONU(ctx context.Context, req *bbsim.ONURequest) (*bbsim.Response, error) {
+	res := &bbsim.Response{}
+
+	logger.WithFields(log.Fields{
+		"OltId": req.OltID,
+		"OnuSn": req.SerialNumber,
+	}).Infof("Received request to remove ONU")
+
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
+
+	if err := olt.RemoveOnu(req.SerialNumber); err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
+
+	res.StatusCode = int32(codes.OK)
+	res.Message = fmt.Sprintf("ONU %s successfully removed.", req.SerialNumber)
+
+	return res, nil
+}
+
+var downloadFailures = map[bbsim.ImageDownloadFailure_Failure]omcisim.DownloadFailure{
+	bbsim.ImageDownloadFailure_NONE:    omcisim.NoFailure,
+	bbsim.ImageDownloadFailure_BAD_CRC: omcisim.BadCrc,
+	bbsim.ImageDownloadFailure_TIMEOUT: omcisim.Timeout,
+}
+
+// GetSoftwareImages returns the software images an ONU reports via OMCI and the progress of the last download
+func (s BBSimServer) GetSoftwareImages(ctx context.Context, req *bbsim.ONURequest) (*bbsim.SoftwareImages, error) {
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		return &bbsim.SoftwareImages{}, err
+	}
+
+	onu, err := olt.FindOnuBySn(req.SerialNumber)
+	if err != nil {
+		return &bbsim.SoftwareImages{}, status.Error(codes.NotFound, err.Error())
+	}
+
+	images, download, failure := onu.SoftwareImages()
+	res := &bbsim.SoftwareImages{
+		Items: []*bbsim.SoftwareImage{},
+	}
+	for i, image := range images {
+		res.Items = append(res.Items, &bbsim.SoftwareImage{
+			Instance:    int32(i),
+			Version:     image.Version,
+			IsCommitted: image.Committed,
+			IsActive:    image.Active,
+			IsValid:     image.Valid,
+		})
+	}
+	if download != nil {
+		res.Download = &bbsim.ImageDownload{
+			Instance:      int32(download.Instance),
+			ImageSize:     download.ImageSize,
+			ReceivedBytes: download.ReceivedBytes,
+			WindowSize:    int32(download.WindowSize),
+			State:         string(download.State),
+		}
+	}
+	for f, v := range downloadFailures {
+		if v == failure {
+			res.Failure = f
+		}
+	}
+	return res, nil
+}
+
+// SetImageDownloadFailure makes the software downloads of an ONU fail, until the failure is set to NONE
+func (s BBSimServer) SetImageDownloadFailure(ctx context.Context, req *bbsim.ImageDownloadFailure) (*bbsim.Response, error) {
+	res := &bbsim.Response{}
+
+	logger.WithFields(log.Fields{
+		"OltId":   req.OltID,
+		"OnuSn":   req.SerialNumber,
+		"Failure": req.Failure,
+	}).Infof("Received request to set the ONU image download failure")
+
+	olt, err := getOlt(req.OltID)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, err
+	}
+
+	onu, err := olt.FindOnuBySn(req.SerialNumber)
+	if err != nil {
+		res.StatusCode = int32(codes.NotFound)
+		res.Message = err.Error()
+		return res, status.Error(codes.NotFound, err.Error())
+	}
+
+	failure, ok := downloadFailures[req.Failure]
+	if !ok {
+		res.StatusCode = int32(codes.InvalidArgument)
+		res.Message = fmt.Sprintf("unknown-image-download-failure-%d", req.Failure)
+		return res, status.Error(codes.InvalidArgument, res.Message)
+	}
+	onu.SetDownloadFailure(failure)
+
+	res.StatusCode = int32(codes.OK)
+	res.Message = fmt.Sprintf("ONU %s image download failure set to %s.", req.SerialNumber, req.Failure)
+
+	return res, nil
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var validFlowTypes = map[string]bool{
+	"upstream":   true,
+	"downstream": true,
+	"multicast":  true,
+}
+
+// NOTE VOLTHA uses the same FlowId for the upstream and downstream flows,
+// so the direction is part of the key
+type FlowKey struct {
+	ID        uint32
+	Direction string
+}
+
+// FlowStore keeps track of the flows VOLTHA installed on the OLT
+type FlowStore struct {
+	mu    sync.RWMutex
+	flows map[FlowKey]*openolt.Flow
+}
+
+func NewFlowStore() *FlowStore {
+	return &FlowStore{
+		flows: make(map[FlowKey]*openolt.Flow),
+	}
+}
+
+func flowKey(flow *openolt.Flow) FlowKey {
+	return FlowKey{
+		ID:        flow.FlowId,
+		Direction: flow.FlowType,
+	}
+}
+
+// Add stores a flow, replacing the one with the same key if present
+func (s *FlowStore) Add(flow *openolt.Flow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flows[flowKey(flow)] = flow
+}
+
+// Insert stores a flow unless one with the same key is stored already. VOLTHA may send the same flow again
+// (eg: after a reconcile), that is fine as long as it did not change and strict is not set.
+// The check and the insert happen under the same lock, so that concurrent FlowAdd calls can't both store a flow
+func (s *FlowStore) Insert(flow *openolt.Flow, strict bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.flows[flowKey(flow)]; ok {
+		if strict || !isSameFlow(existing, flow) {
+			return status.Errorf(codes.AlreadyExists, "flow-%d-%s-already-exists", flow.FlowId, flow.FlowType)
+		}
+	}
+	s.flows[flowKey(flow)] = flow
+	return nil
+}
+
+// Remove deletes a flow and returns it, if it was stored
+func (s *FlowStore) Remove(key FlowKey) (*openolt.Flow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flow, ok := s.flows[key]
+	if ok {
+		delete(s.flows, key)
+	}
+	return flow, ok
+}
+
+func (s *FlowStore) Get(key FlowKey) (*openolt.Flow, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flow, ok := s.flows[key]
+	return flow, ok
+}
+
+// GetAll returns all the flows sorted by FlowId and direction
+func (s *FlowStore) GetAll() []*openolt.Flow {
+	return s.filter(func(*openolt.Flow) bool { return true })
+}
+
+// GetOnuFlows returns the flows installed for a given ONU, on all its UNIs
+func (s *FlowStore) GetOnuFlows(intfId uint32, onuId uint32) []*openolt.Flow {
+	return s.filter(func(flow *openolt.Flow) bool {
+		return flow.AccessIntfId == int32(intfId) && flow.OnuId == int32(onuId)
+	})
+}
+
+// GetUniFlows returns the flows installed for a given UNI of an ONU
+func (s *FlowStore) GetUniFlows(intfId uint32, onuId uint32, uniId uint32) []*openolt.Flow {
+	return s.filter(func(flow *openolt.Flow) bool {
+		return flow.AccessIntfId == int32(intfId) && flow.OnuId == int32(onuId) && flow.UniId == int32(uniId)
+	})
+}
+
+// RemoveOnuFlows removes the flows installed for a given ONU, eg: when it's deleted and its ID can be reused,
+// and returns them
+func (s *FlowStore) RemoveOnuFlows(intfId uint32, onuId uint32) []*openolt.Flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := []*openolt.Flow{}
+	for key, flow := range s.flows {
+		if flow.AccessIntfId == int32(intfId) && flow.OnuId == int32(onuId) {
+			removed = append(removed, flow)
+			delete(s.flows, key)
+		}
+	}
+	return removed
+}
+
+// Clear removes all the flows, eg: when the OLT reboots
+func (s *FlowStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flows = make(map[FlowKey]*openolt.Flow)
+}
+
+func (s *FlowStore) filter(match func(*openolt.Flow) bool) []*openolt.Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	flows := []*openolt.Flow{}
+	for _, flow := range s.flows {
+		if match(flow) {
+			flows = append(flows, flow)
+		}
+	}
+
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].FlowId != flows[j].FlowId {
+			return flows[i].FlowId < flows[j].FlowId
+		}
+		return flows[i].FlowType < flows[j].FlowType
+	})
+	return flows
+}
+
+// validateFlow checks that a flow can be installed on the OLT, the duplicates are rejected by FlowStore.Insert.
+// The returned errors carry the gRPC code VOLTHA receives
+func (o *OltDevice) validateFlow(flow *openolt.Flow) error {
+	if flow.Classifier == nil {
+		return status.Errorf(codes.InvalidArgument, "flow-%d-has-no-classifier", flow.FlowId)
+	}
+
+	if !validFlowTypes[flow.FlowType] {
+		return status.Errorf(codes.InvalidArgument, "flow-%d-has-invalid-type-%s", flow.FlowId, flow.FlowType)
+	}
+
+	if flow.FlowType == "upstream" && flow.AccessIntfId < 0 {
+		return status.Errorf(codes.InvalidArgument, "upstream-flow-%d-has-no-access-interface", flow.FlowId)
+	}
+
+	if flow.AccessIntfId >= 0 {
+		if _, err := o.GetPonById(uint32(flow.AccessIntfId)); err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+
+		onu, err := o.FindOnuById(uint32(flow.AccessIntfId), uint32(flow.OnuId))
+		if err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+
+		uniId := uint32(flow.UniId)
+		if flow.AllocId > 0 && !onu.TechProfile.hasAllocId(uniId, uint32(flow.AllocId)) {
+			return status.Errorf(codes.NotFound, "cannot-find-alloc-id-%d-for-onu-%d-%d-uni-%d", flow.AllocId, onu.PonPortID, onu.ID, uniId)
+		}
+
+		if flow.GemportId > 0 {
+			if !onu.hasGemPort(uniId, uint32(flow.GemportId)) {
+				return status.Errorf(codes.NotFound, "cannot-find-gem-port-%d-for-onu-%d-%d-uni-%d", flow.GemportId, onu.PonPortID, onu.ID, uniId)
+			}
+
+			// NOTE a real OLT only forwards the traffic of a GemPort on the T-CONT it belongs to
+			if flow.AllocId > 0 && !onu.TechProfile.isTcontGemPort(uniId, uint32(flow.AllocId), uint32(flow.GemportId)) {
+				return status.Errorf(codes.InvalidArgument, "gem-port-%d-does-not-belong-to-alloc-id-%d", flow.GemportId, flow.AllocId)
+			}
+		}
+
+		if o.StrictFlows {
+			flowIdRange := o.DeviceInfo.GetRange(openolt.DeviceInfo_DeviceResourceRanges_Pool_FLOW_ID, onu.PonPortID)
+			if !flowIdRange.Contains(flow.FlowId) {
+				return status.Errorf(codes.InvalidArgument, "flow-id-%d-out-of-range-%s", flow.FlowId, flowIdRange)
+			}
+
+			if err := validateOnuFlowStrict(onu, flow); err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.StrictFlows {
+		if _, err := o.getNniById(uint32(flow.NetworkIntfId)); err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validateOnuFlowStrict rejects the ONU flows a real openolt agent would not accept
+func validateOnuFlowStrict(onu *Onu, flow *openolt.Flow) error {
+	if _, err := onu.GetUniById(uint32(flow.UniId)); err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	if flow.Action == nil {
+		return status.Errorf(codes.InvalidArgument, "flow-%d-has-no-action", flow.FlowId)
+	}
+
+	if flow.GemportId <= 0 {
+		return status.Errorf(codes.InvalidArgument, "flow-%d-has-no-gem-port", flow.FlowId)
+	}
+
+	if flow.FlowType == "upstream" && flow.AllocId <= 0 {
+		return status.Errorf(codes.InvalidArgument, "upstream-flow-%d-has-no-alloc-id", flow.FlowId)
+	}
+
+	switch onu.InternalState.Current() {
+	case "created", "discovered", "disabled", "pon_disabled":
+		return status.Errorf(codes.FailedPrecondition, "onu-%d-%d-is-not-active", onu.PonPortID, onu.ID)
+	}
+
+	return nil
+}
+
+// isSameFlow compares the fields that identify what a flow matches on
+func isSameFlow(a *openolt.Flow, b *openolt.Flow) bool {
+	return a.AccessIntfId == b.AccessIntfId &&
+		a.OnuId == b.OnuId &&
+		a.UniId == b.UniId &&
+		proto.Equal(a.Classifier, b.Classifier)
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"github.com/opencord/voltha-protos/go/tech_profile"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+	"sync"
+	"testing"
+)
+
+func Test_FlowStore_AddRemove(t *testing.T) {
+	store := NewFlowStore()
+
+	up := &openolt.Flow{FlowId: 1, FlowType: "upstream", AccessIntfId: 0, OnuId: 1}
+	down := &openolt.Flow{FlowId: 1, FlowType: "downstream", AccessIntfId: 0, OnuId: 1}
+	store.Add(up)
+	store.Add(down)
+
+	assert.Equal(t, len(store.GetAll()), 2)
+
+	flow, ok := store.Get(FlowKey{ID: 1, Direction: "upstream"})
+	assert.Equal(t, ok, true)
+	assert.Equal(t, flow, up)
+
+	flow, ok = store.Remove(FlowKey{ID: 1, Direction: "downstream"})
+	assert.Equal(t, ok, true)
+	assert.Equal(t, flow, down)
+
+	_, ok = store.Remove(FlowKey{ID: 1, Direction: "downstream"})
+	assert.Equal(t, ok, false)
+	assert.Equal(t, len(store.GetAll()), 1)
+}
+
+func Test_FlowStore_Insert(t *testing.T) {
+	store := NewFlowStore()
+	flow := &openolt.Flow{FlowId: 1, FlowType: "upstream", AccessIntfId: 0, OnuId: 1, Classifier: &openolt.Classifier{}}
+
+	// only one of the concurrent inserts of the same flow succeeds
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.Insert(flow, true)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	inserted := 0
+	for err := range errs {
+		if err == nil {
+			inserted++
+		} else {
+			assert.Equal(t, status.Code(err), codes.AlreadyExists)
+		}
+	}
+	assert.Equal(t, inserted, 1)
+
+	// unless strict is set, the same flow can be sent again but it can't be changed
+	assert.NilError(t, store.Insert(flow, false))
+	changed := &openolt.Flow{FlowId: 1, FlowType: "upstream", AccessIntfId: 0, OnuId: 2, Classifier: &openolt.Classifier{}}
+	assert.Equal(t, status.Code(store.Insert(changed, false)), codes.AlreadyExists)
+	assert.Equal(t, len(store.GetAll()), 1)
+}
+
+func Test_FlowStore_GetOnuFlows(t *testing.T) {
+	store := NewFlowStore()
+
+	store.Add(&openolt.Flow{FlowId: 3, FlowType: "upstream", AccessIntfId: 0, OnuId: 1, UniId: 1})
+	store.Add(&openolt.Flow{FlowId: 2, FlowType: "upstream", AccessIntfId: 0, OnuId: 1, UniId: 0})
+	store.Add(&openolt.Flow{FlowId: 2, FlowType: "downstream", AccessIntfId: 0, OnuId: 1, UniId: 0})
+	store.Add(&openolt.Flow{FlowId: 4, FlowType: "upstream", AccessIntfId: 1, OnuId: 1, UniId: 0})
+	store.Add(&openolt.Flow{FlowId: 5, FlowType: "upstream", AccessIntfId: -1, OnuId: -1})
+
+	flows := store.GetOnuFlows(0, 1)
+	assert.Equal(t, len(flows), 3)
+	// flows are sorted by id and direction
+	assert.Equal(t, flows[0].FlowId, uint32(2))
+	assert.Equal(t, flows[0].FlowType, "downstream")
+	assert.Equal(t, flows[1].FlowType, "upstream")
+	assert.Equal(t, flows[2].FlowId, uint32(3))
+
+	flows = store.GetUniFlows(0, 1, 1)
+	assert.Equal(t, len(flows), 1)
+	assert.Equal(t, flows[0].FlowId, uint32(3))
+
+	store.Clear()
+	assert.Equal(t, len(store.GetAll()), 0)
+}
+
+func createOnuFlow(flowId uint32, flowType string, gemPortId int32) *openolt.Flow {
+	return &openolt.Flow{
+		AccessIntfId:  0,
+		OnuId:         1,
+		FlowId:        flowId,
+		FlowType:      flowType,
+		AllocId:       1024,
+		GemportId:     gemPortId,
+		NetworkIntfId: 0,
+		Classifier:    &openolt.Classifier{OVid: 4091},
+		Action:        &openolt.Action{},
+	}
+}
+
+// createTestTechProfile provisions a T-CONT with AllocId 1024 and GemPort 1024 on UNI 0 of the ONU
+func createTestTechProfile(t *testing.T, olt *OltDevice, onu *Onu) {
+	_, err := olt.CreateTrafficSchedulers(context.TODO(), &tech_profile.TrafficSchedulers{
+		IntfId: onu.PonPortID,
+		OnuId:  onu.ID,
+		UniId:  0,
+		TrafficScheds: []*tech_profile.TrafficScheduler{
+			{Direction: tech_profile.Direction_UPSTREAM, AllocId: 1024},
+			{Direction: tech_profile.Direction_DOWNSTREAM, AllocId: 1024},
+		},
+	})
+	assert.NilError(t, err)
+
+	_, err = olt.CreateTrafficQueues(context.TODO(), &tech_profile.TrafficQueues{
+		IntfId: onu.PonPortID,
+		OnuId:  onu.ID,
+		UniId:  0,
+		TrafficQueues: []*tech_profile.TrafficQueue{
+			{Direction: tech_profile.Direction_UPSTREAM, GemportId: 1024},
+			{Direction: tech_profile.Direction_DOWNSTREAM, GemportId: 1024},
+		},
+	})
+	assert.NilError(t, err)
+}
+
+func Test_Olt_FlowAdd_Validation(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	createTestTechProfile(t, olt, olt.Pons[0].Onus[0])
+
+	wrongAlloc := createOnuFlow(1, "upstream", 1024)
+	wrongAlloc.AllocId = 1025
+
+	wrongUni := createOnuFlow(1, "upstream", 1024)
+	wrongUni.UniId = 1
+
+	tests := []struct {
+		name string
+		flow *openolt.Flow
+		code codes.Code
+	}{
+		{"no-classifier", &openolt.Flow{FlowId: 1, FlowType: "upstream"}, codes.InvalidArgument},
+		{"invalid-type", &openolt.Flow{FlowId: 1, FlowType: "foo", Classifier: &openolt.Classifier{}}, codes.InvalidArgument},
+		{"upstream-no-access-intf", &openolt.Flow{FlowId: 1, FlowType: "upstream", AccessIntfId: -1, Classifier: &openolt.Classifier{}}, codes.InvalidArgument},
+		{"unknown-pon", &openolt.Flow{FlowId: 1, FlowType: "upstream", AccessIntfId: 10, Classifier: &openolt.Classifier{}}, codes.NotFound},
+		{"unknown-onu", &openolt.Flow{FlowId: 1, FlowType: "upstream", AccessIntfId: 0, OnuId: 10, Classifier: &openolt.Classifier{}}, codes.NotFound},
+		{"unknown-alloc-id", wrongAlloc, codes.NotFound},
+		{"unknown-uni", wrongUni, codes.NotFound},
+		{"unknown-gem-port", createOnuFlow(1, "upstream", 1025), codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := olt.FlowAdd(context.TODO(), tt.flow)
+			assert.Equal(t, status.Code(err), tt.code)
+		})
+	}
+	assert.Equal(t, len(olt.Flows.GetAll()), 0)
+}
+
+func Test_Olt_FlowAdd_Duplicate(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	onu := olt.Pons[0].Onus[0]
+	createTestTechProfile(t, olt, onu)
+
+	_, err := olt.FlowAdd(context.TODO(), createOnuFlow(1, "downstream", 1024))
+	assert.Equal(t, err, nil)
+	nextMessage(t, onu)
+
+	// the same flow sent again is accepted
+	_, err = olt.FlowAdd(context.TODO(), createOnuFlow(1, "downstream", 1024))
+	assert.Equal(t, err, nil)
+	nextMessage(t, onu)
+
+	changed := createOnuFlow(1, "downstream", 1024)
+	changed.Classifier.OVid = 4092
+	_, err = olt.FlowAdd(context.TODO(), changed)
+	assert.Equal(t, status.Code(err), codes.AlreadyExists)
+	assert.Equal(t, len(olt.Flows.GetAll()), 1)
+}
+
+func Test_Olt_FlowAdd_Strict(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	olt.StrictFlows = true
+	// NOTE the mock OLT does not create the NNI
+	olt.Nnis = append(olt.Nnis, &NniPort{ID: 0})
+	onu := olt.Pons[0].Onus[0]
+	createTestTechProfile(t, olt, onu)
+
+	// the ONU has not been activated yet
+	_, err := olt.FlowAdd(context.TODO(), createOnuFlow(1, "upstream", 1024))
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+
+	onu.InternalState.SetState("enabled")
+
+	noNni := createOnuFlow(1, "upstream", 1024)
+	noNni.NetworkIntfId = 10
+	_, err = olt.FlowAdd(context.TODO(), noNni)
+	assert.Equal(t, status.Code(err), codes.NotFound)
+
+	_, err = olt.FlowAdd(context.TODO(), createOnuFlow(1, "upstream", 1024))
+	assert.Equal(t, err, nil)
+	nextMessage(t, onu)
+
+	// in strict mode the same flow can't be sent twice
+	_, err = olt.FlowAdd(context.TODO(), createOnuFlow(1, "upstream", 1024))
+	assert.Equal(t, status.Code(err), codes.AlreadyExists)
+}
+
+func Test_Olt_FlowAdd_DeletedOnu(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	pon := olt.Pons[0]
+	pon.InternalState.SetState("enabled")
+	deleted := pon.Onus[0]
+	other := pon.Onus[1]
+	deleted.InternalState.SetState("discovered")
+	other.InternalState.SetState("discovered")
+
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 1, SerialNumber: deleted.SerialNumber})
+	assert.NilError(t, err)
+	createTestTechProfile(t, olt, deleted)
+	_, err = olt.FlowAdd(context.TODO(), createOnuFlow(1, "downstream", 1024))
+	assert.NilError(t, err)
+
+	// the flows go away with the ONU
+	_, err = olt.DeleteOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, len(olt.Flows.GetOnuFlows(0, 1)), 0)
+
+	// so the ONU the ID is assigned to next can reuse the flow IDs
+	_, err = olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 1, SerialNumber: other.SerialNumber})
+	assert.NilError(t, err)
+	createTestTechProfile(t, olt, other)
+	changed := createOnuFlow(1, "downstream", 1024)
+	changed.Classifier.OVid = 4092
+	_, err = olt.FlowAdd(context.TODO(), changed)
+	assert.NilError(t, err)
+
+	flows := olt.Flows.GetOnuFlows(0, 1)
+	assert.Equal(t, len(flows), 1)
+	assert.Equal(t, flows[0].Classifier.OVid, uint32(4092))
+}
+
+func Test_Olt_FlowAdd_RemovedOnu(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	pon := olt.Pons[0]
+	pon.InternalState.SetState("enabled")
+	onu := pon.Onus[0]
+	onu.InternalState.SetState("discovered")
+
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 1, SerialNumber: onu.SerialNumber})
+	assert.NilError(t, err)
+	createTestTechProfile(t, olt, onu)
+	_, err = olt.FlowAdd(context.TODO(), createOnuFlow(1, "downstream", 1024))
+	assert.NilError(t, err)
+
+	assert.NilError(t, olt.RemoveOnu(onu.Sn()))
+	assert.Equal(t, len(olt.Flows.GetAll()), 0)
+}
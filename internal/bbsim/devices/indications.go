@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"errors"
+
+	"github.com/opencord/voltha-protos/go/openolt"
+)
+
+type indicationRequest struct {
+	indication *openolt.Indication
+	result     chan error
+}
+
+// indicationStream wraps the EnableIndication stream so that the OLT, NNI and ONU loops can share it:
+// gRPC does not allow concurrent calls to Send on a stream, so the indications are sent
+// one at a time, in the order they are received, by a single goroutine
+type indicationStream struct {
+	openolt.Openolt_EnableIndicationServer
+	ctx      context.Context
+	requests chan indicationRequest
+}
+
+// newIndicationStream starts the goroutine that sends the indications, it stops when ctx is done
+func newIndicationStream(ctx context.Context, stream openolt.Openolt_EnableIndicationServer) *indicationStream {
+	s := &indicationStream{
+		Openolt_EnableIndicationServer: stream,
+		ctx:                            ctx,
+		requests:                       make(chan indicationRequest),
+	}
+	go s.sendIndications()
+	return s
+}
+
+// Send waits for the indication to be sent and returns the result
+func (s *indicationStream) Send(indication *openolt.Indication) error {
+	req := indicationRequest{
+		indication: indication,
+		result:     make(chan error, 1),
+	}
+
+	select {
+	case s.requests <- req:
+	case <-s.ctx.Done():
+		return errors.New("indication-stream-closed")
+	}
+	return <-req.result
+}
+
+func (s *indicationStream) sendIndications() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case req := <-s.requests:
+			req.result <- s.Openolt_EnableIndicationServer.Send(req.indication)
+		}
+	}
+}
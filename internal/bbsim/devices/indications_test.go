@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencord/voltha-protos/go/openolt"
+	"google.golang.org/grpc"
+	"gotest.tools/assert"
+)
+
+// concurrencyCheckStream records the indications and how many Send calls overlapped
+type concurrencyCheckStream struct {
+	grpc.ServerStream
+	inFlight    int32
+	overlapping int32
+	mu          sync.Mutex
+	indications []*openolt.Indication
+}
+
+func (s *concurrencyCheckStream) Send(ind *openolt.Indication) error {
+	if atomic.AddInt32(&s.inFlight, 1) > 1 {
+		atomic.AddInt32(&s.overlapping, 1)
+	}
+	time.Sleep(10 * time.Microsecond)
+	s.mu.Lock()
+	s.indications = append(s.indications, ind)
+	s.mu.Unlock()
+	atomic.AddInt32(&s.inFlight, -1)
+	return nil
+}
+
+func Test_IndicationStream_SerializesSends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	stream := &concurrencyCheckStream{}
+	indications := newIndicationStream(ctx, stream)
+
+	numSenders := 10
+	numIndications := 20
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < numSenders; i++ {
+		wg.Add(1)
+		go func(onuId uint32) {
+			defer wg.Done()
+			for j := 0; j < numIndications; j++ {
+				ind := &openolt.Indication{Data: &openolt.Indication_OmciInd{OmciInd: &openolt.OmciIndication{
+					OnuId: onuId,
+					Pkt:   []byte{byte(j)},
+				}}}
+				assert.NilError(t, indications.Send(ind))
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+
+	assert.Equal(t, stream.overlapping, int32(0))
+	assert.Equal(t, len(stream.indications), numSenders*numIndications)
+
+	// the indications of each sender are sent in order
+	next := make(map[uint32]byte)
+	for _, ind := range stream.indications {
+		omci := ind.GetOmciInd()
+		assert.Equal(t, omci.Pkt[0], next[omci.OnuId])
+		next[omci.OnuId]++
+	}
+}
+
+func Test_IndicationStream_Closed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	stream := &concurrencyCheckStream{}
+	indications := newIndicationStream(ctx, stream)
+	cancel()
+
+	err := indications.Send(&openolt.Indication{})
+	assert.Error(t, err, "indication-stream-closed")
+	assert.Equal(t, len(stream.indications), 0)
+}
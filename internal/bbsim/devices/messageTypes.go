@@ -17,6 +17,8 @@
 package devices
 
 import (
+	"sync"
+
 	"github.com/google/gopacket"
 	"github.com/opencord/bbsim/internal/bbsim/packetHandlers"
 	"github.com/opencord/voltha-protos/go/openolt"
@@ -42,6 +44,10 @@ const (
 	SendEapolFlow  MessageType = 12
 	SendDhcpFlow   MessageType = 13
 	OnuPacketIn    MessageType = 14
+
+	OnuRequest    MessageType = 15 // a change to the ONU state requested from outside the ONU message loop
+	PmIntervalEnd MessageType = 16 // the end of an OMCI PM interval, see onu_pm.go
+	OmciResponse  MessageType = 17 // an OMCI response delayed by the injected faults, see onu_omci_faults.go
 )
 
 func (m MessageType) String() string {
@@ -61,6 +67,9 @@ func (m MessageType) String() string {
 		"SendEapolFlow",
 		"SendDhcpFlow",
 		"OnuPacketIn",
+		"OnuRequest",
+		"PmIntervalEnd",
+		"OmciResponse",
 	}
 	return names[m]
 }
@@ -102,6 +111,14 @@ type OmciMessage struct {
 	omciMsg *openolt.OmciMsg
 }
 
+// OmciResponseMessage is an OMCI response the ONU sends, Duplicate sends it twice
+// and Hold holds it back until the next one is sent
+type OmciResponseMessage struct {
+	Pkt       []byte
+	Duplicate bool
+	Hold      bool
+}
+
 type OmciIndicationMessage struct {
 	OnuSN   *openolt.SerialNumber
 	OnuID   uint32
@@ -117,15 +134,34 @@ type OnuFlowUpdateMessage struct {
 type PacketMessage struct {
 	PonPortID uint32
 	OnuID     uint32
+	UniID     uint32
 }
 
 type OnuPacketMessage struct {
 	IntfId uint32
 	OnuId  uint32
+	PortNo uint32
 	Packet gopacket.Packet
 	Type   packetHandlers.PacketType
 }
 
+// OnuRequestMessage is applied exactly once, either by the ONU message loop
+// or in place if the loop stops before processing it
+type OnuRequestMessage struct {
+	change func() error
+	once   sync.Once
+	err    error
+	result chan error
+}
+
+func (r *OnuRequestMessage) apply() error {
+	r.once.Do(func() {
+		r.err = r.change()
+		r.result <- r.err
+	})
+	return r.err
+}
+
 type DyingGaspIndicationMessage struct {
 	PonPortID uint32
 	OnuID     uint32
@@ -18,12 +18,14 @@ package devices
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
 	"github.com/looplab/fsm"
 	"github.com/opencord/bbsim/internal/bbsim/packetHandlers"
 	"github.com/opencord/bbsim/internal/bbsim/types"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"os/exec"
 )
 
@@ -54,26 +56,47 @@ type NniPort struct {
 	// BBSIM Internals
 	ID uint32
 
+	// the veth pair that connects the NNI to the DHCP server
+	nniVeth      string
+	upstreamVeth string
+	// the packets received on the NNI veth, going to VOLTHA
+	pktInChannel chan *types.PacketMsg
+
 	// PON Attributes
 	OperState *fsm.FSM
 	Type      string
 }
 
-func CreateNNI(olt *OltDevice) (NniPort, error) {
+func CreateNNI(olt *OltDevice, id uint32) (NniPort, error) {
+	nni, upstream := vethNames(olt.ID, id)
 	nniPort := NniPort{
-		ID: uint32(0),
+		ID:           id,
+		nniVeth:      nni,
+		upstreamVeth: upstream,
 		OperState: getOperStateFSM(func(e *fsm.Event) {
 			oltLogger.Debugf("Changing NNI OperState from %s to %s", e.Src, e.Dst)
 		}),
 		Type: "nni",
 	}
-	createNNIPair(executor, olt)
+	createNNIPair(executor, &nniPort)
 	return nniPort, nil
 }
 
+// vethNames returns the names of the veth pair of an NNI,
+// the first NNI of the first OLT keeps the historical "nni" and "upstream" names
+func vethNames(oltId int, nniId uint32) (string, string) {
+	if nniId > 0 {
+		return fmt.Sprintf("%s%d-%d", nniVeth, oltId, nniId), fmt.Sprintf("%s%d-%d", upstreamVeth, oltId, nniId)
+	}
+	if oltId == 0 {
+		return nniVeth, upstreamVeth
+	}
+	return fmt.Sprintf("%s%d", nniVeth, oltId), fmt.Sprintf("%s%d", upstreamVeth, oltId)
+}
+
 // sendNniPacket will send a packet out of the NNI interface.
 // We will send upstream only DHCP packets and drop anything else
-func sendNniPacket(packet gopacket.Packet) error {
+func sendNniPacket(vethName string, packet gopacket.Packet) error {
 	isDhcp := packetHandlers.IsDhcpPacket(packet)
 	isLldp := packetHandlers.IsLldpPacket(packet)
 
@@ -93,7 +116,7 @@ func sendNniPacket(packet gopacket.Packet) error {
 			return err
 		}
 
-		handle, err := getVethHandler(nniVeth)
+		handle, err := getVethHandler(vethName)
 		if err != nil {
 			return err
 		}
@@ -117,30 +140,30 @@ func sendNniPacket(packet gopacket.Packet) error {
 //createNNIBridge will create a veth bridge to fake the connection between the NNI port
 //and something upstream, in this case a DHCP server.
 //It is also responsible to start the DHCP server itself
-func createNNIPair(executor Executor, olt *OltDevice) error {
+func createNNIPair(executor Executor, nni *NniPort) error {
 
-	if err := executor.Command("ip", "link", "add", nniVeth, "type", "veth", "peer", "name", upstreamVeth).Run(); err != nil {
-		nniLogger.Errorf("Couldn't create veth pair between %s and %s", nniVeth, upstreamVeth)
+	if err := executor.Command("ip", "link", "add", nni.nniVeth, "type", "veth", "peer", "name", nni.upstreamVeth).Run(); err != nil {
+		nniLogger.Errorf("Couldn't create veth pair between %s and %s", nni.nniVeth, nni.upstreamVeth)
 		return err
 	}
 
-	if err := setVethUp(executor, nniVeth); err != nil {
+	if err := setVethUp(executor, nni.nniVeth); err != nil {
 		return err
 	}
 
-	if err := setVethUp(executor, upstreamVeth); err != nil {
+	if err := setVethUp(executor, nni.upstreamVeth); err != nil {
 		return err
 	}
 
-	if err := startDHCPServer(); err != nil {
+	if err := startDHCPServer(nni.upstreamVeth); err != nil {
 		return err
 	}
 
-	ch, err := listenOnVeth(nniVeth)
+	ch, err := listenOnVeth(nni.nniVeth)
 	if err != nil {
 		return err
 	}
-	olt.nniPktInChannel = ch
+	nni.pktInChannel = ch
 	return nil
 }
 
@@ -153,21 +176,35 @@ func setVethUp(executor Executor, vethName string) error {
 	return nil
 }
 
-var startDHCPServer = func() error {
-	if err := exec.Command("ip", "addr", "add", dhcpServerIp, "dev", upstreamVeth).Run(); err != nil {
-		nniLogger.Errorf("Couldn't assing ip %s to interface %s: %v", dhcpServerIp, upstreamVeth, err)
+var startDHCPServer = func(vethName string) error {
+	if err := exec.Command("ip", "addr", "add", dhcpServerIp, "dev", vethName).Run(); err != nil {
+		nniLogger.Errorf("Couldn't assing ip %s to interface %s: %v", dhcpServerIp, vethName, err)
 		return err
 	}
 
-	if err := setVethUp(executor, upstreamVeth); err != nil {
+	if err := setVethUp(executor, vethName); err != nil {
 		return err
 	}
 
 	dhcp := "/usr/local/bin/dhcpd"
 	conf := "/etc/dhcp/dhcpd.conf" // copied in the container from configs/dhcpd.conf
 	logfile := "/tmp/dhcplog"
+	args := []string{"-cf", conf, vethName, "-tf", logfile, "-4"}
+	if vethName != upstreamVeth {
+		// NOTE every NNI has its own DHCP server, they can't share the pid and lease files
+		leaseFile := fmt.Sprintf("/var/lib/dhcp/dhcpd-%s.leases", vethName)
+		f, err := os.OpenFile(leaseFile, os.O_CREATE, 0644)
+		if err != nil {
+			nniLogger.Errorf("Couldn't create DHCP lease file %s: %v", leaseFile, err)
+			return err
+		}
+		f.Close()
+
+		args = []string{"-cf", conf, vethName, "-tf", fmt.Sprintf("%s-%s", logfile, vethName), "-4",
+			"-pf", fmt.Sprintf("/var/run/dhcpd-%s.pid", vethName), "-lf", leaseFile}
+	}
 	var stderr bytes.Buffer
-	cmd := exec.Command(dhcp, "-cf", conf, upstreamVeth, "-tf", logfile, "-4")
+	cmd := exec.Command(dhcp, args...)
 	cmd.Stderr = &stderr
 	err := cmd.Run()
 	if err != nil {
@@ -18,8 +18,15 @@
 package devices
 
 import (
+	"context"
 	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/opencord/bbsim/internal/bbsim/types"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gotest.tools/assert"
 	"testing"
 )
@@ -49,7 +56,8 @@ func TestCreateNNIPair(t *testing.T) {
 	startDHCPServerCalled := false
 	_startDHCPServer := startDHCPServer
 	defer func() { startDHCPServer = _startDHCPServer }()
-	startDHCPServer = func() error {
+	startDHCPServer = func(upstreamVeth string) error {
+		assert.Equal(t, upstreamVeth, "upstream")
 		startDHCPServerCalled = true
 		return nil
 	}
@@ -58,6 +66,7 @@ func TestCreateNNIPair(t *testing.T) {
 	_listenOnVeth := listenOnVeth
 	defer func() { listenOnVeth = _listenOnVeth }()
 	listenOnVeth = func(vethName string) (chan *types.PacketMsg, error) {
+		assert.Equal(t, vethName, "nni")
 		listenOnVethCalled = true
 		return make(chan *types.PacketMsg, 1), nil
 	}
@@ -66,15 +75,86 @@ func TestCreateNNIPair(t *testing.T) {
 		Calls:   make(map[int][]string),
 	}
 
-	olt := OltDevice{}
+	nni := NniPort{nniVeth: "nni", upstreamVeth: "upstream"}
 
-	err := createNNIPair(spy, &olt)
+	err := createNNIPair(spy, &nni)
 
 	assert.Equal(t, spy.CommandCallCount, 3)
+	assert.DeepEqual(t, spy.Calls[1], []string{"link", "add", "nni", "type", "veth", "peer", "name", "upstream"})
 	assert.Equal(t, startDHCPServerCalled, true)
 	assert.Equal(t, listenOnVethCalled, true)
 	assert.Equal(t, err, nil)
-	assert.Assert(t, olt.nniPktInChannel != nil)
+	assert.Assert(t, nni.pktInChannel != nil)
+}
+
+func TestVethNames(t *testing.T) {
+	nni, upstream := vethNames(0, 0)
+	assert.Equal(t, nni, "nni")
+	assert.Equal(t, upstream, "upstream")
+
+	nni, upstream = vethNames(3, 0)
+	assert.Equal(t, nni, "nni3")
+	assert.Equal(t, upstream, "upstream3")
+
+	nni, upstream = vethNames(0, 1)
+	assert.Equal(t, nni, "nni0-1")
+	assert.Equal(t, upstream, "upstream0-1")
+
+	// the interface names are limited to 15 characters
+	nni, upstream = vethNames(255, 15)
+	assert.Equal(t, nni, "nni255-15")
+	assert.Equal(t, upstream, "upstream255-15")
+}
+
+type mockIndicationStream struct {
+	grpc.ServerStream
+	indications chan *openolt.Indication
+}
+
+func (s *mockIndicationStream) Send(ind *openolt.Indication) error {
+	s.indications <- ind
+	return nil
+}
+
+func TestProcessNniPacketIns(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.InternalState.SetState("enabled")
+	onu := olt.Pons[0].Onus[0]
+
+	nni := &NniPort{ID: 1, pktInChannel: make(chan *types.PacketMsg, 1)}
+	olt.Nnis = append(olt.Nnis, &NniPort{ID: 0}, nni)
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 1)}
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go olt.processNniPacketIns(ctx, stream, nni)
+
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{},
+		&layers.Ethernet{
+			SrcMAC:       onu.HwAddress,
+			DstMAC:       onu.HwAddress,
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		gopacket.Payload([]byte{0x01, 0x02, 0x03, 0x04}),
+	)
+	nni.pktInChannel <- &types.PacketMsg{
+		Pkt: gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default),
+	}
+
+	// the packet is reported on the NNI it was received on
+	ind := <-stream.indications
+	assert.Equal(t, ind.GetPktInd().IntfType, "nni")
+	assert.Equal(t, ind.GetPktInd().IntfId, uint32(1))
+}
+
+func TestUplinkPacketOut_UnknownNni(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.Nnis = append(olt.Nnis, &NniPort{ID: 0})
+
+	_, err := olt.UplinkPacketOut(context.TODO(), &openolt.UplinkPacket{IntfId: 3, Pkt: []byte{}})
+
+	assert.Equal(t, status.Code(err), codes.NotFound)
 }
 
 type ExecutorSpy struct {
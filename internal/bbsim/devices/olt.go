@@ -20,74 +20,203 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/looplab/fsm"
 	"github.com/opencord/bbsim/internal/bbsim/packetHandlers"
 	bbsim "github.com/opencord/bbsim/internal/bbsim/types"
-	omcisim "github.com/opencord/omci-sim"
+	"github.com/opencord/bbsim/internal/common"
 	"github.com/opencord/voltha-protos/go/openolt"
 	"github.com/opencord/voltha-protos/go/tech_profile"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var oltLogger = log.WithFields(log.Fields{
 	"module": "OLT",
 })
 
+// time to wait before a deleted ONU is discovered again
+var onuRediscoveryDelay = 5 * time.Second
+
+type HeartbeatFailureMode int
+
+const (
+	// HeartbeatFail makes HeartbeatCheck return an error
+	HeartbeatFail HeartbeatFailureMode = iota
+	// HeartbeatHang makes HeartbeatCheck block until the failure expires
+	HeartbeatHang
+)
+
+func (m HeartbeatFailureMode) String() string {
+	names := [...]string{
+		"HeartbeatFail",
+		"HeartbeatHang",
+	}
+	return names[m]
+}
+
+// heartbeatState is what HeartbeatCheck reports, the gRPC calls read it while the API and the reboot change it
+type heartbeatState struct {
+	mu sync.Mutex
+	// changes every time the OLT reboots
+	signature   uint32
+	failureMode HeartbeatFailureMode
+	failureEnd  time.Time
+	// closed when the failure changes or the OLT reboots, to release the hanging HeartbeatCheck calls
+	failureChanged chan struct{}
+}
+
 type OltDevice struct {
 	// BBSIM Internals
-	ID              int
-	SerialNumber    string
-	NumNni          int
-	NumPon          int
-	NumOnuPerPon    int
-	InternalState   *fsm.FSM
-	channel         chan Message
-	oltDoneChannel  *chan bool
-	apiDoneChannel  *chan bool
-	nniPktInChannel chan *bbsim.PacketMsg
-
-	Pons []*PonPort
-	Nnis []*NniPort
+	ID             int
+	SerialNumber   string
+	NumNni         int
+	NumPon         int
+	NumOnuPerPon   int
+	NumUniPerOnu   int
+	UniType        string
+	StrictFlows    bool
+	DeviceInfo     common.DeviceInfoOptions
+	OnuIdentities  *common.OnuIdentities
+	Discovery      common.DiscoveryOptions
+	MibTemplates   *common.MibTemplates
+	OnuRebootDelay time.Duration
+	PmInterval     time.Duration
+	InternalState  *fsm.FSM
+	channel        chan Message
+	oltDoneChannel *chan bool
+	apiDoneChannel *chan bool
+	rebootDelay    time.Duration
+	oltServer      *grpc.Server
+
+	// the OLT gRPC server address, once the server started it contains the port chosen by the OS (if any)
+	// so that the OLT comes back on the same port after a reboot
+	oltAddress string
+
+	// cancels the processing loops started by Enable
+	enableContextCancel context.CancelFunc
+	// the stream of the last Enable, the ONUs added at runtime send their indications on it
+	indications *indicationStream
+	// the PONs that were enabled when the OLT was disabled, ReenableOlt enables them again
+	enabledPons []*PonPort
+
+	// the ONUs added at runtime get the same settings as the ones created at startup
+	sTag     int
+	nextCTag int
+	auth     bool
+	dhcp     bool
+
+	heartbeat *heartbeatState
+	// the AllocIds and GemPorts in use, per pool
+	pools *poolIndexes
+
+	Pons  []*PonPort
+	Nnis  []*NniPort
+	Flows *FlowStore
 
 	// OLT Attributes
 	OperState *fsm.FSM
 }
 
-var olt OltDevice
+// the OLTs emulated by this process, indexed by ID,
+// the lock also protects their gRPC servers, the addresses they listen on and the cancel functions of the loops
+// started by Enable, as a reboot replaces them from another goroutine
+var (
+	oltsLock sync.RWMutex
+	olts     = make(map[int]*OltDevice)
+)
+
+// onusLock serializes adding and removing ONUs at runtime with Enable,
+// so that every ONU is attached to the indication stream and discovered exactly once
+var onusLock sync.Mutex
 
+// GetOLT returns the first OLT, it is used by the APIs that are not aware of multiple OLTs
 func GetOLT() *OltDevice {
-	return &olt
+	all := GetOLTs()
+	if len(all) == 0 {
+		return nil
+	}
+	return all[0]
+}
+
+func GetOLTById(id int) (*OltDevice, error) {
+	oltsLock.RLock()
+	defer oltsLock.RUnlock()
+	if o, ok := olts[id]; ok {
+		return o, nil
+	}
+	return nil, fmt.Errorf("cannot-find-olt-%d", id)
 }
 
-func CreateOLT(oltId int, nni int, pon int, onuPerPon int, sTag int, cTagInit int, oltDoneChannel *chan bool, apiDoneChannel *chan bool, auth bool, dhcp bool, isMock bool) *OltDevice {
+// GetOLTs returns all the OLTs sorted by ID
+func GetOLTs() []*OltDevice {
+	oltsLock.RLock()
+	defer oltsLock.RUnlock()
+	res := make([]*OltDevice, 0, len(olts))
+	for _, o := range olts {
+		res = append(res, o)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+func CreateOLT(options *common.BBSimCliOptions, oltDoneChannel *chan bool, apiDoneChannel *chan bool, isMock bool) *OltDevice {
 	oltLogger.WithFields(log.Fields{
-		"ID":           oltId,
-		"NumNni":       nni,
-		"NumPon":       pon,
-		"NumOnuPerPon": onuPerPon,
+		"ID":           options.OltID,
+		"NumNni":       options.NumNniPerOlt,
+		"NumPon":       options.NumPonPerOlt,
+		"NumOnuPerPon": options.NumOnuPerPon,
+		"NumUniPerOnu": options.NumUniPerOnu,
+		"RebootDelay":  options.RebootDelay,
+		"StrictFlows":  options.StrictFlows,
+		"Discovery":    options.Discovery,
 	}).Debug("CreateOLT")
 
-	olt = OltDevice{
-		ID:           oltId,
-		SerialNumber: fmt.Sprintf("BBSIM_OLT_%d", oltId),
+	olt := &OltDevice{
+		ID:           options.OltID,
+		SerialNumber: fmt.Sprintf("BBSIM_OLT_%d", options.OltID),
 		OperState: getOperStateFSM(func(e *fsm.Event) {
 			oltLogger.Debugf("Changing OLT OperState from %s to %s", e.Src, e.Dst)
 		}),
-		NumNni:          nni,
-		NumPon:          pon,
-		NumOnuPerPon:    onuPerPon,
-		Pons:            []*PonPort{},
-		Nnis:            []*NniPort{},
-		channel:         make(chan Message),
-		oltDoneChannel:  oltDoneChannel,
-		apiDoneChannel:  apiDoneChannel,
-		nniPktInChannel: make(chan *bbsim.PacketMsg, 1024), // packets coming in from the NNI and going to VOLTHA
+		NumNni:         options.NumNniPerOlt,
+		NumPon:         options.NumPonPerOlt,
+		NumOnuPerPon:   options.NumOnuPerPon,
+		NumUniPerOnu:   options.NumUniPerOnu,
+		UniType:        options.UniType,
+		StrictFlows:    options.StrictFlows,
+		DeviceInfo:     options.DeviceInfo,
+		OnuIdentities:  options.OnuIdentities,
+		Discovery:      options.Discovery,
+		MibTemplates:   options.MibTemplates,
+		OnuRebootDelay: options.OnuRebootDelay,
+		PmInterval:     options.PmInterval,
+		Pons:           []*PonPort{},
+		Nnis:           []*NniPort{},
+		Flows:          NewFlowStore(),
+		channel:        make(chan Message),
+		oltDoneChannel: oltDoneChannel,
+		apiDoneChannel: apiDoneChannel,
+		rebootDelay:    time.Duration(options.RebootDelay) * time.Second,
+		oltAddress:     options.OltAddress,
+		sTag:           options.STag,
+		auth:           options.Auth,
+		dhcp:           options.Dhcp,
+	}
+	olt.pools = newPoolIndexes()
+	olt.heartbeat = &heartbeatState{
+		signature:      newHeartbeatSignature(0),
+		failureChanged: make(chan struct{}),
 	}
 
 	// OLT State machine
@@ -95,8 +224,10 @@ func CreateOLT(oltId int, nni int, pon int, onuPerPon int, sTag int, cTagInit in
 	olt.InternalState = fsm.NewFSM(
 		"created",
 		fsm.Events{
-			{Name: "enable", Src: []string{"created"}, Dst: "enabled"},
+			{Name: "enable", Src: []string{"created", "reenabling"}, Dst: "enabled"},
 			{Name: "disable", Src: []string{"enabled"}, Dst: "disabled"},
+			// NOTE reenabling is the state in which we replay the indications VOLTHA expects after ReenableOlt
+			{Name: "reenable", Src: []string{"disabled"}, Dst: "reenabling"},
 		},
 		fsm.Callbacks{
 			"enter_state": func(e *fsm.Event) {
@@ -106,93 +237,150 @@ func CreateOLT(oltId int, nni int, pon int, onuPerPon int, sTag int, cTagInit in
 	)
 
 	if isMock != true {
-		// create NNI Port
-		nniPort, err := CreateNNI(&olt)
-		if err != nil {
-			oltLogger.Fatalf("Couldn't create NNI Port: %v", err)
-		}
+		// create NNI Ports
+		for i := 0; i < olt.NumNni; i++ {
+			nniPort, err := CreateNNI(olt, uint32(i))
+			if err != nil {
+				oltLogger.Fatalf("Couldn't create NNI Port: %v", err)
+			}
 
-		olt.Nnis = append(olt.Nnis, &nniPort)
+			olt.Nnis = append(olt.Nnis, &nniPort)
+		}
 	}
 
 	// create PON ports
-	availableCTag := cTagInit
-	for i := 0; i < pon; i++ {
-		p := PonPort{
-			NumOnu: olt.NumOnuPerPon,
-			ID:     uint32(i),
-			Type:   "pon",
-			Olt:    olt,
-			Onus:   []*Onu{},
-		}
-		p.OperState = getOperStateFSM(func(e *fsm.Event) {
-			oltLogger.WithFields(log.Fields{
-				"ID": p.ID,
-			}).Debugf("Changing PON Port OperState from %s to %s", e.Src, e.Dst)
-		})
+	availableCTag := options.CTagInit
+	for i := 0; i < options.NumPonPerOlt; i++ {
+		p := CreatePonPort(*olt, uint32(i))
 
 		// create ONU devices
-		for j := 0; j < onuPerPon; j++ {
-			o := CreateONU(olt, p, uint32(j+1), sTag, availableCTag, auth, dhcp)
-			p.Onus = append(p.Onus, o)
-			availableCTag = availableCTag + 1
+		for j := 0; j < options.NumOnuPerPon; j++ {
+			o := CreateONU(*olt, *p, uint32(j+1), options.STag, availableCTag, options.Auth, options.Dhcp)
+			p.AddOnu(o)
+			availableCTag = availableCTag + len(o.Unis)
 		}
 
-		olt.Pons = append(olt.Pons, &p)
+		olt.Pons = append(olt.Pons, p)
 	}
-	return &olt
+	olt.nextCTag = availableCTag
+
+	oltsLock.Lock()
+	olts[olt.ID] = olt
+	oltsLock.Unlock()
+
+	return olt
 }
 
 // this function start the OLT gRPC server and blocks until it's done
-func StartOlt(olt *OltDevice, group *sync.WaitGroup) {
-	newOltServer(*olt)
+func StartOlt(olt *OltDevice, group *sync.WaitGroup, addresses *common.ListenAddresses) {
+	if err := olt.newOltServer(); err != nil {
+		oltLogger.Fatalf("OLT failed to listen: %v", err)
+	}
+	addresses.Add(fmt.Sprintf("olt%d", olt.ID), olt.Address())
+
+	for {
+		_, ok := <-*olt.oltDoneChannel
+		if !ok {
+			// if the olt Channel is closed, stop the gRPC server
+			log.Warnf("Stopping OLT gRPC server")
+			olt.server().Stop()
+			break
+		}
+	}
+
 	group.Done()
 }
 
-func newOltServer(o OltDevice) error {
-	// TODO make configurable
-	address := "0.0.0.0:50060"
-	lis, err := net.Listen("tcp", address)
+// newOltServer starts the OLT gRPC server, it is invoked at startup and after a reboot
+func (o *OltDevice) newOltServer() error {
+	lis, err := net.Listen("tcp", o.oltAddress)
 	if err != nil {
-		oltLogger.Fatalf("OLT failed to listen: %v", err)
+		return err
 	}
+	address := common.ListenerAddress(o.oltAddress, lis)
+
 	grpcServer := grpc.NewServer()
 	openolt.RegisterOpenoltServer(grpcServer, o)
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
+	oltsLock.Lock()
+	o.oltAddress = address
+	o.oltServer = grpcServer
+	oltsLock.Unlock()
 
 	go grpcServer.Serve(lis)
-	oltLogger.Debugf("OLT Listening on: %v", address)
+	oltLogger.Infof("OLT Listening on: %v", address)
+	return nil
+}
 
-	for {
-		_, ok := <-*o.oltDoneChannel
-		if !ok {
-			// if the olt Channel is closed, stop the gRPC server
-			log.Warnf("Stopping OLT gRPC server")
-			grpcServer.Stop()
-			wg.Done()
-			break
-		}
+// server returns the OLT gRPC server, it is nil until the server starts
+func (o *OltDevice) server() *grpc.Server {
+	oltsLock.RLock()
+	defer oltsLock.RUnlock()
+	return o.oltServer
+}
+
+// newEnableContext stops the processing loops started by the previous Enable (if any)
+// and returns the context of the new ones
+func (o *OltDevice) newEnableContext() (context.Context, context.CancelFunc) {
+	oltsLock.Lock()
+	defer oltsLock.Unlock()
+	if o.enableContextCancel != nil {
+		o.enableContextCancel()
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o.enableContextCancel = cancel
+	return ctx, cancel
+}
 
-	wg.Wait()
+// cancelEnableContext stops the processing loops started by Enable and closes the indication stream
+func (o *OltDevice) cancelEnableContext() {
+	oltsLock.RLock()
+	defer oltsLock.RUnlock()
+	if o.enableContextCancel != nil {
+		o.enableContextCancel()
+	}
+}
 
-	return nil
+// Address returns the address the OLT gRPC server listens on
+func (o *OltDevice) Address() string {
+	oltsLock.RLock()
+	defer oltsLock.RUnlock()
+	return o.oltAddress
 }
 
 // Device Methods
 
-func (o OltDevice) Enable(stream openolt.Openolt_EnableIndicationServer) error {
+func (o *OltDevice) Enable(stream openolt.Openolt_EnableIndicationServer) error {
 
 	oltLogger.Debug("Enable OLT called")
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	// NOTE if VOLTHA reconnects we stop the processing loops bound to the previous stream
+	ctx, cancel := o.newEnableContext()
+
+	// NOTE all the loops send their indications through the same serialized stream
+	indications := newIndicationStream(ctx, stream)
 
 	// create a Channel for all the OLT events
-	go o.processOltMessages(stream)
-	go o.processNniPacketIns(stream)
+	go o.processOltMessages(ctx, indications)
+	for _, nni := range o.Nnis {
+		go o.processNniPacketIns(ctx, indications, nni)
+	}
+
+	// NOTE the loops stop if the OLT reboots or VOLTHA reconnects while the OLT is being enabled,
+	// then nobody consumes the messages and Enable must give up instead of blocking
+	send := func(msg Message) bool {
+		select {
+		case o.channel <- msg:
+			return true
+		case <-ctx.Done():
+			oltLogger.Warn("Enable OLT interrupted")
+			return false
+		}
+	}
+
+	if err := o.InternalState.Event("enable"); err != nil {
+		oltLogger.Errorf("Failed to transition OLT to enabled state: %s", err.Error())
+	}
 
 	// enable the OLT
 	olt_msg := Message{
@@ -201,7 +389,9 @@ func (o OltDevice) Enable(stream openolt.Openolt_EnableIndicationServer) error {
 			OperState: UP,
 		},
 	}
-	o.channel <- olt_msg
+	if !send(olt_msg) {
+		return nil
+	}
 
 	// send NNI Port Indications
 	for _, nni := range o.Nnis {
@@ -212,58 +402,119 @@ func (o OltDevice) Enable(stream openolt.Openolt_EnableIndicationServer) error {
 				NniPortID: nni.ID,
 			},
 		}
-		o.channel <- msg
+		if !send(msg) {
+			return nil
+		}
 	}
-	go o.processOmciMessages()
 	// send PON Port indications
+	onusLock.Lock()
+	o.indications = indications
 	for _, pon := range o.Pons {
-		msg := Message{
+		// NOTE if VOLTHA reconnected without rebooting the OLT the PON is already enabled,
+		// but the new stream still needs its indications
+		sent := send(Message{
 			Type: PonIndication,
 			Data: PonIndicationMessage{
 				OperState: UP,
 				PonPortID: pon.ID,
 			},
+		})
+		if !sent {
+			onusLock.Unlock()
+			return nil
 		}
-		o.channel <- msg
-
-		for _, onu := range pon.Onus {
-			go onu.ProcessOnuMessages(stream, nil)
-			// FIXME move the message generation in the state transition
-			// from here only invoke the state transition
-			msg := Message{
-				Type: OnuDiscIndication,
-				Data: OnuDiscIndicationMessage{
-					Onu:       onu,
-					OperState: UP,
-				},
+		if !pon.InternalState.Is("enabled") {
+			if err := pon.InternalState.Event("enable"); err != nil {
+				oltLogger.WithFields(log.Fields{
+					"IntfId": pon.ID,
+				}).Errorf("Failed to transition PON to enabled state: %s", err.Error())
 			}
-			onu.Channel <- msg
 		}
+
+		onus := pon.GetOnus()
+		processOnusMessages(ctx, indications, onus)
+		o.discoverOnus(ctx, pon, onus)
+	}
+	onusLock.Unlock()
+
+	// the stream is kept open until VOLTHA disconnects or the OLT is rebooted
+	select {
+	case <-ctx.Done():
+	case <-stream.Context().Done():
+		cancel()
 	}
 
-	wg.Wait()
+	oltLogger.Debug("Enable OLT stream closed")
 	return nil
 }
 
-func (o OltDevice) processOmciMessages() {
-	ch := omcisim.GetChannel()
+// discoverOnus sends an OnuDiscIndication for each ONU on a PON, as fast and in the order
+// configured by the Discovery options. The paced discovery stops when ctx is done or the PON is disabled
+func (o *OltDevice) discoverOnus(ctx context.Context, pon *PonPort, onus []*Onu) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	oltLogger.Debug("Started OMCI Indication Channel")
+	if o.Discovery.Order == common.DiscoveryShuffled {
+		shuffled := make([]*Onu, len(onus))
+		copy(shuffled, onus)
+		rnd.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		onus = shuffled
+	}
 
-	for message := range ch {
-		onuId := message.Data.OnuId
-		intfId := message.Data.IntfId
-		onu, err := o.FindOnuById(intfId, onuId)
-		if err != nil {
-			oltLogger.Errorf("Failed to find onu: %v", err)
+	// FIXME move the message generation in the state transition
+	// from here only invoke the state transition
+	discover := func(onu *Onu) {
+		msg := Message{
+			Type: OnuDiscIndication,
+			Data: OnuDiscIndicationMessage{
+				Onu:       onu,
+				OperState: UP,
+			},
+		}
+		onu.Enqueue(msg)
+	}
+
+	if !o.Discovery.Paced() {
+		for _, onu := range onus {
+			discover(onu)
 		}
-		go onu.processOmciMessage(message)
+		return
 	}
+
+	go func() {
+		for i, onu := range onus {
+			wait := o.Discovery.InitialDelay(rnd)
+			if i > 0 {
+				wait = o.Discovery.Interval(rnd)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				// NOTE the OLT rebooted or VOLTHA reconnected, Enable starts the discovery again
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if !pon.InternalState.Is("enabled") {
+				// NOTE the ONUs that were not discovered yet are once the PON is enabled again, see PonPort.restoreOnus
+				oltLogger.WithFields(log.Fields{
+					"IntfId": pon.ID,
+				}).Debug("Stopping the ONU discovery as the PON is not enabled")
+				return
+			}
+			if !pon.hasOnu(onu) {
+				// NOTE the ONU was removed while it was waiting to be discovered
+				continue
+			}
+			discover(onu)
+		}
+	}()
 }
 
 // Helpers method
 
-func (o OltDevice) GetPonById(id uint32) (*PonPort, error) {
+func (o *OltDevice) GetPonById(id uint32) (*PonPort, error) {
 	for _, pon := range o.Pons {
 		if pon.ID == id {
 			return pon, nil
@@ -272,7 +523,7 @@ func (o OltDevice) GetPonById(id uint32) (*PonPort, error) {
 	return nil, errors.New(fmt.Sprintf("Cannot find PonPort with id %d in OLT %d", id, o.ID))
 }
 
-func (o OltDevice) getNniById(id uint32) (*NniPort, error) {
+func (o *OltDevice) getNniById(id uint32) (*NniPort, error) {
 	for _, nni := range o.Nnis {
 		if nni.ID == id {
 			return nni, nil
@@ -281,7 +532,63 @@ func (o OltDevice) getNniById(id uint32) (*NniPort, error) {
 	return nil, errors.New(fmt.Sprintf("Cannot find NniPort with id %d in OLT %d", id, o.ID))
 }
 
-func (o OltDevice) sendOltIndication(msg OltIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
+// indicationsContext returns the context of the indication loops, it is nil if VOLTHA never called EnableIndication
+func (o *OltDevice) indicationsContext() context.Context {
+	onusLock.Lock()
+	defer onusLock.Unlock()
+	if o.indications == nil {
+		return nil
+	}
+	return o.indications.ctx
+}
+
+// checkConnected fails if the OLT indication loop is not running, eg: because the stream with VOLTHA was closed,
+// as the messages sent to the OLT channel would never be consumed
+func (o *OltDevice) checkConnected() error {
+	if ctx := o.indicationsContext(); ctx == nil || ctx.Err() != nil {
+		return status.Error(codes.Unavailable, fmt.Sprintf("olt-%d-is-not-connected", o.ID))
+	}
+	return nil
+}
+
+// sendOltMessage queues a message for the OLT indication loop, it fails if the loop stops before consuming it
+func (o *OltDevice) sendOltMessage(msg Message) error {
+	ctx := o.indicationsContext()
+	if ctx == nil {
+		return status.Error(codes.Unavailable, fmt.Sprintf("olt-%d-is-not-connected", o.ID))
+	}
+	select {
+	case o.channel <- msg:
+		return nil
+	case <-ctx.Done():
+		return status.Error(codes.Unavailable, fmt.Sprintf("olt-%d-is-not-connected", o.ID))
+	}
+}
+
+// changePonState enables or disables a PON, the PonIndication is sent before the ONUs are restored or brought down.
+// It fails without changing the state if the OLT indication loop is not running
+func (o *OltDevice) changePonState(pon *PonPort, event string) error {
+	if !pon.InternalState.Can(event) {
+		return status.Errorf(codes.FailedPrecondition, "pon-%d-cannot-%s-when-%s", pon.ID, event, pon.InternalState.Current())
+	}
+	operState := UP
+	if event == "disable" {
+		operState = DOWN
+	}
+	msg := Message{
+		Type: PonIndication,
+		Data: PonIndicationMessage{
+			OperState: operState,
+			PonPortID: pon.ID,
+		},
+	}
+	if err := o.sendOltMessage(msg); err != nil {
+		return err
+	}
+	return pon.InternalState.Event(event)
+}
+
+func (o *OltDevice) sendOltIndication(msg OltIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
 	data := &openolt.Indication_OltInd{OltInd: &openolt.OltIndication{OperState: msg.OperState.String()}}
 	if err := stream.Send(&openolt.Indication{Data: data}); err != nil {
 		oltLogger.Errorf("Failed to send Indication_OltInd: %v", err)
@@ -292,9 +599,13 @@ func (o OltDevice) sendOltIndication(msg OltIndicationMessage, stream openolt.Op
 	}).Debug("Sent Indication_OltInd")
 }
 
-func (o OltDevice) sendNniIndication(msg NniIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
+func (o *OltDevice) sendNniIndication(msg NniIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
 	nni, _ := o.getNniById(msg.NniPortID)
-	nni.OperState.Event("enable")
+	if msg.OperState == UP {
+		nni.OperState.Event("enable")
+	} else if msg.OperState == DOWN {
+		nni.OperState.Event("disable")
+	}
 	// NOTE Operstate may need to be an integer
 	operData := &openolt.Indication_IntfOperInd{IntfOperInd: &openolt.IntfOperIndication{
 		Type:      nni.Type,
@@ -313,9 +624,13 @@ func (o OltDevice) sendNniIndication(msg NniIndicationMessage, stream openolt.Op
 	}).Debug("Sent Indication_IntfOperInd for NNI")
 }
 
-func (o OltDevice) sendPonIndication(msg PonIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
+func (o *OltDevice) sendPonIndication(msg PonIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
 	pon, _ := o.GetPonById(msg.PonPortID)
-	pon.OperState.Event("enable")
+	if msg.OperState == UP {
+		pon.OperState.Event("enable")
+	} else if msg.OperState == DOWN {
+		pon.OperState.Event("disable")
+	}
 	discoverData := &openolt.Indication_IntfInd{IntfInd: &openolt.IntfIndication{
 		IntfId:    pon.ID,
 		OperState: pon.OperState.Current(),
@@ -347,9 +662,17 @@ func (o OltDevice) sendPonIndication(msg PonIndicationMessage, stream openolt.Op
 	}).Debug("Sent Indication_IntfOperInd for PON")
 }
 
-func (o OltDevice) processOltMessages(stream openolt.Openolt_EnableIndicationServer) {
+func (o *OltDevice) processOltMessages(ctx context.Context, stream openolt.Openolt_EnableIndicationServer) {
 	oltLogger.Debug("Started OLT Indication Channel")
-	for message := range o.channel {
+loop:
+	for {
+		var message Message
+		select {
+		case <-ctx.Done():
+			oltLogger.Debug("OLT Indication processing canceled via context")
+			break loop
+		case message = <-o.channel:
+		}
 
 		oltLogger.WithFields(log.Fields{
 			"oltId":       o.ID,
@@ -359,11 +682,10 @@ func (o OltDevice) processOltMessages(stream openolt.Openolt_EnableIndicationSer
 		switch message.Type {
 		case OltIndication:
 			msg, _ := message.Data.(OltIndicationMessage)
+			// NOTE the InternalState is driven by Enable, DisableOlt and ReenableOlt
 			if msg.OperState == UP {
-				o.InternalState.Event("enable")
 				o.OperState.Event("enable")
 			} else if msg.OperState == DOWN {
-				o.InternalState.Event("disable")
 				o.OperState.Event("disable")
 			}
 			o.sendOltIndication(msg, stream)
@@ -380,14 +702,36 @@ func (o OltDevice) processOltMessages(stream openolt.Openolt_EnableIndicationSer
 	}
 }
 
-func (o OltDevice) processNniPacketIns(stream openolt.Openolt_EnableIndicationServer) {
+// processNniPacketIns sends to VOLTHA the packets received on an NNI,
+// every NNI has its own veth pair and thus its own loop
+func (o *OltDevice) processNniPacketIns(ctx context.Context, stream openolt.Openolt_EnableIndicationServer, nni *NniPort) {
 	oltLogger.WithFields(log.Fields{
-		"nniChannel": o.nniPktInChannel,
+		"IntfId":     nni.ID,
+		"nniChannel": nni.pktInChannel,
 	}).Debug("Started NNI Channel")
-	nniId := o.Nnis[0].ID // FIXME we are assuming we have only one NNI
-	for message := range o.nniPktInChannel {
+	nniId := nni.ID
+loop:
+	for {
+		var message *bbsim.PacketMsg
+		select {
+		case <-ctx.Done():
+			oltLogger.WithFields(log.Fields{
+				"IntfId": nniId,
+			}).Debug("NNI processing canceled via context")
+			break loop
+		case message = <-nni.pktInChannel:
+		}
 		oltLogger.Tracef("Received packets on NNI Channel")
 
+		if !o.InternalState.Is("enabled") {
+			oltLogger.WithFields(log.Fields{
+				"IntfType":      "nni",
+				"IntfId":        nniId,
+				"InternalState": o.InternalState.Current(),
+			}).Trace("Dropping NNI packet as the OLT is not enabled")
+			continue
+		}
+
 		onuMac, err := packetHandlers.GetDstMacAddressFromPacket(message.Pkt)
 
 		if err != nil {
@@ -396,10 +740,10 @@ func (o OltDevice) processNniPacketIns(stream openolt.Openolt_EnableIndicationSe
 				"IntfId":   nniId,
 				"Pkt":      message.Pkt.Data(),
 			}).Error("Can't find Dst MacAddress in packet")
-			return
+			continue
 		}
 
-		onu, err := o.FindOnuByMacAddress(onuMac)
+		onu, uni, err := o.FindUniByMacAddress(onuMac)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"IntfType":   "nni",
@@ -407,10 +751,10 @@ func (o OltDevice) processNniPacketIns(stream openolt.Openolt_EnableIndicationSe
 				"Pkt":        message.Pkt.Data(),
 				"MacAddress": onuMac.String(),
 			}).Error("Can't find ONU with MacAddress")
-			return
+			continue
 		}
 
-		doubleTaggedPkt, err := packetHandlers.PushDoubleTag(onu.STag, onu.CTag, message.Pkt)
+		doubleTaggedPkt, err := packetHandlers.PushDoubleTag(onu.STag, uni.CTag, message.Pkt)
 		if err != nil {
 			log.Error("Fail to add double tag to packet")
 		}
@@ -436,14 +780,10 @@ func (o OltDevice) processNniPacketIns(stream openolt.Openolt_EnableIndicationSe
 }
 
 // returns an ONU with a given Serial Number
-func (o OltDevice) FindOnuBySn(serialNumber string) (*Onu, error) {
-	// TODO this function can be a performance bottleneck when we have many ONUs,
-	// memoizing it will remove the bottleneck
+func (o *OltDevice) FindOnuBySn(serialNumber string) (*Onu, error) {
 	for _, pon := range o.Pons {
-		for _, onu := range pon.Onus {
-			if onu.Sn() == serialNumber {
-				return onu, nil
-			}
+		if onu, ok := pon.getOnuBySn(serialNumber); ok {
+			return onu, nil
 		}
 	}
 
@@ -451,60 +791,231 @@ func (o OltDevice) FindOnuBySn(serialNumber string) (*Onu, error) {
 }
 
 // returns an ONU with a given interface/Onu Id
-func (o OltDevice) FindOnuById(intfId uint32, onuId uint32) (*Onu, error) {
-	// TODO this function can be a performance bottleneck when we have many ONUs,
-	// memoizing it will remove the bottleneck
-	for _, pon := range o.Pons {
-		if pon.ID == intfId {
-			for _, onu := range pon.Onus {
-				if onu.ID == onuId {
-					return onu, nil
-				}
-			}
+func (o *OltDevice) FindOnuById(intfId uint32, onuId uint32) (*Onu, error) {
+	if pon, err := o.GetPonById(intfId); err == nil {
+		if onu, err := pon.GetOnuById(onuId); err == nil {
+			return onu, nil
 		}
 	}
 	return &Onu{}, errors.New(fmt.Sprintf("cannot-find-onu-by-id-%v-%v", intfId, onuId))
 }
 
-// returns an ONU with a given Mac Address
-func (o OltDevice) FindOnuByMacAddress(mac net.HardwareAddr) (*Onu, error) {
-	// TODO this function can be a performance bottleneck when we have many ONUs,
-	// memoizing it will remove the bottleneck
+// returns the ONU that has an UNI with a given Mac Address
+func (o *OltDevice) FindOnuByMacAddress(mac net.HardwareAddr) (*Onu, error) {
+	onu, _, err := o.FindUniByMacAddress(mac)
+	return onu, err
+}
+
+// returns an UNI with a given Mac Address and the ONU it belongs to
+func (o *OltDevice) FindUniByMacAddress(mac net.HardwareAddr) (*Onu, *UniPort, error) {
 	for _, pon := range o.Pons {
-		for _, onu := range pon.Onus {
-			if onu.HwAddress.String() == mac.String() {
-				return onu, nil
-			}
+		if ref, ok := pon.getUniByMacAddress(mac); ok {
+			return ref.onu, ref.uni, nil
+		}
+	}
+
+	return &Onu{}, nil, errors.New(fmt.Sprintf("cannot-find-onu-by-mac-address-%s", mac))
+}
+
+// AddOnu connects a new ONU to a PON: if sn is empty the serial number is generated from the SN pattern,
+// if the tags are 0 the ONU gets the S-Tag of the OLT and the next C-Tags that were not given to any ONU.
+// The ONU is discovered right away if the OLT and the PON are enabled
+func (o *OltDevice) AddOnu(ponId uint32, sn string, sTag int, cTag int) (*Onu, error) {
+	pon, err := o.GetPonById(ponId)
+	if err != nil {
+		return nil, err
+	}
+	if sTag < 0 || sTag > 4094 {
+		return nil, fmt.Errorf("invalid-s-tag-%d", sTag)
+	}
+	if cTag < 0 || cTag > 4094 {
+		return nil, fmt.Errorf("invalid-c-tag-%d", cTag)
+	}
+
+	var serialNumber *openolt.SerialNumber
+	if sn != "" {
+		if serialNumber, err = common.OnuSnFromString(sn); err != nil {
+			return nil, err
+		}
+	}
+
+	onusLock.Lock()
+	defer onusLock.Unlock()
+
+	identities := o.OnuIdentities
+	if identities == nil {
+		identities = common.DefaultOnuIdentities
+	}
+	id := pon.nextOnuId()
+	numUnis := o.NumUniPerOnu
+	if numUnis < 1 {
+		numUnis = 1
+	}
+	// NOTE CreateONU can't fail, so we make sure the serial number and the MAC addresses can be generated
+	if err := identities.Validate(o.ID, int(pon.ID)+1, int(id), o.MibTemplates.MaxUnis(numUnis)); err != nil {
+		return nil, err
+	}
+	generated := serialNumber == nil
+	if generated {
+		if serialNumber, err = identities.SerialNumber(o.ID, pon.ID, id); err != nil {
+			return nil, err
+		}
+	}
+	// NOTE the vendor ID of the template replaces the one of the generated serial numbers only
+	template := o.MibTemplates.ForOnu(o.ID, pon.ID, id, serialNumber)
+	if generated {
+		serialNumber = template.ApplyVendorId(serialNumber)
+	}
+	// NOTE the serial numbers have to be unique across all the OLTs, as VOLTHA may manage all of them
+	for _, olt := range GetOLTs() {
+		if _, err := olt.FindOnuBySn(common.OnuSnToString(serialNumber)); err == nil {
+			return nil, fmt.Errorf("onu-%s-already-exists", common.OnuSnToString(serialNumber))
+		}
+	}
+
+	if sTag == 0 {
+		sTag = o.sTag
+	}
+	if cTag == 0 {
+		cTag = o.nextCTag
+	}
+
+	onu := newOnu(*o, *pon, id, serialNumber, template, sTag, cTag, o.auth, o.dhcp)
+	if next := cTag + len(onu.Unis); next > o.nextCTag {
+		o.nextCTag = next
+	}
+	pon.AddOnu(onu)
+
+	oltLogger.WithFields(log.Fields{
+		"IntfId": pon.ID,
+		"OnuSn":  onu.Sn(),
+		"OnuId":  onu.ID,
+		"STag":   onu.STag,
+		"CTag":   onu.CTag,
+	}).Info("ONU added")
+
+	// NOTE if the OLT is not connected to VOLTHA the ONU is attached (and discovered) by Enable
+	if o.indications == nil || o.indications.ctx.Err() != nil {
+		return onu, nil
+	}
+	processOnusMessages(o.indications.ctx, o.indications, []*Onu{onu})
+	if o.InternalState.Is("enabled") && pon.InternalState.Is("enabled") {
+		msg := Message{
+			Type: OnuDiscIndication,
+			Data: OnuDiscIndicationMessage{
+				Onu:       onu,
+				OperState: UP,
+			},
 		}
+		onu.Enqueue(msg)
+	}
+	// NOTE otherwise the ONU is discovered once the PON is enabled, see PonPort.restoreOnus
+
+	return onu, nil
+}
+
+// RemoveOnu disconnects an ONU from its PON: if the ONU was active VOLTHA receives an OnuIndication
+// with OperState down, then the ONU stops responding and can't be found anymore
+func (o *OltDevice) RemoveOnu(sn string) error {
+	onusLock.Lock()
+	defer onusLock.Unlock()
+
+	onu, err := o.FindOnuBySn(sn)
+	if err != nil {
+		return err
+	}
+	pon, err := o.GetPonById(onu.PonPortID)
+	if err != nil {
+		return err
 	}
+	// NOTE the flows refer to the ONU by ID, so they are removed while the ONU still holds it
+	o.removeOnuFlows(onu)
+	o.pools.removeOnu(onu)
+	if err := pon.removeOnu(onu); err != nil {
+		return err
+	}
+
+	onu.Do(func() error {
+		o.deactivateOnu(onu)
+		onu.reset()
+		return nil
+	})
+	// NOTE this runs after the OnuIndication queued by deactivateOnu is sent
+	onu.Do(func() error {
+		onu.unplug()
+		return nil
+	})
+
+	oltLogger.WithFields(log.Fields{
+		"IntfId": onu.PonPortID,
+		"OnuSn":  onu.Sn(),
+		"OnuId":  onu.ID,
+	}).Info("ONU removed")
 
-	return &Onu{}, errors.New(fmt.Sprintf("cannot-find-onu-by-mac-address-%s", mac))
+	return nil
 }
 
 // GRPC Endpoints
 
-func (o OltDevice) ActivateOnu(context context.Context, onu *openolt.Onu) (*openolt.Empty, error) {
+func (o *OltDevice) ActivateOnu(context context.Context, onu *openolt.Onu) (*openolt.Empty, error) {
 	oltLogger.WithFields(log.Fields{
 		"OnuSn": onuSnToString(onu.SerialNumber),
 	}).Info("Received ActivateOnu call from VOLTHA")
 
-	pon, _ := o.GetPonById(onu.IntfId)
-	_onu, _ := pon.GetOnuBySn(onu.SerialNumber)
-	_onu.SetID(onu.OnuId)
+	pon, err := o.GetPonById(onu.IntfId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": onu.IntfId,
+			"OnuSn":  onuSnToString(onu.SerialNumber),
+		}).Errorf("Cannot activate ONU: %s", err.Error())
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
 
-	if err := _onu.OperState.Event("enable"); err != nil {
+	if !pon.InternalState.Is("enabled") {
 		oltLogger.WithFields(log.Fields{
-			"IntfId": _onu.PonPortID,
-			"OnuSn":  _onu.Sn(),
-			"OnuId":  _onu.ID,
-		}).Infof("Failed to transition ONU.OperState to enabled state: %s", err.Error())
+			"IntfId": pon.ID,
+			"OnuSn":  onuSnToString(onu.SerialNumber),
+		}).Error("Cannot activate ONU as the PON is not enabled")
+		return nil, status.Errorf(codes.FailedPrecondition, "pon-%d-is-not-enabled", pon.ID)
 	}
-	if err := _onu.InternalState.Event("enable"); err != nil {
+
+	_onu, err := pon.GetOnuBySn(onu.SerialNumber)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": pon.ID,
+			"OnuSn":  onuSnToString(onu.SerialNumber),
+		}).Errorf("Cannot activate ONU: %s", err.Error())
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	err = _onu.Do(func() error {
+		if err := _onu.SetID(onu.OnuId); err != nil {
+			return err
+		}
+
+		if err := _onu.OperState.Event("enable"); err != nil {
+			oltLogger.WithFields(log.Fields{
+				"IntfId": _onu.PonPortID,
+				"OnuSn":  _onu.Sn(),
+				"OnuId":  _onu.ID,
+			}).Infof("Failed to transition ONU.OperState to enabled state: %s", err.Error())
+		}
+		if err := _onu.InternalState.Event("enable"); err != nil {
+			oltLogger.WithFields(log.Fields{
+				"IntfId": _onu.PonPortID,
+				"OnuSn":  _onu.Sn(),
+				"OnuId":  _onu.ID,
+			}).Infof("Failed to transition ONU to enabled state: %s", err.Error())
+		}
+		return nil
+	})
+	if err != nil {
 		oltLogger.WithFields(log.Fields{
-			"IntfId": _onu.PonPortID,
+			"IntfId": pon.ID,
 			"OnuSn":  _onu.Sn(),
-			"OnuId":  _onu.ID,
-		}).Infof("Failed to transition ONU to enabled state: %s", err.Error())
+			"OnuId":  onu.OnuId,
+		}).Errorf("Cannot activate ONU: %s", err.Error())
+		return nil, err
 	}
 
 	// NOTE we need to immediately activate the ONU or the OMCI state machine won't start
@@ -512,45 +1023,294 @@ func (o OltDevice) ActivateOnu(context context.Context, onu *openolt.Onu) (*open
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) DeactivateOnu(context.Context, *openolt.Onu) (*openolt.Empty, error) {
-	oltLogger.Error("DeactivateOnu not implemented")
+func (o *OltDevice) DeactivateOnu(_ context.Context, onu *openolt.Onu) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId": onu.IntfId,
+		"OnuId":  onu.OnuId,
+	}).Info("Received DeactivateOnu call from VOLTHA")
+
+	_onu, err := o.FindOnuById(onu.IntfId, onu.OnuId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": onu.IntfId,
+			"OnuId":  onu.OnuId,
+		}).Errorf("Cannot deactivate ONU: %s", err.Error())
+		return nil, err
+	}
+
+	_onu.Do(func() error {
+		o.deactivateOnu(_onu)
+		_onu.reset()
+		return nil
+	})
+
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) DeleteOnu(context.Context, *openolt.Onu) (*openolt.Empty, error) {
-	oltLogger.Error("DeleteOnu not implemented")
+func (o *OltDevice) DeleteOnu(_ context.Context, onu *openolt.Onu) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId": onu.IntfId,
+		"OnuId":  onu.OnuId,
+	}).Info("Received DeleteOnu call from VOLTHA")
+
+	_onu, err := o.FindOnuById(onu.IntfId, onu.OnuId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": onu.IntfId,
+			"OnuId":  onu.OnuId,
+		}).Errorf("Cannot delete ONU: %s", err.Error())
+		return nil, err
+	}
+
+	_onu.Do(func() error {
+		// NOTE an ONU needs to be deactivated before it's deleted,
+		// VOLTHA may or may not have done it already
+		o.deactivateOnu(_onu)
+
+		// NOTE entering the created state resets the ONU
+		if err := _onu.InternalState.Event("initialize"); err != nil {
+			oltLogger.WithFields(log.Fields{
+				"IntfId": _onu.PonPortID,
+				"OnuSn":  _onu.Sn(),
+				"OnuId":  _onu.ID,
+			}).Infof("Failed to transition ONU to created state: %s", err.Error())
+		}
+		// NOTE VOLTHA can now assign the ID to another ONU
+		o.removeOnuFlows(_onu)
+		o.pools.removeOnu(_onu)
+		_onu.releaseID()
+		return nil
+	})
+
+	// NOTE the ONU is still connected to the PON, so a real OLT would discover it again.
+	// If VOLTHA is not connected the ONU is discovered when it calls EnableIndication
+	pon, _ := o.GetPonById(_onu.PonPortID)
+	if ctx := o.indicationsContext(); ctx != nil && o.InternalState.Is("enabled") && pon.InternalState.Is("enabled") {
+		go o.rediscoverOnu(ctx, pon, _onu, onuRediscoveryDelay)
+	}
+
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) DisableOlt(context.Context, *openolt.Empty) (*openolt.Empty, error) {
-	// NOTE when we disable the OLT should we disable NNI, PONs and ONUs altogether?
+// deactivateOnu brings the ONU down, sending an OnuIndication to VOLTHA if it was active
+func (o *OltDevice) deactivateOnu(onu *Onu) {
+	if err := onu.OperState.Event("disable"); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": onu.PonPortID,
+			"OnuSn":  onu.Sn(),
+			"OnuId":  onu.ID,
+		}).Debugf("Failed to transition ONU.OperState to disabled state: %s", err.Error())
+	}
+	// NOTE entering the disabled state sends the OnuIndication with OperState down
+	if err := onu.InternalState.Event("disable"); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": onu.PonPortID,
+			"OnuSn":  onu.Sn(),
+			"OnuId":  onu.ID,
+		}).Debugf("Failed to transition ONU to disabled state: %s", err.Error())
+	}
+}
+
+// removeOnuFlows drops the flows VOLTHA installed for the ONU, so that they don't clash with the ones
+// of the ONU its ID is assigned to next
+func (o *OltDevice) removeOnuFlows(onu *Onu) {
+	if onu.index == nil || !onu.index.hasAssignedId(onu) {
+		return
+	}
+	flows := o.Flows.RemoveOnuFlows(onu.PonPortID, onu.ID)
+	oltLogger.WithFields(log.Fields{
+		"IntfId": onu.PonPortID,
+		"OnuSn":  onu.Sn(),
+		"OnuId":  onu.ID,
+		"Flows":  len(flows),
+	}).Debug("Removed the ONU flows")
+}
+
+// rediscoverOnu waits for the delay and then sends a new OnuDiscIndication for the ONU,
+// unless the indication loops stop in the meantime (eg: the OLT reboots or VOLTHA disconnects)
+func (o *OltDevice) rediscoverOnu(ctx context.Context, pon *PonPort, onu *Onu, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		// NOTE Enable discovers the ONUs again when VOLTHA reconnects
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+
+	// NOTE the ONU may have been removed, discovered or the PON disabled in the meantime
+	if !pon.hasOnu(onu) || !onu.InternalState.Is("created") {
+		return
+	}
+
+	oltLogger.WithFields(log.Fields{
+		"IntfId": onu.PonPortID,
+		"OnuSn":  onu.Sn(),
+		"OnuId":  onu.ID,
+	}).Debug("Rediscovering ONU")
+
+	msg := Message{
+		Type: OnuDiscIndication,
+		Data: OnuDiscIndicationMessage{
+			Onu:       onu,
+			OperState: UP,
+		},
+	}
+	onu.Enqueue(msg)
+}
+
+func (o *OltDevice) DisableOlt(context.Context, *openolt.Empty) (*openolt.Empty, error) {
+	oltLogger.WithField("oltId", o.ID).Info("Received DisableOlt call from VOLTHA")
+
+	// NOTE the PONs send their indications on the OLT channel as well
+	if err := o.checkConnected(); err != nil {
+		oltLogger.Errorf("Cannot disable OLT: %s", err.Error())
+		return nil, err
+	}
+
+	if err := o.InternalState.Event("disable"); err != nil {
+		oltLogger.Errorf("Failed to transition OLT to disabled state: %s", err.Error())
+		return nil, err
+	}
+
+	// bring down the PONs, this will also bring down the ONUs.
+	// NOTE the PONs VOLTHA disabled one by one stay disabled when the OLT is reenabled
+	o.enabledPons = []*PonPort{}
+	for _, pon := range o.Pons {
+		if pon.InternalState.Can("disable") {
+			o.enabledPons = append(o.enabledPons, pon)
+			if err := o.changePonState(pon, "disable"); err != nil {
+				oltLogger.WithFields(log.Fields{
+					"IntfId": pon.ID,
+				}).Errorf("Failed to transition PON to disabled state: %s", err.Error())
+				return nil, err
+			}
+		}
+	}
+
+	for _, nni := range o.Nnis {
+		msg := Message{
+			Type: NniIndication,
+			Data: NniIndicationMessage{
+				OperState: DOWN,
+				NniPortID: nni.ID,
+			},
+		}
+		if err := o.sendOltMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+
 	olt_msg := Message{
 		Type: OltIndication,
 		Data: OltIndicationMessage{
 			OperState: DOWN,
 		},
 	}
-	o.channel <- olt_msg
+	if err := o.sendOltMessage(olt_msg); err != nil {
+		return nil, err
+	}
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) DisablePonIf(context.Context, *openolt.Interface) (*openolt.Empty, error) {
-	oltLogger.Error("DisablePonIf not implemented")
+func (o *OltDevice) DisablePonIf(_ context.Context, intf *openolt.Interface) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId": intf.IntfId,
+	}).Info("Received DisablePonIf call from VOLTHA")
+
+	// NOTE the PON indications can only be sent when the OLT is enabled
+	if !o.InternalState.Is("enabled") {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": intf.IntfId,
+		}).Errorf("Cannot disable PON as the OLT is %s", o.InternalState.Current())
+		return nil, errors.New(fmt.Sprintf("olt-%d-is-not-enabled", o.ID))
+	}
+	if err := o.checkConnected(); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": intf.IntfId,
+		}).Errorf("Cannot disable PON: %s", err.Error())
+		return nil, err
+	}
+
+	pon, err := o.GetPonById(intf.IntfId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": intf.IntfId,
+		}).Errorf("Cannot disable PON: %s", err.Error())
+		return nil, err
+	}
+
+	// NOTE the PonIndication is sent first, entering the disabled state brings down the ONUs
+	if err := o.changePonState(pon, "disable"); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": pon.ID,
+		}).Errorf("Failed to transition PON to disabled state: %s", err.Error())
+		return nil, err
+	}
+
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) EnableIndication(_ *openolt.Empty, stream openolt.Openolt_EnableIndicationServer) error {
+func (o *OltDevice) EnableIndication(_ *openolt.Empty, stream openolt.Openolt_EnableIndicationServer) error {
 	oltLogger.WithField("oltId", o.ID).Info("OLT receives EnableIndication call from VOLTHA")
 	o.Enable(stream)
 	return nil
 }
 
-func (o OltDevice) EnablePonIf(context.Context, *openolt.Interface) (*openolt.Empty, error) {
-	oltLogger.Error("EnablePonIf not implemented")
+func (o *OltDevice) EnablePonIf(_ context.Context, intf *openolt.Interface) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId": intf.IntfId,
+	}).Info("Received EnablePonIf call from VOLTHA")
+
+	// NOTE the PON indications can only be sent when the OLT is enabled
+	if !o.InternalState.Is("enabled") {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": intf.IntfId,
+		}).Errorf("Cannot enable PON as the OLT is %s", o.InternalState.Current())
+		return nil, errors.New(fmt.Sprintf("olt-%d-is-not-enabled", o.ID))
+	}
+	if err := o.checkConnected(); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": intf.IntfId,
+		}).Errorf("Cannot enable PON: %s", err.Error())
+		return nil, err
+	}
+
+	pon, err := o.GetPonById(intf.IntfId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": intf.IntfId,
+		}).Errorf("Cannot enable PON: %s", err.Error())
+		return nil, err
+	}
+
+	// NOTE the PonIndication is sent first, entering the enabled state restores the ONUs
+	if err := o.changePonState(pon, "enable"); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": pon.ID,
+		}).Errorf("Failed to transition PON to enabled state: %s", err.Error())
+		return nil, err
+	}
+
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) FlowAdd(ctx context.Context, flow *openolt.Flow) (*openolt.Empty, error) {
+func (o *OltDevice) FlowAdd(ctx context.Context, flow *openolt.Flow) (*openolt.Empty, error) {
+	err := o.validateFlow(flow)
+	if err == nil {
+		err = o.Flows.Insert(flow, o.StrictFlows)
+	}
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId":   flow.AccessIntfId,
+			"OnuId":    flow.OnuId,
+			"FlowType": flow.FlowType,
+			"FlowId":   flow.FlowId,
+			"err":      err,
+		}).Error("Rejecting Flow")
+		return nil, err
+	}
+
 	oltLogger.WithFields(log.Fields{
 		"IntfId":    flow.AccessIntfId,
 		"OnuId":     flow.OnuId,
@@ -562,85 +1322,169 @@ func (o OltDevice) FlowAdd(ctx context.Context, flow *openolt.Flow) (*openolt.Em
 		"UniID":     flow.UniId,
 		"PortNo":    flow.PortNo,
 	}).Tracef("OLT receives Flow")
-	// TODO optionally store flows somewhere
 
 	if flow.AccessIntfId == -1 {
 		oltLogger.WithFields(log.Fields{
 			"FlowId": flow.FlowId,
 		}).Debugf("This is an OLT flow")
 	} else {
-		pon, err := o.GetPonById(uint32(flow.AccessIntfId))
-		if err != nil {
-			oltLogger.WithFields(log.Fields{
-				"OnuId":  flow.OnuId,
-				"IntfId": flow.AccessIntfId,
-				"err":    err,
-			}).Error("Can't find PonPort")
-		}
-		onu, err := pon.GetOnuById(uint32(flow.OnuId))
-		if err != nil {
-			oltLogger.WithFields(log.Fields{
-				"OnuId":  flow.OnuId,
-				"IntfId": flow.AccessIntfId,
-				"err":    err,
-			}).Error("Can't find Onu")
-		}
+		// NOTE validateFlow already checked that the ONU exists
+		onu, _ := o.FindOnuById(uint32(flow.AccessIntfId), uint32(flow.OnuId))
 
 		msg := Message{
 			Type: FlowUpdate,
 			Data: OnuFlowUpdateMessage{
-				PonPortID: pon.ID,
+				PonPortID: onu.PonPortID,
 				OnuID:     onu.ID,
 				Flow:      flow,
 			},
 		}
-		onu.Channel <- msg
+		onu.Enqueue(msg)
 	}
 
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) FlowRemove(context.Context, *openolt.Flow) (*openolt.Empty, error) {
-	oltLogger.Tracef("received FlowRemove")
-	// TODO store flows somewhere
+func (o *OltDevice) FlowRemove(_ context.Context, flow *openolt.Flow) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"FlowId":   flow.FlowId,
+		"FlowType": flow.FlowType,
+	}).Tracef("OLT receives FlowRemove")
+
+	if _, ok := o.Flows.Remove(flowKey(flow)); !ok {
+		// NOTE VOLTHA may remove flows that were never installed, a real OLT does not fail in that case
+		oltLogger.WithFields(log.Fields{
+			"FlowId":   flow.FlowId,
+			"FlowType": flow.FlowType,
+		}).Warn("Removing a flow that does not exist")
+	}
+
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) HeartbeatCheck(context.Context, *openolt.Empty) (*openolt.Heartbeat, error) {
-	oltLogger.Error("HeartbeatCheck not implemented")
-	return new(openolt.Heartbeat), nil
+func (o *OltDevice) HeartbeatCheck(ctx context.Context, _ *openolt.Empty) (*openolt.Heartbeat, error) {
+	for {
+		o.heartbeat.mu.Lock()
+		signature := o.heartbeat.signature
+		mode := o.heartbeat.failureMode
+		remaining := time.Until(o.heartbeat.failureEnd)
+		changed := o.heartbeat.failureChanged
+		o.heartbeat.mu.Unlock()
+
+		if remaining <= 0 {
+			oltLogger.WithField("HeartbeatSignature", signature).Trace("Received HeartbeatCheck call from VOLTHA")
+			return &openolt.Heartbeat{HeartbeatSignature: signature}, nil
+		}
+
+		switch mode {
+		case HeartbeatFail:
+			oltLogger.WithField("Remaining", remaining).Debug("Failing HeartbeatCheck")
+			return nil, status.Error(codes.Unavailable, "olt-heartbeat-failure")
+		case HeartbeatHang:
+			oltLogger.WithField("Remaining", remaining).Debug("Hanging HeartbeatCheck")
+			select {
+			case <-time.After(remaining):
+			case <-changed:
+				// NOTE the failure changed or the OLT rebooted, the call is answered according to the new state
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// SetHeartbeatFailure makes HeartbeatCheck fail or hang for the given duration,
+// a duration of 0 restores the normal behaviour
+func (o *OltDevice) SetHeartbeatFailure(mode HeartbeatFailureMode, duration time.Duration) {
+	oltLogger.WithFields(log.Fields{
+		"Mode":     mode,
+		"Duration": duration,
+	}).Info("Setting HeartbeatCheck failure")
+
+	o.heartbeat.mu.Lock()
+	defer o.heartbeat.mu.Unlock()
+	o.heartbeat.failureMode = mode
+	o.heartbeat.failureEnd = time.Now().Add(duration)
+	o.heartbeat.release()
+}
+
+// release wakes up the hanging HeartbeatCheck calls, it must be called with mu held
+func (h *heartbeatState) release() {
+	close(h.failureChanged)
+	h.failureChanged = make(chan struct{})
+}
+
+// newHeartbeatSignature returns the boot time, as the openolt agent does,
+// making sure it differs from the previous one
+func newHeartbeatSignature(previous uint32) uint32 {
+	signature := uint32(time.Now().Unix())
+	if signature == previous {
+		signature++
+	}
+	return signature
 }
 
-func (o OltDevice) GetDeviceInfo(context.Context, *openolt.Empty) (*openolt.DeviceInfo, error) {
+func (o *OltDevice) GetDeviceInfo(context.Context, *openolt.Empty) (*openolt.DeviceInfo, error) {
 
 	oltLogger.WithFields(log.Fields{
 		"oltId":    o.ID,
 		"PonPorts": o.NumPon,
 	}).Info("OLT receives GetDeviceInfo call from VOLTHA")
 	devinfo := new(openolt.DeviceInfo)
-	devinfo.Vendor = "BBSim"
-	devinfo.Model = "asfvolt16"
-	devinfo.HardwareVersion = "emulated"
-	devinfo.FirmwareVersion = ""
-	devinfo.Technology = "xgspon"
+	devinfo.Vendor = o.DeviceInfo.Vendor
+	devinfo.Model = o.DeviceInfo.Model
+	devinfo.HardwareVersion = o.DeviceInfo.HardwareVersion
+	devinfo.FirmwareVersion = o.DeviceInfo.FirmwareVersion
+	devinfo.Technology = o.DeviceInfo.Technology
 	devinfo.PonPorts = uint32(o.NumPon)
-	devinfo.OnuIdStart = 1
-	devinfo.OnuIdEnd = 255
-	devinfo.AllocIdStart = 1024
-	devinfo.AllocIdEnd = 16383
-	devinfo.GemportIdStart = 1024
-	devinfo.GemportIdEnd = 65535
-	devinfo.FlowIdStart = 1
-	devinfo.FlowIdEnd = 16383
+	devinfo.OnuIdStart = o.DeviceInfo.OnuIdRange.Start
+	devinfo.OnuIdEnd = o.DeviceInfo.OnuIdRange.End
+	devinfo.AllocIdStart = o.DeviceInfo.AllocIdRange.Start
+	devinfo.AllocIdEnd = o.DeviceInfo.AllocIdRange.End
+	devinfo.GemportIdStart = o.DeviceInfo.GemportIdRange.Start
+	devinfo.GemportIdEnd = o.DeviceInfo.GemportIdRange.End
+	devinfo.FlowIdStart = o.DeviceInfo.FlowIdRange.Start
+	devinfo.FlowIdEnd = o.DeviceInfo.FlowIdRange.End
+	devinfo.Ranges = o.DeviceInfo.RangesToProto()
 	devinfo.DeviceSerialNumber = o.SerialNumber
-	devinfo.DeviceId = net.HardwareAddr{0xA, 0xA, 0xA, 0xA, 0xA, byte(o.ID)}.String()
+	devinfo.DeviceId = oltDeviceId(o.ID)
 
 	return devinfo, nil
 }
 
-func (o OltDevice) OmciMsgOut(ctx context.Context, omci_msg *openolt.OmciMsg) (*openolt.Empty, error) {
-	pon, _ := o.GetPonById(omci_msg.IntfId)
-	onu, _ := pon.GetOnuById(omci_msg.OnuId)
+// oltDeviceId builds the ID VOLTHA knows the OLT by from the whole OLT ID, so that it's unique across the OLTs.
+// NOTE the upper bytes of the ID are XOR-ed with 0x0A, so the OLTs with an ID below 256 keep the DeviceId they always had
+func oltDeviceId(id int) string {
+	return net.HardwareAddr{
+		0xA,
+		0xA,
+		0xA ^ byte(id>>24),
+		0xA ^ byte(id>>16),
+		0xA ^ byte(id>>8),
+		byte(id),
+	}.String()
+}
+
+func (o *OltDevice) OmciMsgOut(ctx context.Context, omci_msg *openolt.OmciMsg) (*openolt.Empty, error) {
+	pon, err := o.GetPonById(omci_msg.IntfId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"OnuId":  omci_msg.OnuId,
+			"IntfId": omci_msg.IntfId,
+			"err":    err,
+		}).Error("Can't find PonPort")
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	// NOTE the ONU may have been removed or deleted while VOLTHA was still talking to it
+	onu, err := pon.GetOnuById(omci_msg.OnuId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"OnuId":  omci_msg.OnuId,
+			"IntfId": omci_msg.IntfId,
+			"err":    err,
+		}).Error("Can't find Onu")
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
 	oltLogger.WithFields(log.Fields{
 		"IntfId": onu.PonPortID,
 		"OnuId":  onu.ID,
@@ -654,11 +1498,11 @@ func (o OltDevice) OmciMsgOut(ctx context.Context, omci_msg *openolt.OmciMsg) (*
 			omciMsg: omci_msg,
 		},
 	}
-	onu.Channel <- msg
+	onu.Enqueue(msg)
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) OnuPacketOut(ctx context.Context, onuPkt *openolt.OnuPacket) (*openolt.Empty, error) {
+func (o *OltDevice) OnuPacketOut(ctx context.Context, onuPkt *openolt.OnuPacket) (*openolt.Empty, error) {
 	pon, err := o.GetPonById(onuPkt.IntfId)
 	if err != nil {
 		oltLogger.WithFields(log.Fields{
@@ -666,6 +1510,7 @@ func (o OltDevice) OnuPacketOut(ctx context.Context, onuPkt *openolt.OnuPacket)
 			"IntfId": onuPkt.IntfId,
 			"err":    err,
 		}).Error("Can't find PonPort")
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
 	onu, err := pon.GetOnuById(onuPkt.OnuId)
 	if err != nil {
@@ -674,6 +1519,7 @@ func (o OltDevice) OnuPacketOut(ctx context.Context, onuPkt *openolt.OnuPacket)
 			"IntfId": onuPkt.IntfId,
 			"err":    err,
 		}).Error("Can't find Onu")
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
 
 	oltLogger.WithFields(log.Fields{
@@ -690,66 +1536,300 @@ func (o OltDevice) OnuPacketOut(ctx context.Context, onuPkt *openolt.OnuPacket)
 		Data: OnuPacketMessage{
 			IntfId: onuPkt.IntfId,
 			OnuId:  onuPkt.OnuId,
+			PortNo: onuPkt.PortNo,
 			Packet: rawpkt,
 			Type:   pktType,
 		},
 	}
-	onu.Channel <- msg
+	onu.Enqueue(msg)
 
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) Reboot(context.Context, *openolt.Empty) (*openolt.Empty, error) {
-	oltLogger.Info("Shutting Down")
-	close(*o.oltDoneChannel)
-	close(*o.apiDoneChannel)
+func (o *OltDevice) Reboot(context.Context, *openolt.Empty) (*openolt.Empty, error) {
+	oltLogger.WithField("oltId", o.ID).Info("Received Reboot call from VOLTHA")
+	// NOTE the reboot happens in the background so that VOLTHA receives a response
+	go o.restartOlt()
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) ReenableOlt(context.Context, *openolt.Empty) (*openolt.Empty, error) {
-	oltLogger.Error("ReenableOlt not implemented")
+// restartOlt emulates an OLT reboot: it drops the connection with VOLTHA,
+// resets all the devices and brings the gRPC server back after rebootDelay
+func (o *OltDevice) restartOlt() {
+	oltLogger.WithFields(log.Fields{
+		"oltId":       o.ID,
+		"RebootDelay": o.rebootDelay,
+	}).Info("Rebooting OLT")
+
+	// close the indication stream and stop the processing loops
+	o.cancelEnableContext()
+
+	// NOTE the injected heartbeat failure doesn't survive the reboot, releasing the hanging
+	// HeartbeatCheck calls also lets GracefulStop return right away
+	o.heartbeat.mu.Lock()
+	o.heartbeat.failureEnd = time.Time{}
+	o.heartbeat.release()
+	o.heartbeat.mu.Unlock()
+
+	// wait for the pending requests (including Reboot itself) to complete
+	if server := o.server(); server != nil {
+		server.GracefulStop()
+	}
+
+	o.resetDevices()
+
+	time.Sleep(o.rebootDelay)
+
+	o.heartbeat.mu.Lock()
+	o.heartbeat.signature = newHeartbeatSignature(o.heartbeat.signature)
+	o.heartbeat.mu.Unlock()
+
+	if err := o.newOltServer(); err != nil {
+		oltLogger.Errorf("OLT failed to listen after reboot: %v", err)
+		return
+	}
+
+	oltLogger.WithField("oltId", o.ID).Info("OLT rebooted, waiting for EnableIndication")
+}
+
+// resetDevices brings the OLT and all the ports and ONUs back to their initial state
+func (o *OltDevice) resetDevices() {
+	o.InternalState.SetState("created")
+	o.OperState.SetState("down")
+	o.Flows.Clear()
+	o.enabledPons = nil
+
+	for _, nni := range o.Nnis {
+		nni.OperState.SetState("down")
+	}
+
+	for _, pon := range o.Pons {
+		pon.InternalState.SetState("created")
+		pon.OperState.SetState("down")
+
+		for _, onu := range pon.GetOnus() {
+			// drop the messages that were not processed before the reboot
+			onu.clearMessages()
+
+			onu.Do(func() error {
+				// NOTE SetState does not invoke the callbacks, so we need to reset the ONU explicitly
+				onu.InternalState.SetState("created")
+				onu.OperState.SetState("down")
+				onu.reset()
+				// NOTE after a reboot VOLTHA activates the ONUs again, possibly with different IDs
+				onu.releaseID()
+				return nil
+			})
+		}
+	}
+}
+
+func (o *OltDevice) ReenableOlt(context.Context, *openolt.Empty) (*openolt.Empty, error) {
+	oltLogger.WithField("oltId", o.ID).Info("Received ReenableOlt call from VOLTHA")
+
+	// NOTE the PONs send their indications on the OLT channel as well
+	if err := o.checkConnected(); err != nil {
+		oltLogger.Errorf("Cannot reenable OLT: %s", err.Error())
+		return nil, err
+	}
+
+	if err := o.InternalState.Event("reenable"); err != nil {
+		oltLogger.Errorf("Failed to transition OLT to reenabling state: %s", err.Error())
+		return nil, err
+	}
+
+	// replay the indications in the same order as Enable
+	olt_msg := Message{
+		Type: OltIndication,
+		Data: OltIndicationMessage{
+			OperState: UP,
+		},
+	}
+	if err := o.sendOltMessage(olt_msg); err != nil {
+		return nil, err
+	}
+
+	for _, nni := range o.Nnis {
+		msg := Message{
+			Type: NniIndication,
+			Data: NniIndicationMessage{
+				OperState: UP,
+				NniPortID: nni.ID,
+			},
+		}
+		if err := o.sendOltMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	// bring up the PONs that were enabled before DisableOlt, this will also restore the ONUs
+	for _, pon := range o.enabledPons {
+		if pon.InternalState.Can("enable") {
+			if err := o.changePonState(pon, "enable"); err != nil {
+				oltLogger.WithFields(log.Fields{
+					"IntfId": pon.ID,
+				}).Errorf("Failed to transition PON to enabled state: %s", err.Error())
+				return nil, err
+			}
+		}
+	}
+	o.enabledPons = nil
+
+	if err := o.InternalState.Event("enable"); err != nil {
+		oltLogger.Errorf("Failed to transition OLT to enabled state: %s", err.Error())
+		return nil, err
+	}
+
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) UplinkPacketOut(context context.Context, packet *openolt.UplinkPacket) (*openolt.Empty, error) {
+func (o *OltDevice) UplinkPacketOut(context context.Context, packet *openolt.UplinkPacket) (*openolt.Empty, error) {
 	pkt := gopacket.NewPacket(packet.Pkt, layers.LayerTypeEthernet, gopacket.Default)
 
-	sendNniPacket(pkt)
+	nni, err := o.getNniById(packet.IntfId)
+	if err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": packet.IntfId,
+		}).Errorf("Cannot send packet out: %v", err)
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	sendNniPacket(nni.nniVeth, pkt)
 	// NOTE should we return an error if sendNniPakcet fails?
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) CollectStatistics(context.Context, *openolt.Empty) (*openolt.Empty, error) {
+func (o *OltDevice) CollectStatistics(context.Context, *openolt.Empty) (*openolt.Empty, error) {
 	oltLogger.Error("CollectStatistics not implemented")
 	return new(openolt.Empty), nil
 }
 
-func (o OltDevice) GetOnuInfo(context context.Context, packet *openolt.Onu) (*openolt.OnuIndication, error) {
+func (o *OltDevice) GetOnuInfo(context context.Context, packet *openolt.Onu) (*openolt.OnuIndication, error) {
 	oltLogger.Error("GetOnuInfo not implemented")
 	return new(openolt.OnuIndication), nil
 }
 
-func (o OltDevice) GetPonIf(context context.Context, packet *openolt.Interface) (*openolt.IntfIndication, error) {
+func (o *OltDevice) GetPonIf(context context.Context, packet *openolt.Interface) (*openolt.IntfIndication, error) {
 	oltLogger.Error("GetPonIf not implemented")
 	return new(openolt.IntfIndication), nil
 }
 
-func (s OltDevice) CreateTrafficQueues(context.Context, *tech_profile.TrafficQueues) (*openolt.Empty, error) {
-	oltLogger.Info("received CreateTrafficQueues")
+func (s *OltDevice) CreateTrafficQueues(_ context.Context, tq *tech_profile.TrafficQueues) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId":    tq.IntfId,
+		"OnuId":     tq.OnuId,
+		"UniId":     tq.UniId,
+		"NumQueues": len(tq.TrafficQueues),
+	}).Info("received CreateTrafficQueues")
+
+	onu, err := s.FindOnuById(tq.IntfId, tq.OnuId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err := s.validateTrafficQueues(onu, tq); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": tq.IntfId,
+			"OnuId":  tq.OnuId,
+			"UniId":  tq.UniId,
+			"err":    err,
+		}).Error("Rejecting TrafficQueues")
+		return nil, err
+	}
+
+	onu.TechProfile.AddQueues(tq)
+	gemPorts := s.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID, onu.PonPortID)
+	for _, q := range tq.TrafficQueues {
+		gemPorts.add(q.GemportId, onu, tq.UniId)
+	}
 	return new(openolt.Empty), nil
 }
 
-func (s OltDevice) RemoveTrafficQueues(context.Context, *tech_profile.TrafficQueues) (*openolt.Empty, error) {
-	oltLogger.Info("received RemoveTrafficQueues")
+func (s *OltDevice) RemoveTrafficQueues(_ context.Context, tq *tech_profile.TrafficQueues) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId": tq.IntfId,
+		"OnuId":  tq.OnuId,
+		"UniId":  tq.UniId,
+	}).Info("received RemoveTrafficQueues")
+
+	onu, err := s.FindOnuById(tq.IntfId, tq.OnuId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if !onu.TechProfile.RemoveQueues(tq) {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": tq.IntfId,
+			"OnuId":  tq.OnuId,
+			"UniId":  tq.UniId,
+		}).Warn("TrafficQueues were not installed")
+	}
+	// NOTE the upstream and downstream queues share the GemPort, it's released when both are removed
+	gemPorts := s.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID, onu.PonPortID)
+	for _, q := range tq.TrafficQueues {
+		if !onu.TechProfile.hasGemPort(tq.UniId, q.GemportId) {
+			gemPorts.remove(q.GemportId, onu, tq.UniId)
+		}
+	}
 	return new(openolt.Empty), nil
 }
 
-func (s OltDevice) CreateTrafficSchedulers(context.Context, *tech_profile.TrafficSchedulers) (*openolt.Empty, error) {
-	oltLogger.Info("received CreateTrafficSchedulers")
+func (s *OltDevice) CreateTrafficSchedulers(_ context.Context, ts *tech_profile.TrafficSchedulers) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId":        ts.IntfId,
+		"OnuId":         ts.OnuId,
+		"UniId":         ts.UniId,
+		"NumSchedulers": len(ts.TrafficScheds),
+	}).Info("received CreateTrafficSchedulers")
+
+	onu, err := s.FindOnuById(ts.IntfId, ts.OnuId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err := s.validateTrafficSchedulers(onu, ts); err != nil {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": ts.IntfId,
+			"OnuId":  ts.OnuId,
+			"UniId":  ts.UniId,
+			"err":    err,
+		}).Error("Rejecting TrafficSchedulers")
+		return nil, err
+	}
+
+	onu.TechProfile.AddSchedulers(ts)
+	allocIds := s.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID, onu.PonPortID)
+	for _, sched := range ts.TrafficScheds {
+		allocIds.add(sched.AllocId, onu, ts.UniId)
+	}
 	return new(openolt.Empty), nil
 }
 
-func (s OltDevice) RemoveTrafficSchedulers(context.Context, *tech_profile.TrafficSchedulers) (*openolt.Empty, error) {
-	oltLogger.Info("received RemoveTrafficSchedulers")
+func (s *OltDevice) RemoveTrafficSchedulers(_ context.Context, ts *tech_profile.TrafficSchedulers) (*openolt.Empty, error) {
+	oltLogger.WithFields(log.Fields{
+		"IntfId": ts.IntfId,
+		"OnuId":  ts.OnuId,
+		"UniId":  ts.UniId,
+	}).Info("received RemoveTrafficSchedulers")
+
+	onu, err := s.FindOnuById(ts.IntfId, ts.OnuId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if !onu.TechProfile.RemoveSchedulers(ts) {
+		oltLogger.WithFields(log.Fields{
+			"IntfId": ts.IntfId,
+			"OnuId":  ts.OnuId,
+			"UniId":  ts.UniId,
+		}).Warn("TrafficSchedulers were not installed")
+	}
+	// NOTE the upstream and downstream schedulers share the AllocId, it's released when both are removed
+	allocIds := s.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID, onu.PonPortID)
+	for _, sched := range ts.TrafficScheds {
+		if !onu.TechProfile.hasAllocId(ts.UniId, sched.AllocId) {
+			allocIds.remove(sched.AllocId, onu, ts.UniId)
+		}
+	}
 	return new(openolt.Empty), nil
 }
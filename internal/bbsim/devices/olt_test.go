@@ -17,11 +17,34 @@
 package devices
 
 import (
+	"context"
+	"encoding/binary"
+	me "github.com/cboling/omci/generated"
+	"github.com/opencord/bbsim/internal/bbsim/responders/omcisim"
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gotest.tools/assert"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
+func createTestOlt(numPon int, numOnu int) *OltDevice {
+	options := &common.BBSimCliOptions{
+		NumNniPerOlt: 1,
+		NumPonPerOlt: numPon,
+		NumOnuPerPon: numOnu,
+		STag:         900,
+		CTagInit:     900,
+		DeviceInfo:   common.DefaultDeviceInfo(),
+	}
+	return CreateOLT(options, nil, nil, true)
+}
+
 func createMockOlt(numPon int, numOnu int) OltDevice {
 	olt := OltDevice{
 		ID: 0,
@@ -40,8 +63,9 @@ func createMockOlt(numPon int, numOnu int) OltDevice {
 				PonPortID: pon.ID,
 				HwAddress: net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, byte(pon.ID), byte(onuId)},
 			}
-			onu.SerialNumber = onu.NewSN(olt.ID, pon.ID, onu.ID)
-			pon.Onus = append(pon.Onus, &onu)
+			onu.SerialNumber, _ = common.DefaultOnuIdentities.SerialNumber(olt.ID, pon.ID, onu.ID)
+			onu.Unis = []*UniPort{{ID: 0, HwAddress: onu.HwAddress}}
+			pon.AddOnu(&onu)
 		}
 		olt.Pons = append(olt.Pons, &pon)
 	}
@@ -105,3 +129,997 @@ func Test_Olt_FindOnuByMacAddress_Error(t *testing.T) {
 
 	assert.Equal(t, err.Error(), "cannot-find-onu-by-mac-address-2e:60:70:13:03:03")
 }
+
+func Test_Olt_FindOnuById_AfterSetID(t *testing.T) {
+
+	numPon := 2
+	numOnu := 4
+
+	olt := createMockOlt(numPon, numOnu)
+
+	// the ONU on PON 1 with ID 2 is activated by VOLTHA with ID 10
+	onu, err := olt.FindOnuById(1, 2)
+	assert.NilError(t, err)
+	assert.NilError(t, onu.SetID(10))
+
+	found, err := olt.FindOnuById(1, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, found, onu)
+
+	_, err = olt.FindOnuById(1, 2)
+	assert.Equal(t, err.Error(), "cannot-find-onu-by-id-1-2")
+
+	// the ID of an ONU that is not active yet is assigned to another one
+	other, err := olt.FindOnuById(1, 3)
+	assert.NilError(t, err)
+	assert.NilError(t, onu.SetID(3))
+
+	found, err = olt.FindOnuById(1, 3)
+	assert.NilError(t, err)
+	assert.Equal(t, found, onu)
+
+	// once the other ONU gets a new ID it can be found again
+	assert.NilError(t, other.SetID(11))
+	found, err = olt.FindOnuById(1, 11)
+	assert.NilError(t, err)
+	assert.Equal(t, found, other)
+
+	found, err = olt.FindOnuById(1, 3)
+	assert.NilError(t, err)
+	assert.Equal(t, found, onu)
+
+	// the other PON is not affected
+	found, err = olt.FindOnuById(0, 3)
+	assert.NilError(t, err)
+	assert.Equal(t, found.Sn(), "BBSM00000003")
+}
+
+func Test_Olt_ActivateOnu(t *testing.T) {
+	olt := createTestOlt(1, 3)
+	olt.InternalState.SetState("enabled")
+	pon := olt.Pons[0]
+	pon.InternalState.SetState("enabled")
+	for _, onu := range pon.Onus {
+		onu.InternalState.SetState("discovered")
+	}
+
+	// VOLTHA assigns the IDs in any order
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 42, SerialNumber: pon.Onus[0].SerialNumber})
+	assert.NilError(t, err)
+	_, err = olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 1, SerialNumber: pon.Onus[1].SerialNumber})
+	assert.NilError(t, err)
+
+	assert.Equal(t, pon.Onus[0].ID, uint32(42))
+	assert.Equal(t, pon.Onus[0].InternalState.Current(), "enabled")
+	// the physical identity of the ONU does not change
+	assert.Equal(t, pon.Onus[0].Sn(), "BBSM00000001")
+	assert.DeepEqual(t, pon.Onus[0].HwAddress, net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, 0x00, 0x01})
+
+	found, err := olt.FindOnuById(0, 42)
+	assert.NilError(t, err)
+	assert.Equal(t, found, pon.Onus[0])
+	found, err = olt.FindOnuById(0, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, found, pon.Onus[1])
+
+	// an ID can't be assigned to two ONUs
+	_, err = olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 42, SerialNumber: pon.Onus[2].SerialNumber})
+	assert.Error(t, err, "onu-id-42-is-already-assigned-to-BBSM00000001")
+	assert.Equal(t, pon.Onus[2].ID, uint32(3))
+	assert.Equal(t, pon.Onus[2].InternalState.Current(), "discovered")
+}
+
+func Test_Olt_ActivateOnu_Error(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.Pons[0].InternalState.SetState("enabled")
+
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 1, SerialNumber: &openolt.SerialNumber{
+		VendorId:       []byte("BBSM"),
+		VendorSpecific: []byte{0, 0, 0, 10},
+	}})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	assert.ErrorContains(t, err, "Cannot find Onu with serial number")
+
+	_, err = olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 1, OnuId: 1, SerialNumber: olt.Pons[0].Onus[0].SerialNumber})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+}
+
+func Test_Olt_DeleteOnu_ReusesId(t *testing.T) {
+	_onuRediscoveryDelay := onuRediscoveryDelay
+	defer func() { onuRediscoveryDelay = _onuRediscoveryDelay }()
+	onuRediscoveryDelay = 0
+
+	olt := createTestOlt(1, 2)
+	olt.InternalState.SetState("enabled")
+	olt.indications = &indicationStream{ctx: context.TODO()}
+	pon := olt.Pons[0]
+	pon.InternalState.SetState("enabled")
+	deleted := pon.Onus[0]
+	other := pon.Onus[1]
+	deleted.InternalState.SetState("discovered")
+	other.InternalState.SetState("discovered")
+
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 10, SerialNumber: deleted.SerialNumber})
+	assert.NilError(t, err)
+
+	_, err = olt.DeleteOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 10})
+	assert.NilError(t, err)
+	for msg := nextMessage(t, deleted); msg.Type != OnuDiscIndication; msg = nextMessage(t, deleted) {
+	}
+
+	// the deleted ONU can't be found by the ID it had
+	_, err = olt.FindOnuById(0, 10)
+	assert.Error(t, err, "cannot-find-onu-by-id-0-10")
+
+	// and VOLTHA can assign it to another ONU
+	_, err = olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 10, SerialNumber: other.SerialNumber})
+	assert.NilError(t, err)
+	found, err := olt.FindOnuById(0, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, found, other)
+
+	// the deleted ONU is discovered again and gets a new ID
+	deleted.InternalState.SetState("discovered")
+	_, err = olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 11, SerialNumber: deleted.SerialNumber})
+	assert.NilError(t, err)
+	found, err = olt.FindOnuById(0, 11)
+	assert.NilError(t, err)
+	assert.Equal(t, found, deleted)
+}
+
+func Test_Olt_DeleteOnu_LateMessages(t *testing.T) {
+	// NOTE the OLT is not enabled, so the deleted ONU is not discovered again
+	olt := createTestOlt(1, 1)
+	pon := olt.Pons[0]
+	pon.InternalState.SetState("enabled")
+	deleted := pon.Onus[0]
+	deleted.InternalState.SetState("discovered")
+
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 10, SerialNumber: deleted.SerialNumber})
+	assert.NilError(t, err)
+	_, err = olt.DeleteOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 10})
+	assert.NilError(t, err)
+
+	// the ID was released, so the OMCI and packets VOLTHA sent before the delete have nowhere to go
+	_, err = olt.OmciMsgOut(context.TODO(), &openolt.OmciMsg{IntfId: 0, OnuId: 10})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	_, err = olt.OnuPacketOut(context.TODO(), &openolt.OnuPacket{IntfId: 0, OnuId: 10})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+}
+
+// indicationsRecorder is an EnableIndication stream that forwards the indications on a channel
+type indicationsRecorder struct {
+	grpc.ServerStream
+	ctx         context.Context
+	indications chan *openolt.Indication
+}
+
+func (s *indicationsRecorder) Send(ind *openolt.Indication) error {
+	s.indications <- ind
+	return nil
+}
+
+func (s *indicationsRecorder) Context() context.Context {
+	return s.ctx
+}
+
+// nextOnuIndication returns the next OnuDiscIndication or OnuIndication, skipping the other indications
+func (s *indicationsRecorder) nextOnuIndication(t *testing.T) *openolt.Indication {
+	for {
+		select {
+		case ind := <-s.indications:
+			switch ind.Data.(type) {
+			case *openolt.Indication_OnuDiscInd, *openolt.Indication_OnuInd:
+				return ind
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for an ONU indication")
+		}
+	}
+}
+
+func Test_Olt_AddOnu(t *testing.T) {
+	olt := createTestOlt(2, 2)
+
+	onu, err := olt.AddOnu(1, "", 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, onu.ID, uint32(3))
+	assert.Equal(t, onu.Sn(), "BBSM00000103")
+	assert.Equal(t, onu.STag, 900)
+	assert.Equal(t, onu.CTag, 904)
+	found, err := olt.FindOnuBySn("BBSM00000103")
+	assert.NilError(t, err)
+	assert.Equal(t, found, onu)
+	assert.Equal(t, len(olt.Pons[1].GetOnus()), 3)
+	// the OLT is not enabled, the ONU is discovered by Enable
+	assert.Equal(t, onu.pendingMessages(), 0)
+
+	onu, err = olt.AddOnu(1, "ABCD0000cafe", 901, 2000)
+	assert.NilError(t, err)
+	assert.Equal(t, onu.ID, uint32(4))
+	assert.Equal(t, onu.Sn(), "ABCD0000cafe")
+	assert.Equal(t, onu.STag, 901)
+	assert.Equal(t, onu.CTag, 2000)
+
+	// the next ONU gets the C-Tags after the ones given to the others
+	onu, err = olt.AddOnu(0, "", 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, onu.CTag, 2001)
+}
+
+func Test_Olt_MibTemplates(t *testing.T) {
+	options := &common.BBSimCliOptions{
+		NumNniPerOlt: 1,
+		NumPonPerOlt: 2,
+		NumOnuPerPon: 2,
+		NumUniPerOnu: 1,
+		STag:         900,
+		CTagInit:     900,
+		DeviceInfo:   common.DefaultDeviceInfo(),
+		MibTemplates: &common.MibTemplates{Templates: []common.MibTemplate{
+			{
+				Name:          "alpha",
+				VendorId:      "ALPH",
+				Unis:          3,
+				SerialNumbers: []common.SerialNumberRange{{Start: "00000101", End: "000001ff"}},
+			},
+			{
+				Name:    "beta",
+				UniType: common.UniTypeVeip,
+				Onus:    []common.OnuRef{{Olt: 0, Pon: 0, Onu: 2}},
+			},
+		}},
+	}
+	olt := CreateOLT(options, nil, nil, true)
+
+	first := olt.Pons[0].Onus[0]
+	assert.Equal(t, first.MibTemplate, "")
+	assert.Equal(t, first.Sn(), "BBSM00000001")
+	assert.Equal(t, len(first.Unis), 1)
+
+	beta := olt.Pons[0].Onus[1]
+	assert.Equal(t, beta.MibTemplate, "beta")
+	_, ok := beta.mib.Entity(me.VirtualEthernetInterfacePointClassId, omcisim.UniEntityId(0))
+	assert.Assert(t, ok)
+
+	// the ONUs of the second PON use the vendor ID of the template
+	alpha := olt.Pons[1].Onus[0]
+	assert.Equal(t, alpha.MibTemplate, "alpha")
+	assert.Equal(t, alpha.Sn(), "ALPH00000101")
+	assert.Equal(t, len(alpha.Unis), 3)
+	assert.Equal(t, olt.Pons[1].Onus[1].CTag, alpha.CTag+3)
+
+	onu, err := olt.AddOnu(1, "", 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, onu.Sn(), "ALPH00000103")
+	assert.Equal(t, onu.MibTemplate, "alpha")
+
+	// the serial numbers given via the API are kept as they are
+	onu, err = olt.AddOnu(1, "ABCD00000104", 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, onu.Sn(), "ABCD00000104")
+	assert.Equal(t, onu.MibTemplate, "alpha")
+	onuG, _ := onu.mib.Entity(me.OnuGClassId, 0)
+	assert.Equal(t, onuG["VendorId"], binary.BigEndian.Uint32([]byte("ALPH")))
+}
+
+func Test_Olt_AddOnu_Error(t *testing.T) {
+	olt := createTestOlt(1, 1)
+
+	_, err := olt.AddOnu(1, "", 0, 0)
+	assert.Error(t, err, "Cannot find PonPort with id 1 in OLT 0")
+
+	_, err = olt.AddOnu(0, olt.Pons[0].Onus[0].Sn(), 0, 0)
+	assert.Error(t, err, "onu-BBSM00000001-already-exists")
+
+	_, err = olt.AddOnu(0, "BBSM0001", 0, 0)
+	assert.Error(t, err, "invalid-serial-number-BBSM0001")
+
+	_, err = olt.AddOnu(0, "", 0, 4095)
+	assert.Error(t, err, "invalid-c-tag-4095")
+
+	olt.Pons[0].lastOnuId = 255
+	_, err = olt.AddOnu(0, "", 0, 0)
+	assert.Error(t, err, "onu-id-256-does-not-fit-in-sn-pattern-00{olt:2}{pon:2}{onu:2}")
+	assert.Equal(t, len(olt.Pons[0].GetOnus()), 1)
+}
+
+func Test_Olt_RemoveOnu(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	removed := olt.Pons[0].Onus[1]
+
+	assert.NilError(t, olt.RemoveOnu(removed.Sn()))
+
+	_, err := olt.FindOnuBySn(removed.Sn())
+	assert.Error(t, err, "cannot-find-onu-by-serial-number-BBSM00000002")
+	_, err = olt.FindOnuByMacAddress(removed.HwAddress)
+	assert.Error(t, err, "cannot-find-onu-by-mac-address-2e:60:70:13:00:02")
+	_, err = olt.FindOnuById(0, removed.ID)
+	assert.Error(t, err, "cannot-find-onu-by-id-0-2")
+	assert.Equal(t, len(olt.Pons[0].GetOnus()), 1)
+
+	// the ONU is not there anymore, so it does not receive any message
+	removed.Enqueue(Message{Type: OnuDiscIndication})
+	assert.Equal(t, removed.pendingMessages(), 0)
+
+	assert.Error(t, olt.RemoveOnu(removed.Sn()), "cannot-find-onu-by-serial-number-BBSM00000002")
+
+	// the ID and the identities of a removed ONU are not reused
+	onu, err := olt.AddOnu(0, "", 0, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, onu.ID, uint32(3))
+}
+
+func Test_Olt_RemoveOnu_LateMessages(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	removed := olt.Pons[0].Onus[0]
+	assert.NilError(t, olt.RemoveOnu(removed.Sn()))
+
+	// VOLTHA may still send OMCI and packets to the ONU it doesn't know was removed
+	_, err := olt.OmciMsgOut(context.TODO(), &openolt.OmciMsg{IntfId: 0, OnuId: removed.ID})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	_, err = olt.OnuPacketOut(context.TODO(), &openolt.OnuPacket{IntfId: 0, OnuId: removed.ID})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+
+	_, err = olt.OmciMsgOut(context.TODO(), &openolt.OmciMsg{IntfId: 1, OnuId: removed.ID})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	_, err = olt.OnuPacketOut(context.TODO(), &openolt.OnuPacket{IntfId: 1, OnuId: removed.ID})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+}
+
+func Test_Olt_AddRemoveOnu_Enabled(t *testing.T) {
+	olt := createTestOlt(1, 1)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	stream := &indicationsRecorder{ctx: ctx, indications: make(chan *openolt.Indication, 100)}
+	go olt.Enable(stream)
+
+	ind := stream.nextOnuIndication(t)
+	assert.Equal(t, common.OnuSnToString(ind.GetOnuDiscInd().SerialNumber), "BBSM00000001")
+
+	// an ONU added at runtime is discovered right away
+	onu, err := olt.AddOnu(0, "ABCD00000001", 0, 0)
+	assert.NilError(t, err)
+	ind = stream.nextOnuIndication(t)
+	assert.Equal(t, common.OnuSnToString(ind.GetOnuDiscInd().SerialNumber), "ABCD00000001")
+	assert.Equal(t, ind.GetOnuDiscInd().IntfId, uint32(0))
+
+	_, err = olt.ActivateOnu(ctx, &openolt.Onu{IntfId: 0, OnuId: 5, SerialNumber: onu.SerialNumber})
+	assert.NilError(t, err)
+	ind = stream.nextOnuIndication(t)
+	assert.Equal(t, ind.GetOnuInd().OnuId, uint32(5))
+	assert.Equal(t, ind.GetOnuInd().OperState, "up")
+
+	// VOLTHA is told that an active ONU went down when it's removed
+	assert.NilError(t, olt.RemoveOnu("ABCD00000001"))
+	ind = stream.nextOnuIndication(t)
+	assert.Equal(t, ind.GetOnuInd().OnuId, uint32(5))
+	assert.Equal(t, ind.GetOnuInd().OperState, "down")
+
+	_, err = olt.FindOnuById(0, 5)
+	assert.Error(t, err, "cannot-find-onu-by-id-0-5")
+}
+
+// nextIntfIndication returns the next IntfIndication, skipping the other indications
+func (s *indicationsRecorder) nextIntfIndication(t *testing.T) *openolt.IntfIndication {
+	for {
+		select {
+		case ind := <-s.indications:
+			if intf := ind.GetIntfInd(); intf != nil {
+				return intf
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for an IntfIndication")
+		}
+	}
+}
+
+func Test_Olt_Enable_Reconnect(t *testing.T) {
+	olt := createTestOlt(1, 1)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	stream := &indicationsRecorder{ctx: ctx, indications: make(chan *openolt.Indication, 100)}
+	done := make(chan error)
+	go func() { done <- olt.Enable(stream) }()
+	assert.Equal(t, stream.nextIntfIndication(t).OperState, "up")
+	cancel()
+	<-done
+
+	// VOLTHA reconnects without rebooting the OLT, the PON is still enabled
+	ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+	stream = &indicationsRecorder{ctx: ctx, indications: make(chan *openolt.Indication, 100)}
+	go olt.Enable(stream)
+	intf := stream.nextIntfIndication(t)
+	assert.Equal(t, intf.IntfId, uint32(0))
+	assert.Equal(t, intf.OperState, "up")
+	assert.Equal(t, olt.Pons[0].InternalState.Current(), "enabled")
+}
+
+func Test_Olt_PacedDiscovery(t *testing.T) {
+	olt := createTestOlt(1, 4)
+	olt.Discovery = common.DiscoveryOptions{Delay: 20 * time.Millisecond, Order: common.DiscoveryShuffled}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	stream := &indicationsRecorder{ctx: ctx, indications: make(chan *openolt.Indication, 100)}
+	start := time.Now()
+	go olt.Enable(stream)
+
+	discovered := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		ind := stream.nextOnuIndication(t)
+		discovered[common.OnuSnToString(ind.GetOnuDiscInd().SerialNumber)] = true
+	}
+	// NOTE the first ONU is discovered right away, the others wait for the delay
+	assert.Assert(t, time.Since(start) >= 60*time.Millisecond)
+	for _, onu := range olt.Pons[0].Onus {
+		assert.Assert(t, discovered[onu.Sn()])
+	}
+}
+
+func Test_Olt_PacedDiscovery_Stop(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	olt.Discovery = common.DiscoveryOptions{Delay: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	olt.Pons[0].InternalState.SetState("enabled")
+	olt.discoverOnus(ctx, olt.Pons[0], olt.Pons[0].Onus)
+	for olt.Pons[0].Onus[0].pendingMessages() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the ONUs that were not discovered yet are not when the OLT is disconnected
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, olt.Pons[0].Onus[0].pendingMessages(), 1)
+	assert.Equal(t, olt.Pons[0].Onus[1].pendingMessages(), 0)
+}
+
+func Test_Olt_PacedDiscovery_PonDisabled(t *testing.T) {
+	olt, pon := createTestPon()
+	olt.Discovery = common.DiscoveryOptions{Delay: 20 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	olt.discoverOnus(ctx, pon, pon.Onus)
+	for pon.Onus[0].pendingMessages() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the ONUs waiting to be discovered are not once the PON is disabled
+	_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+	assert.NilError(t, err)
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, pon.Onus[1].pendingMessages(), 0)
+}
+
+func Test_Olt_PacedDiscovery_RemovedOnu(t *testing.T) {
+	olt := createTestOlt(1, 3)
+	pon := olt.Pons[0]
+	pon.InternalState.SetState("enabled")
+	olt.Discovery = common.DiscoveryOptions{Delay: 20 * time.Millisecond}
+	onus := pon.GetOnus()
+	removed := onus[1]
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	olt.discoverOnus(ctx, pon, onus)
+	for onus[0].pendingMessages() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the removed ONU is skipped, the next one is discovered
+	assert.NilError(t, pon.removeOnu(removed))
+	for onus[2].pendingMessages() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, removed.pendingMessages(), 0)
+}
+
+func Test_Olt_DeactivateOnu(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	onu := olt.Pons[0].Onus[0]
+	onu.InternalState.SetState("dhcp_ack_received")
+	onu.OperState.SetState("up")
+	onu.Unis[0].PortNo = 16
+	onu.Unis[0].DhcpFlowReceived = true
+
+	_, err := olt.DeactivateOnu(context.TODO(), &openolt.Onu{IntfId: onu.PonPortID, OnuId: onu.ID})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, onu.InternalState.Current(), "disabled")
+	assert.Equal(t, onu.OperState.Current(), "down")
+	assert.Equal(t, onu.Unis[0].PortNo, uint32(0))
+	assert.Equal(t, onu.Unis[0].DhcpFlowReceived, false)
+
+	msg := nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, DOWN)
+}
+
+func Test_Olt_DeleteOnu(t *testing.T) {
+	_onuRediscoveryDelay := onuRediscoveryDelay
+	defer func() { onuRediscoveryDelay = _onuRediscoveryDelay }()
+	onuRediscoveryDelay = 0
+
+	olt := createTestOlt(1, 1)
+	olt.InternalState.SetState("enabled")
+	olt.indications = &indicationStream{ctx: context.TODO()}
+	olt.Pons[0].InternalState.SetState("enabled")
+	onu := olt.Pons[0].Onus[0]
+	onu.InternalState.SetState("eap_response_success_received")
+	onu.OperState.SetState("up")
+
+	_, err := olt.DeleteOnu(context.TODO(), &openolt.Onu{IntfId: onu.PonPortID, OnuId: onu.ID})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, onu.InternalState.Current(), "created")
+	assert.Equal(t, onu.OperState.Current(), "down")
+
+	msg := nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, DOWN)
+
+	// the ONU is discovered again
+	msg = nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OnuDiscIndication)
+}
+
+func Test_Olt_RediscoverOnu_Skipped(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	pon := olt.Pons[0]
+	disconnected := pon.Onus[0]
+	removed := pon.Onus[1]
+	disconnected.InternalState.SetState("created")
+	removed.InternalState.SetState("created")
+
+	// the ONU is not discovered again once VOLTHA disconnects
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	olt.rediscoverOnu(ctx, pon, disconnected, time.Hour)
+	assert.Equal(t, disconnected.pendingMessages(), 0)
+
+	// nor once it's removed from the PON
+	assert.NilError(t, pon.removeOnu(removed))
+	olt.rediscoverOnu(context.TODO(), pon, removed, 0)
+	assert.Equal(t, removed.pendingMessages(), 0)
+}
+
+func Test_Olt_DeleteOnu_Error(t *testing.T) {
+	olt := createTestOlt(1, 1)
+
+	_, err := olt.DeleteOnu(context.TODO(), &openolt.Onu{IntfId: 0, OnuId: 10})
+
+	assert.Equal(t, err.Error(), "cannot-find-onu-by-id-0-10")
+}
+
+func Test_Olt_DisableOlt(t *testing.T) {
+	olt, pon := createTestPon()
+	olt.Nnis = append(olt.Nnis, &NniPort{ID: 0, Type: "nni"})
+	onu := pon.Onus[0]
+	onu.InternalState.SetState("dhcp_ack_received")
+
+	_, err := olt.DisableOlt(context.TODO(), &openolt.Empty{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, olt.InternalState.Current(), "disabled")
+	assert.Equal(t, pon.InternalState.Current(), "disabled")
+	assert.Equal(t, onu.InternalState.Current(), "pon_disabled")
+
+	msg := <-olt.channel
+	assert.Equal(t, msg.Type, PonIndication)
+	assert.Equal(t, msg.Data.(PonIndicationMessage).OperState, DOWN)
+	msg = <-olt.channel
+	assert.Equal(t, msg.Type, NniIndication)
+	assert.Equal(t, msg.Data.(NniIndicationMessage).OperState, DOWN)
+	msg = <-olt.channel
+	assert.Equal(t, msg.Type, OltIndication)
+	assert.Equal(t, msg.Data.(OltIndicationMessage).OperState, DOWN)
+
+	msg = nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, DOWN)
+}
+
+func Test_Olt_DisableOlt_Error(t *testing.T) {
+	olt, _ := createTestPon()
+	olt.InternalState.SetState("created")
+
+	_, err := olt.DisableOlt(context.TODO(), &openolt.Empty{})
+
+	assert.Equal(t, err.Error(), "event disable inappropriate in current state created")
+}
+
+func Test_Olt_ReenableOlt(t *testing.T) {
+	olt, pon := createTestPon()
+	olt.Nnis = append(olt.Nnis, &NniPort{ID: 0, Type: "nni"})
+	olt.InternalState.SetState("disabled")
+	pon.InternalState.SetState("disabled")
+	// NOTE the PON was enabled when the OLT was disabled
+	olt.enabledPons = []*PonPort{pon}
+	onu := pon.Onus[0]
+	onu.InternalState.SetState("pon_disabled")
+
+	_, err := olt.ReenableOlt(context.TODO(), &openolt.Empty{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, olt.InternalState.Current(), "enabled")
+	assert.Equal(t, pon.InternalState.Current(), "enabled")
+	assert.Equal(t, onu.InternalState.Current(), "enabled")
+
+	msg := <-olt.channel
+	assert.Equal(t, msg.Type, OltIndication)
+	assert.Equal(t, msg.Data.(OltIndicationMessage).OperState, UP)
+	msg = <-olt.channel
+	assert.Equal(t, msg.Type, NniIndication)
+	assert.Equal(t, msg.Data.(NniIndicationMessage).OperState, UP)
+	msg = <-olt.channel
+	assert.Equal(t, msg.Type, PonIndication)
+	assert.Equal(t, msg.Data.(PonIndicationMessage).OperState, UP)
+
+	msg = nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, UP)
+}
+
+func Test_Olt_ReenableOlt_DisabledPon(t *testing.T) {
+	olt := createTestOlt(2, 1)
+	olt.channel = make(chan Message, 10)
+	olt.indications = &indicationStream{ctx: context.TODO()}
+	olt.InternalState.SetState("enabled")
+	for _, pon := range olt.Pons {
+		pon.Olt.channel = olt.channel
+		pon.InternalState.SetState("enabled")
+	}
+
+	_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: 1})
+	assert.NilError(t, err)
+	_, err = olt.DisableOlt(context.TODO(), &openolt.Empty{})
+	assert.NilError(t, err)
+	_, err = olt.ReenableOlt(context.TODO(), &openolt.Empty{})
+	assert.NilError(t, err)
+
+	// the PON VOLTHA disabled before the OLT stays disabled
+	assert.Equal(t, olt.Pons[0].InternalState.Current(), "enabled")
+	assert.Equal(t, olt.Pons[1].InternalState.Current(), "disabled")
+}
+
+func Test_Olt_DisableOlt_NotConnected(t *testing.T) {
+	olt, pon := createTestPon()
+	ctx, cancel := context.WithCancel(context.TODO())
+	olt.indications = &indicationStream{ctx: ctx}
+	// NOTE the stream with VOLTHA was closed, nothing consumes the OLT channel anymore
+	cancel()
+
+	_, err := olt.DisableOlt(context.TODO(), &openolt.Empty{})
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Equal(t, olt.InternalState.Current(), "enabled")
+	assert.Equal(t, pon.InternalState.Current(), "enabled")
+
+	olt.InternalState.SetState("disabled")
+	_, err = olt.ReenableOlt(context.TODO(), &openolt.Empty{})
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Equal(t, olt.InternalState.Current(), "disabled")
+}
+
+func Test_Olt_ResetDevices(t *testing.T) {
+	olt, pon := createTestPon()
+	olt.OperState.SetState("up")
+	pon.OperState.SetState("up")
+	onu := pon.Onus[0]
+	onu.InternalState.SetState("dhcp_ack_received")
+	onu.OperState.SetState("up")
+	onu.Unis[0].PortNo = 16
+	onu.Enqueue(Message{Type: OnuIndication})
+
+	olt.resetDevices()
+
+	assert.Equal(t, olt.InternalState.Current(), "created")
+	assert.Equal(t, olt.OperState.Current(), "down")
+	assert.Equal(t, pon.InternalState.Current(), "created")
+	assert.Equal(t, pon.OperState.Current(), "down")
+	assert.Equal(t, onu.InternalState.Current(), "created")
+	assert.Equal(t, onu.OperState.Current(), "down")
+	assert.Equal(t, onu.Unis[0].PortNo, uint32(0))
+	assert.Equal(t, onu.pendingMessages(), 0)
+}
+
+func Test_Olt_HeartbeatCheck(t *testing.T) {
+	olt := createTestOlt(1, 1)
+
+	res, err := olt.HeartbeatCheck(context.TODO(), &openolt.Empty{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, res.HeartbeatSignature, olt.heartbeat.signature)
+	assert.Assert(t, olt.heartbeat.signature != 0)
+}
+
+func Test_Olt_HeartbeatCheck_Fail(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.SetHeartbeatFailure(HeartbeatFail, time.Minute)
+
+	_, err := olt.HeartbeatCheck(context.TODO(), &openolt.Empty{})
+
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+
+	olt.SetHeartbeatFailure(HeartbeatFail, 0)
+
+	_, err = olt.HeartbeatCheck(context.TODO(), &openolt.Empty{})
+
+	assert.Equal(t, err, nil)
+}
+
+func Test_Olt_HeartbeatCheck_Hang(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.SetHeartbeatFailure(HeartbeatHang, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := olt.HeartbeatCheck(ctx, &openolt.Empty{})
+
+	assert.Equal(t, err, context.DeadlineExceeded)
+}
+
+func Test_Olt_HeartbeatCheck_Release(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.SetHeartbeatFailure(HeartbeatHang, time.Minute)
+
+	done := make(chan error)
+	go func() {
+		_, err := olt.HeartbeatCheck(context.TODO(), &openolt.Empty{})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// clearing the failure answers the hanging call
+	olt.SetHeartbeatFailure(HeartbeatHang, 0)
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("HeartbeatCheck is still hanging")
+	}
+
+	// a hanging call released by a new failure follows it
+	olt.SetHeartbeatFailure(HeartbeatHang, time.Minute)
+	go func() {
+		_, err := olt.HeartbeatCheck(context.TODO(), &openolt.Empty{})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	olt.SetHeartbeatFailure(HeartbeatFail, time.Minute)
+	select {
+	case err := <-done:
+		assert.Equal(t, status.Code(err), codes.Unavailable)
+	case <-time.After(time.Second):
+		t.Fatal("HeartbeatCheck is still hanging")
+	}
+}
+
+func Test_Olt_HeartbeatCheck_Reboot(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.oltAddress = "127.0.0.1:0"
+	olt.SetHeartbeatFailure(HeartbeatHang, time.Minute)
+
+	done := make(chan *openolt.Heartbeat)
+	go func() {
+		res, _ := olt.HeartbeatCheck(context.TODO(), &openolt.Empty{})
+		done <- res
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// the reboot clears the failure and releases the hanging call
+	olt.restartOlt()
+	defer olt.server().Stop()
+	select {
+	case res := <-done:
+		assert.Assert(t, res != nil)
+	case <-time.After(time.Second):
+		t.Fatal("HeartbeatCheck is still hanging")
+	}
+}
+
+func Test_Olt_Reboot_Enable(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.oltAddress = "127.0.0.1:0"
+	assert.NilError(t, olt.newOltServer())
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	stream := &indicationsRecorder{ctx: ctx, indications: make(chan *openolt.Indication, 100)}
+
+	// VOLTHA may reconnect while the OLT reboots
+	rebooted := make(chan bool)
+	go func() {
+		olt.restartOlt()
+		rebooted <- true
+	}()
+	enabled := make(chan bool)
+	go func() {
+		olt.Enable(stream)
+		enabled <- true
+	}()
+
+	<-rebooted
+	assert.Assert(t, olt.server() != nil)
+	olt.server().Stop()
+
+	// Enable does not hang if the reboot stopped the loops it sends its messages to
+	cancel()
+	select {
+	case <-enabled:
+	case <-time.After(time.Second):
+		t.Fatal("Enable is blocked after the reboot")
+	}
+}
+
+func Test_Olt_NewHeartbeatSignature(t *testing.T) {
+	first := newHeartbeatSignature(0)
+	second := newHeartbeatSignature(first)
+
+	assert.Assert(t, first != second)
+}
+
+func Test_Olt_FlowAddRemove(t *testing.T) {
+	olt := createTestOlt(1, 1)
+
+	flow := &openolt.Flow{
+		AccessIntfId: -1,
+		OnuId:        -1,
+		FlowId:       1,
+		FlowType:     "downstream",
+		Classifier:   &openolt.Classifier{},
+	}
+
+	_, err := olt.FlowAdd(context.TODO(), flow)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(olt.Flows.GetAll()), 1)
+
+	_, err = olt.FlowRemove(context.TODO(), &openolt.Flow{FlowId: 1, FlowType: "downstream"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(olt.Flows.GetAll()), 0)
+}
+
+func Test_Olt_GetDeviceInfo(t *testing.T) {
+	olt := createTestOlt(2, 1)
+	olt.DeviceInfo.Model = "foo"
+	olt.DeviceInfo.AllocIdRange = common.IdRange{Start: 1024, End: 1087}
+	olt.DeviceInfo.Ranges = []common.ResourceRangesOptions{
+		{
+			IntfIds: []uint32{1},
+			Pools:   []common.PoolOptions{{Type: "ONU_ID", Sharing: "DEDICATED_PER_INTF", Start: 1, End: 32}},
+		},
+	}
+
+	info, err := olt.GetDeviceInfo(context.TODO(), &openolt.Empty{})
+
+	assert.NilError(t, err)
+	assert.Equal(t, info.Vendor, "BBSim")
+	assert.Equal(t, info.Model, "foo")
+	assert.Equal(t, info.PonPorts, uint32(2))
+	assert.Equal(t, info.AllocIdStart, uint32(1024))
+	assert.Equal(t, info.AllocIdEnd, uint32(1087))
+	assert.Equal(t, len(info.Ranges), 1)
+	assert.Equal(t, info.Ranges[0].IntfIds[0], uint32(1))
+	assert.Equal(t, info.Ranges[0].Technology, "xgspon")
+	assert.Equal(t, info.Ranges[0].Pools[0].Type, openolt.DeviceInfo_DeviceResourceRanges_Pool_ONU_ID)
+	assert.Equal(t, info.Ranges[0].Pools[0].End, uint32(32))
+}
+
+func Test_Olt_DeviceId(t *testing.T) {
+	assert.Equal(t, oltDeviceId(0), "0a:0a:0a:0a:0a:00")
+	assert.Equal(t, oltDeviceId(5), "0a:0a:0a:0a:0a:05")
+	// the OLTs whose IDs only differ in the upper bytes don't share the DeviceId
+	assert.Equal(t, oltDeviceId(256), "0a:0a:0a:0a:0b:00")
+	assert.Equal(t, oltDeviceId(65536+5), "0a:0a:0a:0b:0a:05")
+}
+
+func Test_Olt_NewOltServer_RandomPort(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	olt.oltAddress = "127.0.0.1:0"
+
+	err := olt.newOltServer()
+	assert.NilError(t, err)
+	defer olt.server().Stop()
+
+	// NOTE the address is updated with the chosen port, so that after a reboot the OLT listens on the same one
+	assert.Assert(t, olt.Address() != "127.0.0.1:0")
+	assert.Assert(t, strings.HasPrefix(olt.Address(), "127.0.0.1:"))
+}
+
+func Test_Olt_MultipleOlts(t *testing.T) {
+	options := &common.BBSimCliOptions{
+		NumNniPerOlt: 1,
+		NumPonPerOlt: 1,
+		NumOnuPerPon: 1,
+		DeviceInfo:   common.DefaultDeviceInfo(),
+	}
+
+	for _, id := range []int{12, 11} {
+		options.OltID = id
+		CreateOLT(options, nil, nil, true)
+	}
+
+	first, err := GetOLTById(11)
+	assert.NilError(t, err)
+	second, err := GetOLTById(12)
+	assert.NilError(t, err)
+
+	assert.Equal(t, first.SerialNumber, "BBSIM_OLT_11")
+	assert.Equal(t, second.SerialNumber, "BBSIM_OLT_12")
+	assert.Assert(t, first.Pons[0].Onus[0].Sn() != second.Pons[0].Onus[0].Sn())
+	assert.DeepEqual(t, first.Pons[0].Onus[0].HwAddress, net.HardwareAddr{0x2e, 0x6b, 0x70, 0x13, 0x00, 0x01})
+	assert.DeepEqual(t, second.Pons[0].Onus[0].HwAddress, net.HardwareAddr{0x2e, 0x6c, 0x70, 0x13, 0x00, 0x01})
+
+	olts := GetOLTs()
+	for i := 1; i < len(olts); i++ {
+		assert.Assert(t, olts[i-1].ID < olts[i].ID)
+	}
+
+	_, err = GetOLTById(100)
+	assert.Error(t, err, "cannot-find-olt-100")
+}
+
+func Test_Olt_OnuIdentities(t *testing.T) {
+	identities, err := common.NewOnuIdentities("ABCD", "{olt:2}{pon:2}{onu:4}", "2e:60:{olt:2}:{pon:2}:{onu:3}{uni:1}")
+	assert.NilError(t, err)
+
+	options := &common.BBSimCliOptions{
+		OltID:         3,
+		NumNniPerOlt:  1,
+		NumPonPerOlt:  1,
+		NumOnuPerPon:  300,
+		NumUniPerOnu:  2,
+		DeviceInfo:    common.DefaultDeviceInfo(),
+		OnuIdentities: identities,
+	}
+	olt := CreateOLT(options, nil, nil, true)
+
+	onu := olt.Pons[0].Onus[299]
+	assert.Equal(t, onu.Sn(), "ABCD0300012c")
+	assert.DeepEqual(t, onu.HwAddress, net.HardwareAddr{0x2e, 0x60, 0x03, 0x00, 0x12, 0xc0})
+	assert.DeepEqual(t, onu.Unis[1].HwAddress, net.HardwareAddr{0x2e, 0x60, 0x03, 0x00, 0x12, 0xc1})
+
+	// all the ONUs can be found by serial number and MAC address
+	seen := map[string]bool{}
+	for _, onu := range olt.Pons[0].Onus {
+		found, err := olt.FindOnuBySn(onu.Sn())
+		assert.NilError(t, err)
+		assert.Equal(t, found, onu)
+		for _, uni := range onu.Unis {
+			assert.Assert(t, !seen[uni.HwAddress.String()])
+			seen[uni.HwAddress.String()] = true
+		}
+	}
+}
+
+func Test_Olt_MultipleUnis(t *testing.T) {
+	options := &common.BBSimCliOptions{
+		NumNniPerOlt: 1,
+		NumPonPerOlt: 1,
+		NumOnuPerPon: 2,
+		NumUniPerOnu: 4,
+		STag:         900,
+		CTagInit:     900,
+		DeviceInfo:   common.DefaultDeviceInfo(),
+	}
+	olt := CreateOLT(options, nil, nil, true)
+
+	// each UNI gets its own C-Tag
+	second := olt.Pons[0].Onus[1]
+	assert.Equal(t, len(second.Unis), 4)
+	assert.Equal(t, second.CTag, 904)
+	assert.Equal(t, second.Unis[3].CTag, 907)
+
+	onu, uni, err := olt.FindUniByMacAddress(second.Unis[2].HwAddress)
+	assert.NilError(t, err)
+	assert.Equal(t, onu, second)
+	assert.Equal(t, uni, second.Unis[2])
+
+	onu, err = olt.FindOnuByMacAddress(second.Unis[3].HwAddress)
+	assert.NilError(t, err)
+	assert.Equal(t, onu, second)
+}
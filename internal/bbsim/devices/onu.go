@@ -21,17 +21,22 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
 	"github.com/google/gopacket/layers"
 	"github.com/looplab/fsm"
 	"github.com/opencord/bbsim/internal/bbsim/packetHandlers"
 	"github.com/opencord/bbsim/internal/bbsim/responders/dhcp"
 	"github.com/opencord/bbsim/internal/bbsim/responders/eapol"
+	"github.com/opencord/bbsim/internal/bbsim/responders/omcisim"
 	"github.com/opencord/bbsim/internal/common"
 	omcilib "github.com/opencord/bbsim/internal/common/omci"
-	omcisim "github.com/opencord/omci-sim"
 	"github.com/opencord/voltha-protos/go/openolt"
 	log "github.com/sirupsen/logrus"
+	"math/bits"
+	"math/rand"
 	"net"
+	"sync"
+	"time"
 )
 
 var onuLogger = log.WithFields(log.Fields{
@@ -43,29 +48,60 @@ type Onu struct {
 	PonPortID uint32
 	PonPort   PonPort
 	STag      int
-	CTag      int
-	Auth      bool // automatically start EAPOL if set to true
-	Dhcp      bool // automatically start DHCP if set to true
-	// PortNo comes with flows and it's used when sending packetIndications,
-	// There is one PortNo per UNI Port, for now we're only storing the first one
-	// FIXME add support for multiple UNIs
-	HwAddress     net.HardwareAddr
+	CTag      int              // C-Tag of the first UNI
+	Auth      bool             // automatically start EAPOL if set to true
+	Dhcp      bool             // automatically start DHCP if set to true
+	HwAddress net.HardwareAddr // MAC Address of the first UNI
+	// NOTE the InternalState tracks the ONU lifecycle and runs the EAPOL and DHCP clients of the first UNI
 	InternalState *fsm.FSM
 
-	// ONU State
-	PortNo           uint32
-	DhcpFlowReceived bool
+	// Unis are the UNI ports of the ONU, each one with its own EAPOL and DHCP clients
+	Unis []*UniPort
+	// mib stores the managed entities of the ONU, it answers the OMCI requests
+	mib *omcisim.Mib
+	// MibTemplate is the name of the template the MIB is built from, empty for the default MIB
+	MibTemplate string
+	// rebootDelay is the time the ONU takes to come back after a reboot requested via OMCI
+	rebootDelay time.Duration
+	// pmInterval is the length of the OMCI PM intervals, pmTimer ends them once the OLT synchronized the time
+	pmInterval time.Duration
+	pmTimer    *pmIntervalTimer
+	// omciFaults are the OMCI faults injected in the ONU, if nil the global ones are, see onu_omci_faults.go.
+	// heldOmciResponse is a response held back to be sent out of order and rnd is created only if there are faults
+	omciFaults       *common.OmciFaults
+	heldOmciResponse []byte
+	rnd              *rand.Rand
+	// index is the one of the PON the ONU belongs to, it is updated when the ONU ID changes
+	index *onuIndex
+
+	// NOTE the ONU state is changed while processing its messages only, the changes requested by
+	// the gRPC and API handlers are queued in the mailbox (see Do).
+	// mu is held while processing a message, so that the changes can be
+	// safely applied in place when the ONU is detached (eg: while the OLT is rebooting)
+	mu sync.Mutex
+
+	// the mailbox is allocated when a message is queued and released once it is empty, see onu_scheduler.go
+	mailboxLock sync.Mutex
+	mailbox     []Message
+	scheduled   bool                                   // the ONU is waiting for a worker or being processed by one
+	loopDone    chan struct{}                          // closed when the ONU is detached, nil if it is not attached
+	stream      openolt.Openolt_EnableIndicationServer // where the indications are sent while the ONU is attached
+	client      openolt.OpenoltClient                  // BBR only
+	unplugged   bool                                   // the ONU was removed from the PON, see unplug
 
 	OperState    *fsm.FSM
 	SerialNumber *openolt.SerialNumber
 
-	Channel chan Message // this Channel is to track state changes OMCI messages, EAPOL and DHCP packets
-
 	// OMCI params
 	tid        uint16
 	hpTid      uint16
 	seqNumber  uint16
 	HasGemPort bool
+	// mibUploadCommands is the number of MibUploadNext requests BBR has to send
+	mibUploadCommands uint16
+
+	// TechProfile stores the T-CONTs and GemPorts VOLTHA created on the ONU, they are used to validate the flows
+	TechProfile *TechProfileStore
 
 	DoneChannel chan bool // this channel is used to signal once the onu is complete (when the struct is used by BBR)
 }
@@ -75,25 +111,91 @@ func (o *Onu) Sn() string {
 }
 
 func CreateONU(olt OltDevice, pon PonPort, id uint32, sTag int, cTag int, auth bool, dhcp bool) *Onu {
+	// NOTE the serial number and the MAC addresses are derived from the ID the ONU is created with,
+	// they don't change when VOLTHA assigns a different ID to the ONU
+	identities := olt.OnuIdentities
+	if identities == nil {
+		identities = common.DefaultOnuIdentities
+	}
+	sn, err := identities.SerialNumber(olt.ID, pon.ID, id)
+	if err != nil {
+		// NOTE the IDs are validated against the patterns when BBSim starts
+		onuLogger.Fatalf("Cannot generate the ONU serial number: %v", err)
+	}
+	template := olt.MibTemplates.ForOnu(olt.ID, pon.ID, id, sn)
+	return newOnu(olt, pon, id, template.ApplyVendorId(sn), template, sTag, cTag, auth, dhcp)
+}
+
+// newOnu creates an ONU with a given serial number, the MIB it reports via OMCI is described by template,
+// if it is nil the ONU reports the default MIB
+func newOnu(olt OltDevice, pon PonPort, id uint32, sn *openolt.SerialNumber, template *common.MibTemplate,
+	sTag int, cTag int, auth bool, dhcp bool) *Onu {
 
 	o := Onu{
-		ID:               id,
-		PonPortID:        pon.ID,
-		PonPort:          pon,
-		STag:             sTag,
-		CTag:             cTag,
-		Auth:             auth,
-		Dhcp:             dhcp,
-		HwAddress:        net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, byte(pon.ID), byte(id)},
-		PortNo:           0,
-		Channel:          make(chan Message, 2048),
-		tid:              0x1,
-		hpTid:            0x8000,
-		seqNumber:        0,
-		DoneChannel:      make(chan bool, 1),
-		DhcpFlowReceived: false,
-	}
-	o.SerialNumber = o.NewSN(olt.ID, pon.ID, o.ID)
+		ID:           id,
+		PonPortID:    pon.ID,
+		PonPort:      pon,
+		STag:         sTag,
+		CTag:         cTag,
+		Auth:         auth,
+		Dhcp:         dhcp,
+		tid:          0x1,
+		hpTid:        0x8000,
+		seqNumber:    0,
+		DoneChannel:  make(chan bool, 1),
+		TechProfile:  NewTechProfileStore(),
+		SerialNumber: sn,
+		rebootDelay:  olt.OnuRebootDelay,
+		pmInterval:   olt.PmInterval,
+	}
+	identities := olt.OnuIdentities
+	if identities == nil {
+		identities = common.DefaultOnuIdentities
+	}
+
+	numUnis := olt.NumUniPerOnu
+	if numUnis < 1 {
+		numUnis = 1
+	}
+	config := omcisim.MibConfig{
+		Veip:         olt.UniType == common.UniTypeVeip,
+		SerialNumber: append(append([]byte{}, sn.VendorId...), sn.VendorSpecific...),
+	}
+	if template != nil {
+		o.MibTemplate = template.Name
+		if template.Unis > 0 {
+			numUnis = template.Unis
+		}
+		if template.UniType != "" {
+			config.Veip = template.UniType == common.UniTypeVeip
+		}
+		config.VendorId = template.VendorId
+		config.EquipmentId = template.EquipmentId
+		config.Version = template.Version
+		config.SoftwareImages = template.SoftwareImages
+		config.NumTconts = template.Tconts
+		config.QueuesPerPort = template.PriorityQueues
+	}
+	config.NumUnis = numUnis
+	o.mib = omcisim.NewMib(config)
+
+	// NOTE each UNI gets a sequential C-Tag, starting from the one of the ONU
+	for i := 0; i < numUnis; i++ {
+		mac, err := identities.MacAddress(olt.ID, pon.ID, id, uint32(i))
+		if err != nil {
+			onuLogger.Fatalf("Cannot generate the UNI MAC address: %v", err)
+		}
+		uni := &UniPort{
+			ID:        uint32(i),
+			HwAddress: mac,
+			CTag:      cTag + i,
+		}
+		if i > 0 {
+			uni.InternalState = newUniStateMachine(o.uniCallbacks(uni))
+		}
+		o.Unis = append(o.Unis, uni)
+	}
+	o.HwAddress = o.Unis[0].HwAddress
 
 	// NOTE this state machine is used to track the operational
 	// state as requested by VOLTHA
@@ -104,117 +206,210 @@ func CreateONU(olt OltDevice, pon PonPort, id uint32, sTag int, cTag int, auth b
 	})
 
 	// NOTE this state machine is used to activate the OMCI, EAPOL and DHCP clients
-	o.InternalState = fsm.NewFSM(
-		"created",
-		fsm.Events{
-			// DEVICE Lifecycle
-			{Name: "discover", Src: []string{"created"}, Dst: "discovered"},
-			{Name: "enable", Src: []string{"discovered", "disabled"}, Dst: "enabled"},
-			{Name: "receive_eapol_flow", Src: []string{"enabled", "gem_port_added"}, Dst: "eapol_flow_received"},
-			{Name: "add_gem_port", Src: []string{"enabled", "eapol_flow_received"}, Dst: "gem_port_added"},
-			// NOTE should disabled state be diffente for oper_disabled (emulating an error) and admin_disabled (received a disabled call via VOLTHA)?
-			{Name: "disable", Src: []string{"eap_response_success_received", "auth_failed", "dhcp_ack_received", "dhcp_failed"}, Dst: "disabled"},
-			// EAPOL
-			{Name: "start_auth", Src: []string{"eapol_flow_received", "gem_port_added", "eap_response_success_received", "auth_failed", "dhcp_ack_received", "dhcp_failed"}, Dst: "auth_started"},
-			{Name: "eap_start_sent", Src: []string{"auth_started"}, Dst: "eap_start_sent"},
-			{Name: "eap_response_identity_sent", Src: []string{"eap_start_sent"}, Dst: "eap_response_identity_sent"},
-			{Name: "eap_response_challenge_sent", Src: []string{"eap_response_identity_sent"}, Dst: "eap_response_challenge_sent"},
-			{Name: "eap_response_success_received", Src: []string{"eap_response_challenge_sent"}, Dst: "eap_response_success_received"},
-			{Name: "auth_failed", Src: []string{"auth_started", "eap_start_sent", "eap_response_identity_sent", "eap_response_challenge_sent"}, Dst: "auth_failed"},
-			// DHCP
-			{Name: "start_dhcp", Src: []string{"eap_response_success_received", "dhcp_discovery_sent", "dhcp_request_sent", "dhcp_ack_received", "dhcp_failed"}, Dst: "dhcp_started"},
-			{Name: "dhcp_discovery_sent", Src: []string{"dhcp_started"}, Dst: "dhcp_discovery_sent"},
-			{Name: "dhcp_request_sent", Src: []string{"dhcp_discovery_sent"}, Dst: "dhcp_request_sent"},
-			{Name: "dhcp_ack_received", Src: []string{"dhcp_request_sent"}, Dst: "dhcp_ack_received"},
-			{Name: "dhcp_failed", Src: []string{"dhcp_started", "dhcp_discovery_sent", "dhcp_request_sent"}, Dst: "dhcp_failed"},
-			// BBR States
-			// TODO add start OMCI state
-			{Name: "send_eapol_flow", Src: []string{"created"}, Dst: "eapol_flow_sent"},
-			{Name: "send_dhcp_flow", Src: []string{"eapol_flow_sent"}, Dst: "dhcp_flow_sent"},
-		},
-		fsm.Callbacks{
-			"enter_state": func(e *fsm.Event) {
-				o.logStateChange(e.Src, e.Dst)
-			},
-			"enter_enabled": func(event *fsm.Event) {
-				msg := Message{
-					Type: OnuIndication,
-					Data: OnuIndicationMessage{
-						OnuSN:     o.SerialNumber,
-						PonPortID: o.PonPortID,
-						OperState: UP,
-					},
-				}
-				o.Channel <- msg
-			},
-			"enter_disabled": func(event *fsm.Event) {
-				msg := Message{
-					Type: OnuIndication,
-					Data: OnuIndicationMessage{
-						OnuSN:     o.SerialNumber,
-						PonPortID: o.PonPortID,
-						OperState: DOWN,
-					},
-				}
-				o.Channel <- msg
-			},
-			"enter_auth_started": func(e *fsm.Event) {
-				o.logStateChange(e.Src, e.Dst)
-				msg := Message{
-					Type: StartEAPOL,
-					Data: PacketMessage{
-						PonPortID: o.PonPortID,
-						OnuID:     o.ID,
-					},
-				}
-				o.Channel <- msg
-			},
-			"enter_auth_failed": func(e *fsm.Event) {
-				onuLogger.WithFields(log.Fields{
-					"OnuId":  o.ID,
-					"IntfId": o.PonPortID,
-					"OnuSn":  o.Sn(),
-				}).Errorf("ONU failed to authenticate!")
-			},
-			"before_start_dhcp": func(e *fsm.Event) {
-				if o.DhcpFlowReceived == false {
-					e.Cancel(errors.New("cannot-go-to-dhcp-started-as-dhcp-flow-is-missing"))
-				}
-			},
-			"enter_dhcp_started": func(e *fsm.Event) {
-				msg := Message{
-					Type: StartDHCP,
-					Data: PacketMessage{
-						PonPortID: o.PonPortID,
-						OnuID:     o.ID,
-					},
-				}
-				o.Channel <- msg
-			},
-			"enter_dhcp_failed": func(e *fsm.Event) {
-				onuLogger.WithFields(log.Fields{
-					"OnuId":  o.ID,
-					"IntfId": o.PonPortID,
-					"OnuSn":  o.Sn(),
-				}).Errorf("ONU failed to DHCP!")
+	events := fsm.Events{
+		// DEVICE Lifecycle
+		{Name: "discover", Src: []string{"created"}, Dst: "discovered"},
+		{Name: "enable", Src: []string{"discovered", "disabled", "pon_disabled"}, Dst: "enabled"},
+		// NOTE should disabled state be diffente for oper_disabled (emulating an error) and admin_disabled (received a disabled call via VOLTHA)?
+		{Name: "disable", Src: append([]string{"enabled", "pon_disabled"}, subscriberStates...), Dst: "disabled"},
+		{Name: "pon_disabled", Src: append([]string{"enabled"}, subscriberStates...), Dst: "pon_disabled"},
+		// NOTE initialize brings the ONU back to its initial state once VOLTHA deletes it, so that it can be discovered again
+		{Name: "initialize", Src: append([]string{"discovered", "enabled", "disabled", "pon_disabled"}, subscriberStates...), Dst: "created"},
+		// BBR States
+		// TODO add start OMCI state
+		{Name: "send_eapol_flow", Src: []string{"created"}, Dst: "eapol_flow_sent"},
+		{Name: "send_dhcp_flow", Src: []string{"eapol_flow_sent"}, Dst: "dhcp_flow_sent"},
+	}
+
+	callbacks := o.uniCallbacks(o.Unis[0])
+	callbacks["enter_state"] = func(e *fsm.Event) {
+		o.logStateChange(e.Src, e.Dst)
+	}
+	callbacks["enter_created"] = func(e *fsm.Event) {
+		o.reset()
+	}
+	callbacks["enter_enabled"] = func(event *fsm.Event) {
+		msg := Message{
+			Type: OnuIndication,
+			Data: OnuIndicationMessage{
+				OnuSN:     o.SerialNumber,
+				PonPortID: o.PonPortID,
+				OperState: UP,
 			},
-			"enter_eapol_flow_sent": func(e *fsm.Event) {
-				msg := Message{
-					Type: SendEapolFlow,
-				}
-				o.Channel <- msg
+		}
+		o.Enqueue(msg)
+		o.uniLifecycleEvent("enable")
+	}
+	callbacks["enter_disabled"] = func(event *fsm.Event) {
+		msg := Message{
+			Type: OnuIndication,
+			Data: OnuIndicationMessage{
+				OnuSN:     o.SerialNumber,
+				PonPortID: o.PonPortID,
+				OperState: DOWN,
 			},
-			"enter_dhcp_flow_sent": func(e *fsm.Event) {
-				msg := Message{
-					Type: SendDhcpFlow,
-				}
-				o.Channel <- msg
+		}
+		o.Enqueue(msg)
+		o.uniLifecycleEvent("disable")
+	}
+	callbacks["enter_pon_disabled"] = func(event *fsm.Event) {
+		msg := Message{
+			Type: OnuIndication,
+			Data: OnuIndicationMessage{
+				OnuSN:     o.SerialNumber,
+				PonPortID: o.PonPortID,
+				OperState: DOWN,
 			},
-		},
-	)
+		}
+		o.Enqueue(msg)
+		o.uniLifecycleEvent("disable")
+	}
+	callbacks["enter_eapol_flow_sent"] = func(e *fsm.Event) {
+		msg := Message{
+			Type: SendEapolFlow,
+		}
+		o.Enqueue(msg)
+	}
+	callbacks["enter_dhcp_flow_sent"] = func(e *fsm.Event) {
+		msg := Message{
+			Type: SendDhcpFlow,
+		}
+		o.Enqueue(msg)
+	}
+
+	o.InternalState = fsm.NewFSM("created", append(events, subscriberEvents...), callbacks)
 	return &o
 }
 
+// uniCallbacks are the callbacks that drive the EAPOL and DHCP clients of an UNI
+func (o *Onu) uniCallbacks(uni *UniPort) fsm.Callbacks {
+	return fsm.Callbacks{
+		"enter_state": func(e *fsm.Event) {
+			onuLogger.WithFields(log.Fields{
+				"OnuId":  o.ID,
+				"IntfId": o.PonPortID,
+				"OnuSn":  o.Sn(),
+				"UniId":  uni.ID,
+			}).Debugf("Changing UNI InternalState from %s to %s", e.Src, e.Dst)
+		},
+		"enter_auth_started": func(e *fsm.Event) {
+			msg := Message{
+				Type: StartEAPOL,
+				Data: PacketMessage{
+					PonPortID: o.PonPortID,
+					OnuID:     o.ID,
+					UniID:     uni.ID,
+				},
+			}
+			o.Enqueue(msg)
+		},
+		"enter_auth_failed": func(e *fsm.Event) {
+			onuLogger.WithFields(log.Fields{
+				"OnuId":  o.ID,
+				"IntfId": o.PonPortID,
+				"OnuSn":  o.Sn(),
+				"UniId":  uni.ID,
+			}).Errorf("ONU failed to authenticate!")
+		},
+		"before_start_dhcp": func(e *fsm.Event) {
+			if uni.DhcpFlowReceived == false {
+				e.Cancel(errors.New("cannot-go-to-dhcp-started-as-dhcp-flow-is-missing"))
+			}
+		},
+		"enter_dhcp_started": func(e *fsm.Event) {
+			msg := Message{
+				Type: StartDHCP,
+				Data: PacketMessage{
+					PonPortID: o.PonPortID,
+					OnuID:     o.ID,
+					UniID:     uni.ID,
+				},
+			}
+			o.Enqueue(msg)
+		},
+		"enter_dhcp_failed": func(e *fsm.Event) {
+			onuLogger.WithFields(log.Fields{
+				"OnuId":  o.ID,
+				"IntfId": o.PonPortID,
+				"OnuSn":  o.Sn(),
+				"UniId":  uni.ID,
+			}).Errorf("ONU failed to DHCP!")
+		},
+	}
+}
+
+// uniLifecycleEvent moves the state machines of all the UNIs but the first one
+// (that shares the ONU state machine) through the ONU lifecycle
+func (o *Onu) uniLifecycleEvent(event string) {
+	for _, uni := range o.Unis[1:] {
+		if !uni.InternalState.Can(event) {
+			continue
+		}
+		if err := uni.InternalState.Event(event); err != nil {
+			onuLogger.WithFields(log.Fields{
+				"OnuId":  o.ID,
+				"IntfId": o.PonPortID,
+				"OnuSn":  o.Sn(),
+				"UniId":  uni.ID,
+			}).Errorf("Can't %s UNI: %v", event, err)
+		}
+	}
+}
+
+// UniState returns the state machine running the EAPOL and DHCP clients of an UNI
+func (o *Onu) UniState(uni *UniPort) *fsm.FSM {
+	if uni.ID == 0 {
+		return o.InternalState
+	}
+	return uni.InternalState
+}
+
+func (o *Onu) GetUniById(id uint32) (*UniPort, error) {
+	for _, uni := range o.Unis {
+		if uni.ID == id {
+			return uni, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot-find-uni-%d-on-onu-%s", id, o.Sn())
+}
+
+// getUniByPortNo returns the UNI a packet coming from VOLTHA is directed to,
+// if VOLTHA does not specify a known PortNo the packet goes to the first UNI
+func (o *Onu) getUniByPortNo(portNo uint32) *UniPort {
+	for _, uni := range o.Unis {
+		if portNo != 0 && uni.PortNo == portNo {
+			return uni
+		}
+	}
+	return o.Unis[0]
+}
+
+// getGemPortId returns the GemPort the packets of an UNI are sent on
+func (o *Onu) getGemPortId(uni *UniPort) (uint32, error) {
+	if uni.GemPortId != 0 {
+		return uni.GemPortId, nil
+	}
+	gemPorts := o.mib.UniGemPorts(uni.ID)
+	if len(gemPorts) == 0 {
+		return 0, fmt.Errorf("no-gem-port-created-for-uni-%d-on-onu-%s", uni.ID, o.Sn())
+	}
+	return gemPorts[0], nil
+}
+
+// uniGemPortCreated checks whether the OLT created via OMCI the GemPort of an UNI,
+// either the one that comes with the EAPOL flow or one bridged to the UNI
+func (o *Onu) uniGemPortCreated(uni *UniPort) bool {
+	if uni.GemPortId == 0 {
+		return len(o.mib.UniGemPorts(uni.ID)) > 0
+	}
+	for _, gem := range o.mib.GemPorts() {
+		if gem == uni.GemPortId {
+			return true
+		}
+	}
+	return false
+}
+
 func (o *Onu) logStateChange(src string, dst string) {
 	onuLogger.WithFields(log.Fields{
 		"OnuId":  o.ID,
@@ -223,120 +418,238 @@ func (o *Onu) logStateChange(src string, dst string) {
 	}).Debugf("Changing ONU InternalState from %s to %s", src, dst)
 }
 
-func (o *Onu) ProcessOnuMessages(stream openolt.Openolt_EnableIndicationServer, client openolt.OpenoltClient) {
-	onuLogger.WithFields(log.Fields{
-		"onuID": o.ID,
-		"onuSN": o.Sn(),
-	}).Debug("Started ONU Indication Channel")
+// Do applies a change to the ONU state from outside the ONU message loop (eg: the gRPC and API handlers),
+// the change is queued after the messages the ONU already received and Do waits for it to be applied.
+// If no loop is running the change is applied in place.
+// NOTE Do must not be called from the ONU message loop (eg: in a state machine callback)
+func (o *Onu) Do(change func() error) error {
+	o.mailboxLock.Lock()
+	done := o.loopDone
+	o.mailboxLock.Unlock()
+
+	req := &OnuRequestMessage{
+		change: change,
+		result: make(chan error, 1),
+	}
 
-	for message := range o.Channel {
-		onuLogger.WithFields(log.Fields{
-			"onuID":       o.ID,
-			"onuSN":       o.Sn(),
-			"messageType": message.Type,
-		}).Tracef("Received message on ONU Channel")
-
-		switch message.Type {
-		case OnuDiscIndication:
-			msg, _ := message.Data.(OnuDiscIndicationMessage)
-			o.sendOnuDiscIndication(msg, stream)
-		case OnuIndication:
-			msg, _ := message.Data.(OnuIndicationMessage)
-			o.sendOnuIndication(msg, stream)
-		case OMCI:
-			msg, _ := message.Data.(OmciMessage)
-			o.handleOmciMessage(msg, stream)
-		case FlowUpdate:
-			msg, _ := message.Data.(OnuFlowUpdateMessage)
-			o.handleFlowUpdate(msg)
-		case StartEAPOL:
-			log.Infof("Receive StartEAPOL message on ONU Channel")
-			eapol.SendEapStart(o.ID, o.PonPortID, o.Sn(), o.PortNo, o.HwAddress, o.InternalState, stream)
-		case StartDHCP:
-			log.Infof("Receive StartDHCP message on ONU Channel")
-			// FIXME use id, ponId as SendEapStart
-			dhcp.SendDHCPDiscovery(o.PonPortID, o.ID, o.Sn(), o.PortNo, o.InternalState, o.HwAddress, o.CTag, stream)
-		case OnuPacketOut:
-
-			msg, _ := message.Data.(OnuPacketMessage)
-
-			log.WithFields(log.Fields{
-				"IntfId":  msg.IntfId,
-				"OnuId":   msg.OnuId,
-				"pktType": msg.Type,
-			}).Trace("Received OnuPacketOut Message")
-
-			if msg.Type == packetHandlers.EAPOL {
-				eapol.HandleNextPacket(msg.OnuId, msg.IntfId, o.Sn(), o.PortNo, o.InternalState, msg.Packet, stream, client)
-			} else if msg.Type == packetHandlers.DHCP {
-				// NOTE here we receive packets going from the DHCP Server to the ONU
-				// for now we expect them to be double-tagged, but ideally the should be single tagged
-				dhcp.HandleNextPacket(o.ID, o.PonPortID, o.Sn(), o.PortNo, o.HwAddress, o.CTag, o.InternalState, msg.Packet, stream)
-			}
-		case OnuPacketIn:
-			// NOTE we only receive BBR packets here.
-			// Eapol.HandleNextPacket can handle both BBSim and BBr cases so the call is the same
-			// in the DHCP case VOLTHA only act as a proxy, the behaviour is completely different thus we have a dhcp.HandleNextBbrPacket
-			msg, _ := message.Data.(OnuPacketMessage)
-
-			log.WithFields(log.Fields{
-				"IntfId":  msg.IntfId,
-				"OnuId":   msg.OnuId,
-				"pktType": msg.Type,
-			}).Trace("Received OnuPacketIn Message")
-
-			if msg.Type == packetHandlers.EAPOL {
-				eapol.HandleNextPacket(msg.OnuId, msg.IntfId, o.Sn(), o.PortNo, o.InternalState, msg.Packet, stream, client)
-			} else if msg.Type == packetHandlers.DHCP {
-				dhcp.HandleNextBbrPacket(o.ID, o.PonPortID, o.Sn(), o.STag, o.HwAddress, o.DoneChannel, msg.Packet, client)
-			}
-		case DyingGaspIndication:
-			msg, _ := message.Data.(DyingGaspIndicationMessage)
-			o.sendDyingGaspInd(msg, stream)
-		case OmciIndication:
-			msg, _ := message.Data.(OmciIndicationMessage)
-			o.handleOmci(msg, client)
-		case SendEapolFlow:
-			o.sendEapolFlow(client)
-		case SendDhcpFlow:
-			o.sendDhcpFlow(client)
-		default:
-			onuLogger.Warnf("Received unknown message data %v for type %v in OLT Channel", message.Data, message.Type)
+	if done != nil {
+		o.Enqueue(Message{
+			Type: OnuRequest,
+			Data: req,
+		})
+		select {
+		case err := <-req.result:
+			return err
+		case <-done:
+			// NOTE the loop stopped, the change may or may not have been applied
 		}
 	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return req.apply()
 }
 
-func (o *Onu) processOmciMessage(message omcisim.OmciChMessage) {
+// InternalStateEvent fires an event on the ONU InternalState from outside the ONU message loop
+func (o *Onu) InternalStateEvent(event string) error {
+	return o.Do(func() error {
+		return o.InternalState.Event(event)
+	})
+}
+
+func (o *Onu) handleMessage(message Message, stream openolt.Openolt_EnableIndicationServer, client openolt.OpenoltClient) {
+	if stream != nil {
+		stream = pmStream{Openolt_EnableIndicationServer: stream, mib: o.mib}
+	}
+
 	switch message.Type {
-	case omcisim.GemPortAdded:
+	case OnuDiscIndication:
+		msg, _ := message.Data.(OnuDiscIndicationMessage)
+		o.sendOnuDiscIndication(msg, stream)
+	case OnuIndication:
+		msg, _ := message.Data.(OnuIndicationMessage)
+		o.sendOnuIndication(msg, stream)
+	case OMCI:
+		msg, _ := message.Data.(OmciMessage)
+		o.handleOmciMessage(msg, stream)
+	case FlowUpdate:
+		msg, _ := message.Data.(OnuFlowUpdateMessage)
+		o.handleFlowUpdate(msg)
+	case StartEAPOL:
+		log.Infof("Receive StartEAPOL message on ONU Channel")
+		msg, _ := message.Data.(PacketMessage)
+		o.startEapol(msg.UniID, stream)
+	case StartDHCP:
+		log.Infof("Receive StartDHCP message on ONU Channel")
+		msg, _ := message.Data.(PacketMessage)
+		o.startDhcp(msg.UniID, stream)
+	case OnuPacketOut:
+
+		msg, _ := message.Data.(OnuPacketMessage)
+
+		log.WithFields(log.Fields{
+			"IntfId":  msg.IntfId,
+			"OnuId":   msg.OnuId,
+			"PortNo":  msg.PortNo,
+			"pktType": msg.Type,
+		}).Trace("Received OnuPacketOut Message")
+
+		uni := o.getUniByPortNo(msg.PortNo)
+		gemPortId, err := o.getGemPortId(uni)
+		if err != nil {
+			onuLogger.WithFields(log.Fields{
+				"IntfId": o.PonPortID,
+				"OnuId":  o.ID,
+				"OnuSn":  o.Sn(),
+				"UniId":  uni.ID,
+			}).Errorf("Can't retrieve GemPortId, dropping the packet: %s", err)
+			o.mib.DropDownstream()
+			return
+		}
+		o.mib.CountDownstream(gemPortId, msg.Packet.Data())
+
+		if msg.Type == packetHandlers.EAPOL {
+			eapol.HandleNextPacket(msg.OnuId, msg.IntfId, o.Sn(), uni.PortNo, gemPortId, uni.HwAddress, o.UniState(uni), msg.Packet, stream, client)
+		} else if msg.Type == packetHandlers.DHCP {
+			// NOTE here we receive packets going from the DHCP Server to the ONU
+			// for now we expect them to be double-tagged, but ideally the should be single tagged
+			dhcp.HandleNextPacket(o.ID, o.PonPortID, o.Sn(), uni.PortNo, gemPortId, uni.HwAddress, uni.CTag, o.UniState(uni), msg.Packet, stream)
+		}
+	case OnuPacketIn:
+		// NOTE we only receive BBR packets here.
+		// Eapol.HandleNextPacket can handle both BBSim and BBr cases so the call is the same
+		// in the DHCP case VOLTHA only act as a proxy, the behaviour is completely different thus we have a dhcp.HandleNextBbrPacket
+		msg, _ := message.Data.(OnuPacketMessage)
+
 		log.WithFields(log.Fields{
-			"OnuId":  message.Data.OnuId,
-			"IntfId": message.Data.IntfId,
-		}).Infof("GemPort Added")
+			"IntfId":  msg.IntfId,
+			"OnuId":   msg.OnuId,
+			"pktType": msg.Type,
+		}).Trace("Received OnuPacketIn Message")
+
+		// NOTE BBR drives the first UNI only and it only sends packets to BBSim, so the GemPort is not used
+		if msg.Type == packetHandlers.EAPOL {
+			eapol.HandleNextPacket(msg.OnuId, msg.IntfId, o.Sn(), o.Unis[0].PortNo, 0, o.HwAddress, o.InternalState, msg.Packet, stream, client)
+		} else if msg.Type == packetHandlers.DHCP {
+			dhcp.HandleNextBbrPacket(o.ID, o.PonPortID, o.Sn(), o.STag, o.HwAddress, o.DoneChannel, msg.Packet, client)
+		}
+	case DyingGaspIndication:
+		msg, _ := message.Data.(DyingGaspIndicationMessage)
+		o.sendDyingGaspInd(msg, stream)
+	case OmciIndication:
+		msg, _ := message.Data.(OmciIndicationMessage)
+		o.handleOmci(msg, client)
+	case SendEapolFlow:
+		o.sendEapolFlow(client)
+	case SendDhcpFlow:
+		o.sendDhcpFlow(client)
+	case OnuRequest:
+		req, _ := message.Data.(*OnuRequestMessage)
+		req.apply()
+	case PmIntervalEnd:
+		timer, _ := message.Data.(*pmIntervalTimer)
+		o.endPmInterval(timer, stream)
+	case OmciResponse:
+		msg, _ := message.Data.(OmciResponseMessage)
+		_ = o.deliverOmciResponse(msg, stream)
+	default:
+		onuLogger.Warnf("Received unknown message data %v for type %v in OLT Channel", message.Data, message.Type)
+	}
+}
 
-		// NOTE if we receive the GemPort but we don't have EAPOL flows
-		// go an intermediate state, otherwise start auth
-		if o.InternalState.Is("enabled") {
-			if err := o.InternalState.Event("add_gem_port"); err != nil {
-				log.Errorf("Can't go to gem_port_added: %v", err)
-			}
-		} else if o.InternalState.Is("eapol_flow_received") {
-			if err := o.InternalState.Event("start_auth"); err != nil {
-				log.Errorf("Can't go to auth_started: %v", err)
-			}
+// gemPortsChanged is called when the OLT creates or changes via OMCI the entities that tie the GemPorts to the UNIs
+func (o *Onu) gemPortsChanged() {
+	for _, uni := range o.Unis {
+		o.gemPortAdded(uni)
+	}
+}
+
+// gemPortAdded moves an UNI forward once its GemPort is created
+func (o *Onu) gemPortAdded(uni *UniPort) {
+	state := o.UniState(uni)
+	if !state.Is("enabled") && !state.Is("eapol_flow_received") {
+		return
+	}
+	if !o.uniGemPortCreated(uni) {
+		return
+	}
+	gemPortId, _ := o.getGemPortId(uni)
+	log.WithFields(log.Fields{
+		"OnuId":     o.ID,
+		"IntfId":    o.PonPortID,
+		"UniId":     uni.ID,
+		"GemPortId": gemPortId,
+	}).Infof("GemPort Added")
+
+	// If we receive the GemPort but we don't have EAPOL flows
+	// go an intermediate state, otherwise start auth
+	if state.Is("enabled") {
+		if err := state.Event("add_gem_port"); err != nil {
+			log.Errorf("Can't go to gem_port_added: %v", err)
+		}
+	} else if state.Is("eapol_flow_received") {
+		if err := state.Event("start_auth"); err != nil {
+			log.Errorf("Can't go to auth_started: %v", err)
 		}
 	}
 }
 
-func (o *Onu) NewSN(oltid int, intfid uint32, onuid uint32) *openolt.SerialNumber {
+// startEapol sends the EAPOL Start packet of an UNI
+func (o *Onu) startEapol(uniId uint32, stream openolt.Openolt_EnableIndicationServer) {
+	uni, err := o.GetUniById(uniId)
+	if err != nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId": o.PonPortID,
+			"OnuId":  o.ID,
+			"OnuSn":  o.Sn(),
+		}).Errorf("Can't start EAPOL: %s", err)
+		return
+	}
 
-	sn := new(openolt.SerialNumber)
+	gemPortId, err := o.getGemPortId(uni)
+	if err != nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId": o.PonPortID,
+			"OnuId":  o.ID,
+			"OnuSn":  o.Sn(),
+			"UniId":  uni.ID,
+		}).Errorf("Can't retrieve GemPortId: %s", err)
+		if err := o.UniState(uni).Event("auth_failed"); err != nil {
+			log.Errorf("Can't go to auth_failed: %v", err)
+		}
+		return
+	}
+
+	eapol.SendEapStart(o.ID, o.PonPortID, o.Sn(), uni.PortNo, gemPortId, uni.HwAddress, o.UniState(uni), stream)
+}
 
-	//sn = new(openolt.SerialNumber)
-	sn.VendorId = []byte("BBSM")
-	sn.VendorSpecific = []byte{0, byte(oltid % 256), byte(intfid), byte(onuid)}
+// startDhcp sends the DHCP Discovery packet of an UNI
+func (o *Onu) startDhcp(uniId uint32, stream openolt.Openolt_EnableIndicationServer) {
+	uni, err := o.GetUniById(uniId)
+	if err != nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId": o.PonPortID,
+			"OnuId":  o.ID,
+			"OnuSn":  o.Sn(),
+		}).Errorf("Can't start DHCP: %s", err)
+		return
+	}
 
-	return sn
+	gemPortId, err := o.getGemPortId(uni)
+	if err != nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId": o.PonPortID,
+			"OnuId":  o.ID,
+			"OnuSn":  o.Sn(),
+			"UniId":  uni.ID,
+		}).Errorf("Can't retrieve GemPortId: %s", err)
+		if err := o.UniState(uni).Event("dhcp_failed"); err != nil {
+			log.Errorf("Can't go to dhcp_failed: %v", err)
+		}
+		return
+	}
+
+	dhcp.SendDHCPDiscovery(o.PonPortID, o.ID, o.Sn(), uni.PortNo, gemPortId, o.UniState(uni), uni.HwAddress, uni.CTag, stream)
 }
 
 // NOTE handle_/process methods can change the ONU internal state as they are receiving messages
@@ -391,11 +704,6 @@ func (o *Onu) sendOnuDiscIndication(msg OnuDiscIndicationMessage, stream openolt
 }
 
 func (o *Onu) sendOnuIndication(msg OnuIndicationMessage, stream openolt.Openolt_EnableIndicationServer) {
-	// NOTE voltha returns an ID, but if we use that ID then it complains:
-	// expected_onu_id: 1, received_onu_id: 1024, event: ONU-id-mismatch, can happen if both voltha and the olt rebooted
-	// so we're using the internal ID that is 1
-	// o.ID = msg.OnuID
-
 	indData := &openolt.Indication_OnuInd{OnuInd: &openolt.OnuIndication{
 		IntfId:       o.PonPortID,
 		OnuId:        o.ID,
@@ -417,6 +725,29 @@ func (o *Onu) sendOnuIndication(msg OnuIndicationMessage, stream openolt.Openolt
 
 }
 
+// sendOmciIndication sends an OMCI message to the OLT
+func (o *Onu) sendOmciIndication(pkt []byte, stream openolt.Openolt_EnableIndicationServer) error {
+	indication := &openolt.Indication_OmciInd{OmciInd: &openolt.OmciIndication{
+		IntfId: o.PonPortID,
+		OnuId:  o.ID,
+		Pkt:    pkt,
+	}}
+	if err := stream.Send(&openolt.Indication{Data: indication}); err != nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId":       o.PonPortID,
+			"SerialNumber": o.Sn(),
+			"omciPacket":   pkt,
+		}).Errorf("send omci indication failed: %v", err)
+		return err
+	}
+	onuLogger.WithFields(log.Fields{
+		"IntfId":       o.PonPortID,
+		"SerialNumber": o.Sn(),
+		"omciPacket":   pkt,
+	}).Tracef("Sent OMCI message")
+	return nil
+}
+
 func (o *Onu) handleOmciMessage(msg OmciMessage, stream openolt.Openolt_EnableIndicationServer) {
 
 	onuLogger.WithFields(log.Fields{
@@ -425,60 +756,195 @@ func (o *Onu) handleOmciMessage(msg OmciMessage, stream openolt.Openolt_EnableIn
 		"omciPacket":   msg.omciMsg.Pkt,
 	}).Tracef("Received OMCI message")
 
-	var omciInd openolt.OmciIndication
-	respPkt, err := omcisim.OmciSim(o.PonPortID, o.ID, HexDecode(msg.omciMsg.Pkt))
+	faults, _ := o.currentOmciFaults()
+	var rnd *rand.Rand
+	if faults.Enabled() {
+		rnd = o.random()
+	}
+	if faults.Silent || faults.Happens(rnd, faults.DropRate) {
+		onuLogger.WithFields(log.Fields{
+			"IntfId":       o.PonPortID,
+			"SerialNumber": o.Sn(),
+			"omciPacket":   msg.omciMsg.Pkt,
+		}).Debug("Dropping OMCI message, as requested")
+		return
+	}
+
+	pkt := HexDecode(msg.omciMsg.Pkt)
+	var resp *omcisim.Response
+	var err error
+	if faults.Happens(rnd, faults.ErrorRate) {
+		resp, err = o.mib.ErrorResponse(pkt, faults.Result)
+	} else {
+		resp, err = o.mib.HandleRequest(pkt)
+	}
 	if err != nil {
 		onuLogger.WithFields(log.Fields{
 			"IntfId":       o.PonPortID,
 			"SerialNumber": o.Sn(),
-			"omciPacket":   omciInd.Pkt,
+			"omciPacket":   msg.omciMsg.Pkt,
 			"msg":          msg,
 		}).Errorf("Error handling OMCI message %v", msg)
 		return
 	}
-
-	omciInd.IntfId = o.PonPortID
-	omciInd.OnuId = o.ID
-	omciInd.Pkt = respPkt
-
-	omci := &openolt.Indication_OmciInd{OmciInd: &omciInd}
-	if err := stream.Send(&openolt.Indication{Data: omci}); err != nil {
+	if resp.Pkt == nil {
+		// NOTE eg: the download sections that are not the last one of a window
 		onuLogger.WithFields(log.Fields{
 			"IntfId":       o.PonPortID,
 			"SerialNumber": o.Sn(),
-			"omciPacket":   omciInd.Pkt,
-			"msg":          msg,
-		}).Errorf("send omcisim indication failed: %v", err)
+			"MessageType":  resp.MessageType,
+		}).Trace("OMCI message not answered")
+		return
+	}
+
+	if err := o.sendOmciResponse(resp.Pkt, faults, stream); err != nil {
+		return
+	}
+
+	if (resp.MessageType == omci.CreateRequestType || resp.MessageType == omci.SetRequestType) && resp.Result == me.Success {
+		switch resp.EntityClass {
+		case me.GemPortNetworkCtpClassId, me.GemInterworkingTerminationPointClassId,
+			me.Ieee8021PMapperServiceProfileClassId, me.MacBridgePortConfigurationDataClassId:
+			o.gemPortsChanged()
+		}
+	}
+	if resp.MessageType == omci.SynchronizeTimeRequestType && resp.Result == me.Success {
+		o.startPmIntervals()
+	}
+	if resp.Reboot {
+		o.reboot()
+	}
+}
+
+// reboot emulates the reboot requested via OMCI (eg: to activate a software image) once the response is sent:
+// the ONU goes down, it loses the entities the OLT created and it comes back after the reboot delay
+func (o *Onu) reboot() {
+	if err := o.InternalState.Event("disable"); err != nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId":        o.PonPortID,
+			"SerialNumber":  o.Sn(),
+			"InternalState": o.InternalState.Current(),
+		}).Errorf("Cannot reboot the ONU: %v", err)
 		return
 	}
 	onuLogger.WithFields(log.Fields{
 		"IntfId":       o.PonPortID,
 		"SerialNumber": o.Sn(),
-		"omciPacket":   omciInd.Pkt,
-	}).Tracef("Sent OMCI message")
+		"RebootDelay":  o.rebootDelay,
+	}).Info("Rebooting ONU")
+	o.HasGemPort = false
+	o.mib.Reset()
+	o.stopPmIntervals()
+
+	time.AfterFunc(o.rebootDelay, func() {
+		err := o.Do(func() error {
+			// NOTE the ONU may have been disabled (or removed) in the meantime
+			if o.unplugged || o.InternalState.Current() != "disabled" {
+				return nil
+			}
+			return o.InternalState.Event("enable")
+		})
+		if err != nil {
+			onuLogger.WithFields(log.Fields{
+				"IntfId":       o.PonPortID,
+				"SerialNumber": o.Sn(),
+			}).Errorf("Cannot bring the ONU back after the reboot: %v", err)
+		}
+	})
+}
+
+// SoftwareImages returns the state of the software images of the ONU and of the last download, if there is one
+func (o *Onu) SoftwareImages() ([2]omcisim.SoftwareImage, *omcisim.ImageDownload, omcisim.DownloadFailure) {
+	var images [2]omcisim.SoftwareImage
+	var download *omcisim.ImageDownload
+	var failure omcisim.DownloadFailure
+	_ = o.Do(func() error {
+		images = o.mib.Images()
+		if d, ok := o.mib.Download(); ok {
+			download = &d
+		}
+		failure = o.mib.DownloadFailure()
+		return nil
+	})
+	return images, download, failure
+}
+
+// SetDownloadFailure injects a failure in the software downloads of the ONU, until it is set to NoFailure
+func (o *Onu) SetDownloadFailure(failure omcisim.DownloadFailure) {
+	_ = o.Do(func() error {
+		o.mib.SetDownloadFailure(failure)
+		return nil
+	})
 }
 
-func (o *Onu) storePortNumber(portNo uint32) {
-	// NOTE this needed only as long as we don't support multiple UNIs
-	// we need to add support for multiple UNIs
-	// the action plan is:
-	// - refactor the omcisim-sim library to use https://github.com/cboling/omci instead of canned messages
-	// - change the library so that it reports a single UNI and remove this workaroung
-	// - add support for multiple UNIs in BBSim
-	if o.PortNo == 0 || portNo < o.PortNo {
+func (o *Onu) storePortNumber(uni *UniPort, portNo uint32) {
+	if uni.PortNo != portNo {
 		onuLogger.WithFields(log.Fields{
 			"IntfId":       o.PonPortID,
 			"OnuId":        o.ID,
+			"UniId":        uni.ID,
 			"SerialNumber": o.Sn(),
-			"OnuPortNo":    o.PortNo,
+			"UniPortNo":    uni.PortNo,
 			"FlowPortNo":   portNo,
-		}).Debug("Storing ONU portNo")
-		o.PortNo = portNo
+		}).Debug("Storing UNI portNo")
+		uni.PortNo = portNo
+	}
+}
+
+// SetID gives the ONU the ID VOLTHA assigned to it, it fails if another ONU on the same PON is using it
+func (o *Onu) SetID(id uint32) error {
+	if o.index == nil {
+		o.ID = id
+		return nil
+	}
+	return o.index.assignId(o, id)
+}
+
+// releaseID frees the ID VOLTHA assigned to the ONU, eg: once it's deleted
+func (o *Onu) releaseID() {
+	if o.index != nil {
+		o.index.releaseId(o)
+	}
+}
+
+// reset clears everything the ONU learned after being activated (flows, GemPorts and OMCI state),
+// so that it can go through the activation process again
+func (o *Onu) reset() {
+	onuLogger.WithFields(log.Fields{
+		"IntfId":       o.PonPortID,
+		"OnuId":        o.ID,
+		"SerialNumber": o.Sn(),
+	}).Debug("Resetting ONU")
+
+	for _, uni := range o.Unis {
+		uni.reset()
 	}
+	o.uniLifecycleEvent("initialize")
+	o.HasGemPort = false
+	o.tid = 0x1
+	o.hpTid = 0x8000
+	o.seqNumber = 0
+	o.TechProfile.Clear()
+
+	// NOTE dropping the entities the OLT created forces a new MIB upload and GemPort creation
+	o.mib.Reset()
+	o.stopPmIntervals()
+	o.heldOmciResponse = nil
 }
 
-func (o *Onu) SetID(id uint32) {
-	o.ID = id
+// hasGemPort checks whether a GemPort has been created on a UNI of the ONU,
+// either via the TrafficQueues or, if VOLTHA did not send any, via OMCI and bridged to the UNI
+func (o *Onu) hasGemPort(uniId uint32, gemPortId uint32) bool {
+	if o.TechProfile.hasQueues(uniId) {
+		return o.TechProfile.hasGemPort(uniId, gemPortId)
+	}
+
+	for _, gem := range o.mib.UniGemPorts(uniId) {
+		if gem == gemPortId {
+			return true
+		}
+	}
+	return false
 }
 
 func (o *Onu) handleFlowUpdate(msg OnuFlowUpdateMessage) {
@@ -498,30 +964,37 @@ func (o *Onu) handleFlowUpdate(msg OnuFlowUpdateMessage) {
 		"UniID":     msg.Flow.UniId,
 	}).Debug("ONU receives Flow")
 
-	if msg.Flow.UniId != 0 {
-		// as of now BBSim only support a single UNI, so ignore everything that is not targeted to it
+	uni, err := o.GetUniById(uint32(msg.Flow.UniId))
+	if err != nil {
 		onuLogger.WithFields(log.Fields{
 			"IntfId":       o.PonPortID,
 			"OnuId":        o.ID,
 			"SerialNumber": o.Sn(),
-		}).Debug("Ignoring flow as it's not for the first UNI")
+			"UniID":        msg.Flow.UniId,
+		}).Debug("Ignoring flow as the UNI does not exist")
 		return
 	}
+	state := o.UniState(uni)
 
 	if msg.Flow.Classifier.EthType == uint32(layers.EthernetTypeEAPOL) && msg.Flow.Classifier.OVid == 4091 {
-		// NOTE storing the PortNO, it's needed when sending PacketIndications
-		o.storePortNumber(uint32(msg.Flow.PortNo))
+		// NOTE storing the PortNO and the GemPort, they are needed when sending PacketIndications
+		o.storePortNumber(uni, uint32(msg.Flow.PortNo))
+		if msg.Flow.GemportId > 0 {
+			uni.GemPortId = uint32(msg.Flow.GemportId)
+		}
 
 		// NOTE if we receive the EAPOL flows but we don't have GemPorts
 		// go an intermediate state, otherwise start auth
-		if o.InternalState.Is("enabled") {
-			if err := o.InternalState.Event("receive_eapol_flow"); err != nil {
+		if state.Is("enabled") {
+			if err := state.Event("receive_eapol_flow"); err != nil {
 				log.Warnf("Can't go to eapol_flow_received: %v", err)
 			}
-		} else if o.InternalState.Is("gem_port_added") {
+			// NOTE the GemPort of the flow may have been created before it
+			o.gemPortAdded(uni)
+		} else if state.Is("gem_port_added") {
 
 			if o.Auth == true {
-				if err := o.InternalState.Event("start_auth"); err != nil {
+				if err := state.Event("start_auth"); err != nil {
 					log.Warnf("Can't go to auth_started: %v", err)
 				}
 			} else {
@@ -538,11 +1011,11 @@ func (o *Onu) handleFlowUpdate(msg OnuFlowUpdateMessage) {
 		msg.Flow.Classifier.DstPort == uint32(67) {
 
 		// keep track that we reveived the DHCP Flows so that we can transition the state to dhcp_started
-		o.DhcpFlowReceived = true
+		uni.DhcpFlowReceived = true
 
 		if o.Dhcp == true {
 			// NOTE we are receiving mulitple DHCP flows but we shouldn't call the transition multiple times
-			if err := o.InternalState.Event("start_dhcp"); err != nil {
+			if err := state.Event("start_dhcp"); err != nil {
 				log.Errorf("Can't go to dhcp_started: %v", err)
 			}
 		} else {
@@ -640,13 +1113,15 @@ func (o *Onu) handleOmci(msg OmciIndicationMessage, client openolt.OpenoltClient
 		mibUpload, _ := omcilib.CreateMibUploadRequest(o.getNextTid(false))
 		sendOmciMsg(mibUpload, o.PonPortID, o.ID, o.SerialNumber, "mibUpload", client)
 	case omci.MibUploadResponseType:
+		// NOTE the number of commands depends on the number of UNIs BBSim emulates
+		o.mibUploadCommands = uint16(msg.OmciInd.Pkt[8])<<8 | uint16(msg.OmciInd.Pkt[9])
 		mibUploadNext, _ := omcilib.CreateMibUploadNextRequest(o.getNextTid(false), o.seqNumber)
 		sendOmciMsg(mibUploadNext, o.PonPortID, o.ID, o.SerialNumber, "mibUploadNext", client)
 	case omci.MibUploadNextResponseType:
 		o.seqNumber++
 
-		if o.seqNumber > 290 {
-			// NOTE we are done with the MIB Upload (290 is the number of messages the omci-sim library will respond to)
+		if o.seqNumber >= o.mibUploadCommands {
+			// NOTE we are done with the MIB Upload
 			galEnet, _ := omcilib.CreateGalEnetRequest(o.getNextTid(false))
 			sendOmciMsg(galEnet, o.PonPortID, o.ID, o.SerialNumber, "CreateGalEnetRequest", client)
 		} else {
@@ -678,6 +1153,25 @@ func (o *Onu) handleOmci(msg OmciIndicationMessage, client openolt.OpenoltClient
 	}
 }
 
+const (
+	eapolFlowOffset = 0
+	dhcpFlowOffset  = 1
+)
+
+// bbrFlowId generates a FlowId that is unique across all the ONUs on all the PONs, as the OLT rejects
+// flows that are already installed. The ONU ID takes as many bits as the end of the ONU ID range,
+// at least 8 so that the flows of the default ranges fit in the default FlowId range
+func (o *Onu) bbrFlowId(offset uint32) (uint32, error) {
+	onuBits := bits.Len32(o.PonPort.Olt.DeviceInfo.OnuIdRange.End)
+	if onuBits < 8 {
+		onuBits = 8
+	}
+	if bits.Len32(o.ID) > onuBits || bits.Len32(o.PonPortID)+onuBits+1 > 32 {
+		return 0, fmt.Errorf("onu-id-%d-on-pon-%d-does-not-fit-in-a-flow-id", o.ID, o.PonPortID)
+	}
+	return (o.PonPortID<<uint(onuBits)|o.ID)<<1 | offset, nil
+}
+
 func (o *Onu) sendEapolFlow(client openolt.OpenoltClient) {
 
 	classifierProto := openolt.Classifier{
@@ -687,11 +1181,20 @@ func (o *Onu) sendEapolFlow(client openolt.OpenoltClient) {
 
 	actionProto := openolt.Action{}
 
+	flowId, err := o.bbrFlowId(eapolFlowOffset)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"IntfId":       o.PonPortID,
+			"OnuId":        o.ID,
+			"SerialNumber": common.OnuSnToString(o.SerialNumber),
+		}).Fatalf("Cannot send EAPOL Flow: %v", err)
+	}
+
 	downstreamFlow := openolt.Flow{
 		AccessIntfId:  int32(o.PonPortID),
 		OnuId:         int32(o.ID),
-		UniId:         int32(0), // NOTE do not hardcode this, we need to support multiple UNIs
-		FlowId:        uint32(o.ID),
+		UniId:         int32(0), // NOTE BBR only drives the first UNI
+		FlowId:        flowId,
 		FlowType:      "downstream",
 		AllocId:       int32(0),
 		NetworkIntfId: int32(0),
@@ -730,11 +1233,20 @@ func (o *Onu) sendDhcpFlow(client openolt.OpenoltClient) {
 
 	actionProto := openolt.Action{}
 
+	flowId, err := o.bbrFlowId(dhcpFlowOffset)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"IntfId":       o.PonPortID,
+			"OnuId":        o.ID,
+			"SerialNumber": common.OnuSnToString(o.SerialNumber),
+		}).Fatalf("Cannot send DHCP Flow: %v", err)
+	}
+
 	downstreamFlow := openolt.Flow{
 		AccessIntfId:  int32(o.PonPortID),
 		OnuId:         int32(o.ID),
-		UniId:         int32(0), // FIXME do not hardcode this
-		FlowId:        uint32(o.ID),
+		UniId:         int32(0), // NOTE BBR only drives the first UNI
+		FlowId:        flowId,
 		FlowType:      "downstream",
 		AllocId:       int32(0),
 		NetworkIntfId: int32(0),
@@ -19,6 +19,7 @@ package devices
 import (
 	"github.com/google/gopacket/layers"
 	"github.com/looplab/fsm"
+	"github.com/opencord/bbsim/internal/common"
 	"github.com/opencord/voltha-protos/go/openolt"
 	"gotest.tools/assert"
 	"testing"
@@ -40,11 +41,40 @@ func Test_Onu_SendEapolFlow(t *testing.T) {
 	assert.Equal(t, client.FlowAddSpy.Calls[1].AccessIntfId, int32(onu.PonPortID))
 	assert.Equal(t, client.FlowAddSpy.Calls[1].OnuId, int32(onu.ID))
 	assert.Equal(t, client.FlowAddSpy.Calls[1].UniId, int32(0))
-	assert.Equal(t, client.FlowAddSpy.Calls[1].FlowId, onu.ID)
+	flowId, _ := onu.bbrFlowId(eapolFlowOffset)
+	assert.Equal(t, client.FlowAddSpy.Calls[1].FlowId, flowId)
 	assert.Equal(t, client.FlowAddSpy.Calls[1].FlowType, "downstream")
 	assert.Equal(t, client.FlowAddSpy.Calls[1].PortNo, onu.ID)
 }
 
+func Test_Onu_BbrFlowId(t *testing.T) {
+	deviceInfo := common.DefaultDeviceInfo()
+	deviceInfo.OnuIdRange = common.IdRange{Start: 1, End: 1023}
+	first := createMockOnu(256, 0, 900, 900, false, false)
+	first.PonPort.Olt.DeviceInfo = deviceInfo
+	second := createMockOnu(1, 2, 900, 900, false, false)
+	second.PonPort.Olt.DeviceInfo = deviceInfo
+
+	// the ONU IDs above 255 don't overlap with the PON bits
+	firstId, err := first.bbrFlowId(eapolFlowOffset)
+	assert.NilError(t, err)
+	secondId, err := second.bbrFlowId(eapolFlowOffset)
+	assert.NilError(t, err)
+	assert.Equal(t, firstId, uint32(512))
+	assert.Equal(t, secondId, uint32(2<<10|1)<<1)
+
+	// the IDs out of the ONU ID range could collide, so they are rejected
+	second.ID = 1024
+	_, err = second.bbrFlowId(eapolFlowOffset)
+	assert.Error(t, err, "onu-id-1024-on-pon-2-does-not-fit-in-a-flow-id")
+
+	// the default ranges give the same IDs as before
+	onu := createMockOnu(3, 1, 900, 900, false, false)
+	flowId, err := onu.bbrFlowId(dhcpFlowOffset)
+	assert.NilError(t, err)
+	assert.Equal(t, flowId, uint32(1<<8|3)<<1|1)
+}
+
 // validates that when an ONU receives an EAPOL flow for UNI 0
 // it transition to auth_started state
 func Test_HandleFlowUpdateEapolFromGem(t *testing.T) {
@@ -86,7 +116,7 @@ func Test_HandleFlowUpdateEapolFromGem(t *testing.T) {
 	assert.Equal(t, onu.InternalState.Current(), "auth_started")
 }
 
-// validates that when an ONU receives an EAPOL flow for UNI that is not 0
+// validates that when an ONU receives an EAPOL flow for an UNI it does not have
 // no action is taken
 func Test_HandleFlowUpdateEapolFromGemIgnore(t *testing.T) {
 
@@ -168,7 +198,7 @@ func Test_HandleFlowUpdateEapolFromEnabled(t *testing.T) {
 	assert.Equal(t, onu.InternalState.Current(), "eapol_flow_received")
 }
 
-// validates that when an ONU receives an EAPOL flow for UNI that is not 0
+// validates that when an ONU receives an EAPOL flow for an UNI it does not have
 // no action is taken
 func Test_HandleFlowUpdateEapolFromEnabledIgnore(t *testing.T) {
 
@@ -286,7 +316,7 @@ func Test_HandleFlowUpdateDhcp(t *testing.T) {
 
 	onu.handleFlowUpdate(msg)
 	assert.Equal(t, onu.InternalState.Current(), "dhcp_started")
-	assert.Equal(t, onu.DhcpFlowReceived, true)
+	assert.Equal(t, onu.Unis[0].DhcpFlowReceived, true)
 }
 
 func Test_HandleFlowUpdateDhcpNoDhcp(t *testing.T) {
@@ -326,5 +356,44 @@ func Test_HandleFlowUpdateDhcpNoDhcp(t *testing.T) {
 
 	onu.handleFlowUpdate(msg)
 	assert.Equal(t, onu.InternalState.Current(), "eap_response_success_received")
-	assert.Equal(t, onu.DhcpFlowReceived, true)
+	assert.Equal(t, onu.Unis[0].DhcpFlowReceived, true)
+}
+
+// validates that the flows of an UNI that is not the first one
+// drive the state machine of that UNI only
+func Test_HandleFlowUpdateEapolSecondUni(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+	onu.InternalState.SetState("enabled")
+	onu.Unis[1].InternalState.SetState("enabled")
+
+	flow := openolt.Flow{
+		AccessIntfId:  int32(onu.PonPortID),
+		OnuId:         int32(onu.ID),
+		UniId:         int32(1),
+		FlowId:        uint32(onu.ID),
+		FlowType:      "downstream",
+		AllocId:       int32(1024),
+		NetworkIntfId: int32(0),
+		GemportId:     int32(1025),
+		Classifier: &openolt.Classifier{
+			EthType: uint32(layers.EthernetTypeEAPOL),
+			OVid:    4091,
+		},
+		Action:   &openolt.Action{},
+		Priority: int32(100),
+		PortNo:   uint32(17),
+	}
+
+	msg := OnuFlowUpdateMessage{
+		PonPortID: 1,
+		OnuID:     1,
+		Flow:      &flow,
+	}
+
+	onu.handleFlowUpdate(msg)
+	assert.Equal(t, onu.Unis[1].InternalState.Current(), "eapol_flow_received")
+	assert.Equal(t, onu.Unis[1].PortNo, uint32(17))
+	assert.Equal(t, onu.Unis[1].GemPortId, uint32(1025))
+	assert.Equal(t, onu.InternalState.Current(), "enabled")
+	assert.Equal(t, onu.Unis[0].PortNo, uint32(0))
 }
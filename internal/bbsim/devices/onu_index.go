@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+)
+
+type uniRef struct {
+	onu *Onu
+	uni *UniPort
+}
+
+// onuIndex keeps the ONUs of a PON indexed by Serial Number, ID and UNI Mac Address,
+// so that the lookups done for every packet and OMCI message don't have to scan all the ONUs
+type onuIndex struct {
+	mu   sync.RWMutex
+	bySn map[string]*Onu
+	byId map[uint32]*Onu
+	// assigned are the IDs VOLTHA assigned to the ONUs it activated,
+	// the other ones are the IDs the ONUs were created with
+	assigned map[uint32]bool
+	byMac    map[string]uniRef
+}
+
+func newOnuIndex() *onuIndex {
+	return &onuIndex{
+		bySn:     make(map[string]*Onu),
+		byId:     make(map[uint32]*Onu),
+		assigned: make(map[uint32]bool),
+		byMac:    make(map[string]uniRef),
+	}
+}
+
+// add indexes the ONU, the caller holds i.mu
+func (i *onuIndex) add(onu *Onu) {
+	i.bySn[onu.Sn()] = onu
+	if _, ok := i.byId[onu.ID]; !ok {
+		i.byId[onu.ID] = onu
+	}
+	for _, uni := range onu.Unis {
+		i.byMac[string(uni.HwAddress)] = uniRef{onu: onu, uni: uni}
+	}
+	onu.index = i
+}
+
+// remove drops the ONU from the index, the caller holds i.mu
+func (i *onuIndex) remove(onu *Onu) {
+	if i.bySn[onu.Sn()] == onu {
+		delete(i.bySn, onu.Sn())
+	}
+	if i.byId[onu.ID] == onu {
+		delete(i.byId, onu.ID)
+		delete(i.assigned, onu.ID)
+	}
+	for _, uni := range onu.Unis {
+		if i.byMac[string(uni.HwAddress)].onu == onu {
+			delete(i.byMac, string(uni.HwAddress))
+		}
+	}
+}
+
+// assignId gives the ONU the ID chosen by VOLTHA, it fails if the ID is assigned to another ONU
+func (i *onuIndex) assignId(onu *Onu, id uint32) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// NOTE VOLTHA does not know the IDs the ONUs that are not active yet were created with,
+	// so it can assign them to other ONUs. Those ONUs can't be found by ID until they are activated
+	if owner, ok := i.byId[id]; ok && owner != onu && i.assigned[id] {
+		return fmt.Errorf("onu-id-%d-is-already-assigned-to-%s", id, owner.Sn())
+	}
+
+	if i.byId[onu.ID] == onu {
+		delete(i.byId, onu.ID)
+		delete(i.assigned, onu.ID)
+	}
+	onu.ID = id
+	i.byId[id] = onu
+	i.assigned[id] = true
+	return nil
+}
+
+// releaseId frees the ID VOLTHA assigned to the ONU so that it can be assigned to another one,
+// the ONU can't be found by ID until it is activated again
+func (i *onuIndex) releaseId(onu *Onu) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.byId[onu.ID] == onu && i.assigned[onu.ID] {
+		delete(i.byId, onu.ID)
+		delete(i.assigned, onu.ID)
+	}
+}
+
+// hasAssignedId returns true if the ONU holds an ID assigned by VOLTHA, ie: the flows can refer to it
+func (i *onuIndex) hasAssignedId(onu *Onu) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.byId[onu.ID] == onu && i.assigned[onu.ID]
+}
+
+// has returns true if the ONU is still on the PON, eg: it was not removed
+func (i *onuIndex) has(onu *Onu) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.bySn[onu.Sn()] == onu
+}
+
+func (i *onuIndex) getBySn(sn string) (*Onu, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	onu, ok := i.bySn[sn]
+	return onu, ok
+}
+
+func (i *onuIndex) getById(id uint32) (*Onu, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	onu, ok := i.byId[id]
+	return onu, ok
+}
+
+func (i *onuIndex) getByMac(mac net.HardwareAddr) (uniRef, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	ref, ok := i.byMac[string(mac)]
+	return ref, ok
+}
+
+// poolUser is an UNI that uses an ID of a pool, eg: an AllocId or a GemPort
+type poolUser struct {
+	onu   *Onu
+	uniId uint32
+}
+
+// poolIndex keeps the UNIs using the IDs of a pool, so that checking whether an ID is already in use
+// doesn't have to scan all the ONUs of the PONs sharing the pool.
+// The users are added when VOLTHA creates the T-CONTs or GemPorts and removed along with them or with the ONU.
+// NOTE the lookups still check that a user has the ID and drop the ones that don't,
+// eg: when the ONU is reset as the OLT reboots
+type poolIndex struct {
+	mu    sync.Mutex
+	users map[uint32][]poolUser
+}
+
+func newPoolIndex() *poolIndex {
+	return &poolIndex{
+		users: make(map[uint32][]poolUser),
+	}
+}
+
+// add records that an UNI uses the ID
+func (i *poolIndex) add(id uint32, onu *Onu, uniId uint32) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	user := poolUser{onu: onu, uniId: uniId}
+	for _, u := range i.users[id] {
+		if u == user {
+			return
+		}
+	}
+	i.users[id] = append(i.users[id], user)
+}
+
+// remove records that an UNI does not use the ID anymore
+func (i *poolIndex) remove(id uint32, onu *Onu, uniId uint32) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.removeUsers(id, func(u poolUser) bool {
+		return u.onu == onu && u.uniId == uniId
+	})
+}
+
+// removeOnu drops the ONU from the users of all the IDs
+func (i *poolIndex) removeOnu(onu *Onu) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for id := range i.users {
+		i.removeUsers(id, func(u poolUser) bool {
+			return u.onu == onu
+		})
+	}
+}
+
+// removeUsers must be called with the lock held
+func (i *poolIndex) removeUsers(id uint32, match func(user poolUser) bool) {
+	users := []poolUser{}
+	for _, u := range i.users[id] {
+		if !match(u) {
+			users = append(users, u)
+		}
+	}
+	if len(users) == 0 {
+		delete(i.users, id)
+	} else {
+		i.users[id] = users
+	}
+}
+
+// get returns the UNIs that use the ID, inUse tells whether a user still has it
+func (i *poolIndex) get(id uint32, inUse func(user poolUser) bool) []poolUser {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	users := []poolUser{}
+	for _, u := range i.users[id] {
+		if u.onu.index != nil && u.onu.index.has(u.onu) && inUse(u) {
+			users = append(users, u)
+		}
+	}
+	if len(users) == 0 {
+		delete(i.users, id)
+	} else {
+		i.users[id] = users
+	}
+	return users
+}
+
+// poolKey identifies a pool: the dedicated ones by PON, the shared ones by their range
+type poolKey struct {
+	poolType openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType
+	shared   bool
+	intfId   uint32
+	idRange  common.IdRange
+}
+
+// poolIndexes keeps the index of each pool of the OLT, they are created when first used
+type poolIndexes struct {
+	mu    sync.Mutex
+	pools map[poolKey]*poolIndex
+}
+
+func newPoolIndexes() *poolIndexes {
+	return &poolIndexes{
+		pools: make(map[poolKey]*poolIndex),
+	}
+}
+
+func (p *poolIndexes) get(key poolKey) *poolIndex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool, ok := p.pools[key]
+	if !ok {
+		pool = newPoolIndex()
+		p.pools[key] = pool
+	}
+	return pool
+}
+
+// removeOnu drops the ONU from all the pools, eg: when it's deleted
+func (p *poolIndexes) removeOnu(onu *Onu) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pool := range p.pools {
+		pool.removeOnu(onu)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gotest.tools/assert"
+)
+
+func Test_Onu_DoWithoutLoop(t *testing.T) {
+	onu := createTestOnu()
+
+	// without a message loop the change is applied in place
+	err := onu.InternalStateEvent("discover")
+	assert.NilError(t, err)
+	assert.Equal(t, onu.InternalState.Current(), "discovered")
+
+	err = onu.InternalStateEvent("start_auth")
+	assert.ErrorContains(t, err, "inappropriate in current state discovered")
+}
+
+func Test_Onu_DoIsSerializedWithTheLoop(t *testing.T) {
+	onu := createTestOnu()
+	onu.InternalState.SetState("enabled")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 100)}
+	go onu.ProcessOnuMessages(ctx, stream, nil)
+
+	// wait for the loop to start
+	for {
+		onu.mailboxLock.Lock()
+		started := onu.loopDone != nil
+		onu.mailboxLock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// NOTE the counter is not protected, the race detector complains if the changes are not serialized
+	counter := 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := onu.Do(func() error {
+				counter++
+				return nil
+			})
+			assert.NilError(t, err)
+		}()
+	}
+
+	// the changes are interleaved with the messages the ONU receives
+	onu.Enqueue(Message{
+		Type: OnuIndication,
+		Data: OnuIndicationMessage{OperState: UP},
+	})
+
+	wg.Wait()
+	assert.Equal(t, counter, 50)
+
+	ind := <-stream.indications
+	assert.Equal(t, ind.GetOnuInd().OperState, "up")
+
+	err := onu.InternalStateEvent("disable")
+	assert.NilError(t, err)
+	assert.Equal(t, onu.InternalState.Current(), "disabled")
+}
+
+func Test_Onu_DoAfterTheLoopStops(t *testing.T) {
+	onu := createTestOnu()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan bool)
+	go func() {
+		onu.ProcessOnuMessages(ctx, nil, nil)
+		done <- true
+	}()
+	cancel()
+	<-done
+
+	err := onu.InternalStateEvent("discover")
+	assert.NilError(t, err)
+	assert.Equal(t, onu.InternalState.Current(), "discovered")
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// NOTE the OMCI faults are either the global ones, that apply to all the ONUs,
+// or the ones of an ONU, that replace the global ones for that ONU only
+
+var (
+	globalOmciFaultsLock sync.RWMutex
+	globalOmciFaults     common.OmciFaults
+)
+
+// SetGlobalOmciFaults sets the OMCI faults injected in the ONUs that don't have their own
+func SetGlobalOmciFaults(faults common.OmciFaults) {
+	onuLogger.WithFields(log.Fields{
+		"Faults": faults,
+	}).Info("Setting the global OMCI faults")
+
+	globalOmciFaultsLock.Lock()
+	defer globalOmciFaultsLock.Unlock()
+	globalOmciFaults = faults
+}
+
+// GlobalOmciFaults returns the OMCI faults injected in the ONUs that don't have their own
+func GlobalOmciFaults() common.OmciFaults {
+	globalOmciFaultsLock.RLock()
+	defer globalOmciFaultsLock.RUnlock()
+	return globalOmciFaults
+}
+
+// SetOmciFaults sets the OMCI faults injected in the ONU, nil makes it use the global ones again
+func (o *Onu) SetOmciFaults(faults *common.OmciFaults) {
+	onuLogger.WithFields(log.Fields{
+		"IntfId":       o.PonPortID,
+		"SerialNumber": o.Sn(),
+		"Faults":       faults,
+	}).Info("Setting the ONU OMCI faults")
+
+	_ = o.Do(func() error {
+		o.omciFaults = faults
+		return nil
+	})
+}
+
+// OmciFaults returns the OMCI faults injected in the ONU, global is true if the ONU has none of its own
+func (o *Onu) OmciFaults() (faults common.OmciFaults, global bool) {
+	_ = o.Do(func() error {
+		faults, global = o.currentOmciFaults()
+		return nil
+	})
+	return faults, global
+}
+
+func (o *Onu) currentOmciFaults() (common.OmciFaults, bool) {
+	if o.omciFaults != nil {
+		return *o.omciFaults, false
+	}
+	return GlobalOmciFaults(), true
+}
+
+// random returns the random generator of the ONU, it is created only for the ONUs with faults
+func (o *Onu) random() *rand.Rand {
+	if o.rnd == nil {
+		o.rnd = rand.New(rand.NewSource(time.Now().UnixNano() + int64(o.ID)))
+	}
+	return o.rnd
+}
+
+// sendOmciResponse sends an OMCI response once the faults are applied: it can be delayed,
+// sent twice or held back until the next one is sent
+func (o *Onu) sendOmciResponse(pkt []byte, faults common.OmciFaults, stream openolt.Openolt_EnableIndicationServer) error {
+	if !faults.Enabled() {
+		return o.deliverOmciResponse(OmciResponseMessage{Pkt: pkt}, stream)
+	}
+
+	rnd := o.random()
+	msg := OmciResponseMessage{
+		Pkt:       pkt,
+		Duplicate: faults.Happens(rnd, faults.DuplicateRate),
+		Hold:      faults.Happens(rnd, faults.ReorderRate),
+	}
+	if delay := faults.ResponseDelay(rnd); delay > 0 {
+		onuLogger.WithFields(log.Fields{
+			"IntfId":       o.PonPortID,
+			"SerialNumber": o.Sn(),
+			"Delay":        delay,
+		}).Debug("Delaying OMCI response")
+		time.AfterFunc(delay, func() {
+			o.Enqueue(Message{
+				Type: OmciResponse,
+				Data: msg,
+			})
+		})
+		return nil
+	}
+	return o.deliverOmciResponse(msg, stream)
+}
+
+func (o *Onu) deliverOmciResponse(msg OmciResponseMessage, stream openolt.Openolt_EnableIndicationServer) error {
+	if msg.Hold && o.heldOmciResponse == nil {
+		onuLogger.WithFields(log.Fields{
+			"IntfId":       o.PonPortID,
+			"SerialNumber": o.Sn(),
+			"omciPacket":   msg.Pkt,
+		}).Debug("Holding back OMCI response until the next one is sent")
+		o.heldOmciResponse = msg.Pkt
+		return nil
+	}
+
+	if err := o.sendOmciIndication(msg.Pkt, stream); err != nil {
+		return err
+	}
+	if msg.Duplicate {
+		if err := o.sendOmciIndication(msg.Pkt, stream); err != nil {
+			return err
+		}
+	}
+	if held := o.heldOmciResponse; held != nil {
+		o.heldOmciResponse = nil
+		return o.sendOmciIndication(held, stream)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gotest.tools/assert"
+)
+
+// sendGalCreate sends the OMCI request creating a GAL Ethernet profile, the TID is the entity ID
+func sendGalCreate(t *testing.T, onu *Onu, tid uint16, stream *mockIndicationStream) {
+	gal, _ := me.NewGalEthernetProfile(me.ParamData{
+		EntityID:   tid,
+		Attributes: me.AttributeValueMap{"MaximumGemPayloadSize": uint16(48)},
+	})
+	req, err := omci.GenFrame(gal, omci.CreateRequestType, omci.TransactionID(tid))
+	assert.NilError(t, err)
+	onu.handleOmciMessage(OmciMessage{omciMsg: &openolt.OmciMsg{Pkt: []byte(hex.EncodeToString(req))}}, stream)
+}
+
+// sentTids returns the TIDs of the OMCI responses sent so far
+func sentTids(stream *mockIndicationStream) []uint16 {
+	tids := []uint16{}
+	for len(stream.indications) > 0 {
+		tids = append(tids, binary.BigEndian.Uint16((<-stream.indications).GetOmciInd().Pkt[0:2]))
+	}
+	return tids
+}
+
+func Test_Onu_OmciFaults(t *testing.T) {
+	defer SetGlobalOmciFaults(common.OmciFaults{})
+	onu := createTestOnu()
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 10)}
+
+	// the silent ONU neither answers nor applies the requests
+	SetGlobalOmciFaults(common.OmciFaults{Silent: true})
+	sendGalCreate(t, onu, 1, stream)
+	assert.DeepEqual(t, sentTids(stream), []uint16{})
+	_, ok := onu.mib.Entity(me.GalEthernetProfileClassId, 1)
+	assert.Assert(t, !ok)
+
+	// the faults of the ONU replace the global ones
+	onu.SetOmciFaults(&common.OmciFaults{ErrorRate: 1, Result: me.ParameterError})
+	faults, global := onu.OmciFaults()
+	assert.Equal(t, faults.Result, me.ParameterError)
+	assert.Equal(t, global, false)
+	sendGalCreate(t, onu, 2, stream)
+	resp := (<-stream.indications).GetOmciInd()
+	assert.Equal(t, resp.Pkt[8], byte(me.ParameterError))
+	_, ok = onu.mib.Entity(me.GalEthernetProfileClassId, 2)
+	assert.Assert(t, !ok)
+
+	onu.SetOmciFaults(&common.OmciFaults{DuplicateRate: 1})
+	sendGalCreate(t, onu, 3, stream)
+	assert.DeepEqual(t, sentTids(stream), []uint16{3, 3})
+
+	// the first response is held back and sent after the second one
+	onu.SetOmciFaults(&common.OmciFaults{ReorderRate: 1})
+	sendGalCreate(t, onu, 4, stream)
+	sendGalCreate(t, onu, 5, stream)
+	assert.DeepEqual(t, sentTids(stream), []uint16{5, 4})
+
+	onu.SetOmciFaults(&common.OmciFaults{Delay: 10 * time.Millisecond})
+	sendGalCreate(t, onu, 6, stream)
+	assert.DeepEqual(t, sentTids(stream), []uint16{})
+	msg := nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OmciResponse)
+	onu.handleMessage(msg, stream, nil)
+	assert.DeepEqual(t, sentTids(stream), []uint16{6})
+
+	onu.SetOmciFaults(nil)
+	faults, global = onu.OmciFaults()
+	assert.Equal(t, faults.Silent, true)
+	assert.Equal(t, global, true)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"time"
+
+	"github.com/opencord/bbsim/internal/bbsim/responders/omcisim"
+	"github.com/opencord/voltha-protos/go/openolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// NOTE the PM intervals start when the OLT synchronizes the time of the ONU, as on a real ONU.
+// At the end of each interval the PM history data entities in the MIB report the traffic of the interval
+// and the ONU sends the threshold crossing alerts, if any
+
+// pmStream counts the packets the ONU sends upstream, so that they are reported in the PM history data
+type pmStream struct {
+	openolt.Openolt_EnableIndicationServer
+	mib *omcisim.Mib
+}
+
+func (s pmStream) Send(indication *openolt.Indication) error {
+	if err := s.Openolt_EnableIndicationServer.Send(indication); err != nil {
+		return err
+	}
+	if pktInd, ok := indication.Data.(*openolt.Indication_PktInd); ok && pktInd.PktInd.IntfType == "pon" {
+		s.mib.CountUpstream(pktInd.PktInd.GemportId, pktInd.PktInd.Pkt)
+	}
+	return nil
+}
+
+// pmIntervalTimer queues a PmIntervalEnd message at the end of each PM interval, the message carries
+// the timer so that the ones queued by a stopped timer are ignored
+type pmIntervalTimer struct {
+	*time.Timer
+}
+
+// startPmIntervals starts the PM intervals, or starts them again if they were already running
+func (o *Onu) startPmIntervals() {
+	o.stopPmIntervals()
+	timer := &pmIntervalTimer{}
+	timer.Timer = time.AfterFunc(o.pmInterval, func() {
+		o.Enqueue(Message{
+			Type: PmIntervalEnd,
+			Data: timer,
+		})
+	})
+	o.pmTimer = timer
+}
+
+func (o *Onu) stopPmIntervals() {
+	if o.pmTimer != nil {
+		o.pmTimer.Stop()
+		o.pmTimer = nil
+	}
+}
+
+// endPmInterval ends the current PM interval and sends the threshold crossing alerts to the OLT
+func (o *Onu) endPmInterval(timer *pmIntervalTimer, stream openolt.Openolt_EnableIndicationServer) {
+	if timer != o.pmTimer {
+		return
+	}
+	notifications := o.mib.EndInterval()
+	o.pmTimer.Reset(o.pmInterval)
+
+	onuLogger.WithFields(log.Fields{
+		"IntfId":          o.PonPortID,
+		"SerialNumber":    o.Sn(),
+		"IntervalEndTime": o.mib.IntervalEndTime(),
+		"Alerts":          len(notifications),
+	}).Debug("PM interval ended")
+
+	for _, pkt := range notifications {
+		if err := o.sendOmciIndication(pkt, stream); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gotest.tools/assert"
+)
+
+func Test_Onu_PmIntervals(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+	onu.pmInterval = 20 * time.Millisecond
+	uni := onu.Unis[1]
+	uni.InternalState.SetState("auth_started")
+	uni.GemPortId = 1025
+
+	pm, _ := me.NewEthernetFramePerformanceMonitoringHistoryDataUpstream(me.ParamData{
+		EntityID:   1,
+		Attributes: me.AttributeValueMap{"ThresholdData12Id": uint16(0)},
+	})
+	pmReq, _ := omci.GenFrame(pm, omci.CreateRequestType, omci.TransactionID(1))
+	onuG, _ := me.NewOnuG(me.ParamData{EntityID: 0})
+	syncReq, err := omci.GenFrame(onuG, omci.SynchronizeTimeRequestType, omci.TransactionID(2))
+	assert.NilError(t, err)
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 10)}
+	for _, req := range [][]byte{pmReq, syncReq} {
+		onu.handleMessage(Message{Type: OMCI, Data: OmciMessage{omciMsg: &openolt.OmciMsg{Pkt: []byte(hex.EncodeToString(req))}}}, stream, nil)
+	}
+	assert.Assert(t, onu.pmTimer != nil)
+
+	// the packets the ONU sends are counted
+	onu.handleMessage(Message{Type: StartEAPOL, Data: PacketMessage{UniID: uni.ID}}, stream, nil)
+	assert.Equal(t, len(stream.indications), 3)
+
+	msg := nextMessage(t, onu)
+	assert.Equal(t, msg.Type, PmIntervalEnd)
+	onu.handleMessage(msg, stream, nil)
+	attributes, _ := onu.mib.Entity(me.EthernetFramePerformanceMonitoringHistoryDataUpstreamClassId, 1)
+	assert.Equal(t, attributes["IntervalEndTime"], uint8(1))
+	assert.Equal(t, attributes["Packets"], uint32(1))
+
+	// the intervals stop when the ONU is reset, the ones that already ended are ignored
+	msg = nextMessage(t, onu)
+	assert.Equal(t, msg.Type, PmIntervalEnd)
+	onu.reset()
+	assert.Assert(t, onu.pmTimer == nil)
+	onu.handleMessage(msg, stream, nil)
+	assert.Equal(t, onu.mib.IntervalEndTime(), uint8(1))
+}
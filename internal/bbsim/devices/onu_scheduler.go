@@ -0,0 +1,272 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// NOTE the ONUs don't have a goroutine each: the messages they receive are queued in their mailbox
+// and a bounded pool of workers processes them. An ONU is handled by at most one worker at a time,
+// so its messages are still processed in order and one at a time.
+
+const (
+	// onuMessageBatch is the number of messages a worker processes for an ONU
+	// before giving the other ONUs a chance to run
+	onuMessageBatch = 16
+)
+
+var (
+	onuWorkers     = common.DefaultOnuWorkers
+	schedulerOnce  sync.Once
+	scheduler      *onuScheduler
+	onuWorkersLock sync.Mutex
+)
+
+// SetOnuWorkers sets the number of workers processing the ONU messages,
+// it has to be called before any ONU starts processing messages
+func SetOnuWorkers(workers int) {
+	onuWorkersLock.Lock()
+	defer onuWorkersLock.Unlock()
+	if workers > 0 {
+		onuWorkers = workers
+	}
+}
+
+func getOnuScheduler() *onuScheduler {
+	schedulerOnce.Do(func() {
+		onuWorkersLock.Lock()
+		defer onuWorkersLock.Unlock()
+		scheduler = newOnuScheduler(onuWorkers)
+	})
+	return scheduler
+}
+
+// onuScheduler keeps the ONUs that have messages to process
+type onuScheduler struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	ready []*Onu
+}
+
+func newOnuScheduler(workers int) *onuScheduler {
+	s := &onuScheduler{}
+	s.cond = sync.NewCond(&s.lock)
+
+	log.WithFields(log.Fields{
+		"Workers": workers,
+	}).Debug("Starting ONU workers")
+
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+func (s *onuScheduler) schedule(onu *Onu) {
+	s.lock.Lock()
+	s.ready = append(s.ready, onu)
+	s.lock.Unlock()
+	s.cond.Signal()
+}
+
+func (s *onuScheduler) next() *Onu {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.ready) == 0 {
+		s.cond.Wait()
+	}
+	onu := s.ready[0]
+	s.ready[0] = nil
+	s.ready = s.ready[1:]
+	if len(s.ready) == 0 {
+		s.ready = nil
+	}
+	return onu
+}
+
+func (s *onuScheduler) work() {
+	for {
+		onu := s.next()
+		if onu.processMessages(onuMessageBatch) {
+			// NOTE the ONU has more messages, it goes back in the queue so that the others are not starved
+			s.schedule(onu)
+		}
+	}
+}
+
+// Enqueue adds a message to the ONU mailbox,
+// the messages are processed in order once the ONU is attached to an indication stream
+func (o *Onu) Enqueue(msg Message) {
+	o.mailboxLock.Lock()
+	if o.unplugged {
+		// NOTE the messages for an ONU that was removed from the PON are dropped, eg: the ones sent by its timers
+		o.mailboxLock.Unlock()
+		return
+	}
+	o.mailbox = append(o.mailbox, msg)
+	schedule := o.loopDone != nil && !o.scheduled
+	if schedule {
+		o.scheduled = true
+	}
+	o.mailboxLock.Unlock()
+
+	if schedule {
+		getOnuScheduler().schedule(o)
+	}
+}
+
+// attach starts processing the ONU messages, the indications are sent on stream
+// and the BBR requests via client. It returns the channel that is closed by detach
+func (o *Onu) attach(stream openolt.Openolt_EnableIndicationServer, client openolt.OpenoltClient) chan struct{} {
+	o.mailboxLock.Lock()
+	done := make(chan struct{})
+	o.loopDone = done
+	o.stream = stream
+	o.client = client
+	schedule := len(o.mailbox) > 0 && !o.scheduled
+	if schedule {
+		o.scheduled = true
+	}
+	o.mailboxLock.Unlock()
+
+	if schedule {
+		getOnuScheduler().schedule(o)
+	}
+	return done
+}
+
+// detach stops processing the ONU messages, the ones that are still queued
+// are processed once the ONU is attached to a new stream
+func (o *Onu) detach(done chan struct{}) {
+	o.mailboxLock.Lock()
+	defer o.mailboxLock.Unlock()
+	close(done)
+	// NOTE when VOLTHA reconnects the ONU may be attached to the new stream before it is detached from the old one
+	if o.loopDone == done {
+		o.loopDone = nil
+		o.stream = nil
+		o.client = nil
+	}
+}
+
+// unplug stops processing the ONU messages and drops the ones that are queued, for good:
+// the ONU is disconnected from the PON. It is safe to call it while processing a message
+func (o *Onu) unplug() {
+	o.mailboxLock.Lock()
+	defer o.mailboxLock.Unlock()
+	o.unplugged = true
+	o.mailbox = nil
+	// NOTE the loopDone channel is still closed by detach
+	o.loopDone = nil
+	o.stream = nil
+	o.client = nil
+}
+
+// processMessages processes up to max messages, it returns true if the ONU has more messages to process
+func (o *Onu) processMessages(max int) bool {
+	for i := 0; i < max; i++ {
+		o.mailboxLock.Lock()
+		if len(o.mailbox) == 0 || o.loopDone == nil {
+			o.scheduled = false
+			o.mailboxLock.Unlock()
+			return false
+		}
+		message := o.mailbox[0]
+		o.mailbox[0] = Message{}
+		o.mailbox = o.mailbox[1:]
+		if len(o.mailbox) == 0 {
+			// NOTE release the memory, most of the ONUs are idle most of the time
+			o.mailbox = nil
+		}
+		stream, client := o.stream, o.client
+		o.mailboxLock.Unlock()
+
+		onuLogger.WithFields(log.Fields{
+			"onuID":       o.ID,
+			"onuSN":       o.Sn(),
+			"messageType": message.Type,
+		}).Tracef("Received message on ONU Channel")
+
+		o.mu.Lock()
+		o.handleMessage(message, stream, client)
+		o.mu.Unlock()
+	}
+
+	o.mailboxLock.Lock()
+	defer o.mailboxLock.Unlock()
+	if len(o.mailbox) == 0 || o.loopDone == nil {
+		o.scheduled = false
+		return false
+	}
+	return true
+}
+
+// pendingMessages returns the number of messages waiting to be processed
+func (o *Onu) pendingMessages() int {
+	o.mailboxLock.Lock()
+	defer o.mailboxLock.Unlock()
+	return len(o.mailbox)
+}
+
+// clearMessages drops the messages waiting to be processed
+func (o *Onu) clearMessages() {
+	o.mailboxLock.Lock()
+	defer o.mailboxLock.Unlock()
+	o.mailbox = nil
+}
+
+// ProcessOnuMessages processes the ONU messages until ctx is done
+func (o *Onu) ProcessOnuMessages(ctx context.Context, stream openolt.Openolt_EnableIndicationServer, client openolt.OpenoltClient) {
+	onuLogger.WithFields(log.Fields{
+		"onuID": o.ID,
+		"onuSN": o.Sn(),
+	}).Debug("Started ONU Indication Channel")
+
+	done := o.attach(stream, client)
+	<-ctx.Done()
+	o.detach(done)
+
+	onuLogger.WithFields(log.Fields{
+		"onuID": o.ID,
+		"onuSN": o.Sn(),
+	}).Debug("ONU message handling canceled via context")
+}
+
+// processOnusMessages processes the messages of all the ONUs until ctx is done,
+// it does not block and uses a single goroutine to wait for ctx
+func processOnusMessages(ctx context.Context, stream openolt.Openolt_EnableIndicationServer, onus []*Onu) {
+	dones := make([]chan struct{}, len(onus))
+	for i, onu := range onus {
+		dones[i] = onu.attach(stream, nil)
+	}
+
+	go func() {
+		<-ctx.Done()
+		for i, onu := range onus {
+			onu.detach(dones[i])
+		}
+		oltLogger.WithFields(log.Fields{
+			"Onus": len(onus),
+		}).Debug("ONU message handling canceled via context")
+	}()
+}
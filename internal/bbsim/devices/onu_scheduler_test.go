@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func Test_Onu_MessagesAreQueuedUntilAttached(t *testing.T) {
+	onu := createTestOnu()
+
+	onu.Enqueue(Message{Type: OnuDiscIndication})
+	onu.Enqueue(Message{Type: OnuIndication})
+	assert.Equal(t, onu.pendingMessages(), 2)
+	assert.Equal(t, onu.scheduled, false)
+
+	onu.clearMessages()
+	assert.Equal(t, onu.pendingMessages(), 0)
+}
+
+func Test_OnuScheduler_PreservesTheOrder(t *testing.T) {
+	numOnus := 200
+	numMessages := 50
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	onus := []*Onu{}
+	for i := 0; i < numOnus; i++ {
+		onus = append(onus, createMockOnu(uint32(i), 0, 900, 900, false, false))
+	}
+	processOnusMessages(ctx, nil, onus)
+
+	// NOTE the slices are not protected, the race detector complains if the messages of an ONU are processed concurrently
+	received := make([][]uint32, numOnus)
+	wg := sync.WaitGroup{}
+	wg.Add(numOnus * numMessages)
+	for i, onu := range onus {
+		i := i
+		for j := 0; j < numMessages; j++ {
+			j := uint32(j)
+			onu.Enqueue(Message{
+				Type: OnuRequest,
+				Data: &OnuRequestMessage{
+					change: func() error {
+						received[i] = append(received[i], j)
+						wg.Done()
+						return nil
+					},
+					result: make(chan error, 1),
+				},
+			})
+		}
+	}
+	wg.Wait()
+
+	for i, onu := range onus {
+		assert.Equal(t, len(received[i]), numMessages)
+		for j, v := range received[i] {
+			assert.Equal(t, v, uint32(j))
+		}
+		// the mailbox is released once it's empty
+		onu.mailboxLock.Lock()
+		assert.Assert(t, onu.mailbox == nil)
+		onu.mailboxLock.Unlock()
+	}
+}
+
+func Test_OnuScheduler_Reattach(t *testing.T) {
+	onu := createTestOnu()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan bool)
+	go func() {
+		onu.ProcessOnuMessages(ctx, nil, nil)
+		done <- true
+	}()
+	cancel()
+	<-done
+
+	// the messages received while the ONU is detached are kept
+	processed := make(chan bool, 1)
+	onu.Enqueue(Message{
+		Type: OnuRequest,
+		Data: &OnuRequestMessage{
+			change: func() error {
+				processed <- true
+				return nil
+			},
+			result: make(chan error, 1),
+		},
+	})
+	assert.Equal(t, onu.pendingMessages(), 1)
+
+	ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+	go onu.ProcessOnuMessages(ctx, nil, nil)
+
+	<-processed
+}
@@ -85,7 +85,7 @@ func Test_Onu_StateMachine_eapol_states(t *testing.T) {
 
 func Test_Onu_StateMachine_dhcp_start(t *testing.T) {
 	onu := createTestOnu()
-	onu.DhcpFlowReceived = true
+	onu.Unis[0].DhcpFlowReceived = true
 
 	onu.InternalState.SetState("eap_response_success_received")
 	assert.Equal(t, onu.InternalState.Current(), "eap_response_success_received")
@@ -110,7 +110,7 @@ func Test_Onu_StateMachine_dhcp_start_error(t *testing.T) {
 func Test_Onu_StateMachine_dhcp_states(t *testing.T) {
 	onu := createTestOnu()
 
-	onu.DhcpFlowReceived = false
+	onu.Unis[0].DhcpFlowReceived = false
 
 	onu.InternalState.SetState("dhcp_started")
 
@@ -122,3 +122,16 @@ func Test_Onu_StateMachine_dhcp_states(t *testing.T) {
 	onu.InternalState.Event("dhcp_ack_received")
 	assert.Equal(t, onu.InternalState.Current(), "dhcp_ack_received")
 }
+
+func Test_Onu_StateMachine_initialize(t *testing.T) {
+	onu := createTestOnu()
+	onu.Unis[0].PortNo = 16
+	onu.Unis[0].DhcpFlowReceived = true
+
+	onu.InternalState.SetState("dhcp_ack_received")
+	onu.InternalState.Event("initialize")
+
+	assert.Equal(t, onu.InternalState.Current(), "created")
+	assert.Equal(t, onu.Unis[0].PortNo, uint32(0))
+	assert.Equal(t, onu.Unis[0].DhcpFlowReceived, false)
+}
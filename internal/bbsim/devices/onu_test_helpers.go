@@ -19,10 +19,14 @@ package devices
 import (
 	"context"
 	"errors"
+	"github.com/opencord/bbsim/internal/bbsim/responders/omcisim"
+	"github.com/opencord/bbsim/internal/common"
 	"github.com/opencord/voltha-protos/go/openolt"
 	"github.com/opencord/voltha-protos/go/tech_profile"
 	"google.golang.org/grpc"
 	"net"
+	"testing"
+	"time"
 )
 
 type FlowAddSpy struct {
@@ -105,18 +109,21 @@ func (s *mockClient) EnableIndication(ctx context.Context, in *openolt.Empty, op
 }
 
 // this method creates a fake ONU used in the tests
-func createMockOnu(id uint32, ponPortId uint32, sTag int, cTag int, auth bool, dhcp bool) Onu {
-	o := Onu{
+func createMockOnu(id uint32, ponPortId uint32, sTag int, cTag int, auth bool, dhcp bool) *Onu {
+	o := &Onu{
 		ID:        id,
 		PonPortID: ponPortId,
 		STag:      sTag,
 		CTag:      cTag,
 		HwAddress: net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, byte(ponPortId), byte(id)},
-		PortNo:    0,
 		Auth:      auth,
 		Dhcp:      dhcp,
 	}
-	o.SerialNumber = o.NewSN(0, ponPortId, o.ID)
+	o.SerialNumber, _ = common.DefaultOnuIdentities.SerialNumber(0, ponPortId, o.ID)
+	o.Unis = []*UniPort{
+		{ID: 0, HwAddress: o.HwAddress, CTag: cTag},
+	}
+	o.mib = omcisim.NewMib(omcisim.MibConfig{NumUnis: 1})
 	return o
 }
 
@@ -131,3 +138,34 @@ func createTestOnu() *Onu {
 	onu := CreateONU(olt, pon, 1, 900, 900, false, false)
 	return onu
 }
+
+// this method creates a real ONU with multiple UNIs to be used in the tests
+func createTestOnuWithUnis(numUnis int) *Onu {
+	olt := OltDevice{
+		ID:           0,
+		NumUniPerOnu: numUnis,
+	}
+	pon := PonPort{
+		ID: 1,
+	}
+	onu := CreateONU(olt, pon, 1, 900, 900, false, false)
+	return onu
+}
+
+// this method returns the first message in the ONU mailbox,
+// it is used in the tests where the ONU is not processing its messages
+func nextMessage(t *testing.T, onu *Onu) Message {
+	for i := 0; i < 100; i++ {
+		onu.mailboxLock.Lock()
+		if len(onu.mailbox) > 0 {
+			msg := onu.mailbox[0]
+			onu.mailbox = onu.mailbox[1:]
+			onu.mailboxLock.Unlock()
+			return msg
+		}
+		onu.mailboxLock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no message for ONU %s", onu.Sn())
+	return Message{}
+}
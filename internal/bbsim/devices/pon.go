@@ -17,42 +17,225 @@
 package devices
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"net"
 
 	"github.com/looplab/fsm"
+	"github.com/opencord/bbsim/internal/common"
 	"github.com/opencord/voltha-protos/go/openolt"
+	log "github.com/sirupsen/logrus"
 )
 
 type PonPort struct {
 	// BBSIM Internals
 	ID     uint32
 	NumOnu int
-	Onus   []*Onu
-	Olt    OltDevice
+	// NOTE Onus is replaced when an ONU is removed, use GetOnus to read it while the ONUs can be added or removed
+	Onus          []*Onu
+	Olt           OltDevice
+	onus          *onuIndex
+	InternalState *fsm.FSM
+	// lastOnuId is the highest ID an ONU was created with, the ONUs added at runtime get the next ones
+	lastOnuId uint32
 
 	// PON Attributes
 	OperState *fsm.FSM
 	Type      string
+}
+
+// CreatePonPort creates a PON port, the ONUs are added by the caller
+func CreatePonPort(olt OltDevice, id uint32) *PonPort {
+	p := PonPort{
+		NumOnu: olt.NumOnuPerPon,
+		ID:     id,
+		Type:   "pon",
+		Olt:    olt,
+		Onus:   []*Onu{},
+		onus:   newOnuIndex(),
+	}
+
+	p.OperState = getOperStateFSM(func(e *fsm.Event) {
+		oltLogger.WithFields(log.Fields{
+			"ID": p.ID,
+		}).Debugf("Changing PON Port OperState from %s to %s", e.Src, e.Dst)
+	})
+
+	// NOTE this state machine is used to track the admin state of the PON as requested by VOLTHA
+	p.InternalState = fsm.NewFSM(
+		"created",
+		fsm.Events{
+			{Name: "enable", Src: []string{"created", "disabled"}, Dst: "enabled"},
+			{Name: "disable", Src: []string{"enabled"}, Dst: "disabled"},
+		},
+		fsm.Callbacks{
+			"enter_state": func(e *fsm.Event) {
+				oltLogger.WithFields(log.Fields{
+					"ID": p.ID,
+				}).Debugf("Changing PON Port InternalState from %s to %s", e.Src, e.Dst)
+			},
+			// NOTE the PonIndication is sent by the OLT before the transition, see OltDevice.changePonState
+			"enter_enabled": func(e *fsm.Event) {
+				if e.Src == "disabled" {
+					p.restoreOnus()
+				}
+			},
+			"enter_disabled": func(e *fsm.Event) {
+				p.disableOnus()
+			},
+		},
+	)
 
-	// NOTE do we need a state machine for the PON Ports?
+	return &p
 }
 
-func (p PonPort) GetOnuBySn(sn *openolt.SerialNumber) (*Onu, error) {
-	for _, onu := range p.Onus {
-		if bytes.Equal(onu.SerialNumber.VendorSpecific, sn.VendorSpecific) {
-			return onu, nil
+// disableOnus brings down all the ONUs on the PON,
+// the ones that were activated by VOLTHA will send an OnuIndication
+func (p *PonPort) disableOnus() {
+	for _, onu := range p.GetOnus() {
+		onu.Do(func() error {
+			if onu.InternalState.Can("pon_disabled") {
+				if err := onu.InternalState.Event("pon_disabled"); err != nil {
+					oltLogger.WithFields(log.Fields{
+						"IntfId": onu.PonPortID,
+						"OnuSn":  onu.Sn(),
+						"OnuId":  onu.ID,
+					}).Errorf("Failed to transition ONU to pon_disabled state: %s", err.Error())
+				}
+			} else if onu.InternalState.Is("discovered") {
+				// NOTE the ONU was not activated yet, it will be discovered again once the PON is enabled
+				if err := onu.InternalState.Event("initialize"); err != nil {
+					oltLogger.WithFields(log.Fields{
+						"IntfId": onu.PonPortID,
+						"OnuSn":  onu.Sn(),
+						"OnuId":  onu.ID,
+					}).Errorf("Failed to transition ONU to created state: %s", err.Error())
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// restoreOnus reactivates the ONUs that went down together with the PON
+// and discovers the ones that were never activated
+func (p *PonPort) restoreOnus() {
+	for _, onu := range p.GetOnus() {
+		onu.Do(func() error {
+			if onu.InternalState.Is("pon_disabled") {
+				if err := onu.InternalState.Event("enable"); err != nil {
+					oltLogger.WithFields(log.Fields{
+						"IntfId": onu.PonPortID,
+						"OnuSn":  onu.Sn(),
+						"OnuId":  onu.ID,
+					}).Errorf("Failed to transition ONU to enabled state: %s", err.Error())
+				}
+			} else if onu.InternalState.Is("created") {
+				msg := Message{
+					Type: OnuDiscIndication,
+					Data: OnuDiscIndicationMessage{
+						Onu:       onu,
+						OperState: UP,
+					},
+				}
+				onu.Enqueue(msg)
+			}
+			return nil
+		})
+	}
+}
+
+// AddOnu adds an ONU to the PON and indexes it, the ONU still has the ID it was created with
+func (p *PonPort) AddOnu(onu *Onu) {
+	if p.onus == nil {
+		p.onus = newOnuIndex()
+	}
+	p.onus.mu.Lock()
+	defer p.onus.mu.Unlock()
+
+	// NOTE appending does not change the elements of the lists returned by GetOnus
+	p.Onus = append(p.Onus, onu)
+	p.onus.add(onu)
+	if onu.ID > p.lastOnuId {
+		p.lastOnuId = onu.ID
+	}
+}
+
+// removeOnu removes an ONU from the PON, it can't be found anymore
+func (p *PonPort) removeOnu(onu *Onu) error {
+	if p.onus == nil {
+		return fmt.Errorf("cannot-find-onu-%s-in-pon-%d", onu.Sn(), p.ID)
+	}
+	p.onus.mu.Lock()
+	defer p.onus.mu.Unlock()
+
+	onus := make([]*Onu, 0, len(p.Onus))
+	for _, o := range p.Onus {
+		if o != onu {
+			onus = append(onus, o)
 		}
 	}
+	if len(onus) == len(p.Onus) {
+		return fmt.Errorf("cannot-find-onu-%s-in-pon-%d", onu.Sn(), p.ID)
+	}
+	p.Onus = onus
+	p.onus.remove(onu)
+	return nil
+}
+
+// GetOnus returns the ONUs on the PON, the list is not modified when ONUs are added or removed
+func (p *PonPort) GetOnus() []*Onu {
+	if p.onus == nil {
+		return p.Onus
+	}
+	p.onus.mu.RLock()
+	defer p.onus.mu.RUnlock()
+	// NOTE the capacity is capped, so that appending to the list copies it
+	return p.Onus[:len(p.Onus):len(p.Onus)]
+}
+
+// nextOnuId returns the ID the next ONU added at runtime is created with
+func (p *PonPort) nextOnuId() uint32 {
+	if p.onus == nil {
+		return p.lastOnuId + 1
+	}
+	p.onus.mu.RLock()
+	defer p.onus.mu.RUnlock()
+	return p.lastOnuId + 1
+}
+
+func (p *PonPort) GetOnuBySn(sn *openolt.SerialNumber) (*Onu, error) {
+	if onu, ok := p.getOnuBySn(common.OnuSnToString(sn)); ok {
+		return onu, nil
+	}
 	return nil, errors.New(fmt.Sprintf("Cannot find Onu with serial number %d in PonPort %d", sn, p.ID))
 }
 
-func (p PonPort) GetOnuById(id uint32) (*Onu, error) {
-	for _, onu := range p.Onus {
-		if onu.ID == id {
+func (p *PonPort) GetOnuById(id uint32) (*Onu, error) {
+	if p.onus != nil {
+		if onu, ok := p.onus.getById(id); ok {
 			return onu, nil
 		}
 	}
 	return nil, errors.New(fmt.Sprintf("Cannot find Onu with id %d in PonPort %d", id, p.ID))
 }
+
+func (p *PonPort) getOnuBySn(sn string) (*Onu, bool) {
+	if p.onus == nil {
+		return nil, false
+	}
+	return p.onus.getBySn(sn)
+}
+
+// hasOnu returns true if the ONU is still connected to the PON, ie: it was not removed
+func (p *PonPort) hasOnu(onu *Onu) bool {
+	found, ok := p.getOnuBySn(onu.Sn())
+	return ok && found == onu
+}
+
+func (p *PonPort) getUniByMacAddress(mac net.HardwareAddr) (uniRef, bool) {
+	if p.onus == nil {
+		return uniRef{}, false
+	}
+	return p.onus.getByMac(mac)
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func createTestPon() (*OltDevice, *PonPort) {
+	olt := createTestOlt(1, 2)
+	pon := olt.Pons[0]
+	// NOTE the OLT channel is only consumed once the OLT is enabled
+	olt.channel = make(chan Message, 10)
+	olt.indications = &indicationStream{ctx: context.TODO()}
+	pon.Olt.channel = olt.channel
+	olt.InternalState.SetState("enabled")
+	pon.InternalState.SetState("enabled")
+	return olt, pon
+}
+
+func Test_Pon_DisablePonIf(t *testing.T) {
+	olt, pon := createTestPon()
+
+	active := pon.Onus[0]
+	active.InternalState.SetState("dhcp_ack_received")
+	discovered := pon.Onus[1]
+	discovered.InternalState.SetState("discovered")
+
+	_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pon.InternalState.Current(), "disabled")
+
+	msg := <-pon.Olt.channel
+	assert.Equal(t, msg.Type, PonIndication)
+	assert.Equal(t, msg.Data.(PonIndicationMessage).OperState, DOWN)
+
+	assert.Equal(t, active.InternalState.Current(), "pon_disabled")
+	msg = nextMessage(t, active)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, DOWN)
+
+	assert.Equal(t, discovered.InternalState.Current(), "created")
+}
+
+func Test_Pon_EnablePonIf(t *testing.T) {
+	olt, pon := createTestPon()
+
+	active := pon.Onus[0]
+	active.InternalState.SetState("dhcp_ack_received")
+	created := pon.Onus[1]
+
+	_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+	assert.Equal(t, err, nil)
+	<-pon.Olt.channel
+	nextMessage(t, active)
+
+	_, err = olt.EnablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pon.InternalState.Current(), "enabled")
+
+	msg := <-pon.Olt.channel
+	assert.Equal(t, msg.Type, PonIndication)
+	assert.Equal(t, msg.Data.(PonIndicationMessage).OperState, UP)
+
+	assert.Equal(t, active.InternalState.Current(), "enabled")
+	msg = nextMessage(t, active)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, UP)
+
+	// the ONU that was never activated is discovered again
+	msg = nextMessage(t, created)
+	assert.Equal(t, msg.Type, OnuDiscIndication)
+}
+
+func Test_Pon_DisablePonIf_Error(t *testing.T) {
+	olt, _ := createTestPon()
+
+	_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: 10})
+
+	assert.Equal(t, err.Error(), "Cannot find PonPort with id 10 in OLT 0")
+}
+
+func Test_Pon_EnablePonIf_OltDisabled(t *testing.T) {
+	olt, pon := createTestPon()
+	olt.InternalState.SetState("disabled")
+	pon.InternalState.SetState("disabled")
+
+	_, err := olt.EnablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+
+	assert.Equal(t, err.Error(), "olt-0-is-not-enabled")
+	assert.Equal(t, pon.InternalState.Current(), "disabled")
+}
+
+func Test_Pon_DisablePonIf_NotConnected(t *testing.T) {
+	olt, pon := createTestPon()
+	ctx, cancel := context.WithCancel(context.TODO())
+	olt.indications = &indicationStream{ctx: ctx}
+	cancel()
+
+	_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Equal(t, pon.InternalState.Current(), "enabled")
+
+	pon.InternalState.SetState("disabled")
+	_, err = olt.EnablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Equal(t, pon.InternalState.Current(), "disabled")
+}
+
+func Test_Pon_DisablePonIf_Disconnect(t *testing.T) {
+	olt, pon := createTestPon()
+	// NOTE the stream is still open when the call starts, but the OLT loop is not consuming the messages
+	olt.channel = make(chan Message)
+	ctx, cancel := context.WithCancel(context.TODO())
+	olt.indications = &indicationStream{ctx: ctx}
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error)
+	go func() {
+		_, err := olt.DisablePonIf(context.TODO(), &openolt.Interface{IntfId: pon.ID})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, status.Code(err), codes.Unavailable)
+	case <-time.After(time.Second):
+		t.Fatal("DisablePonIf is blocked after the disconnection")
+	}
+	assert.Equal(t, pon.InternalState.Current(), "enabled")
+}
+
+func Test_Olt_ActivateOnu_PonDisabled(t *testing.T) {
+	olt, pon := createTestPon()
+	pon.InternalState.SetState("disabled")
+	onu := pon.Onus[0]
+
+	_, err := olt.ActivateOnu(context.TODO(), &openolt.Onu{IntfId: pon.ID, OnuId: 1, SerialNumber: onu.SerialNumber})
+
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+	assert.Equal(t, status.Convert(err).Message(), "pon-0-is-not-enabled")
+}
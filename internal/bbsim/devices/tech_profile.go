@@ -0,0 +1,355 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"github.com/opencord/voltha-protos/go/tech_profile"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NOTE VOLTHA sends the upstream and downstream queues in separate calls,
+// and the same GemPort is used in both directions
+type queueKey struct {
+	Direction tech_profile.Direction
+	GemportId uint32
+}
+
+type uniTechProfile struct {
+	portNo     uint32
+	schedulers map[tech_profile.Direction]*tech_profile.TrafficScheduler
+	queues     map[queueKey]*tech_profile.TrafficQueue
+}
+
+// TechProfileStore keeps the TrafficSchedulers (T-CONTs) and the TrafficQueues (GemPorts)
+// VOLTHA provisioned on an ONU, per UNI
+type TechProfileStore struct {
+	mu   sync.RWMutex
+	unis map[uint32]*uniTechProfile
+}
+
+func NewTechProfileStore() *TechProfileStore {
+	return &TechProfileStore{
+		unis: make(map[uint32]*uniTechProfile),
+	}
+}
+
+func (s *TechProfileStore) getOrCreateUni(uniId uint32, portNo uint32) *uniTechProfile {
+	uni, ok := s.unis[uniId]
+	if !ok {
+		uni = &uniTechProfile{
+			schedulers: make(map[tech_profile.Direction]*tech_profile.TrafficScheduler),
+			queues:     make(map[queueKey]*tech_profile.TrafficQueue),
+		}
+		s.unis[uniId] = uni
+	}
+	uni.portNo = portNo
+	return uni
+}
+
+// removeUniIfEmpty must be called with the lock held
+func (s *TechProfileStore) removeUniIfEmpty(uniId uint32) {
+	if uni, ok := s.unis[uniId]; ok && len(uni.schedulers) == 0 && len(uni.queues) == 0 {
+		delete(s.unis, uniId)
+	}
+}
+
+func (s *TechProfileStore) AddSchedulers(ts *tech_profile.TrafficSchedulers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uni := s.getOrCreateUni(ts.UniId, ts.PortNo)
+	for _, sched := range ts.TrafficScheds {
+		uni.schedulers[sched.Direction] = sched
+	}
+}
+
+// RemoveSchedulers deletes the schedulers of the UNI for the directions listed in the request,
+// it returns false if none of them was stored
+func (s *TechProfileStore) RemoveSchedulers(ts *tech_profile.TrafficSchedulers) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uni, ok := s.unis[ts.UniId]
+	if !ok {
+		return false
+	}
+	removed := false
+	for _, sched := range ts.TrafficScheds {
+		if _, ok := uni.schedulers[sched.Direction]; ok {
+			delete(uni.schedulers, sched.Direction)
+			removed = true
+		}
+	}
+	s.removeUniIfEmpty(ts.UniId)
+	return removed
+}
+
+func (s *TechProfileStore) AddQueues(tq *tech_profile.TrafficQueues) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uni := s.getOrCreateUni(tq.UniId, tq.PortNo)
+	for _, q := range tq.TrafficQueues {
+		uni.queues[queueKey{Direction: q.Direction, GemportId: q.GemportId}] = q
+	}
+}
+
+// RemoveQueues deletes the queues of the UNI listed in the request,
+// it returns false if none of them was stored
+func (s *TechProfileStore) RemoveQueues(tq *tech_profile.TrafficQueues) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uni, ok := s.unis[tq.UniId]
+	if !ok {
+		return false
+	}
+	removed := false
+	for _, q := range tq.TrafficQueues {
+		key := queueKey{Direction: q.Direction, GemportId: q.GemportId}
+		if _, ok := uni.queues[key]; ok {
+			delete(uni.queues, key)
+			removed = true
+		}
+	}
+	s.removeUniIfEmpty(tq.UniId)
+	return removed
+}
+
+// GetSchedulers returns the schedulers of the ONU, one TrafficSchedulers per UNI sorted by UniId
+func (s *TechProfileStore) GetSchedulers(intfId uint32, onuId uint32) []*tech_profile.TrafficSchedulers {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := []*tech_profile.TrafficSchedulers{}
+	for _, uniId := range s.sortedUnis() {
+		uni := s.unis[uniId]
+		if len(uni.schedulers) == 0 {
+			continue
+		}
+		ts := &tech_profile.TrafficSchedulers{
+			IntfId: intfId,
+			OnuId:  onuId,
+			UniId:  uniId,
+			PortNo: uni.portNo,
+		}
+		for _, sched := range uni.schedulers {
+			ts.TrafficScheds = append(ts.TrafficScheds, sched)
+		}
+		sort.Slice(ts.TrafficScheds, func(i, j int) bool {
+			return ts.TrafficScheds[i].Direction < ts.TrafficScheds[j].Direction
+		})
+		res = append(res, ts)
+	}
+	return res
+}
+
+// GetQueues returns the queues of the ONU, one TrafficQueues per UNI sorted by UniId
+func (s *TechProfileStore) GetQueues(intfId uint32, onuId uint32) []*tech_profile.TrafficQueues {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := []*tech_profile.TrafficQueues{}
+	for _, uniId := range s.sortedUnis() {
+		uni := s.unis[uniId]
+		if len(uni.queues) == 0 {
+			continue
+		}
+		tq := &tech_profile.TrafficQueues{
+			IntfId: intfId,
+			OnuId:  onuId,
+			UniId:  uniId,
+			PortNo: uni.portNo,
+		}
+		for _, q := range uni.queues {
+			tq.TrafficQueues = append(tq.TrafficQueues, q)
+		}
+		sort.Slice(tq.TrafficQueues, func(i, j int) bool {
+			if tq.TrafficQueues[i].Direction != tq.TrafficQueues[j].Direction {
+				return tq.TrafficQueues[i].Direction < tq.TrafficQueues[j].Direction
+			}
+			return tq.TrafficQueues[i].GemportId < tq.TrafficQueues[j].GemportId
+		})
+		res = append(res, tq)
+	}
+	return res
+}
+
+// Clear removes all the schedulers and queues, eg: when the ONU is deleted
+func (s *TechProfileStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unis = make(map[uint32]*uniTechProfile)
+}
+
+// sortedUnis must be called with the lock held
+func (s *TechProfileStore) sortedUnis() []uint32 {
+	ids := []uint32{}
+	for id := range s.unis {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *TechProfileStore) getScheduler(uniId uint32, direction tech_profile.Direction) (*tech_profile.TrafficScheduler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if uni, ok := s.unis[uniId]; ok {
+		sched, ok := uni.schedulers[direction]
+		return sched, ok
+	}
+	return nil, false
+}
+
+// hasQueues returns true if VOLTHA provisioned any GemPort on the UNI
+func (s *TechProfileStore) hasQueues(uniId uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uni, ok := s.unis[uniId]
+	return ok && len(uni.queues) > 0
+}
+
+func (s *TechProfileStore) hasAllocId(uniId uint32, allocId uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if uni, ok := s.unis[uniId]; ok {
+		for _, sched := range uni.schedulers {
+			if sched.AllocId == allocId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *TechProfileStore) hasGemPort(uniId uint32, gemPortId uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if uni, ok := s.unis[uniId]; ok {
+		for key := range uni.queues {
+			if key.GemportId == gemPortId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTcontGemPort checks that a GemPort belongs to the T-CONT identified by allocId,
+// eg: that the queue is scheduled by a scheduler with that AllocId
+func (s *TechProfileStore) isTcontGemPort(uniId uint32, allocId uint32, gemPortId uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uni, ok := s.unis[uniId]
+	if !ok {
+		return false
+	}
+	for key := range uni.queues {
+		if key.GemportId != gemPortId {
+			continue
+		}
+		if sched, ok := uni.schedulers[key.Direction]; ok && sched.AllocId == allocId {
+			return true
+		}
+	}
+	return false
+}
+
+// poolIndex returns the index of the pool a PON takes the IDs of a given type from,
+// the PONs sharing a pool with the same range share its index
+func (o *OltDevice) poolIndex(poolType openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType, intfId uint32) *poolIndex {
+	key := poolKey{
+		poolType: poolType,
+		shared:   o.DeviceInfo.IsShared(poolType, intfId),
+		idRange:  o.DeviceInfo.GetRange(poolType, intfId),
+	}
+	if !key.shared {
+		key.intfId = intfId
+	}
+	return o.pools.get(key)
+}
+
+// validateTrafficSchedulers checks that the T-CONTs can be created on the ONU,
+// AllocIds are unique in their pool but the upstream and downstream schedulers of a UNI share the same one
+func (o *OltDevice) validateTrafficSchedulers(onu *Onu, ts *tech_profile.TrafficSchedulers) error {
+	pon, err := o.GetPonById(onu.PonPortID)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	allocIdRange := o.DeviceInfo.GetRange(openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID, pon.ID)
+	allocIds := o.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID, pon.ID)
+	directions := map[tech_profile.Direction]bool{}
+	for _, sched := range ts.TrafficScheds {
+		if !allocIdRange.Contains(sched.AllocId) {
+			return status.Errorf(codes.InvalidArgument, "alloc-id-%d-out-of-range-%s", sched.AllocId, allocIdRange)
+		}
+
+		if directions[sched.Direction] {
+			return status.Errorf(codes.InvalidArgument, "duplicate-%s-scheduler-for-uni-%d", sched.Direction, ts.UniId)
+		}
+		directions[sched.Direction] = true
+
+		if existing, ok := onu.TechProfile.getScheduler(ts.UniId, sched.Direction); ok && !proto.Equal(existing, sched) {
+			return status.Errorf(codes.AlreadyExists, "%s-scheduler-already-exists-for-onu-%d-%d-uni-%d", sched.Direction, onu.PonPortID, onu.ID, ts.UniId)
+		}
+
+		users := allocIds.get(sched.AllocId, func(user poolUser) bool {
+			return user.onu.TechProfile.hasAllocId(user.uniId, sched.AllocId)
+		})
+		for _, other := range users {
+			if other.onu != onu || other.uniId != ts.UniId {
+				return status.Errorf(codes.AlreadyExists, "alloc-id-%d-already-in-use-on-onu-%d-%d", sched.AllocId, other.onu.PonPortID, other.onu.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTrafficQueues checks that the GemPorts can be created on the ONU,
+// every queue must be scheduled by a T-CONT that was already created for the UNI
+func (o *OltDevice) validateTrafficQueues(onu *Onu, tq *tech_profile.TrafficQueues) error {
+	pon, err := o.GetPonById(onu.PonPortID)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	gemportIdRange := o.DeviceInfo.GetRange(openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID, pon.ID)
+	gemPorts := o.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID, pon.ID)
+	for _, q := range tq.TrafficQueues {
+		if !gemportIdRange.Contains(q.GemportId) {
+			return status.Errorf(codes.InvalidArgument, "gem-port-%d-out-of-range-%s", q.GemportId, gemportIdRange)
+		}
+
+		if _, ok := onu.TechProfile.getScheduler(tq.UniId, q.Direction); !ok {
+			return status.Errorf(codes.FailedPrecondition, "cannot-find-%s-scheduler-for-onu-%d-%d-uni-%d", q.Direction, onu.PonPortID, onu.ID, tq.UniId)
+		}
+
+		users := gemPorts.get(q.GemportId, func(user poolUser) bool {
+			return user.onu.TechProfile.hasGemPort(user.uniId, q.GemportId)
+		})
+		for _, other := range users {
+			if other.onu != onu || other.uniId != tq.UniId {
+				return status.Errorf(codes.AlreadyExists, "gem-port-%d-already-in-use-on-onu-%d-%d", q.GemportId, other.onu.PonPortID, other.onu.ID)
+			}
+		}
+	}
+	return nil
+}
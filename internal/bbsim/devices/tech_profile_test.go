@@ -0,0 +1,250 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"context"
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"github.com/opencord/voltha-protos/go/tech_profile"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func createTestSchedulers(onu *Onu, uniId uint32, allocId uint32) *tech_profile.TrafficSchedulers {
+	return &tech_profile.TrafficSchedulers{
+		IntfId: onu.PonPortID,
+		OnuId:  onu.ID,
+		UniId:  uniId,
+		TrafficScheds: []*tech_profile.TrafficScheduler{
+			{Direction: tech_profile.Direction_UPSTREAM, AllocId: allocId},
+		},
+	}
+}
+
+func createTestQueues(onu *Onu, uniId uint32, gemPortIds ...uint32) *tech_profile.TrafficQueues {
+	tq := &tech_profile.TrafficQueues{
+		IntfId: onu.PonPortID,
+		OnuId:  onu.ID,
+		UniId:  uniId,
+	}
+	for _, gem := range gemPortIds {
+		tq.TrafficQueues = append(tq.TrafficQueues, &tech_profile.TrafficQueue{Direction: tech_profile.Direction_UPSTREAM, GemportId: gem})
+	}
+	return tq
+}
+
+func Test_Olt_CreateTrafficSchedulers(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	onu := olt.Pons[0].Onus[0]
+	other := olt.Pons[0].Onus[1]
+
+	_, err := olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu, 0, 1024))
+	assert.NilError(t, err)
+
+	// VOLTHA can send the same schedulers again
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu, 0, 1024))
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name string
+		ts   *tech_profile.TrafficSchedulers
+		code codes.Code
+	}{
+		{"unknown-onu", &tech_profile.TrafficSchedulers{IntfId: 0, OnuId: 10}, codes.NotFound},
+		{"alloc-id-out-of-range", createTestSchedulers(onu, 1, 10), codes.InvalidArgument},
+		{"different-scheduler-same-uni", createTestSchedulers(onu, 0, 1025), codes.AlreadyExists},
+		{"alloc-id-used-by-another-uni", createTestSchedulers(onu, 1, 1024), codes.AlreadyExists},
+		{"alloc-id-used-by-another-onu", createTestSchedulers(other, 0, 1024), codes.AlreadyExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := olt.CreateTrafficSchedulers(context.TODO(), tt.ts)
+			assert.Equal(t, status.Code(err), tt.code)
+		})
+	}
+
+	schedulers := onu.TechProfile.GetSchedulers(onu.PonPortID, onu.ID)
+	assert.Equal(t, len(schedulers), 1)
+	assert.Equal(t, schedulers[0].TrafficScheds[0].AllocId, uint32(1024))
+
+	_, err = olt.RemoveTrafficSchedulers(context.TODO(), createTestSchedulers(onu, 0, 1024))
+	assert.NilError(t, err)
+	assert.Equal(t, len(onu.TechProfile.GetSchedulers(onu.PonPortID, onu.ID)), 0)
+
+	// once removed the AllocId can be reused
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(other, 0, 1024))
+	assert.NilError(t, err)
+}
+
+func Test_Olt_CreateTrafficQueues(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	onu := olt.Pons[0].Onus[0]
+	other := olt.Pons[0].Onus[1]
+
+	// queues need a scheduler
+	_, err := olt.CreateTrafficQueues(context.TODO(), createTestQueues(onu, 0, 1024))
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu, 0, 1024))
+	assert.NilError(t, err)
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(other, 0, 1025))
+	assert.NilError(t, err)
+
+	_, err = olt.CreateTrafficQueues(context.TODO(), createTestQueues(onu, 0, 1024, 1025))
+	assert.NilError(t, err)
+
+	_, err = olt.CreateTrafficQueues(context.TODO(), createTestQueues(onu, 0, 10))
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+
+	_, err = olt.CreateTrafficQueues(context.TODO(), createTestQueues(other, 0, 1025))
+	assert.Equal(t, status.Code(err), codes.AlreadyExists)
+
+	queues := onu.TechProfile.GetQueues(onu.PonPortID, onu.ID)
+	assert.Equal(t, len(queues), 1)
+	assert.Equal(t, len(queues[0].TrafficQueues), 2)
+
+	_, err = olt.RemoveTrafficQueues(context.TODO(), createTestQueues(onu, 0, 1025))
+	assert.NilError(t, err)
+	assert.Equal(t, onu.TechProfile.hasGemPort(0, 1024), true)
+	assert.Equal(t, onu.TechProfile.hasGemPort(0, 1025), false)
+}
+
+func Test_TechProfileStore_IsTcontGemPort(t *testing.T) {
+	store := NewTechProfileStore()
+	store.AddSchedulers(&tech_profile.TrafficSchedulers{
+		UniId: 0,
+		TrafficScheds: []*tech_profile.TrafficScheduler{
+			{Direction: tech_profile.Direction_UPSTREAM, AllocId: 1024},
+		},
+	})
+	store.AddQueues(&tech_profile.TrafficQueues{
+		UniId: 0,
+		TrafficQueues: []*tech_profile.TrafficQueue{
+			{Direction: tech_profile.Direction_UPSTREAM, GemportId: 1024},
+		},
+	})
+
+	assert.Equal(t, store.isTcontGemPort(0, 1024, 1024), true)
+	assert.Equal(t, store.isTcontGemPort(0, 1025, 1024), false)
+	assert.Equal(t, store.isTcontGemPort(1, 1024, 1024), false)
+
+	store.Clear()
+	assert.Equal(t, store.hasAllocId(0, 1024), false)
+}
+
+func Test_Olt_CreateTrafficSchedulers_Pools(t *testing.T) {
+	olt := createTestOlt(3, 1)
+	olt.DeviceInfo.Ranges = []common.ResourceRangesOptions{
+		{
+			IntfIds: []uint32{0, 1},
+			Pools:   []common.PoolOptions{{Type: "ALLOC_ID", Sharing: "SHARED_BY_ALL_INTF_ALL_TECH", Start: 2048, End: 2559}},
+		},
+	}
+	onu0 := olt.Pons[0].Onus[0]
+	onu1 := olt.Pons[1].Onus[0]
+	onu2 := olt.Pons[2].Onus[0]
+
+	// PON 0 and 1 use the shared pool, PON 2 the device wide range
+	_, err := olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu0, 0, 1024))
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu0, 0, 2048))
+	assert.NilError(t, err)
+
+	// the AllocId is already used on the shared pool
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu1, 0, 2048))
+	assert.Equal(t, status.Code(err), codes.AlreadyExists)
+
+	// but it can be used on a PON with a dedicated pool
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu2, 0, 2048))
+	assert.NilError(t, err)
+}
+
+func Test_Olt_CreateTrafficSchedulers_RemovedOnu(t *testing.T) {
+	olt := createTestOlt(1, 2)
+	onu := olt.Pons[0].Onus[0]
+	other := olt.Pons[0].Onus[1]
+
+	_, err := olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(onu, 0, 1024))
+	assert.NilError(t, err)
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(other, 0, 1024))
+	assert.Equal(t, status.Code(err), codes.AlreadyExists)
+
+	// the AllocIds of an ONU that is removed can be reused right away
+	assert.NilError(t, olt.RemoveOnu(onu.Sn()))
+	_, err = olt.CreateTrafficSchedulers(context.TODO(), createTestSchedulers(other, 0, 1024))
+	assert.NilError(t, err)
+}
+
+func Test_Olt_RemoveTrafficQueuesSchedulers_PoolIndex(t *testing.T) {
+	olt := createTestOlt(1, 1)
+	onu := olt.Pons[0].Onus[0]
+	createTestTechProfile(t, olt, onu)
+	allocIds := olt.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID, 0)
+	gemPorts := olt.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID, 0)
+
+	// the GemPort is released once the upstream and the downstream queues are removed
+	_, err := olt.RemoveTrafficQueues(context.TODO(), createTestQueues(onu, 0, 1024))
+	assert.NilError(t, err)
+	assert.Equal(t, len(gemPorts.users[1024]), 1)
+	downstream := createTestQueues(onu, 0, 1024)
+	downstream.TrafficQueues[0].Direction = tech_profile.Direction_DOWNSTREAM
+	_, err = olt.RemoveTrafficQueues(context.TODO(), downstream)
+	assert.NilError(t, err)
+	assert.Equal(t, len(gemPorts.users), 0)
+
+	// and so is the AllocId
+	_, err = olt.RemoveTrafficSchedulers(context.TODO(), createTestSchedulers(onu, 0, 1024))
+	assert.NilError(t, err)
+	assert.Equal(t, len(allocIds.users[1024]), 1)
+	downstreamSched := createTestSchedulers(onu, 0, 1024)
+	downstreamSched.TrafficScheds[0].Direction = tech_profile.Direction_DOWNSTREAM
+	_, err = olt.RemoveTrafficSchedulers(context.TODO(), downstreamSched)
+	assert.NilError(t, err)
+	assert.Equal(t, len(allocIds.users), 0)
+}
+
+func Test_Olt_DeleteRemoveOnu_PoolIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(olt *OltDevice, onu *Onu) error
+	}{
+		{"delete", func(olt *OltDevice, onu *Onu) error {
+			_, err := olt.DeleteOnu(context.TODO(), &openolt.Onu{IntfId: onu.PonPortID, OnuId: onu.ID})
+			return err
+		}},
+		{"remove", func(olt *OltDevice, onu *Onu) error {
+			return olt.RemoveOnu(onu.Sn())
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			olt := createTestOlt(1, 1)
+			onu := olt.Pons[0].Onus[0]
+			createTestTechProfile(t, olt, onu)
+
+			// the IDs the ONU used are released along with it
+			assert.NilError(t, tt.remove(olt, onu))
+			assert.Equal(t, len(olt.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID, 0).users), 0)
+			assert.Equal(t, len(olt.poolIndex(openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID, 0).users), 0)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"github.com/looplab/fsm"
+	"net"
+)
+
+// subscriberStates are the states the EAPOL and DHCP clients of an UNI go through
+var subscriberStates = []string{"eapol_flow_received", "gem_port_added", "auth_started", "eap_start_sent", "eap_response_identity_sent", "eap_response_challenge_sent", "eap_response_success_received", "auth_failed", "dhcp_started", "dhcp_discovery_sent", "dhcp_request_sent", "dhcp_ack_received", "dhcp_failed"}
+
+// subscriberEvents drive the EAPOL and DHCP clients of an UNI,
+// they are part of both the ONU state machine (that drives the first UNI) and the UNI one
+var subscriberEvents = fsm.Events{
+	{Name: "receive_eapol_flow", Src: []string{"enabled", "gem_port_added"}, Dst: "eapol_flow_received"},
+	{Name: "add_gem_port", Src: []string{"enabled", "eapol_flow_received"}, Dst: "gem_port_added"},
+	// EAPOL
+	{Name: "start_auth", Src: []string{"eapol_flow_received", "gem_port_added", "eap_response_success_received", "auth_failed", "dhcp_ack_received", "dhcp_failed"}, Dst: "auth_started"},
+	{Name: "eap_start_sent", Src: []string{"auth_started"}, Dst: "eap_start_sent"},
+	{Name: "eap_response_identity_sent", Src: []string{"eap_start_sent"}, Dst: "eap_response_identity_sent"},
+	{Name: "eap_response_challenge_sent", Src: []string{"eap_response_identity_sent"}, Dst: "eap_response_challenge_sent"},
+	{Name: "eap_response_success_received", Src: []string{"eap_response_challenge_sent"}, Dst: "eap_response_success_received"},
+	{Name: "auth_failed", Src: []string{"auth_started", "eap_start_sent", "eap_response_identity_sent", "eap_response_challenge_sent"}, Dst: "auth_failed"},
+	// DHCP
+	{Name: "start_dhcp", Src: []string{"eap_response_success_received", "dhcp_discovery_sent", "dhcp_request_sent", "dhcp_ack_received", "dhcp_failed"}, Dst: "dhcp_started"},
+	{Name: "dhcp_discovery_sent", Src: []string{"dhcp_started"}, Dst: "dhcp_discovery_sent"},
+	{Name: "dhcp_request_sent", Src: []string{"dhcp_discovery_sent"}, Dst: "dhcp_request_sent"},
+	{Name: "dhcp_ack_received", Src: []string{"dhcp_request_sent"}, Dst: "dhcp_ack_received"},
+	{Name: "dhcp_failed", Src: []string{"dhcp_started", "dhcp_discovery_sent", "dhcp_request_sent"}, Dst: "dhcp_failed"},
+}
+
+type UniPort struct {
+	ID        uint32
+	HwAddress net.HardwareAddr
+	CTag      int
+
+	// PortNo comes with the flows and it's used when sending packetIndications
+	PortNo uint32
+	// GemPortId comes with the EAPOL flow, if it's not set the one created via OMCI is used
+	GemPortId        uint32
+	DhcpFlowReceived bool
+
+	// InternalState runs the EAPOL and DHCP clients of the UNI,
+	// it is nil for the first UNI as that one is driven by the ONU InternalState
+	InternalState *fsm.FSM
+}
+
+// newUniStateMachine creates the state machine of an UNI that is not the first one,
+// it follows the ONU through its lifecycle (enable, disable, initialize)
+func newUniStateMachine(callbacks fsm.Callbacks) *fsm.FSM {
+	active := append([]string{"enabled"}, subscriberStates...)
+	events := fsm.Events{
+		{Name: "enable", Src: []string{"created", "disabled"}, Dst: "enabled"},
+		{Name: "disable", Src: active, Dst: "disabled"},
+		{Name: "initialize", Src: append(active, "disabled"), Dst: "created"},
+	}
+	return fsm.NewFSM("created", append(events, subscriberEvents...), callbacks)
+}
+
+// reset clears everything the UNI learned from the flows
+func (u *UniPort) reset() {
+	u.PortNo = 0
+	u.GemPortId = 0
+	u.DhcpFlowReceived = false
+}
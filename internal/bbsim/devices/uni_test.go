@@ -0,0 +1,284 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"github.com/opencord/bbsim/internal/bbsim/responders/omcisim"
+	omcilib "github.com/opencord/bbsim/internal/common/omci"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func Test_CreateONU_Unis(t *testing.T) {
+	onu := createTestOnuWithUnis(3)
+
+	assert.Equal(t, len(onu.Unis), 3)
+
+	// the first UNI is the ONU itself
+	assert.Equal(t, onu.Unis[0].HwAddress.String(), onu.HwAddress.String())
+	assert.Equal(t, onu.Unis[0].CTag, onu.CTag)
+	assert.Equal(t, onu.UniState(onu.Unis[0]), onu.InternalState)
+
+	for i, uni := range onu.Unis[1:] {
+		assert.Equal(t, uni.ID, uint32(i+1))
+		assert.Equal(t, uni.CTag, onu.CTag+i+1)
+		assert.Assert(t, uni.HwAddress.String() != onu.HwAddress.String())
+		assert.Equal(t, uni.InternalState.Current(), "created")
+	}
+	assert.Equal(t, onu.Unis[2].HwAddress.String(), "2e:60:72:13:01:01")
+}
+
+func Test_Onu_UnisFollowTheOnuLifecycle(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+	uni := onu.Unis[1]
+
+	onu.InternalState.Event("discover")
+	assert.Equal(t, uni.InternalState.Current(), "created")
+
+	onu.InternalState.Event("enable")
+	assert.Equal(t, uni.InternalState.Current(), "enabled")
+
+	uni.InternalState.SetState("dhcp_ack_received")
+	onu.InternalState.Event("pon_disabled")
+	assert.Equal(t, uni.InternalState.Current(), "disabled")
+
+	onu.InternalState.Event("enable")
+	assert.Equal(t, uni.InternalState.Current(), "enabled")
+
+	uni.PortNo = 17
+	uni.GemPortId = 1025
+	uni.DhcpFlowReceived = true
+	onu.InternalState.Event("initialize")
+	assert.Equal(t, uni.InternalState.Current(), "created")
+	assert.Equal(t, uni.PortNo, uint32(0))
+	assert.Equal(t, uni.GemPortId, uint32(0))
+	assert.Equal(t, uni.DhcpFlowReceived, false)
+}
+
+func Test_Onu_StartEapolWithoutGemPort(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+	uni := onu.Unis[1]
+	uni.InternalState.SetState("auth_started")
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 1)}
+	onu.startEapol(uni.ID, stream)
+
+	assert.Equal(t, len(stream.indications), 0)
+	assert.Equal(t, uni.InternalState.Current(), "auth_failed")
+}
+
+func Test_Onu_StartEapolWithoutGemPort_FirstUni(t *testing.T) {
+	// NOTE the OLT did not create any GemPort yet, so not even the first UNI has one
+	onu := createTestOnu()
+	uni := onu.Unis[0]
+	// NOTE the first UNI uses the state machine of the ONU
+	onu.UniState(uni).SetState("auth_started")
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 1)}
+	onu.startEapol(uni.ID, stream)
+
+	assert.Equal(t, len(stream.indications), 0)
+	assert.Equal(t, onu.UniState(uni).Current(), "auth_failed")
+}
+
+func Test_Onu_StartDhcpWithoutGemPort(t *testing.T) {
+	tests := []struct {
+		name string
+		onu  *Onu
+		uni  int
+	}{
+		{"first-uni", createTestOnu(), 0},
+		{"other-uni", createTestOnuWithUnis(2), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uni := tt.onu.Unis[tt.uni]
+			tt.onu.UniState(uni).SetState("dhcp_started")
+
+			stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 1)}
+			tt.onu.startDhcp(uni.ID, stream)
+
+			assert.Equal(t, len(stream.indications), 0)
+			assert.Equal(t, tt.onu.UniState(uni).Current(), "dhcp_failed")
+		})
+	}
+}
+
+func Test_Onu_StartEapolOnUni(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+	uni := onu.Unis[1]
+	uni.InternalState.SetState("auth_started")
+	uni.PortNo = 17
+	uni.GemPortId = 1025
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 1)}
+	onu.startEapol(uni.ID, stream)
+
+	assert.Equal(t, len(stream.indications), 1)
+	pktInd := (<-stream.indications).GetPktInd()
+	assert.Equal(t, pktInd.PortNo, uint32(17))
+	assert.Equal(t, pktInd.GemportId, uint32(1025))
+	assert.Equal(t, uni.InternalState.Current(), "eap_start_sent")
+	assert.Equal(t, onu.InternalState.Current(), "created")
+}
+
+func Test_Onu_MibReportsUnis(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+
+	for i := uint32(0); i < 2; i++ {
+		_, ok := onu.mib.Entity(me.PhysicalPathTerminationPointEthernetUniClassId, omcisim.UniEntityId(i))
+		assert.Assert(t, ok)
+	}
+	_, ok := onu.mib.Entity(me.PhysicalPathTerminationPointEthernetUniClassId, omcisim.UniEntityId(2))
+	assert.Assert(t, !ok)
+
+	// the ONU-G reports the serial number of the ONU
+	onuG, _ := onu.mib.Entity(me.OnuGClassId, 0)
+	assert.Equal(t, onuG["VendorId"], binary.BigEndian.Uint32(onu.SerialNumber.VendorId))
+}
+
+func Test_Onu_OmciGemPortAdded(t *testing.T) {
+	onu := createTestOnuWithUnis(2)
+	for _, uni := range onu.Unis {
+		onu.UniState(uni).SetState("enabled")
+	}
+	_, err := onu.getGemPortId(onu.Unis[1])
+	assert.Assert(t, err != nil)
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 1)}
+	gemReq, _ := omcilib.CreateGemPortRequest(1)
+	onu.handleOmciMessage(OmciMessage{omciMsg: &openolt.OmciMsg{Pkt: gemReq}}, stream)
+
+	resp := (<-stream.indications).GetOmciInd()
+	assert.Equal(t, resp.Pkt[2], byte(omci.CreateResponseType))
+	assert.Equal(t, resp.Pkt[8], byte(me.Success))
+
+	// without bridge ports the GemPort belongs to the first UNI only
+	assert.Equal(t, onu.UniState(onu.Unis[0]).Current(), "gem_port_added")
+	assert.Equal(t, onu.UniState(onu.Unis[1]).Current(), "enabled")
+	_, err = onu.getGemPortId(onu.Unis[1])
+	assert.Assert(t, err != nil)
+	assert.Assert(t, onu.hasGemPort(0, 1))
+	assert.Assert(t, !onu.hasGemPort(1, 1))
+
+	// the GemPort is bridged to the second UNI
+	bridgePort := func(id uint16, tpType uint8, tpPointer uint16) *me.ManagedEntity {
+		port, _ := me.NewMacBridgePortConfigurationData(me.ParamData{
+			EntityID: id,
+			Attributes: me.AttributeValueMap{
+				"BridgeIdPointer":     uint16(0x201),
+				"PortNum":             uint8(id),
+				"TpType":              tpType,
+				"TpPointer":           tpPointer,
+				"PortPriority":        uint16(0),
+				"PortPathCost":        uint16(1),
+				"PortSpanningTreeInd": uint8(0),
+				"Deprecated1":         uint8(0),
+				"Deprecated2":         uint8(0),
+				"MacLearningDepth":    uint8(0),
+			},
+		})
+		return port
+	}
+	iwtp, _ := me.NewGemInterworkingTerminationPoint(me.ParamData{
+		EntityID: 1,
+		Attributes: me.AttributeValueMap{
+			"GemPortNetworkCtpConnectivityPointer": uint16(1),
+			"InterworkingOption":                   uint8(5),
+			"ServiceProfilePointer":                uint16(0x8001),
+			"InterworkingTerminationPointPointer":  uint16(0),
+			"GalProfilePointer":                    uint16(1),
+		},
+	})
+	mapperAttributes := me.AttributeValueMap{
+		"TpPointer":             uint16(0xFFFF),
+		"UnmarkedFrameOption":   uint8(1),
+		"DefaultPBitAssumption": uint8(0),
+		"TpType":                uint8(0),
+	}
+	for p := 0; p < 8; p++ {
+		mapperAttributes[fmt.Sprintf("InterworkTpPointerForPBitPriority%d", p)] = uint16(0xFFFF)
+	}
+	mapperAttributes["InterworkTpPointerForPBitPriority0"] = uint16(1)
+	mapper, _ := me.NewIeee8021PMapperServiceProfile(me.ParamData{EntityID: 0x8001, Attributes: mapperAttributes})
+	uniPort := bridgePort(0x201, 1, omcisim.UniEntityId(1))
+	aniPort := bridgePort(0x202, 3, 0x8001)
+	for i, entity := range []*me.ManagedEntity{uniPort, iwtp, mapper} {
+		req, err := omci.GenFrame(entity, omci.CreateRequestType, omci.TransactionID(uint16(i+2)))
+		assert.NilError(t, err)
+		onu.handleOmciMessage(OmciMessage{omciMsg: &openolt.OmciMsg{Pkt: []byte(hex.EncodeToString(req))}}, stream)
+		<-stream.indications
+		assert.Equal(t, onu.UniState(onu.Unis[1]).Current(), "enabled")
+	}
+	req, err := omci.GenFrame(aniPort, omci.CreateRequestType, omci.TransactionID(5))
+	assert.NilError(t, err)
+	onu.handleOmciMessage(OmciMessage{omciMsg: &openolt.OmciMsg{Pkt: []byte(hex.EncodeToString(req))}}, stream)
+	<-stream.indications
+
+	assert.Equal(t, onu.UniState(onu.Unis[1]).Current(), "gem_port_added")
+	gem, err := onu.getGemPortId(onu.Unis[1])
+	assert.NilError(t, err)
+	assert.Equal(t, gem, uint32(1))
+	assert.Assert(t, onu.hasGemPort(1, 1))
+
+	// the GemPorts are dropped when the ONU is reset
+	onu.reset()
+	assert.Assert(t, !onu.hasGemPort(1, 1))
+}
+
+func Test_Onu_OmciReboot(t *testing.T) {
+	onu := createTestOnu()
+	onu.InternalState.SetState("enabled")
+	onu.rebootDelay = 10 * time.Millisecond
+
+	gal, _ := me.NewGalEthernetProfile(me.ParamData{
+		EntityID:   1,
+		Attributes: me.AttributeValueMap{"MaximumGemPayloadSize": uint16(48)},
+	})
+	galReq, _ := omci.GenFrame(gal, omci.CreateRequestType, omci.TransactionID(1))
+	onuG, _ := me.NewOnuG(me.ParamData{EntityID: 0})
+	rebootReq, _ := omci.GenFrame(onuG, omci.RebootRequestType, omci.TransactionID(2))
+
+	stream := &mockIndicationStream{indications: make(chan *openolt.Indication, 2)}
+	for _, req := range [][]byte{galReq, rebootReq} {
+		onu.handleOmciMessage(OmciMessage{omciMsg: &openolt.OmciMsg{Pkt: []byte(hex.EncodeToString(req))}}, stream)
+	}
+	<-stream.indications
+	resp := (<-stream.indications).GetOmciInd()
+	assert.Equal(t, resp.Pkt[2], byte(omci.RebootResponseType))
+
+	// the response is sent before the ONU goes down, losing what the OLT created
+	assert.Equal(t, onu.InternalState.Current(), "disabled")
+	msg := nextMessage(t, onu)
+	assert.Equal(t, msg.Type, OnuIndication)
+	assert.Equal(t, msg.Data.(OnuIndicationMessage).OperState, DOWN)
+	_, ok := onu.mib.Entity(me.GalEthernetProfileClassId, 1)
+	assert.Assert(t, !ok)
+
+	for i := 0; i < 100 && onu.InternalState.Current() != "enabled"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, onu.InternalState.Current(), "enabled")
+}
@@ -18,6 +18,7 @@ package dhcp
 
 import (
 	"errors"
+	"github.com/google/gopacket/layers"
 	"github.com/looplab/fsm"
 	"github.com/opencord/voltha-protos/go/openolt"
 	"google.golang.org/grpc"
@@ -67,20 +68,12 @@ func TestSendDHCPDiscovery(t *testing.T) {
 	var mac = net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, byte(ponPortId), byte(onuId)}
 	var portNo uint32 = 16
 
-	// Save current function and restore at the end:
-	old := GetGemPortId
-	defer func() { GetGemPortId = old }()
-
-	GetGemPortId = func(intfId uint32, onuId uint32) (uint16, error) {
-		return gemPortId, nil
-	}
-
 	stream := &mockStreamSuccess{
 		Calls: make(map[int]*openolt.PacketIndication),
 		fail:  false,
 	}
 
-	if err := SendDHCPDiscovery(ponPortId, onuId, serialNumber, portNo, dhcpStateMachine, mac, 1, stream); err != nil {
+	if err := SendDHCPDiscovery(ponPortId, onuId, serialNumber, portNo, uint32(gemPortId), dhcpStateMachine, mac, 1, stream); err != nil {
 		t.Errorf("SendDHCPDiscovery returned an error: %v", err)
 		t.Fail()
 	}
@@ -94,6 +87,29 @@ func TestSendDHCPDiscovery(t *testing.T) {
 	assert.Equal(t, dhcpStateMachine.Current(), "dhcp_discovery_sent")
 }
 
+func TestCreateDHCPDisc_UniqueXid(t *testing.T) {
+	// the ONU IDs VOLTHA assigns are not related to the MAC addresses,
+	// the XID and the client ID are derived from the latter
+	first := createDHCPDisc(0, 1, net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, 0x00, 0x0b})
+	second := createDHCPDisc(10, 1, net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, 0x0a, 0x01})
+	secondUni := createDHCPDisc(10, 1, net.HardwareAddr{0x2e, 0x60, 0x71, 0x13, 0x0a, 0x01})
+
+	assert.Equal(t, first.Xid, uint32(0x7013000b))
+	assert.Assert(t, first.Xid != second.Xid)
+	assert.Assert(t, second.Xid != secondUni.Xid)
+
+	clientId := func(dhcp *layers.DHCPv4) []byte {
+		for _, opt := range dhcp.Options {
+			if opt.Type == layers.DHCPOptClientID {
+				return opt.Data
+			}
+		}
+		return nil
+	}
+	assert.DeepEqual(t, clientId(second)[12:], []byte{0x2e, 0x60, 0x70, 0x13, 0x0a, 0x01})
+	assert.DeepEqual(t, clientId(secondUni)[12:], []byte{0x2e, 0x60, 0x71, 0x13, 0x0a, 0x01})
+}
+
 // TODO test dhcp.HandleNextPacket
 
 func TestUpdateDhcpFailed(t *testing.T) {
@@ -24,7 +24,6 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/looplab/fsm"
 	bbsim "github.com/opencord/bbsim/internal/bbsim/types"
-	omci "github.com/opencord/omci-sim"
 	"github.com/opencord/voltha-protos/go/openolt"
 	log "github.com/sirupsen/logrus"
 	"net"
@@ -35,22 +34,13 @@ var eapolLogger = log.WithFields(log.Fields{
 })
 
 var eapolVersion uint8 = 1
-var GetGemPortId = omci.GetGemPortId
 
-func sendEapolPktIn(msg bbsim.ByteMsg, portNo uint32, stream openolt.Openolt_EnableIndicationServer) {
+func sendEapolPktIn(msg bbsim.ByteMsg, portNo uint32, gemPortId uint32, stream openolt.Openolt_EnableIndicationServer) {
 	// FIXME unify sendDHCPPktIn and sendEapolPktIn methods
-	gemid, err := omci.GetGemPortId(msg.IntfId, msg.OnuId)
-	if err != nil {
-		eapolLogger.WithFields(log.Fields{
-			"OnuId":  msg.OnuId,
-			"IntfId": msg.IntfId,
-		}).Errorf("Can't retrieve GemPortId: %s", err)
-		return
-	}
 	data := &openolt.Indication_PktInd{PktInd: &openolt.PacketIndication{
 		IntfType:  "pon",
 		IntfId:    msg.IntfId,
-		GemportId: uint32(gemid),
+		GemportId: gemPortId,
 		Pkt:       msg.Bytes,
 		PortNo:    portNo,
 	}}
@@ -123,12 +113,12 @@ func createEAPSuccess(eapId uint8) *layers.EAP {
 	return &eap
 }
 
-func createEAPOLPkt(eap *layers.EAP, onuId uint32, intfId uint32) []byte {
+func createEAPOLPkt(eap *layers.EAP, macAddress net.HardwareAddr) []byte {
 	buffer := gopacket.NewSerializeBuffer()
 	options := gopacket.SerializeOptions{}
 
 	ethernetLayer := &layers.Ethernet{
-		SrcMAC:       net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, byte(intfId), byte(onuId)},
+		SrcMAC:       macAddress,
 		DstMAC:       net.HardwareAddr{0x01, 0x80, 0xC2, 0x00, 0x00, 0x03},
 		EthernetType: layers.EthernetTypeEAPOL,
 	}
@@ -188,23 +178,9 @@ func updateAuthFailed(onuId uint32, ponPortId uint32, serialNumber string, onuSt
 	return nil
 }
 
-func SendEapStart(onuId uint32, ponPortId uint32, serialNumber string, portNo uint32, macAddress net.HardwareAddr, onuStateMachine *fsm.FSM, stream bbsim.Stream) error {
+func SendEapStart(onuId uint32, ponPortId uint32, serialNumber string, portNo uint32, gemPortId uint32, macAddress net.HardwareAddr, onuStateMachine *fsm.FSM, stream bbsim.Stream) error {
 
 	// send the packet (hacked together)
-	gemId, err := GetGemPortId(ponPortId, onuId)
-	if err != nil {
-		eapolLogger.WithFields(log.Fields{
-			"OnuId":  onuId,
-			"IntfId": ponPortId,
-			"OnuSn":  serialNumber,
-		}).Errorf("Can't retrieve GemPortId: %s", err)
-
-		if err := updateAuthFailed(onuId, ponPortId, serialNumber, onuStateMachine); err != nil {
-			return err
-		}
-		return err
-	}
-
 	// TODO use createEAPOLPkt
 	buffer := gopacket.NewSerializeBuffer()
 	options := gopacket.SerializeOptions{}
@@ -227,14 +203,13 @@ func SendEapStart(onuId uint32, ponPortId uint32, serialNumber string, portNo ui
 		PktInd: &openolt.PacketIndication{
 			IntfType:  "pon",
 			IntfId:    ponPortId,
-			GemportId: uint32(gemId),
+			GemportId: gemPortId,
 			Pkt:       msg,
 			PortNo:    portNo,
 		},
 	}
 
-	err = stream.Send(&openolt.Indication{Data: data})
-	if err != nil {
+	if err := stream.Send(&openolt.Indication{Data: data}); err != nil {
 		eapolLogger.WithFields(log.Fields{
 			"OnuId":  onuId,
 			"IntfId": ponPortId,
@@ -265,7 +240,7 @@ func SendEapStart(onuId uint32, ponPortId uint32, serialNumber string, portNo ui
 	return nil
 }
 
-func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portNo uint32, onuStateMachine *fsm.FSM, pkt gopacket.Packet, stream openolt.Openolt_EnableIndicationServer, client openolt.OpenoltClient) {
+func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portNo uint32, gemPortId uint32, macAddress net.HardwareAddr, onuStateMachine *fsm.FSM, pkt gopacket.Packet, stream openolt.Openolt_EnableIndicationServer, client openolt.OpenoltClient) {
 
 	eap, eapErr := extractEAP(pkt)
 
@@ -298,7 +273,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 
 	if eapol != nil && eapol.Type == layers.EAPOLTypeStart {
 		identityRequest := createEAPIdentityRequest(1)
-		pkt := createEAPOLPkt(identityRequest, onuId, ponPortId)
+		pkt := createEAPOLPkt(identityRequest, macAddress)
 
 		if err := sendEapolPktOut(client, ponPortId, onuId, pkt); err != nil {
 			log.WithFields(log.Fields{
@@ -318,7 +293,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 		return
 	} else if eap.Code == layers.EAPCodeRequest && eap.Type == layers.EAPTypeIdentity {
 		reseap := createEAPIdentityResponse(eap.Id)
-		pkt := createEAPOLPkt(reseap, onuId, ponPortId)
+		pkt := createEAPOLPkt(reseap, macAddress)
 
 		msg := bbsim.ByteMsg{
 			IntfId: ponPortId,
@@ -326,7 +301,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 			Bytes:  pkt,
 		}
 
-		sendEapolPktIn(msg, portNo, stream)
+		sendEapolPktIn(msg, portNo, gemPortId, stream)
 		eapolLogger.WithFields(log.Fields{
 			"OnuId":  onuId,
 			"IntfId": ponPortId,
@@ -345,7 +320,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 		senddata := getMD5Data(eap)
 		senddata = append([]byte{0x10}, senddata...)
 		challengeRequest := createEAPChallengeRequest(eap.Id, senddata)
-		pkt := createEAPOLPkt(challengeRequest, onuId, ponPortId)
+		pkt := createEAPOLPkt(challengeRequest, macAddress)
 
 		if err := sendEapolPktOut(client, ponPortId, onuId, pkt); err != nil {
 			log.WithFields(log.Fields{
@@ -366,7 +341,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 		senddata := getMD5Data(eap)
 		senddata = append([]byte{0x10}, senddata...)
 		sendeap := createEAPChallengeResponse(eap.Id, senddata)
-		pkt := createEAPOLPkt(sendeap, onuId, ponPortId)
+		pkt := createEAPOLPkt(sendeap, macAddress)
 
 		msg := bbsim.ByteMsg{
 			IntfId: ponPortId,
@@ -374,7 +349,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 			Bytes:  pkt,
 		}
 
-		sendEapolPktIn(msg, portNo, stream)
+		sendEapolPktIn(msg, portNo, gemPortId, stream)
 		eapolLogger.WithFields(log.Fields{
 			"OnuId":  onuId,
 			"IntfId": ponPortId,
@@ -390,7 +365,7 @@ func HandleNextPacket(onuId uint32, ponPortId uint32, serialNumber string, portN
 		}
 	} else if eap.Code == layers.EAPCodeResponse && eap.Type == layers.EAPTypeOTP {
 		eapSuccess := createEAPSuccess(eap.Id)
-		pkt := createEAPOLPkt(eapSuccess, onuId, ponPortId)
+		pkt := createEAPOLPkt(eapSuccess, macAddress)
 
 		if err := sendEapolPktOut(client, ponPortId, onuId, pkt); err != nil {
 			log.WithFields(log.Fields{
@@ -0,0 +1,487 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+)
+
+const (
+	// by default the ONU has 8 T-CONTs, each one with 8 upstream priority queues and a traffic scheduler,
+	// and 8 downstream priority queues per UNI
+	defaultTconts        = 8
+	defaultQueuesPerPort = 8
+	defaultEquipmentId   = "BBSM_EQUIPMENT"
+	defaultVersion       = "BBSM_IMG_00001"
+	omccVersion          = 0xA3
+	maxQueueSize         = 0x0100
+	ethernetUniType      = 0x2F // 10/100/1000BASE-T
+	gponAniType          = 0xF8 // GPON24881244
+	uniSlot              = 0x01
+	aniSlot              = 0x80
+	maxEthernetFrames    = 0x05EE
+)
+
+// MibConfig describes the ONU a MIB is built for, the zero values are replaced by the defaults
+type MibConfig struct {
+	NumUnis int
+	// Veip reports the UNIs as VEIPs instead of PPTPs
+	Veip bool
+	// SerialNumber is the vendor ID followed by the vendor specific part
+	SerialNumber []byte
+	// VendorId is reported instead of the one in the serial number
+	VendorId    string
+	EquipmentId string
+	Version     string
+	// SoftwareImages are the versions of the active and standby images,
+	// if there is only one both images have the same version
+	SoftwareImages []string
+	NumTconts      int
+	QueuesPerPort  int
+}
+
+func (c MibConfig) withDefaults() MibConfig {
+	if c.EquipmentId == "" {
+		c.EquipmentId = defaultEquipmentId
+	}
+	if c.Version == "" {
+		c.Version = defaultVersion
+	}
+	if len(c.SoftwareImages) == 0 {
+		c.SoftwareImages = []string{c.Version}
+	}
+	if len(c.SoftwareImages) == 1 {
+		c.SoftwareImages = []string{c.SoftwareImages[0], c.SoftwareImages[0]}
+	}
+	if c.NumTconts == 0 {
+		c.NumTconts = defaultTconts
+	}
+	if c.QueuesPerPort == 0 {
+		c.QueuesPerPort = defaultQueuesPerPort
+	}
+	return c
+}
+
+type entityKey struct {
+	class    me.ClassID
+	instance uint16
+}
+
+// Mib stores the managed entities of an ONU: the ones the ONU creates when it is reset
+// and the ones the OLT creates, with the values of their attributes.
+// NOTE the Mib is not safe for concurrent use, it is accessed while the ONU processes its messages only
+type Mib struct {
+	config   MibConfig
+	entities map[entityKey]me.AttributeValueMap
+	// order is the order the entities are reported in the MIB upload, the ones created by the OLT come last
+	order []entityKey
+	// upload is the snapshot of the MIB taken by the last MIB upload, one entry per MibUploadNext command
+	upload []*me.ManagedEntity
+	// NOTE the software images and the download survive the MIB reset, as they are not part of the configuration
+	images          [2]SoftwareImage
+	download        *download
+	downloadFailure DownloadFailure
+	// pm is the traffic of the current PM interval, intervalEndTime is the number of the last one that ended
+	pm              *pmInterval
+	intervalEndTime uint8
+	alarmSequence   uint8
+}
+
+func NewMib(config MibConfig) *Mib {
+	m := &Mib{config: config, pm: newPmInterval()}
+	for i, version := range config.withDefaults().SoftwareImages {
+		// the first image is the active and committed one
+		m.images[i] = SoftwareImage{Version: version, Committed: i == 0, Active: i == 0, Valid: true}
+	}
+	m.Reset()
+	return m
+}
+
+// Reset drops the entities the OLT created and restores the ones the ONU creates
+func (m *Mib) Reset() {
+	m.entities = make(map[entityKey]me.AttributeValueMap)
+	m.order = nil
+	m.upload = nil
+
+	config := m.config.withDefaults()
+	numTconts := uint16(config.NumTconts)
+	queuesPerPort := uint16(config.QueuesPerPort)
+
+	serialNumber := make([]byte, 8)
+	copy(serialNumber, config.SerialNumber)
+	vendorId := binary.BigEndian.Uint32(serialNumber[0:4])
+	if config.VendorId != "" {
+		vendorId = binary.BigEndian.Uint32(fixedString(config.VendorId, 4))
+	}
+
+	m.add(me.OnuDataClassId, 0, me.AttributeValueMap{
+		"MibDataSync": uint8(0),
+	})
+	m.add(me.OnuGClassId, 0, me.AttributeValueMap{
+		"VendorId":                vendorId,
+		"Version":                 fixedString(config.Version, 14),
+		"SerialNumber":            binary.BigEndian.Uint64(serialNumber),
+		"TrafficManagementOption": uint8(0), // priority controlled
+	})
+	m.add(me.Onu2GClassId, 0, me.AttributeValueMap{
+		"EquipmentId": fixedString(config.EquipmentId, 20),
+		"OpticalNetworkUnitManagementAndControlChannelOmccVersion": uint8(omccVersion),
+		"SecurityCapability":          uint8(1),
+		"SecurityMode":                uint8(1),
+		"TotalPriorityQueueNumber":    queuesPerPort * (numTconts + uint16(config.NumUnis)),
+		"TotalTrafficSchedulerNumber": uint8(numTconts),
+		"Deprecated":                  uint8(1),
+		"TotalGemPortIdNumber":        uint16(0x0400),
+	})
+	for image := range m.images {
+		m.add(me.SoftwareImageClassId, uint16(image), me.AttributeValueMap{})
+	}
+	m.updateImages()
+	m.add(me.CircuitPackClassId, uniSlot<<8|uint16(uniSlot), me.AttributeValueMap{
+		"Type":                        uint8(ethernetUniType),
+		"NumberOfPorts":               uint8(config.NumUnis),
+		"SerialNumber":                binary.BigEndian.Uint64(serialNumber),
+		"Version":                     fixedString(config.Version, 14),
+		"VendorId":                    vendorId,
+		"EquipmentId":                 fixedString(config.EquipmentId, 20),
+		"TotalPriorityQueueNumber":    uint8(queuesPerPort * uint16(config.NumUnis)),
+		"TotalTrafficSchedulerNumber": uint8(0),
+	})
+	m.add(me.CircuitPackClassId, aniSlot<<8|uint16(aniSlot), me.AttributeValueMap{
+		"Type":                        uint8(gponAniType),
+		"NumberOfPorts":               uint8(1),
+		"SerialNumber":                binary.BigEndian.Uint64(serialNumber),
+		"Version":                     fixedString(config.Version, 14),
+		"VendorId":                    vendorId,
+		"EquipmentId":                 fixedString(config.EquipmentId, 20),
+		"TotalTContBufferNumber":      uint8(numTconts),
+		"TotalPriorityQueueNumber":    uint8(queuesPerPort * numTconts),
+		"TotalTrafficSchedulerNumber": uint8(numTconts),
+	})
+	m.add(me.AniGClassId, aniSlot<<8|1, me.AttributeValueMap{
+		"SrIndication":                uint8(1),
+		"TotalTcontNumber":            numTconts,
+		"GemBlockLength":              uint16(0x0030),
+		"SignalFailThreshold":         uint8(5),
+		"SignalDegradeSdThreshold":    uint8(9),
+		"LowerOpticalThreshold":       uint8(0xFF),
+		"UpperOpticalThreshold":       uint8(0xFF),
+		"LowerTransmitPowerThreshold": uint8(0x81),
+		"UpperTransmitPowerThreshold": uint8(0x81),
+	})
+
+	for i := 0; i < config.NumUnis; i++ {
+		uni := UniEntityId(uint32(i))
+		if config.Veip {
+			m.add(me.VirtualEthernetInterfacePointClassId, uni, me.AttributeValueMap{
+				"IanaAssignedPort": uint16(0xFFFF),
+			})
+		} else {
+			m.add(me.PhysicalPathTerminationPointEthernetUniClassId, uni, me.AttributeValueMap{
+				"SensedType":       uint8(ethernetUniType),
+				"ConfigurationInd": uint8(0x03), // 1000BASE-T full duplex
+				"MaxFrameSize":     uint16(maxEthernetFrames),
+				"BridgedOrIpInd":   uint8(0x02), // depends on the parent circuit pack
+			})
+		}
+		m.add(me.UniGClassId, uni, me.AttributeValueMap{})
+	}
+
+	for t := uint16(0); t < numTconts; t++ {
+		m.add(me.TContClassId, tcontEntityId(t), me.AttributeValueMap{
+			"AllocId":    uint16(0xFFFF), // not assigned
+			"Deprecated": uint8(1),
+			"Policy":     uint8(1), // strict priority
+		})
+		m.add(me.TrafficSchedulerClassId, aniSlot<<8|t, me.AttributeValueMap{
+			"TContPointer": tcontEntityId(t),
+			"Policy":       uint8(1),
+		})
+	}
+
+	// NOTE the upstream queues are related to the T-CONTs and the downstream ones to the UNIs,
+	// the related port is the entity ID of the port followed by the priority of the queue
+	for t := uint16(0); t < numTconts; t++ {
+		for q := uint16(0); q < queuesPerPort; q++ {
+			m.add(me.PriorityQueueClassId, 0x8000|(t*queuesPerPort+q+1), priorityQueue(tcontEntityId(t), q))
+		}
+	}
+	for i := 0; i < config.NumUnis; i++ {
+		for q := uint16(0); q < queuesPerPort; q++ {
+			m.add(me.PriorityQueueClassId, uint16(i)*queuesPerPort+q+1, priorityQueue(UniEntityId(uint32(i)), q))
+		}
+	}
+}
+
+// UniEntityId is the entity ID of the PPTP (or VEIP) and the UNI-G of an UNI
+func UniEntityId(uniId uint32) uint16 {
+	return uniSlot<<8 | uint16(uniId+1)
+}
+
+func tcontEntityId(tcont uint16) uint16 {
+	return aniSlot<<8 | (tcont + 1)
+}
+
+func priorityQueue(port uint16, priority uint16) me.AttributeValueMap {
+	return me.AttributeValueMap{
+		"MaximumQueueSize":   uint16(maxQueueSize),
+		"AllocatedQueueSize": uint16(maxQueueSize),
+		"RelatedPort":        uint32(port)<<16 | uint32(priority),
+		"Weight":             uint8(1),
+		"PacketDropMaxP":     uint16(0xFFFF),
+		"QueueDropWQ":        uint8(9),
+	}
+}
+
+// fixedString pads s with NUL characters, as the string attributes have a fixed size
+func fixedString(s string, size int) []byte {
+	b := make([]byte, size)
+	copy(b, s)
+	return b
+}
+
+// add stores an entity, the attributes that are not given get their zero value
+func (m *Mib) add(class me.ClassID, instance uint16, attributes me.AttributeValueMap) {
+	entity, err := loadDefinition(class)
+	if err != nil {
+		// NOTE the entities the ONU creates are known to the OMCI library
+		panic(err)
+	}
+	values := zeroAttributes(entity)
+	for name, value := range attributes {
+		values[name] = value
+	}
+	key := entityKey{class: class, instance: instance}
+	m.entities[key] = values
+	m.order = append(m.order, key)
+}
+
+func (m *Mib) remove(key entityKey) {
+	delete(m.entities, key)
+	for i, k := range m.order {
+		if k == key {
+			m.order = append(m.order[:i:i], m.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// zeroAttributes returns the zero value of the attributes of an entity,
+// with the same types the OMCI library decodes them to
+func zeroAttributes(entity *me.ManagedEntity) me.AttributeValueMap {
+	values := make(me.AttributeValueMap)
+	for index, def := range *entity.GetAttributeDefinitions() {
+		if index == 0 {
+			continue
+		}
+		values[def.GetName()] = zeroValue(def)
+	}
+	return values
+}
+
+func zeroValue(def *me.AttributeDefinition) interface{} {
+	if def.IsTableAttribute() {
+		return [][]byte{}
+	}
+	switch def.GetSize() {
+	case 1:
+		return uint8(0)
+	case 2:
+		return uint16(0)
+	case 4:
+		return uint32(0)
+	case 8:
+		return uint64(0)
+	default:
+		return make([]byte, def.GetSize())
+	}
+}
+
+// Entity returns the attributes of an entity, if it exists
+func (m *Mib) Entity(class me.ClassID, instance uint16) (me.AttributeValueMap, bool) {
+	attributes, ok := m.entities[entityKey{class: class, instance: instance}]
+	return attributes, ok
+}
+
+// Entities returns the number of entities in the MIB
+func (m *Mib) Entities() int {
+	return len(m.order)
+}
+
+// GemPorts returns the IDs of the GEM ports the OLT created, in order of creation
+func (m *Mib) GemPorts() []uint32 {
+	gems := []uint32{}
+	for _, key := range m.order {
+		if key.class == me.GemPortNetworkCtpClassId {
+			gems = append(gems, uint32(m.entities[key]["PortId"].(uint16)))
+		}
+	}
+	return gems
+}
+
+// the termination point types of the MAC bridge port configuration data
+const (
+	pptpEthernetUniTpType = 1
+	mapperTpType          = 3
+	gemInterworkingTpType = 5
+	veipTpType            = 11
+)
+
+// UniGemPorts returns the IDs of the GEM ports that carry the traffic of an UNI, in order of creation.
+// They are the ones the OLT bridged to the PPTP (or VEIP) of the UNI: the MAC bridge port of the UNI,
+// the ANI side ports of the same bridge, their 802.1p mappers, the GEM interworking TPs and the GEM port network CTPs.
+// NOTE if the OLT didn't create any bridge port for the UNIs (eg: BBR) the GEM ports belong to the first UNI
+func (m *Mib) UniGemPorts(uniId uint32) []uint32 {
+	bridges := map[uint16]bool{}
+	uniPorts := 0
+	for _, key := range m.order {
+		if key.class != me.MacBridgePortConfigurationDataClassId {
+			continue
+		}
+		port := m.entities[key]
+		tpType, _ := port["TpType"].(uint8)
+		if tpType != pptpEthernetUniTpType && tpType != veipTpType {
+			continue
+		}
+		uniPorts++
+		if tpPointer, _ := port["TpPointer"].(uint16); tpPointer == UniEntityId(uniId) {
+			bridge, _ := port["BridgeIdPointer"].(uint16)
+			bridges[bridge] = true
+		}
+	}
+	if uniPorts == 0 {
+		if uniId == 0 {
+			return m.GemPorts()
+		}
+		return []uint32{}
+	}
+
+	interworkingTps := map[uint16]bool{}
+	for _, key := range m.order {
+		if key.class != me.MacBridgePortConfigurationDataClassId {
+			continue
+		}
+		port := m.entities[key]
+		if bridge, _ := port["BridgeIdPointer"].(uint16); !bridges[bridge] {
+			continue
+		}
+		tpType, _ := port["TpType"].(uint8)
+		tpPointer, _ := port["TpPointer"].(uint16)
+		switch tpType {
+		case gemInterworkingTpType:
+			interworkingTps[tpPointer] = true
+		case mapperTpType:
+			mapper, ok := m.entities[entityKey{class: me.Ieee8021PMapperServiceProfileClassId, instance: tpPointer}]
+			if !ok {
+				continue
+			}
+			for p := 0; p < 8; p++ {
+				if tp, _ := mapper[fmt.Sprintf("InterworkTpPointerForPBitPriority%d", p)].(uint16); tp != 0xFFFF {
+					interworkingTps[tp] = true
+				}
+			}
+		}
+	}
+
+	ctps := map[uint16]bool{}
+	for tp := range interworkingTps {
+		if iwtp, ok := m.entities[entityKey{class: me.GemInterworkingTerminationPointClassId, instance: tp}]; ok {
+			ctp, _ := iwtp["GemPortNetworkCtpConnectivityPointer"].(uint16)
+			ctps[ctp] = true
+		}
+	}
+
+	gems := []uint32{}
+	for _, key := range m.order {
+		if key.class == me.GemPortNetworkCtpClassId && ctps[key.instance] {
+			gems = append(gems, uint32(m.entities[key]["PortId"].(uint16)))
+		}
+	}
+	return gems
+}
+
+// DataSync returns the MIB data sync counter, the OLT uses it to detect whether the MIB changed
+func (m *Mib) DataSync() uint8 {
+	return m.entities[entityKey{class: me.OnuDataClassId}]["MibDataSync"].(uint8)
+}
+
+// changed increments the MIB data sync counter, 0 is used only after a MIB reset
+func (m *Mib) changed() {
+	attributes := m.entities[entityKey{class: me.OnuDataClassId}]
+	sync := attributes["MibDataSync"].(uint8) + 1
+	if sync == 0 {
+		sync = 1
+	}
+	attributes["MibDataSync"] = sync
+}
+
+// snapshot splits the entities in the MibUploadNext commands, each one reports as many
+// attributes of an entity as fit in a baseline message. The table attributes are not reported
+func (m *Mib) snapshot() ([]*me.ManagedEntity, error) {
+	commands := []*me.ManagedEntity{}
+	for _, key := range m.order {
+		entity, err := loadDefinition(key.class)
+		if err != nil {
+			return nil, err
+		}
+		defs := *entity.GetAttributeDefinitions()
+		values := m.entities[key]
+
+		attributes := me.AttributeValueMap{}
+		size := 0
+		reported := false
+		flush := func() error {
+			command, err := loadDefinition(key.class, me.ParamData{
+				EntityID:   key.instance,
+				Attributes: attributes,
+			})
+			if err != nil {
+				return fmt.Errorf("cannot-report-entity-%d-%d: %v", key.class, key.instance, err.GetError())
+			}
+			commands = append(commands, command)
+			attributes = me.AttributeValueMap{}
+			size = 0
+			reported = true
+			return nil
+		}
+
+		for index := uint(1); index <= 16; index++ {
+			def, ok := defs[index]
+			if !ok || def.IsTableAttribute() || !me.SupportsAttributeAccess(def, me.Read) {
+				continue
+			}
+			if size+def.GetSize() > omci.MaxAttributeMibUploadNextBaselineLength {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			attributes[def.GetName()] = values[def.GetName()]
+			size += def.GetSize()
+		}
+		// NOTE every entity is reported, even if it has no attributes
+		if len(attributes) > 0 || !reported {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return commands, nil
+}
@@ -0,0 +1,506 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"github.com/google/gopacket"
+	log "github.com/sirupsen/logrus"
+)
+
+var omciLogger = log.WithFields(log.Fields{
+	"module": "OMCI",
+})
+
+// NOTE the requests are decoded here rather than with the OMCI library, as it can't decode
+// the requests for unknown entities (which get an UnknownEntity result) nor the table attributes in a Set
+
+// request is a baseline OMCI request
+type request struct {
+	tid      uint16
+	msgType  omci.MessageType
+	class    me.ClassID
+	instance uint16
+	contents []byte
+}
+
+// Response is the reply to an OMCI request
+type Response struct {
+	Pkt []byte
+	// the request the response is for
+	MessageType    omci.MessageType
+	EntityClass    me.ClassID
+	EntityInstance uint16
+	Result         me.Results
+	// Reboot is true if the ONU reboots once the response is sent, eg: to activate a software image
+	Reboot bool
+}
+
+// noResponse is returned by the handlers of the requests the ONU doesn't answer,
+// eg: the download sections that are not the last one of a window
+type noResponse struct {
+	gopacket.Payload
+}
+
+func decodeRequest(pkt []byte) (*request, error) {
+	if len(pkt) < omci.MaxBaselineLength-8 {
+		return nil, fmt.Errorf("omci-message-too-short-%d-bytes", len(pkt))
+	}
+	if omci.DeviceIdent(pkt[3]) != omci.BaselineIdent {
+		return nil, fmt.Errorf("unsupported-omci-device-identifier-%#x", pkt[3])
+	}
+	// NOTE only the last download section of a window asks for a response
+	if pkt[2]&me.AR == 0 && pkt[2]&me.MsgTypeMask != byte(me.DownloadSection) {
+		return nil, fmt.Errorf("omci-message-type-%#x-is-not-a-request", pkt[2])
+	}
+	return &request{
+		tid:      binary.BigEndian.Uint16(pkt[0:2]),
+		msgType:  omci.MessageType(pkt[2]),
+		class:    me.ClassID(binary.BigEndian.Uint16(pkt[4:6])),
+		instance: binary.BigEndian.Uint16(pkt[6:8]),
+		contents: pkt[8 : omci.MaxBaselineLength-8],
+	}, nil
+}
+
+// HandleRequest applies an OMCI request to the MIB and returns the response,
+// it fails only if the request can't be decoded. The response has no Pkt if the ONU doesn't answer
+func (m *Mib) HandleRequest(pkt []byte) (*Response, error) {
+	req, err := decodeRequest(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	var layer gopacket.SerializableLayer
+	result := me.Success
+	switch req.msgType {
+	case omci.MibResetRequestType:
+		layer, result = m.mibReset(req)
+	case omci.MibUploadRequestType:
+		layer, result = m.mibUpload(req)
+	case omci.MibUploadNextRequestType:
+		layer, result = m.mibUploadNext(req)
+	case omci.CreateRequestType:
+		layer, result = m.create(req)
+	case omci.DeleteRequestType:
+		layer, result = m.delete(req)
+	case omci.SetRequestType:
+		layer, result = m.set(req)
+	case omci.GetRequestType:
+		layer, result = m.get(req)
+	case omci.GetAllAlarmsRequestType:
+		layer, result = m.getAllAlarms(req)
+	case omci.GetAllAlarmsNextRequestType:
+		layer, result = m.getAllAlarmsNext(req)
+	case omci.SynchronizeTimeRequestType:
+		layer, result = m.synchronizeTime(req)
+	case omci.RebootRequestType:
+		layer, result = m.reboot(req)
+	case omci.StartSoftwareDownloadRequestType:
+		layer, result = m.startSoftwareDownload(req)
+	case omci.DownloadSectionRequestType, omci.MessageType(me.DownloadSection):
+		layer, result = m.downloadSection(req)
+	case omci.EndSoftwareDownloadRequestType:
+		layer, result = m.endSoftwareDownload(req)
+	case omci.ActivateSoftwareRequestType:
+		layer, result = m.activateSoftware(req)
+	case omci.CommitSoftwareRequestType:
+		layer, result = m.commitSoftware(req)
+	default:
+		result = me.NotSupported
+	}
+
+	if _, local := localDefinitions[req.class]; local && layer != nil {
+		if layer, err = localResponse(req, layer); err != nil {
+			return nil, err
+		}
+	}
+	if layer == nil {
+		// NOTE all the responses start with the result after the entity, unsupported requests
+		// and the ones for unknown entities can't be serialized by the OMCI library
+		layer = resultPayload(req, result)
+	}
+
+	response := &Response{
+		MessageType:    req.msgType,
+		EntityClass:    req.class,
+		EntityInstance: req.instance,
+		Result:         result,
+		Reboot:         result == me.Success && (req.msgType == omci.RebootRequestType || req.msgType == omci.ActivateSoftwareRequestType),
+	}
+	if _, silent := layer.(noResponse); !silent {
+		responseType := omci.MessageType(byte(req.msgType)&me.MsgTypeMask | me.AK)
+		if response.Pkt, err = serialize(req.tid, responseType, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	omciLogger.WithFields(log.Fields{
+		"MessageType":    req.msgType,
+		"EntityClass":    req.class,
+		"EntityInstance": req.instance,
+		"Result":         result,
+		"Answered":       response.Pkt != nil,
+	}).Trace("Handled OMCI request")
+
+	return response, nil
+}
+
+// ErrorResponse answers an OMCI request with result without applying it to the MIB, eg: to inject errors.
+// It fails only if the request can't be decoded
+func (m *Mib) ErrorResponse(pkt []byte, result me.Results) (*Response, error) {
+	req, err := decodeRequest(pkt)
+	if err != nil {
+		return nil, err
+	}
+	response := &Response{
+		MessageType:    req.msgType,
+		EntityClass:    req.class,
+		EntityInstance: req.instance,
+		Result:         result,
+	}
+	if byte(req.msgType)&me.AR != 0 {
+		responseType := omci.MessageType(byte(req.msgType)&me.MsgTypeMask | me.AK)
+		if response.Pkt, err = serialize(req.tid, responseType, resultPayload(req, result)); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+func serialize(tid uint16, msgType omci.MessageType, layer gopacket.SerializableLayer) ([]byte, error) {
+	omciLayer := &omci.OMCI{
+		TransactionID: tid,
+		MessageType:   msgType,
+	}
+	var options gopacket.SerializeOptions
+	options.FixLengths = true
+
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, options, omciLayer, layer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func resultPayload(req *request, result me.Results) gopacket.Payload {
+	return payload(req, byte(result))
+}
+
+// payload is a response with the entity of the request followed by contents
+func payload(req *request, contents ...byte) gopacket.Payload {
+	p := make([]byte, 4, 4+len(contents))
+	binary.BigEndian.PutUint16(p[0:2], uint16(req.class))
+	binary.BigEndian.PutUint16(p[2:4], req.instance)
+	return append(p, contents...)
+}
+
+func base(req *request) omci.MeBasePacket {
+	return omci.MeBasePacket{
+		EntityClass:    req.class,
+		EntityInstance: req.instance,
+	}
+}
+
+// definition returns the definition of the entity the request is for,
+// if it is known and it supports the request
+func definition(req *request) (*me.ManagedEntity, me.Results) {
+	entity, err := loadDefinition(req.class, me.ParamData{EntityID: req.instance})
+	if err != nil {
+		return nil, me.UnknownEntity
+	}
+	if !me.SupportsMsgType(entity, me.MsgType(byte(req.msgType)&me.MsgTypeMask)) {
+		return nil, me.NotSupported
+	}
+	return entity, me.Success
+}
+
+// existing returns the definition and the attributes of the entity the request is for
+func (m *Mib) existing(req *request) (*me.ManagedEntity, me.AttributeValueMap, me.Results) {
+	entity, result := definition(req)
+	if result != me.Success {
+		return nil, nil, result
+	}
+	attributes, ok := m.Entity(req.class, req.instance)
+	if !ok {
+		return nil, nil, me.UnknownInstance
+	}
+	return entity, attributes, me.Success
+}
+
+func (m *Mib) mibReset(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	m.Reset()
+	return &omci.MibResetResponse{MeBasePacket: base(req), Result: me.Success}, me.Success
+}
+
+func (m *Mib) mibUpload(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	upload, err := m.snapshot()
+	if err != nil {
+		omciLogger.Errorf("Cannot upload the MIB: %v", err)
+		return nil, me.ProcessingError
+	}
+	m.upload = upload
+	return &omci.MibUploadResponse{MeBasePacket: base(req), NumberOfCommands: uint16(len(upload))}, me.Success
+}
+
+func (m *Mib) mibUploadNext(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	command := binary.BigEndian.Uint16(req.contents[0:2])
+	if int(command) >= len(m.upload) {
+		// NOTE the ONU reports an entity with class and instance 0 if the command is out of range
+		invalid, _ := me.NewManagedEntity(&me.ManagedEntityDefinition{
+			Name:                 "InvalidSequenceNumberManagedEntity",
+			AttributeDefinitions: make(me.AttributeDefinitionMap),
+		})
+		return &omci.MibUploadNextResponse{MeBasePacket: base(req), ReportedME: *invalid}, me.Success
+	}
+	return &omci.MibUploadNextResponse{MeBasePacket: base(req), ReportedME: *m.upload[command]}, me.Success
+}
+
+func (m *Mib) create(req *request) (gopacket.SerializableLayer, me.Results) {
+	entity, result := definition(req)
+	if result != me.Success {
+		return nil, result
+	}
+	if _, ok := m.Entity(req.class, req.instance); ok {
+		return nil, me.InstanceExists
+	}
+
+	var mask uint16
+	for index, def := range *entity.GetAttributeDefinitions() {
+		if index != 0 && me.SupportsAttributeAccess(def, me.SetByCreate) {
+			mask |= attributeBit(index)
+		}
+	}
+	attributes, failed := decodeAttributes(entity, mask, req.contents, byte(req.msgType))
+	if failed != 0 {
+		return &omci.CreateResponse{
+			MeBasePacket:           base(req),
+			Result:                 me.ParameterError,
+			AttributeExecutionMask: failed,
+		}, me.ParameterError
+	}
+
+	if _, ok := pmClasses[req.class]; ok {
+		attributes["IntervalEndTime"] = m.intervalEndTime
+	}
+	m.add(req.class, req.instance, attributes)
+	m.changed()
+	return &omci.CreateResponse{MeBasePacket: base(req), Result: me.Success}, me.Success
+}
+
+func (m *Mib) delete(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	m.remove(entityKey{class: req.class, instance: req.instance})
+	m.changed()
+	return &omci.DeleteResponse{MeBasePacket: base(req), Result: me.Success}, me.Success
+}
+
+func (m *Mib) set(req *request) (gopacket.SerializableLayer, me.Results) {
+	entity, attributes, result := m.existing(req)
+	if result != me.Success {
+		return nil, result
+	}
+
+	mask := binary.BigEndian.Uint16(req.contents[0:2])
+	data := req.contents[2:]
+	defs := *entity.GetAttributeDefinitions()
+	var unsupported, failed uint16
+	for index := uint(1); index <= 16; index++ {
+		bit := attributeBit(index)
+		if mask&bit == 0 {
+			continue
+		}
+		def, ok := defs[index]
+		if !ok {
+			unsupported |= bit
+			continue
+		}
+		value, err := decodeAttribute(def, data, byte(req.msgType))
+		if err != nil {
+			// NOTE the attributes that follow can't be decoded either
+			failed |= mask & (bit<<1 - 1)
+			break
+		}
+		data = data[def.GetSize():]
+		if !me.SupportsAttributeAccess(def, me.Write) {
+			failed |= bit
+			continue
+		}
+		if def.IsTableAttribute() {
+			attributes[def.GetName()] = addTableRow(attributes[def.GetName()].([][]byte), value.([]byte))
+		} else {
+			attributes[def.GetName()] = value
+		}
+	}
+	// NOTE the OLT sets the MIB data sync counter after a MIB upload, that's not a change of the MIB
+	if req.class != me.OnuDataClassId && mask&^(unsupported|failed) != 0 {
+		m.changed()
+	}
+
+	if unsupported != 0 || failed != 0 {
+		return &omci.SetResponse{
+			MeBasePacket:             base(req),
+			Result:                   me.AttributeFailure,
+			UnsupportedAttributeMask: unsupported,
+			FailedAttributeMask:      failed,
+		}, me.AttributeFailure
+	}
+	return &omci.SetResponse{MeBasePacket: base(req), Result: me.Success}, me.Success
+}
+
+// addTableRow adds a row to a table attribute, unless the table already has it
+func addTableRow(table [][]byte, row []byte) [][]byte {
+	for _, r := range table {
+		if bytes.Equal(r, row) {
+			return table
+		}
+	}
+	return append(table, row)
+}
+
+// getResponseAttributes is the space for the attributes in a Get response,
+// the last 4 bytes are for the masks of the attributes that are not reported
+const getResponseAttributes = omci.MaxBaselineLength - 8 - 4 - 4 - 3 - 4
+
+func (m *Mib) get(req *request) (gopacket.SerializableLayer, me.Results) {
+	entity, attributes, result := m.existing(req)
+	if result != me.Success {
+		return nil, result
+	}
+
+	mask := binary.BigEndian.Uint16(req.contents[0:2])
+	defs := *entity.GetAttributeDefinitions()
+	resp := &omci.GetResponse{
+		MeBasePacket: base(req),
+		Result:       me.Success,
+		Attributes:   me.AttributeValueMap{},
+	}
+	size := 0
+	for index := uint(1); index <= 16; index++ {
+		bit := attributeBit(index)
+		if mask&bit == 0 {
+			continue
+		}
+		def, ok := defs[index]
+		if !ok || !me.SupportsAttributeAccess(def, me.Read) {
+			resp.UnsupportedAttributeMask |= bit
+			continue
+		}
+		value := attributes[def.GetName()]
+		attrSize := def.GetSize()
+		if def.IsTableAttribute() {
+			// NOTE the size of the table is reported, the OLT reads the rows with GetNext
+			table := value.([][]byte)
+			value = uint32(len(table) * def.GetSize())
+			attrSize = 4
+		}
+		if size+attrSize > getResponseAttributes {
+			resp.FailedAttributeMask |= bit
+			continue
+		}
+		resp.AttributeMask |= bit
+		resp.Attributes[def.GetName()] = value
+		size += attrSize
+	}
+
+	if resp.UnsupportedAttributeMask != 0 || resp.FailedAttributeMask != 0 {
+		resp.Result = me.AttributeFailure
+	}
+	return resp, resp.Result
+}
+
+func (m *Mib) getAllAlarms(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	// NOTE the ONU has no active alarms
+	return &omci.GetAllAlarmsResponse{MeBasePacket: base(req), NumberOfCommands: 0}, me.Success
+}
+
+func (m *Mib) getAllAlarmsNext(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	return &omci.GetAllAlarmsNextResponse{MeBasePacket: base(req)}, me.Success
+}
+
+func (m *Mib) synchronizeTime(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	m.synchronizeIntervals()
+	return &omci.SynchronizeTimeResponse{MeBasePacket: base(req), Result: me.Success}, me.Success
+}
+
+func (m *Mib) reboot(req *request) (gopacket.SerializableLayer, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	return &omci.RebootResponse{MeBasePacket: base(req), Result: me.Success}, me.Success
+}
+
+// attributeBit is the bit of an attribute in the attribute masks, the first attribute is the MSB
+func attributeBit(index uint) uint16 {
+	return 1 << (16 - index)
+}
+
+// decodeAttributes decodes the attributes in mask, it returns the mask of the ones that can't be decoded
+func decodeAttributes(entity *me.ManagedEntity, mask uint16, data []byte, msgType byte) (me.AttributeValueMap, uint16) {
+	defs := *entity.GetAttributeDefinitions()
+	values := me.AttributeValueMap{}
+	for index := uint(1); index <= 16; index++ {
+		bit := attributeBit(index)
+		if mask&bit == 0 {
+			continue
+		}
+		value, err := decodeAttribute(defs[index], data, msgType)
+		if err != nil {
+			return values, mask & (bit<<1 - 1)
+		}
+		values[defs[index].GetName()] = value
+		data = data[defs[index].GetSize():]
+	}
+	return values, 0
+}
+
+// decodeAttribute decodes the value of an attribute, the table attributes are decoded to a single row
+func decodeAttribute(def *me.AttributeDefinition, data []byte, msgType byte) (interface{}, error) {
+	if len(data) < def.GetSize() {
+		return nil, fmt.Errorf("attribute-%s-is-truncated", def.GetName())
+	}
+	if def.IsTableAttribute() {
+		row := make([]byte, def.GetSize())
+		copy(row, data)
+		return row, nil
+	}
+	return def.Decode(data[:def.GetSize()], gopacket.NilDecodeFeedback, msgType)
+}
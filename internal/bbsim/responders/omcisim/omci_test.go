@@ -0,0 +1,313 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"github.com/google/gopacket"
+	"gotest.tools/assert"
+)
+
+var serialNumber = []byte{'B', 'B', 'S', 'M', 0x00, 0x00, 0x01, 0x02}
+
+func newTestMib(numUnis int, veip bool) *Mib {
+	return NewMib(MibConfig{NumUnis: numUnis, Veip: veip, SerialNumber: serialNumber})
+}
+
+func genRequest(t *testing.T, entity *me.ManagedEntity, msgType omci.MessageType, options ...omci.FrameOption) []byte {
+	options = append(options, omci.TransactionID(1))
+	pkt, err := omci.GenFrame(entity, msgType, options...)
+	assert.NilError(t, err)
+	return pkt
+}
+
+// rawRequest builds a baseline request without the OMCI library, eg: for the entities it doesn't know about
+func rawRequest(msgType omci.MessageType, class me.ClassID, instance uint16, contents ...byte) []byte {
+	pkt := make([]byte, omci.MaxBaselineLength-8)
+	binary.BigEndian.PutUint16(pkt[0:2], 1)
+	pkt[2] = byte(msgType)
+	pkt[3] = byte(omci.BaselineIdent)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(class))
+	binary.BigEndian.PutUint16(pkt[6:8], instance)
+	copy(pkt[8:], contents)
+	return pkt
+}
+
+func handle(t *testing.T, mib *Mib, pkt []byte, layerType gopacket.LayerType) (*Response, gopacket.Layer) {
+	resp, err := mib.HandleRequest(pkt)
+	assert.NilError(t, err)
+	assert.Equal(t, len(resp.Pkt), omci.MaxBaselineLength-4)
+	assert.Equal(t, resp.Pkt[2], byte(resp.MessageType)&me.MsgTypeMask|me.AK)
+
+	packet := gopacket.NewPacket(resp.Pkt, omci.LayerTypeOMCI, gopacket.NoCopy)
+	return resp, packet.Layer(layerType)
+}
+
+func upload(t *testing.T, mib *Mib) []me.ManagedEntity {
+	onuData, _ := me.NewOnuData(me.ParamData{EntityID: 0})
+	_, layer := handle(t, mib, genRequest(t, onuData, omci.MibUploadRequestType), omci.LayerTypeMibUploadResponse)
+	assert.Assert(t, layer != nil)
+	commands := layer.(*omci.MibUploadResponse).NumberOfCommands
+
+	entities := []me.ManagedEntity{}
+	for i := uint16(0); i < commands; i++ {
+		pkt := genRequest(t, onuData, omci.MibUploadNextRequestType, omci.SequenceNumberCountOrSize(i))
+		_, layer := handle(t, mib, pkt, omci.LayerTypeMibUploadNextResponse)
+		assert.Assert(t, layer != nil, "cannot decode MibUploadNext response %d", i)
+		entities = append(entities, layer.(*omci.MibUploadNextResponse).ReportedME)
+	}
+	return entities
+}
+
+func countEntities(entities []me.ManagedEntity, class me.ClassID) int {
+	found := map[uint16]bool{}
+	for _, entity := range entities {
+		if entity.GetClassID() == class {
+			found[entity.GetEntityID()] = true
+		}
+	}
+	return len(found)
+}
+
+func Test_Mib_Upload(t *testing.T) {
+	entities := upload(t, newTestMib(4, false))
+
+	assert.Equal(t, countEntities(entities, me.OnuDataClassId), 1)
+	assert.Equal(t, countEntities(entities, me.OnuGClassId), 1)
+	assert.Equal(t, countEntities(entities, me.PhysicalPathTerminationPointEthernetUniClassId), 4)
+	assert.Equal(t, countEntities(entities, me.VirtualEthernetInterfacePointClassId), 0)
+	assert.Equal(t, countEntities(entities, me.UniGClassId), 4)
+	assert.Equal(t, countEntities(entities, me.TContClassId), 8)
+	assert.Equal(t, countEntities(entities, me.PriorityQueueClassId), 8*8+4*8)
+
+	for _, entity := range entities {
+		if entity.GetClassID() == me.OnuGClassId {
+			if sn, err := entity.GetAttribute("SerialNumber"); err == nil {
+				assert.Equal(t, sn, binary.BigEndian.Uint64(serialNumber))
+			}
+		}
+	}
+
+	entities = upload(t, newTestMib(2, true))
+	assert.Equal(t, countEntities(entities, me.PhysicalPathTerminationPointEthernetUniClassId), 0)
+	assert.Equal(t, countEntities(entities, me.VirtualEthernetInterfacePointClassId), 2)
+}
+
+func Test_Mib_Config(t *testing.T) {
+	mib := NewMib(MibConfig{
+		NumUnis:        2,
+		SerialNumber:   serialNumber,
+		VendorId:       "ALPH",
+		EquipmentId:    "ALPHA_SFU",
+		SoftwareImages: []string{"ALPHA_IMG_1", "ALPHA_IMG_0"},
+		NumTconts:      4,
+		QueuesPerPort:  2,
+	})
+	entities := upload(t, mib)
+	assert.Equal(t, countEntities(entities, me.TContClassId), 4)
+	assert.Equal(t, countEntities(entities, me.TrafficSchedulerClassId), 4)
+	assert.Equal(t, countEntities(entities, me.PriorityQueueClassId), 4*2+2*2)
+
+	onuG, _ := mib.Entity(me.OnuGClassId, 0)
+	assert.Equal(t, onuG["VendorId"], binary.BigEndian.Uint32([]byte("ALPH")))
+	assert.Equal(t, onuG["SerialNumber"], binary.BigEndian.Uint64(serialNumber))
+	onu2G, _ := mib.Entity(me.Onu2GClassId, 0)
+	assert.DeepEqual(t, onu2G["EquipmentId"], fixedString("ALPHA_SFU", 20))
+	assert.Equal(t, onu2G["TotalPriorityQueueNumber"], uint16(12))
+
+	// the first image is the active one
+	image, _ := mib.Entity(me.SoftwareImageClassId, 0)
+	assert.DeepEqual(t, image["Version"], fixedString("ALPHA_IMG_1", 14))
+	assert.Equal(t, image["IsActive"], uint8(1))
+	image, _ = mib.Entity(me.SoftwareImageClassId, 1)
+	assert.DeepEqual(t, image["Version"], fixedString("ALPHA_IMG_0", 14))
+	assert.Equal(t, image["IsActive"], uint8(0))
+}
+
+func Test_Mib_CreateSetGetDelete(t *testing.T) {
+	mib := newTestMib(1, false)
+	assert.Equal(t, mib.DataSync(), uint8(0))
+
+	gem, _ := me.NewGemPortNetworkCtp(me.ParamData{
+		EntityID: 1,
+		Attributes: me.AttributeValueMap{
+			"PortId":                              uint16(1024),
+			"TContPointer":                        uint16(0x8001),
+			"Direction":                           uint8(3),
+			"TrafficManagementPointerForUpstream": uint16(0x8001),
+			"TrafficDescriptorProfilePointerForUpstream":   uint16(0),
+			"PriorityQueuePointerForDownStream":            uint16(0x0001),
+			"TrafficDescriptorProfilePointerForDownstream": uint16(0),
+			"EncryptionKeyRing":                            uint8(0),
+		},
+	})
+	resp, layer := handle(t, mib, genRequest(t, gem, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Equal(t, layer.(*omci.CreateResponse).Result, me.Success)
+	assert.DeepEqual(t, mib.GemPorts(), []uint32{1024})
+	assert.Equal(t, mib.DataSync(), uint8(1))
+
+	resp, _ = handle(t, mib, genRequest(t, gem, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.InstanceExists)
+
+	// the attributes the OLT set are stored in the MIB
+	set, _ := me.NewGemPortNetworkCtp(me.ParamData{
+		EntityID:   1,
+		Attributes: me.AttributeValueMap{"TContPointer": uint16(0x8002)},
+	})
+	resp, layer = handle(t, mib, genRequest(t, set, omci.SetRequestType, omci.AttributeMask(0x4000)), omci.LayerTypeSetResponse)
+	assert.Equal(t, layer.(*omci.SetResponse).Result, me.Success)
+	assert.Equal(t, mib.DataSync(), uint8(2))
+
+	resp, layer = handle(t, mib, rawRequest(omci.GetRequestType, me.GemPortNetworkCtpClassId, 1, 0xc0, 0x00), omci.LayerTypeGetResponse)
+	get := layer.(*omci.GetResponse)
+	assert.Equal(t, get.Result, me.Success)
+	assert.Equal(t, get.Attributes["PortId"], uint16(1024))
+	assert.Equal(t, get.Attributes["TContPointer"], uint16(0x8002))
+
+	// the entities the OLT created are reported in the MIB upload
+	assert.Equal(t, countEntities(upload(t, mib), me.GemPortNetworkCtpClassId), 1)
+
+	resp, layer = handle(t, mib, genRequest(t, gem, omci.DeleteRequestType), omci.LayerTypeDeleteResponse)
+	assert.Equal(t, layer.(*omci.DeleteResponse).Result, me.Success)
+	assert.DeepEqual(t, mib.GemPorts(), []uint32{})
+	assert.Equal(t, mib.DataSync(), uint8(3))
+
+	resp, _ = handle(t, mib, genRequest(t, gem, omci.DeleteRequestType), omci.LayerTypeDeleteResponse)
+	assert.Equal(t, resp.Result, me.UnknownInstance)
+	resp, _ = handle(t, mib, rawRequest(omci.GetRequestType, me.GemPortNetworkCtpClassId, 1, 0x80, 0x00), omci.LayerTypeGetResponse)
+	assert.Equal(t, resp.Result, me.UnknownInstance)
+}
+
+func Test_Mib_UniGemPorts(t *testing.T) {
+	mib := newTestMib(2, false)
+	for i, port := range []uint16{1024, 1025, 1026} {
+		mib.add(me.GemPortNetworkCtpClassId, uint16(i+1), me.AttributeValueMap{"PortId": port})
+	}
+
+	// without bridge ports the GEM ports belong to the first UNI
+	assert.DeepEqual(t, mib.UniGemPorts(0), []uint32{1024, 1025, 1026})
+	assert.DeepEqual(t, mib.UniGemPorts(1), []uint32{})
+
+	// the first UNI reaches the first two GEM ports through an 802.1p mapper
+	mib.add(me.MacBridgePortConfigurationDataClassId, 0x101, me.AttributeValueMap{
+		"BridgeIdPointer": uint16(0x101), "TpType": uint8(pptpEthernetUniTpType), "TpPointer": UniEntityId(0),
+	})
+	mib.add(me.MacBridgePortConfigurationDataClassId, 0x102, me.AttributeValueMap{
+		"BridgeIdPointer": uint16(0x101), "TpType": uint8(mapperTpType), "TpPointer": uint16(0x8001),
+	})
+	mapper := me.AttributeValueMap{}
+	for p := 0; p < 8; p++ {
+		mapper[fmt.Sprintf("InterworkTpPointerForPBitPriority%d", p)] = uint16(0xFFFF)
+	}
+	mapper["InterworkTpPointerForPBitPriority0"] = uint16(2)
+	mapper["InterworkTpPointerForPBitPriority7"] = uint16(1)
+	mib.add(me.Ieee8021PMapperServiceProfileClassId, 0x8001, mapper)
+	mib.add(me.GemInterworkingTerminationPointClassId, 1, me.AttributeValueMap{"GemPortNetworkCtpConnectivityPointer": uint16(1)})
+	mib.add(me.GemInterworkingTerminationPointClassId, 2, me.AttributeValueMap{"GemPortNetworkCtpConnectivityPointer": uint16(2)})
+
+	// the second UNI is bridged straight to the third GEM port
+	mib.add(me.MacBridgePortConfigurationDataClassId, 0x201, me.AttributeValueMap{
+		"BridgeIdPointer": uint16(0x201), "TpType": uint8(pptpEthernetUniTpType), "TpPointer": UniEntityId(1),
+	})
+	assert.DeepEqual(t, mib.UniGemPorts(1), []uint32{})
+	mib.add(me.MacBridgePortConfigurationDataClassId, 0x202, me.AttributeValueMap{
+		"BridgeIdPointer": uint16(0x201), "TpType": uint8(gemInterworkingTpType), "TpPointer": uint16(3),
+	})
+	mib.add(me.GemInterworkingTerminationPointClassId, 3, me.AttributeValueMap{"GemPortNetworkCtpConnectivityPointer": uint16(3)})
+
+	assert.DeepEqual(t, mib.UniGemPorts(0), []uint32{1024, 1025})
+	assert.DeepEqual(t, mib.UniGemPorts(1), []uint32{1026})
+}
+
+func Test_Mib_ResultCodes(t *testing.T) {
+	mib := newTestMib(1, false)
+
+	// an entity the ONU doesn't know about
+	resp, _ := handle(t, mib, rawRequest(omci.CreateRequestType, me.ClassID(0x7fff), 1), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.UnknownEntity)
+	assert.Equal(t, resp.Pkt[8], byte(me.UnknownEntity))
+
+	// the ONU-G can't be created
+	resp, _ = handle(t, mib, rawRequest(omci.CreateRequestType, me.OnuGClassId, 1), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.NotSupported)
+
+	// the serial number is read only
+	resp, layer := handle(t, mib, rawRequest(omci.SetRequestType, me.OnuGClassId, 0, 0x20, 0x00), omci.LayerTypeSetResponse)
+	assert.Equal(t, resp.Result, me.AttributeFailure)
+	assert.Equal(t, layer.(*omci.SetResponse).FailedAttributeMask, uint16(0x2000))
+
+	// the vendor ID, version and serial number don't fit in a Get response
+	resp, layer = handle(t, mib, rawRequest(omci.GetRequestType, me.OnuGClassId, 0, 0xe0, 0x00), omci.LayerTypeGetResponse)
+	get := layer.(*omci.GetResponse)
+	assert.Equal(t, get.Result, me.AttributeFailure)
+	assert.Equal(t, get.AttributeMask, uint16(0xc000))
+	assert.Equal(t, get.FailedAttributeMask, uint16(0x2000))
+	assert.Equal(t, get.Attributes["VendorId"], binary.BigEndian.Uint32(serialNumber[0:4]))
+
+	resp, _ = handle(t, mib, rawRequest(omci.TestRequestType, me.OnuGClassId, 0), omci.LayerTypeTestResponse)
+	assert.Equal(t, resp.Result, me.NotSupported)
+
+	_, err := mib.HandleRequest([]byte{0x00, 0x01, 0x49, 0x0a})
+	assert.Error(t, err, "omci-message-too-short-4-bytes")
+}
+
+func Test_Mib_ErrorResponse(t *testing.T) {
+	mib := newTestMib(1, false)
+	entities := mib.Entities()
+
+	gal, _ := me.NewGalEthernetProfile(me.ParamData{
+		EntityID:   1,
+		Attributes: me.AttributeValueMap{"MaximumGemPayloadSize": uint16(48)},
+	})
+	resp, err := mib.ErrorResponse(genRequest(t, gal, omci.CreateRequestType), me.ProcessingError)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Result, me.ProcessingError)
+	layer := gopacket.NewPacket(resp.Pkt, omci.LayerTypeOMCI, gopacket.NoCopy).Layer(omci.LayerTypeCreateResponse)
+	assert.Equal(t, layer.(*omci.CreateResponse).Result, me.ProcessingError)
+
+	// the request is not applied
+	assert.Equal(t, mib.Entities(), entities)
+	assert.Equal(t, mib.DataSync(), uint8(0))
+
+	_, err = mib.ErrorResponse([]byte{0x00, 0x01, 0x49, 0x0a}, me.ProcessingError)
+	assert.Error(t, err, "omci-message-too-short-4-bytes")
+}
+
+func Test_Mib_Reset(t *testing.T) {
+	mib := newTestMib(1, false)
+	entities := mib.Entities()
+
+	gal, _ := me.NewGalEthernetProfile(me.ParamData{
+		EntityID:   1,
+		Attributes: me.AttributeValueMap{"MaximumGemPayloadSize": uint16(48)},
+	})
+	resp, _ := handle(t, mib, genRequest(t, gal, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Equal(t, mib.Entities(), entities+1)
+
+	onuData, _ := me.NewOnuData(me.ParamData{EntityID: 0})
+	resp, layer := handle(t, mib, genRequest(t, onuData, omci.MibResetRequestType), omci.LayerTypeMibResetResponse)
+	assert.Equal(t, layer.(*omci.MibResetResponse).Result, me.Success)
+	assert.Equal(t, mib.Entities(), entities)
+	assert.Equal(t, mib.DataSync(), uint8(0))
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/google/gopacket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FecPmHistoryDataClassId is the FEC PM history data, the OMCI library doesn't define it
+	FecPmHistoryDataClassId me.ClassID = 312
+
+	// the frames are counted as they are on the wire: with the FCS and padded to the minimum size
+	fcsSize      = 4
+	minFrameSize = 64
+	// rsPayload is the data carried by a RS(255, 239) FEC code word
+	rsPayload = 239
+	// alarmBitmapSize is the size of the alarm bitmap in a baseline alarm notification
+	alarmBitmapSize = 28
+)
+
+// localDefinitions are the entities the ONU supports that the OMCI library doesn't define
+var localDefinitions = map[me.ClassID]*me.ManagedEntityDefinition{
+	FecPmHistoryDataClassId: {
+		Name:                 "FecPerformanceMonitoringHistoryData",
+		ClassID:              FecPmHistoryDataClassId,
+		MessageTypes:         mapset.NewSetWith(me.Create, me.Delete, me.Get, me.Set),
+		AllowedAttributeMask: 0xFE00,
+		AttributeDefinitions: me.AttributeDefinitionMap{
+			0: me.Uint16Field("ManagedEntityId", 0, mapset.NewSetWith(me.Read, me.SetByCreate), false, false, false, false, 0),
+			1: me.ByteField("IntervalEndTime", 0, mapset.NewSetWith(me.Read), false, false, false, false, 1),
+			2: me.Uint16Field("ThresholdData12Id", 0, mapset.NewSetWith(me.Read, me.SetByCreate, me.Write), false, false, false, false, 2),
+			3: me.Uint32Field("CorrectedBytes", 0, mapset.NewSetWith(me.Read), false, true, false, false, 3),
+			4: me.Uint32Field("CorrectedCodeWords", 0, mapset.NewSetWith(me.Read), false, true, false, false, 4),
+			5: me.Uint32Field("UncorrectableCodeWords", 0, mapset.NewSetWith(me.Read), false, true, false, false, 5),
+			6: me.Uint32Field("TotalCodeWords", 0, mapset.NewSetWith(me.Read), false, true, false, false, 6),
+			7: me.Uint16Field("FecSeconds", 0, mapset.NewSetWith(me.Read), false, true, false, false, 7),
+		},
+	},
+}
+
+// loadDefinition is me.LoadManagedEntityDefinition, including the entities in localDefinitions
+func loadDefinition(class me.ClassID, params ...me.ParamData) (*me.ManagedEntity, me.OmciErrors) {
+	if definition, ok := localDefinitions[class]; ok {
+		return me.NewManagedEntity(definition, params...)
+	}
+	return me.LoadManagedEntityDefinition(class, params...)
+}
+
+// localResponse encodes the responses for the entities in localDefinitions, as the OMCI library
+// can't serialize them. The responses with the results of the checks that fail have no layer
+func localResponse(req *request, layer gopacket.SerializableLayer) (gopacket.SerializableLayer, error) {
+	switch resp := layer.(type) {
+	case *omci.CreateResponse:
+		mask := resp.AttributeExecutionMask
+		return payload(req, byte(resp.Result), byte(mask>>8), byte(mask)), nil
+	case *omci.DeleteResponse:
+		return payload(req, byte(resp.Result)), nil
+	case *omci.SetResponse:
+		unsupported, failed := resp.UnsupportedAttributeMask, resp.FailedAttributeMask
+		return payload(req, byte(resp.Result), byte(unsupported>>8), byte(unsupported), byte(failed>>8), byte(failed)), nil
+	case *omci.GetResponse:
+		entity, err := loadDefinition(req.class)
+		if err != nil {
+			return nil, err
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		if err := entity.SerializeAttributes(resp.Attributes, resp.AttributeMask, buffer, byte(omci.GetResponseType), getResponseAttributes); err != nil {
+			return nil, err
+		}
+		contents := make([]byte, 3+getResponseAttributes+4)
+		contents[0] = byte(resp.Result)
+		binary.BigEndian.PutUint16(contents[1:3], resp.AttributeMask)
+		copy(contents[3:], buffer.Bytes())
+		binary.BigEndian.PutUint16(contents[3+getResponseAttributes:], resp.UnsupportedAttributeMask)
+		binary.BigEndian.PutUint16(contents[5+getResponseAttributes:], resp.FailedAttributeMask)
+		return payload(req, contents...), nil
+	}
+	return layer, nil
+}
+
+// ethernetTraffic counts the Ethernet frames in one direction
+type ethernetTraffic struct {
+	frames, octets, broadcast, multicast uint64
+	// drops is the number of frames the ONU dropped, eg: because there is no GEM port to send them on
+	drops uint64
+	// sizes counts the frames of 64, 65-127, 128-255, 256-511, 512-1023 and 1024-1518 octets
+	sizes [6]uint64
+}
+
+func (t *ethernetTraffic) count(frame []byte) {
+	size := len(frame) + fcsSize
+	if size < minFrameSize {
+		size = minFrameSize
+	}
+	t.frames++
+	t.octets += uint64(size)
+	if len(frame) >= 6 && frame[0]&0x01 != 0 {
+		if string(frame[0:6]) == "\xff\xff\xff\xff\xff\xff" {
+			t.broadcast++
+		} else {
+			t.multicast++
+		}
+	}
+	for i, max := range [...]int{64, 127, 255, 511, 1023, 1518} {
+		if size <= max {
+			t.sizes[i]++
+			break
+		}
+	}
+}
+
+// gemTraffic counts the GEM frames of a GEM port, transmitted upstream and received downstream
+type gemTraffic struct {
+	transmitted, received           uint64
+	transmittedBytes, receivedBytes uint64
+}
+
+// pmInterval is the traffic of a 15-minute interval
+type pmInterval struct {
+	upstream, downstream ethernetTraffic
+	gems                 map[uint32]*gemTraffic
+}
+
+func newPmInterval() *pmInterval {
+	return &pmInterval{gems: make(map[uint32]*gemTraffic)}
+}
+
+func (p *pmInterval) gem(gemPortId uint32) *gemTraffic {
+	gem, ok := p.gems[gemPortId]
+	if !ok {
+		gem = &gemTraffic{}
+		p.gems[gemPortId] = gem
+	}
+	return gem
+}
+
+// CountUpstream counts a frame the ONU sends on a GEM port, for the PM history data
+func (m *Mib) CountUpstream(gemPortId uint32, frame []byte) {
+	m.pm.upstream.count(frame)
+	gem := m.pm.gem(gemPortId)
+	gem.transmitted++
+	gem.transmittedBytes += uint64(len(frame))
+}
+
+// CountDownstream counts a frame the ONU receives on a GEM port, for the PM history data
+func (m *Mib) CountDownstream(gemPortId uint32, frame []byte) {
+	m.pm.downstream.count(frame)
+	gem := m.pm.gem(gemPortId)
+	gem.received++
+	gem.receivedBytes += uint64(len(frame))
+}
+
+// DropDownstream counts a frame the ONU receives but can't forward, for the PM history data
+func (m *Mib) DropDownstream() {
+	m.pm.downstream.drops++
+}
+
+// tca is a counter with a threshold, number is the one of the threshold value in the Threshold Data 1 and 2
+type tca struct {
+	counter string
+	number  int
+	alarm   uint
+}
+
+// pmClass describes a PM history data entity: how its counters are derived from the traffic of an interval
+// and the threshold crossing alerts it reports. The counters that are not returned are 0
+type pmClass struct {
+	counters func(m *Mib, instance uint16, pm *pmInterval) map[string]uint64
+	tcas     []tca
+}
+
+// NOTE the Ethernet frame PM is related to a MAC bridge port, but the traffic is not tracked per port
+// so all the instances count the traffic of the whole ONU
+func ethernetFrameCounters(traffic func(pm *pmInterval) *ethernetTraffic) func(*Mib, uint16, *pmInterval) map[string]uint64 {
+	return func(m *Mib, instance uint16, pm *pmInterval) map[string]uint64 {
+		t := traffic(pm)
+		return map[string]uint64{
+			"DropEvents":              t.drops,
+			"Octets":                  t.octets,
+			"Packets":                 t.frames,
+			"BroadcastPackets":        t.broadcast,
+			"MulticastPackets":        t.multicast,
+			"Packets64Octets":         t.sizes[0],
+			"Packets65To127Octets":    t.sizes[1],
+			"Packets128To255Octets":   t.sizes[2],
+			"Packets256To511Octets":   t.sizes[3],
+			"Packets512To1023Octets":  t.sizes[4],
+			"Packets1024To1518Octets": t.sizes[5],
+		}
+	}
+}
+
+var ethernetFrameTcas = []tca{
+	{counter: "DropEvents", number: 1, alarm: 0},
+	{counter: "CrcErroredPackets", number: 2, alarm: 1},
+	{counter: "UndersizePackets", number: 3, alarm: 2},
+	{counter: "OversizePackets", number: 4, alarm: 3},
+}
+
+var pmClasses = map[me.ClassID]pmClass{
+	me.EthernetFramePerformanceMonitoringHistoryDataUpstreamClassId: {
+		counters: ethernetFrameCounters(func(pm *pmInterval) *ethernetTraffic { return &pm.upstream }),
+		tcas:     ethernetFrameTcas,
+	},
+	me.EthernetFramePerformanceMonitoringHistoryDataDownstreamClassId: {
+		counters: ethernetFrameCounters(func(pm *pmInterval) *ethernetTraffic { return &pm.downstream }),
+		tcas:     ethernetFrameTcas,
+	},
+	// NOTE the emulated UNIs have no errors
+	me.EthernetPerformanceMonitoringHistoryDataClassId: {
+		counters: func(m *Mib, instance uint16, pm *pmInterval) map[string]uint64 {
+			return nil
+		},
+		tcas: []tca{
+			{counter: "FcsErrors", number: 1, alarm: 0},
+			{counter: "ExcessiveCollisionCounter", number: 2, alarm: 1},
+			{counter: "LateCollisionCounter", number: 3, alarm: 2},
+			{counter: "FramesTooLong", number: 4, alarm: 3},
+			{counter: "BufferOverflowsOnReceive", number: 5, alarm: 4},
+			{counter: "BufferOverflowsOnTransmit", number: 6, alarm: 5},
+			{counter: "SingleCollisionFrameCounter", number: 7, alarm: 6},
+			{counter: "MultipleCollisionsFrameCounter", number: 8, alarm: 7},
+			{counter: "SqeCounter", number: 9, alarm: 8},
+			{counter: "DeferredTransmissionCounter", number: 10, alarm: 9},
+			{counter: "InternalMacTransmitErrorCounter", number: 11, alarm: 10},
+			{counter: "CarrierSenseErrorCounter", number: 12, alarm: 11},
+			{counter: "AlignmentErrorCounter", number: 13, alarm: 12},
+			{counter: "InternalMacReceiveErrorCounter", number: 14, alarm: 13},
+		},
+	},
+	// the instance is the one of the GEM port network CTP
+	me.GemPortNetworkCtpPerformanceMonitoringHistoryDataClassId: {
+		counters: func(m *Mib, instance uint16, pm *pmInterval) map[string]uint64 {
+			ctp, ok := m.Entity(me.GemPortNetworkCtpClassId, instance)
+			if !ok {
+				return nil
+			}
+			gem, ok := pm.gems[uint32(ctp["PortId"].(uint16))]
+			if !ok {
+				return nil
+			}
+			return map[string]uint64{
+				"TransmittedGemFrames":    gem.transmitted,
+				"ReceivedGemFrames":       gem.received,
+				"TransmittedPayloadBytes": gem.transmittedBytes,
+				"ReceivedPayloadBytes":    gem.receivedBytes,
+			}
+		},
+		tcas: []tca{
+			{counter: "EncryptionKeyErrors", number: 1, alarm: 1},
+		},
+	},
+	// the instance is the one of the ANI-G, the downstream is error free
+	FecPmHistoryDataClassId: {
+		counters: func(m *Mib, instance uint16, pm *pmInterval) map[string]uint64 {
+			return map[string]uint64{
+				"TotalCodeWords": (pm.downstream.octets + rsPayload - 1) / rsPayload,
+			}
+		},
+		tcas: []tca{
+			{counter: "CorrectedBytes", number: 1, alarm: 0},
+			{counter: "CorrectedCodeWords", number: 2, alarm: 1},
+			{counter: "UncorrectableCodeWords", number: 3, alarm: 2},
+			{counter: "FecSeconds", number: 4, alarm: 3},
+		},
+	},
+}
+
+// IntervalEndTime returns the number of the last interval that ended, modulo 256
+func (m *Mib) IntervalEndTime() uint8 {
+	return m.intervalEndTime
+}
+
+// synchronizeIntervals starts the intervals from 0, the OLT does it when it synchronizes the time of the ONU
+func (m *Mib) synchronizeIntervals() {
+	m.intervalEndTime = 0
+	m.pm = newPmInterval()
+}
+
+// EndInterval ends the current interval: the PM history data entities report the counters of the interval
+// and a new one starts. It returns the alarm notifications for the counters that crossed their thresholds
+func (m *Mib) EndInterval() [][]byte {
+	m.intervalEndTime++
+	ended := m.pm
+	m.pm = newPmInterval()
+
+	notifications := [][]byte{}
+	for _, key := range m.order {
+		class, ok := pmClasses[key.class]
+		if !ok {
+			continue
+		}
+		entity, err := loadDefinition(key.class)
+		if err != nil {
+			continue
+		}
+		defs := *entity.GetAttributeDefinitions()
+		attributes := m.entities[key]
+		counters := class.counters(m, key.instance, ended)
+		for index, def := range defs {
+			if index > 2 {
+				attributes[def.GetName()] = counterValue(def, counters[def.GetName()])
+			}
+		}
+		attributes["IntervalEndTime"] = m.intervalEndTime
+
+		if pkt := m.thresholdCrossings(key, class, counters); pkt != nil {
+			notifications = append(notifications, pkt)
+		}
+	}
+	return notifications
+}
+
+// counterValue saturates a counter to the size of its attribute
+func counterValue(def *me.AttributeDefinition, value uint64) interface{} {
+	switch def.GetSize() {
+	case 2:
+		if value > 0xFFFF {
+			value = 0xFFFF
+		}
+		return uint16(value)
+	case 4:
+		if value > 0xFFFFFFFF {
+			value = 0xFFFFFFFF
+		}
+		return uint32(value)
+	default:
+		return value
+	}
+}
+
+// thresholdCrossings returns the alarm notification with the threshold crossing alerts of a PM entity,
+// or nil if no counter crossed its threshold. The thresholds are in the Threshold Data 1 and 2 the entity points to
+func (m *Mib) thresholdCrossings(key entityKey, class pmClass, counters map[string]uint64) []byte {
+	id := m.entities[key]["ThresholdData12Id"].(uint16)
+	thresholds := map[int]uint32{}
+	for _, td := range []me.ClassID{me.ThresholdData1ClassId, me.ThresholdData2ClassId} {
+		attributes, ok := m.Entity(td, id)
+		if !ok {
+			continue
+		}
+		for name, value := range attributes {
+			var number int
+			if _, err := fmt.Sscanf(name, "ThresholdValue%d", &number); err == nil {
+				thresholds[number] = value.(uint32)
+			}
+		}
+	}
+
+	bitmap := make([]byte, alarmBitmapSize)
+	crossed := false
+	for _, t := range class.tcas {
+		threshold, ok := thresholds[t.number]
+		if ok && counters[t.counter] > uint64(threshold) {
+			bitmap[t.alarm/8] |= 0x80 >> (t.alarm % 8)
+			crossed = true
+		}
+	}
+	if !crossed {
+		return nil
+	}
+
+	// the alarm sequence number skips 0
+	m.alarmSequence++
+	if m.alarmSequence == 0 {
+		m.alarmSequence = 1
+	}
+	contents := append(bitmap, 0, 0, 0, m.alarmSequence)
+	pkt, err := serialize(0, omci.AlarmNotificationType, payload(&request{class: key.class, instance: key.instance}, contents...))
+	if err != nil {
+		omciLogger.WithFields(log.Fields{
+			"EntityClass":    key.class,
+			"EntityInstance": key.instance,
+		}).Errorf("Cannot serialize the threshold crossing alert: %v", err)
+		return nil
+	}
+	return pkt
+}
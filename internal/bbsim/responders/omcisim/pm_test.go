@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"github.com/google/gopacket"
+	"gotest.tools/assert"
+)
+
+var broadcastFrame = append([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, make([]byte, 54)...)
+
+func createGemPort(t *testing.T, mib *Mib, instance uint16, portId uint16) {
+	gem, _ := me.NewGemPortNetworkCtp(me.ParamData{
+		EntityID: instance,
+		Attributes: me.AttributeValueMap{
+			"PortId":                              portId,
+			"TContPointer":                        uint16(0x8001),
+			"Direction":                           uint8(3),
+			"TrafficManagementPointerForUpstream": uint16(0x8001),
+			"TrafficDescriptorProfilePointerForUpstream":   uint16(0),
+			"PriorityQueuePointerForDownStream":            uint16(0x0001),
+			"TrafficDescriptorProfilePointerForDownstream": uint16(0),
+			"EncryptionKeyRing":                            uint8(0),
+		},
+	})
+	resp, _ := handle(t, mib, genRequest(t, gem, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+}
+
+func Test_Mib_PmHistoryData(t *testing.T) {
+	mib := newTestMib(1, false)
+	createGemPort(t, mib, 1, 1024)
+
+	params := me.ParamData{EntityID: 1, Attributes: me.AttributeValueMap{"ThresholdData12Id": uint16(0)}}
+	gemPm, _ := me.NewGemPortNetworkCtpPerformanceMonitoringHistoryData(params)
+	resp, _ := handle(t, mib, genRequest(t, gemPm, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+	ethernetPm, _ := me.NewEthernetFramePerformanceMonitoringHistoryDataUpstream(params)
+	resp, _ = handle(t, mib, genRequest(t, ethernetPm, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+
+	for i := 0; i < 3; i++ {
+		mib.CountUpstream(1024, broadcastFrame)
+	}
+	mib.CountDownstream(1024, make([]byte, 200))
+	assert.Equal(t, len(mib.EndInterval()), 0)
+	assert.Equal(t, mib.IntervalEndTime(), uint8(1))
+
+	attributes, _ := mib.Entity(me.EthernetFramePerformanceMonitoringHistoryDataUpstreamClassId, 1)
+	assert.Equal(t, attributes["IntervalEndTime"], uint8(1))
+	assert.Equal(t, attributes["Packets"], uint32(3))
+	assert.Equal(t, attributes["Octets"], uint32(3*64))
+	assert.Equal(t, attributes["BroadcastPackets"], uint32(3))
+	assert.Equal(t, attributes["Packets64Octets"], uint32(3))
+
+	resp, layer := handle(t, mib, rawRequest(omci.GetRequestType, me.GemPortNetworkCtpPerformanceMonitoringHistoryDataClassId, 1, 0xb4, 0x00), omci.LayerTypeGetResponse)
+	get := layer.(*omci.GetResponse)
+	assert.Equal(t, get.Result, me.Success)
+	assert.Equal(t, get.Attributes["IntervalEndTime"], uint8(1))
+	assert.Equal(t, get.Attributes["TransmittedGemFrames"], uint32(3))
+	assert.Equal(t, get.Attributes["ReceivedGemFrames"], uint32(1))
+	assert.Equal(t, get.Attributes["TransmittedPayloadBytes"], uint64(3*len(broadcastFrame)))
+
+	// the counters start from 0 in every interval
+	mib.EndInterval()
+	attributes, _ = mib.Entity(me.EthernetFramePerformanceMonitoringHistoryDataUpstreamClassId, 1)
+	assert.Equal(t, attributes["IntervalEndTime"], uint8(2))
+	assert.Equal(t, attributes["Packets"], uint32(0))
+
+	// the intervals start again when the OLT synchronizes the time
+	resp, _ = handle(t, mib, rawRequest(omci.SynchronizeTimeRequestType, me.OnuGClassId, 0), omci.LayerTypeSynchronizeTimeResponse)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Equal(t, mib.IntervalEndTime(), uint8(0))
+}
+
+func Test_Mib_PmThresholdCrossing(t *testing.T) {
+	mib := newTestMib(1, false)
+
+	thresholds, _ := me.NewThresholdData1(me.ParamData{EntityID: 1, Attributes: me.AttributeValueMap{
+		"ThresholdValue1": uint32(2), // drop events
+		"ThresholdValue2": uint32(0),
+		"ThresholdValue3": uint32(0),
+		"ThresholdValue4": uint32(0),
+		"ThresholdValue5": uint32(0),
+		"ThresholdValue6": uint32(0),
+		"ThresholdValue7": uint32(0),
+	}})
+	resp, _ := handle(t, mib, genRequest(t, thresholds, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+	ethernetPm, _ := me.NewEthernetFramePerformanceMonitoringHistoryDataDownstream(me.ParamData{
+		EntityID:   1,
+		Attributes: me.AttributeValueMap{"ThresholdData12Id": uint16(1)},
+	})
+	resp, _ = handle(t, mib, genRequest(t, ethernetPm, omci.CreateRequestType), omci.LayerTypeCreateResponse)
+	assert.Equal(t, resp.Result, me.Success)
+
+	mib.DropDownstream()
+	mib.DropDownstream()
+	assert.Equal(t, len(mib.EndInterval()), 0)
+
+	for i := 0; i < 3; i++ {
+		mib.DropDownstream()
+	}
+	notifications := mib.EndInterval()
+	assert.Equal(t, len(notifications), 1)
+	packet := gopacket.NewPacket(notifications[0], omci.LayerTypeOMCI, gopacket.NoCopy)
+	header := packet.Layer(omci.LayerTypeOMCI).(*omci.OMCI)
+	assert.Equal(t, header.TransactionID, uint16(0))
+	assert.Equal(t, header.MessageType, omci.AlarmNotificationType)
+	alarm := packet.Layer(omci.LayerTypeAlarmNotification).(*omci.AlarmNotificationMsg)
+	assert.Equal(t, alarm.EntityClass, me.EthernetFramePerformanceMonitoringHistoryDataDownstreamClassId)
+	assert.Equal(t, alarm.AlarmBitmap[0], byte(0x80))
+	assert.Equal(t, alarm.AlarmSequenceNumber, byte(1))
+}
+
+func Test_Mib_FecPmHistoryData(t *testing.T) {
+	mib := newTestMib(1, false)
+	ani := uint16(aniSlot<<8 | 1)
+
+	// the OMCI library doesn't know the FEC PM, so the requests and the responses are encoded here
+	resp, err := mib.HandleRequest(rawRequest(omci.CreateRequestType, FecPmHistoryDataClassId, ani, 0x00, 0x00))
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Equal(t, resp.Pkt[8], byte(me.Success))
+
+	mib.CountDownstream(1024, make([]byte, 1000))
+	mib.EndInterval()
+
+	resp, err = mib.HandleRequest(rawRequest(omci.GetRequestType, FecPmHistoryDataClassId, ani, 0x84, 0x00))
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.DeepEqual(t, resp.Pkt[8:16], []byte{byte(me.Success), 0x84, 0x00, 1, 0, 0, 0, 5})
+
+	// the entity is reported last in the MIB upload
+	resp, err = mib.HandleRequest(rawRequest(omci.MibUploadRequestType, me.OnuDataClassId, 0))
+	assert.NilError(t, err)
+	commands := binary.BigEndian.Uint16(resp.Pkt[8:10])
+	resp, err = mib.HandleRequest(rawRequest(omci.MibUploadNextRequestType, me.OnuDataClassId, 0, byte((commands-1)>>8), byte(commands-1)))
+	assert.NilError(t, err)
+	assert.Equal(t, me.ClassID(binary.BigEndian.Uint16(resp.Pkt[8:10])), FecPmHistoryDataClassId)
+
+	resp, err = mib.HandleRequest(rawRequest(omci.DeleteRequestType, FecPmHistoryDataClassId, ani))
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Result, me.Success)
+	_, ok := mib.Entity(FecPmHistoryDataClassId, ani)
+	assert.Assert(t, !ok)
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	me "github.com/cboling/omci/generated"
+	"github.com/google/gopacket"
+	log "github.com/sirupsen/logrus"
+)
+
+// NOTE the software download requests and responses are encoded here as the OMCI library
+// doesn't serialize them as G.988 describes
+
+const (
+	// maxWindowSize is the largest window the ONU accepts, the OLT can ask for a smaller one
+	maxWindowSize = 32
+	// sectionSize is the image data in a baseline DownloadSection request, after the section number
+	sectionSize = 31
+	// aal5Polynomial is the polynomial of the CRC-32 (ITU-T I.363.5) the OLT computes over the image
+	aal5Polynomial = 0x04C11DB7
+)
+
+// DownloadFailure is a failure injected in the software downloads of an ONU
+type DownloadFailure int
+
+const (
+	// NoFailure lets the downloads complete
+	NoFailure DownloadFailure = iota
+	// BadCrc fails the downloads at the end, as if the image the ONU received was corrupted
+	BadCrc
+	// Timeout stops answering the download in the middle of the image, so that the OLT times out
+	Timeout
+)
+
+func (f DownloadFailure) String() string {
+	return [...]string{"none", "bad_crc", "timeout"}[f]
+}
+
+// DownloadState is the state of the last software download
+type DownloadState string
+
+const (
+	Downloading    DownloadState = "downloading"
+	Downloaded     DownloadState = "downloaded"
+	DownloadFailed DownloadState = "failed"
+	// DownloadStalled is the state of a download the ONU stopped answering, see Timeout
+	DownloadStalled DownloadState = "stalled"
+)
+
+// SoftwareImage is the state of one of the two images of the ONU
+type SoftwareImage struct {
+	Version   string
+	Committed bool
+	Active    bool
+	Valid     bool
+}
+
+// ImageDownload reports the progress of the last software download
+type ImageDownload struct {
+	Instance      uint16
+	ImageSize     uint32
+	WindowSize    int
+	ReceivedBytes uint32
+	State         DownloadState
+}
+
+// download is the software download in progress, the sections of a window are added to data
+// only once the last section of the window is received
+type download struct {
+	ImageDownload
+	data []byte
+	// window is the data of the sections of the current window, next is the section that is expected
+	window []byte
+	next   int
+	// missed is true if a section of the current window was not received, the OLT sends the window again
+	missed bool
+}
+
+// Images returns the state of the software images
+func (m *Mib) Images() [2]SoftwareImage {
+	return m.images
+}
+
+// Download returns the progress of the last software download, if there is one
+func (m *Mib) Download() (ImageDownload, bool) {
+	if m.download == nil {
+		return ImageDownload{}, false
+	}
+	return m.download.ImageDownload, true
+}
+
+// SetDownloadFailure injects a failure in the next software downloads, until it is set to NoFailure
+func (m *Mib) SetDownloadFailure(failure DownloadFailure) {
+	m.downloadFailure = failure
+}
+
+// DownloadFailure returns the failure injected in the software downloads
+func (m *Mib) DownloadFailure() DownloadFailure {
+	return m.downloadFailure
+}
+
+// updateImages reports the state of the images in the SoftwareImage entities
+func (m *Mib) updateImages() {
+	for instance, image := range m.images {
+		attributes, ok := m.Entity(me.SoftwareImageClassId, uint16(instance))
+		if !ok {
+			continue
+		}
+		attributes["Version"] = fixedString(image.Version, 14)
+		attributes["IsCommitted"] = flag(image.Committed)
+		attributes["IsActive"] = flag(image.Active)
+		attributes["IsValid"] = flag(image.Valid)
+	}
+}
+
+func flag(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// image returns the image the request is for, the entity instance is the image number
+func (m *Mib) image(req *request) (*SoftwareImage, me.Results) {
+	if _, _, result := m.existing(req); result != me.Success {
+		return nil, result
+	}
+	if int(req.instance) >= len(m.images) {
+		return nil, me.UnknownInstance
+	}
+	return &m.images[req.instance], me.Success
+}
+
+func (m *Mib) startSoftwareDownload(req *request) (gopacket.SerializableLayer, me.Results) {
+	image, result := m.image(req)
+	if result != me.Success {
+		return nil, result
+	}
+	windowSize := int(req.contents[0]) + 1
+	imageSize := binary.BigEndian.Uint32(req.contents[1:5])
+	if image.Active || imageSize == 0 {
+		// NOTE the active image can't be replaced, the OLT has to download to the standby one
+		return downloadPayload(req, me.ParameterError, 0), me.ParameterError
+	}
+	if windowSize > maxWindowSize {
+		windowSize = maxWindowSize
+	}
+
+	// NOTE the image is not valid until the download completes, whatever it was before
+	*image = SoftwareImage{}
+	m.updateImages()
+	m.download = &download{
+		ImageDownload: ImageDownload{
+			Instance:   req.instance,
+			ImageSize:  imageSize,
+			WindowSize: windowSize,
+			State:      Downloading,
+		},
+	}
+
+	omciLogger.WithFields(log.Fields{
+		"Instance":   req.instance,
+		"ImageSize":  imageSize,
+		"WindowSize": windowSize,
+	}).Debug("Software download started")
+	return downloadPayload(req, me.Success, windowSize), me.Success
+}
+
+// downloadPayload is the StartSoftwareDownload response: the result, the window size
+// and the result for the only image instance being downloaded
+func downloadPayload(req *request, result me.Results, windowSize int) gopacket.Payload {
+	var window byte
+	if windowSize > 0 {
+		window = byte(windowSize - 1)
+	}
+	return payload(req, byte(result), window, 1, byte(req.instance>>8), byte(req.instance), byte(result))
+}
+
+func (m *Mib) downloadSection(req *request) (gopacket.SerializableLayer, me.Results) {
+	ack := byte(req.msgType)&me.AR != 0
+	d := m.download
+	if d == nil || d.Instance != req.instance || d.State != Downloading {
+		if d != nil && d.State == DownloadStalled {
+			return noResponse{}, me.Success
+		}
+		if !ack {
+			return noResponse{}, me.ProcessingError
+		}
+		return payload(req, byte(me.ProcessingError), req.contents[0]), me.ProcessingError
+	}
+
+	section := int(req.contents[0])
+	if section != d.next || section >= d.WindowSize {
+		d.missed = true
+	} else {
+		d.window = append(d.window, req.contents[1:1+sectionSize]...)
+		d.next++
+	}
+
+	if m.downloadFailure == Timeout && 2*(len(d.data)+len(d.window)) >= int(d.ImageSize) {
+		omciLogger.WithFields(log.Fields{
+			"Instance":      d.Instance,
+			"ReceivedBytes": len(d.data) + len(d.window),
+		}).Info("Stalling the software download, as requested")
+		d.State = DownloadStalled
+		return noResponse{}, me.Success
+	}
+	if !ack {
+		return noResponse{}, me.Success
+	}
+
+	// the last section of the window, the OLT sends the whole window again if a section is missing
+	result := me.Success
+	if d.missed {
+		result = me.ProcessingError
+	} else {
+		d.data = append(d.data, d.window...)
+		if len(d.data) > int(d.ImageSize) {
+			// NOTE the last section is padded
+			d.data = d.data[:d.ImageSize]
+		}
+		d.ReceivedBytes = uint32(len(d.data))
+	}
+	d.window = d.window[:0]
+	d.next = 0
+	d.missed = false
+	return payload(req, byte(result), byte(section)), result
+}
+
+func (m *Mib) endSoftwareDownload(req *request) (gopacket.SerializableLayer, me.Results) {
+	image, result := m.image(req)
+	if result != me.Success {
+		return nil, result
+	}
+	d := m.download
+	if d != nil && d.State == DownloadStalled {
+		return noResponse{}, me.Success
+	}
+	if d == nil || d.Instance != req.instance || d.State != Downloading {
+		return endPayload(req, me.ProcessingError), me.ProcessingError
+	}
+
+	crc := binary.BigEndian.Uint32(req.contents[0:4])
+	imageSize := binary.BigEndian.Uint32(req.contents[4:8])
+	result = me.Success
+	switch {
+	case imageSize != d.ImageSize:
+		result = me.ParameterError
+	case d.ReceivedBytes != d.ImageSize, crc != aal5Crc(d.data), m.downloadFailure == BadCrc:
+		result = me.ProcessingError
+	}
+
+	omciLogger.WithFields(log.Fields{
+		"Instance":      d.Instance,
+		"ImageSize":     imageSize,
+		"ReceivedBytes": d.ReceivedBytes,
+		"Crc":           fmt.Sprintf("%#08x", crc),
+		"Result":        result,
+	}).Debug("Software download ended")
+
+	if result != me.Success {
+		d.State = DownloadFailed
+		d.data = nil
+		return endPayload(req, result), result
+	}
+
+	*image = SoftwareImage{Version: imageVersion(d.data, crc), Valid: true}
+	m.updateImages()
+	m.changed()
+	d.State = Downloaded
+	d.data = nil
+	return endPayload(req, me.Success), me.Success
+}
+
+// endPayload is the EndSoftwareDownload response: the result and the result for the only image instance
+func endPayload(req *request, result me.Results) gopacket.Payload {
+	return payload(req, byte(result), 1, byte(req.instance>>8), byte(req.instance), byte(result))
+}
+
+// imageVersion is the version a downloaded image reports: the printable characters it starts with,
+// so that the images built for the tests can carry a version, or its CRC
+func imageVersion(data []byte, crc uint32) string {
+	end := 0
+	for end < len(data) && end < 14 && data[end] >= 0x20 && data[end] < 0x7F {
+		end++
+	}
+	if end == 0 {
+		return fmt.Sprintf("IMG_%08X", crc)
+	}
+	return string(data[:end])
+}
+
+func (m *Mib) activateSoftware(req *request) (gopacket.SerializableLayer, me.Results) {
+	image, result := m.image(req)
+	if result != me.Success {
+		return nil, result
+	}
+	if !image.Valid {
+		return payload(req, byte(me.ParameterError)), me.ParameterError
+	}
+	for i := range m.images {
+		m.images[i].Active = false
+	}
+	image.Active = true
+	m.updateImages()
+	m.changed()
+	return payload(req, byte(me.Success)), me.Success
+}
+
+func (m *Mib) commitSoftware(req *request) (gopacket.SerializableLayer, me.Results) {
+	image, result := m.image(req)
+	if result != me.Success {
+		return nil, result
+	}
+	if !image.Valid {
+		return payload(req, byte(me.ParameterError)), me.ParameterError
+	}
+	for i := range m.images {
+		m.images[i].Committed = false
+	}
+	image.Committed = true
+	m.updateImages()
+	m.changed()
+	return payload(req, byte(me.Success)), me.Success
+}
+
+var aal5Table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ aal5Polynomial
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// aal5Crc is the CRC-32 of ITU-T I.363.5, it is not reflected unlike the one of hash/crc32
+func aal5Crc(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ aal5Table[byte(crc>>24)^b]
+	}
+	return ^crc
+}
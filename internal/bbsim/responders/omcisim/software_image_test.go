@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package omcisim
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cboling/omci"
+	me "github.com/cboling/omci/generated"
+	"gotest.tools/assert"
+)
+
+func testImage(version string, size int) []byte {
+	image := make([]byte, size)
+	copy(image, version)
+	for i := len(version); i < size; i++ {
+		image[i] = byte(i)
+	}
+	return image
+}
+
+func startDownload(t *testing.T, mib *Mib, instance uint16, size int, windowSize int) *Response {
+	contents := []byte{byte(windowSize - 1), 0, 0, 0, 0, 1, 0, byte(instance)}
+	binary.BigEndian.PutUint32(contents[1:5], uint32(size))
+	resp, _ := handle(t, mib, rawRequest(omci.StartSoftwareDownloadRequestType, me.SoftwareImageClassId, instance, contents...), omci.LayerTypeOMCI)
+	return resp
+}
+
+// sendSections sends the image in windows of windowSize sections, it returns the results
+// of the responses to the last section of each window
+func sendSections(t *testing.T, mib *Mib, instance uint16, image []byte, windowSize int) []me.Results {
+	results := []me.Results{}
+	sections := (len(image) + sectionSize - 1) / sectionSize
+	for s := 0; s < sections; s++ {
+		section := s % windowSize
+		msgType := omci.MessageType(me.DownloadSection)
+		if section == windowSize-1 || s == sections-1 {
+			msgType = omci.DownloadSectionRequestType
+		}
+		end := (s + 1) * sectionSize
+		if end > len(image) {
+			end = len(image)
+		}
+		contents := append([]byte{byte(section)}, image[s*sectionSize:end]...)
+		resp, err := mib.HandleRequest(rawRequest(msgType, me.SoftwareImageClassId, instance, contents...))
+		assert.NilError(t, err)
+		if msgType == omci.DownloadSectionRequestType && resp.Pkt != nil {
+			assert.Equal(t, resp.Pkt[9], byte(section))
+			results = append(results, me.Results(resp.Pkt[8]))
+		} else {
+			assert.Assert(t, resp.Pkt == nil)
+		}
+	}
+	return results
+}
+
+func endDownload(t *testing.T, mib *Mib, instance uint16, image []byte) *Response {
+	contents := make([]byte, 11)
+	binary.BigEndian.PutUint32(contents[0:4], aal5Crc(image))
+	binary.BigEndian.PutUint32(contents[4:8], uint32(len(image)))
+	contents[8] = 1
+	binary.BigEndian.PutUint16(contents[9:11], instance)
+	resp, err := mib.HandleRequest(rawRequest(omci.EndSoftwareDownloadRequestType, me.SoftwareImageClassId, instance, contents...))
+	assert.NilError(t, err)
+	return resp
+}
+
+func Test_Mib_AalCrc(t *testing.T) {
+	// the check value of CRC-32/BZIP2
+	assert.Equal(t, aal5Crc([]byte("123456789")), uint32(0xFC891918))
+}
+
+func Test_Mib_SoftwareDownload(t *testing.T) {
+	mib := newTestMib(1, false)
+	image := testImage("BBSM_IMG_00002", 1000)
+
+	// the active image can't be replaced
+	resp := startDownload(t, mib, 0, len(image), 8)
+	assert.Equal(t, resp.Result, me.ParameterError)
+
+	// the window is capped
+	resp = startDownload(t, mib, 1, len(image), 64)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Equal(t, resp.Pkt[9], byte(maxWindowSize-1))
+	assert.Equal(t, mib.Images()[1].Valid, false)
+
+	resp = startDownload(t, mib, 1, len(image), 8)
+	assert.Equal(t, resp.Pkt[9], byte(7))
+	for _, result := range sendSections(t, mib, 1, image, 8) {
+		assert.Equal(t, result, me.Success)
+	}
+	download, ok := mib.Download()
+	assert.Assert(t, ok)
+	assert.Equal(t, download.ReceivedBytes, uint32(len(image)))
+
+	resp = endDownload(t, mib, 1, image)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Equal(t, mib.Images()[1], SoftwareImage{Version: "BBSM_IMG_00002", Valid: true})
+	download, _ = mib.Download()
+	assert.Equal(t, download.State, Downloaded)
+
+	resp, _ = handle(t, mib, rawRequest(omci.ActivateSoftwareRequestType, me.SoftwareImageClassId, 1), omci.LayerTypeOMCI)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Assert(t, resp.Reboot)
+	resp, _ = handle(t, mib, rawRequest(omci.CommitSoftwareRequestType, me.SoftwareImageClassId, 1), omci.LayerTypeOMCI)
+	assert.Equal(t, resp.Result, me.Success)
+	assert.Assert(t, !resp.Reboot)
+
+	// the images survive the MIB reset
+	mib.Reset()
+	images := mib.Images()
+	assert.Equal(t, images[0], SoftwareImage{Version: defaultVersion, Valid: true})
+	assert.Equal(t, images[1], SoftwareImage{Version: "BBSM_IMG_00002", Valid: true, Active: true, Committed: true})
+	attributes, _ := mib.Entity(me.SoftwareImageClassId, 1)
+	assert.Equal(t, attributes["IsActive"], uint8(1))
+	assert.DeepEqual(t, attributes["Version"], []byte("BBSM_IMG_00002"))
+}
+
+func Test_Mib_SoftwareDownloadMissingSection(t *testing.T) {
+	mib := newTestMib(1, false)
+	image := testImage("BBSM_IMG_00002", 4*sectionSize)
+	startDownload(t, mib, 1, len(image), 4)
+
+	// the second section is lost, the ONU asks for the window again
+	for _, s := range []int{0, 2} {
+		contents := append([]byte{byte(s)}, image[s*sectionSize:(s+1)*sectionSize]...)
+		_, err := mib.HandleRequest(rawRequest(omci.MessageType(me.DownloadSection), me.SoftwareImageClassId, 1, contents...))
+		assert.NilError(t, err)
+	}
+	contents := append([]byte{3}, image[3*sectionSize:]...)
+	resp, _ := handle(t, mib, rawRequest(omci.DownloadSectionRequestType, me.SoftwareImageClassId, 1, contents...), omci.LayerTypeOMCI)
+	assert.Equal(t, resp.Result, me.ProcessingError)
+
+	assert.DeepEqual(t, sendSections(t, mib, 1, image, 4), []me.Results{me.Success})
+	assert.Equal(t, endDownload(t, mib, 1, image).Result, me.Success)
+
+	// an image without a version is named after its CRC
+	image = make([]byte, 100)
+	startDownload(t, mib, 1, len(image), 4)
+	sendSections(t, mib, 1, image, 4)
+	assert.Equal(t, endDownload(t, mib, 1, image).Result, me.Success)
+	assert.Equal(t, mib.Images()[1].Version, "IMG_53631199")
+}
+
+func Test_Mib_SoftwareDownloadFailures(t *testing.T) {
+	mib := newTestMib(1, false)
+	image := testImage("BBSM_IMG_00002", 1000)
+
+	// the image is corrupted
+	startDownload(t, mib, 1, len(image), 8)
+	sendSections(t, mib, 1, image, 8)
+	assert.Equal(t, endDownload(t, mib, 1, append([]byte{}, image[1:]...)).Result, me.ParameterError)
+	startDownload(t, mib, 1, len(image), 8)
+	sendSections(t, mib, 1, image, 8)
+	corrupted := append([]byte{}, image...)
+	corrupted[500]++
+	assert.Equal(t, endDownload(t, mib, 1, corrupted).Result, me.ProcessingError)
+	download, _ := mib.Download()
+	assert.Equal(t, download.State, DownloadFailed)
+	assert.Equal(t, mib.Images()[1].Valid, false)
+
+	// an invalid image can't be activated nor committed
+	resp, _ := handle(t, mib, rawRequest(omci.ActivateSoftwareRequestType, me.SoftwareImageClassId, 1), omci.LayerTypeOMCI)
+	assert.Equal(t, resp.Result, me.ParameterError)
+	assert.Assert(t, !resp.Reboot)
+	resp, _ = handle(t, mib, rawRequest(omci.CommitSoftwareRequestType, me.SoftwareImageClassId, 1), omci.LayerTypeOMCI)
+	assert.Equal(t, resp.Result, me.ParameterError)
+
+	mib.SetDownloadFailure(BadCrc)
+	startDownload(t, mib, 1, len(image), 8)
+	sendSections(t, mib, 1, image, 8)
+	assert.Equal(t, endDownload(t, mib, 1, image).Result, me.ProcessingError)
+
+	// the ONU stops answering in the middle of the image
+	mib.SetDownloadFailure(Timeout)
+	startDownload(t, mib, 1, len(image), 8)
+	results := sendSections(t, mib, 1, image, 8)
+	windows := (len(image) + 8*sectionSize - 1) / (8 * sectionSize)
+	assert.Assert(t, len(results) > 0 && len(results) < windows)
+	assert.Assert(t, endDownload(t, mib, 1, image).Pkt == nil)
+	download, _ = mib.Download()
+	assert.Equal(t, download.State, DownloadStalled)
+
+	mib.SetDownloadFailure(NoFailure)
+	startDownload(t, mib, 1, len(image), 8)
+	sendSections(t, mib, 1, image, 8)
+	assert.Equal(t, endDownload(t, mib, 1, image).Result, me.Success)
+}
@@ -30,20 +30,31 @@ import (
 )
 
 const (
-	DEFAULT_OLT_DEVICE_HEADER_FORMAT = "table{{ .ID }}\t{{ .SerialNumber }}\t{{ .OperState }}\t{{ .InternalState }}"
+	DEFAULT_OLT_DEVICE_HEADER_FORMAT = "table{{ .ID }}\t{{ .SerialNumber }}\t{{ .OperState }}\t{{ .InternalState }}\t{{ .Address }}"
 	DEFAULT_PORT_HEADER_FORMAT       = "table{{ .ID }}\t{{ .OperState }}"
 )
 
+type OltList struct{}
+
 type OltGet struct{}
 
 type OltNNIs struct{}
 
 type OltPONs struct{}
 
+type OltHeartbeatFailure struct {
+	Mode string `short:"m" long:"mode" default:"fail" choice:"fail" choice:"hang" description:"Whether the heartbeat returns an error or does not respond"`
+	Args struct {
+		Duration uint32
+	} `positional-args:"yes" required:"yes"`
+}
+
 type oltOptions struct {
-	Get OltGet  `command:"get"`
-	NNI OltNNIs `command:"nnis"`
-	PON OltPONs `command:"pons"`
+	List             OltList             `command:"list"`
+	Get              OltGet              `command:"get"`
+	NNI              OltNNIs             `command:"nnis"`
+	PON              OltPONs             `command:"pons"`
+	HeartbeatFailure OltHeartbeatFailure `command:"heartbeat_failure"`
 }
 
 func RegisterOltCommands(parser *flags.Parser) {
@@ -63,7 +74,7 @@ func getOLT() *pb.Olt {
 
 	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
 	defer cancel()
-	olt, err := c.GetOlt(ctx, &pb.Empty{})
+	olt, err := c.GetOlt(ctx, &pb.OltRequest{OltID: config.GlobalOptions.Olt})
 	if err != nil {
 		log.Fatalf("could not get OLT: %v", err)
 		return nil
@@ -76,6 +87,25 @@ func printOltHeader(prefix string, o *pb.Olt) {
 	fmt.Println()
 }
 
+func (o *OltList) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+
+	olts, err := client.GetOlts(ctx, &pb.Empty{})
+	if err != nil {
+		log.Fatalf("could not get OLTs: %v", err)
+		return err
+	}
+
+	tableFormat := format.Format(DEFAULT_OLT_DEVICE_HEADER_FORMAT)
+	tableFormat.Execute(os.Stdout, true, olts.Items)
+
+	return nil
+}
+
 func (o *OltGet) Execute(args []string) error {
 	olt := getOLT()
 
@@ -107,3 +137,31 @@ func (o *OltPONs) Execute(args []string) error {
 
 	return nil
 }
+
+func (o *OltHeartbeatFailure) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+
+	req := pb.HeartbeatFailure{
+		Mode:     pb.HeartbeatFailure_FAIL,
+		Duration: o.Args.Duration,
+		OltID:    config.GlobalOptions.Olt,
+	}
+	if o.Mode == "hang" {
+		req.Mode = pb.HeartbeatFailure_HANG
+	}
+
+	res, err := client.SetHeartbeatFailure(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot set the OLT heartbeat failure: %v", err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("[Status: %d] %s", res.StatusCode, res.Message))
+
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	pb "github.com/opencord/bbsim/api/bbsim"
+	"github.com/opencord/bbsim/internal/bbsimctl/config"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// the commands act on the global OMCI faults if no ONU serial number is given
+
+type OmciFaultsGet struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes"`
+}
+
+type OmciFaultsSet struct {
+	DropRate      float64       `long:"drop" description:"Fraction of the requests that are lost, between 0 and 1"`
+	Delay         time.Duration `long:"delay" description:"Delay of the responses, the minimum of the uniform distribution or the mean of the exponential one"`
+	MaxDelay      time.Duration `long:"max-delay" description:"Maximum delay of the responses, for the uniform and exponential distributions"`
+	Distribution  string        `long:"distribution" default:"fixed" choice:"fixed" choice:"uniform" choice:"exponential" description:"Distribution of the delays"`
+	ErrorRate     float64       `long:"error" description:"Fraction of the requests that are answered with the result, without being applied"`
+	Result        string        `long:"result" default:"success" description:"OMCI result of the errors, eg: parameter_error, processing_error or unknown_instance"`
+	DuplicateRate float64       `long:"duplicate" description:"Fraction of the responses that are sent twice"`
+	ReorderRate   float64       `long:"reorder" description:"Fraction of the responses that are sent after the next one"`
+	Silent        bool          `long:"silent" description:"Stop answering OMCI altogether"`
+	Args          struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes"`
+}
+
+type OmciFaultsClear struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes"`
+}
+
+type omciFaultsOptions struct {
+	Get   OmciFaultsGet   `command:"get"`
+	Set   OmciFaultsSet   `command:"set"`
+	Clear OmciFaultsClear `command:"clear"`
+}
+
+type omciOptions struct {
+	Faults omciFaultsOptions `command:"faults"`
+}
+
+func RegisterOmciCommands(parser *flags.Parser) {
+	parser.AddCommand("omci", "OMCI Commands", "Commands to inject faults in the OMCI exchanges of the ONUs", &omciOptions{})
+}
+
+// faultsTarget describes the faults a command acts on
+func faultsTarget(onuSn OnuSnString) string {
+	if onuSn == "" {
+		return "the global OMCI faults"
+	}
+	return fmt.Sprintf("the OMCI faults of ONU %s", onuSn)
+}
+
+func (options *OmciFaultsGet) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.GetOmciFaults(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot get %s: %v", faultsTarget(options.Args.OnuSn), err)
+		return err
+	}
+
+	if options.Args.OnuSn != "" && res.Global {
+		fmt.Println("The ONU has no OMCI faults of its own, the global ones apply")
+	}
+	fmt.Println(fmt.Sprintf("Drop rate: %g", res.DropRate))
+	fmt.Println(fmt.Sprintf("Delay: %s, max %s (%s)", time.Duration(res.Delay)*time.Millisecond,
+		time.Duration(res.MaxDelay)*time.Millisecond, res.Distribution))
+	fmt.Println(fmt.Sprintf("Error rate: %g (%s)", res.ErrorRate, res.Result))
+	fmt.Println(fmt.Sprintf("Duplicate rate: %g", res.DuplicateRate))
+	fmt.Println(fmt.Sprintf("Reorder rate: %g", res.ReorderRate))
+	fmt.Println(fmt.Sprintf("Silent: %t", res.Silent))
+
+	return nil
+}
+
+func (options *OmciFaultsSet) Execute(args []string) error {
+	result, ok := pb.OmciFaults_Result_value[strings.ToUpper(options.Result)]
+	if !ok {
+		log.Fatalf("Unknown OMCI result %s, eg: parameter_error, processing_error or unknown_instance", options.Result)
+	}
+
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.OmciFaults{
+		SerialNumber:  string(options.Args.OnuSn),
+		OltID:         config.GlobalOptions.Olt,
+		DropRate:      options.DropRate,
+		Delay:         uint32(options.Delay / time.Millisecond),
+		MaxDelay:      uint32(options.MaxDelay / time.Millisecond),
+		Distribution:  pb.OmciFaults_Distribution(pb.OmciFaults_Distribution_value[strings.ToUpper(options.Distribution)]),
+		ErrorRate:     options.ErrorRate,
+		Result:        pb.OmciFaults_Result(result),
+		DuplicateRate: options.DuplicateRate,
+		ReorderRate:   options.ReorderRate,
+		Silent:        options.Silent,
+	}
+	res, err := client.SetOmciFaults(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot set %s: %v", faultsTarget(options.Args.OnuSn), err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("[Status: %d] %s", res.StatusCode, res.Message))
+
+	return nil
+}
+
+func (options *OmciFaultsClear) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.ClearOmciFaults(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot clear %s: %v", faultsTarget(options.Args.OnuSn), err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("[Status: %d] %s", res.StatusCode, res.Message))
+
+	return nil
+}
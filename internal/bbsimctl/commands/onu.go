@@ -31,7 +31,12 @@ import (
 )
 
 const (
-	DEFAULT_ONU_DEVICE_HEADER_FORMAT = "table{{ .PonPortID }}\t{{ .ID }}\t{{ .PortNo }}\t{{ .SerialNumber }}\t{{ .HwAddress }}\t{{ .STag }}\t{{ .CTag }}\t{{ .OperState }}\t{{ .InternalState }}"
+	DEFAULT_ONU_DEVICE_HEADER_FORMAT = "table{{ .PonPortID }}\t{{ .ID }}\t{{ .PortNo }}\t{{ .SerialNumber }}\t{{ .HwAddress }}\t{{ .STag }}\t{{ .CTag }}\t{{ .OperState }}\t{{ .InternalState }}\t{{ .MibTemplate }}"
+	DEFAULT_UNI_HEADER_FORMAT        = "table{{ .ID }}\t{{ .PortNo }}\t{{ .HwAddress }}\t{{ .CTag }}\t{{ .InternalState }}"
+	DEFAULT_TCONT_HEADER_FORMAT      = "table{{ .UniId }}\t{{ .PortNo }}\t{{ .Direction }}\t{{ .AllocId }}\t{{ .AdditionalBw }}\t{{ .Priority }}\t{{ .Weight }}\t{{ .SchedPolicy }}"
+	DEFAULT_GEM_PORT_HEADER_FORMAT   = "table{{ .UniId }}\t{{ .PortNo }}\t{{ .Direction }}\t{{ .GemportId }}\t{{ .PbitMap }}\t{{ .Priority }}\t{{ .Weight }}\t{{ .SchedPolicy }}"
+	DEFAULT_IMAGE_HEADER_FORMAT      = "table{{ .Instance }}\t{{ .Version }}\t{{ .IsCommitted }}\t{{ .IsActive }}\t{{ .IsValid }}"
+	DEFAULT_FLOW_HEADER_FORMAT       = "table{{ .FlowId }}\t{{ .FlowType }}\t{{ .AccessIntfId }}\t{{ .OnuId }}\t{{ .UniId }}\t{{ .PortNo }}\t{{ .AllocId }}\t{{ .GemportId }}\t{{ .Classifier.EthType }}\t{{ .Classifier.OVid }}\t{{ .Classifier.IVid }}\t{{ .Classifier.IpProto }}"
 )
 
 type OnuSnString string
@@ -67,6 +72,75 @@ type ONUDhcpRestart struct {
 	} `positional-args:"yes" required:"yes"`
 }
 
+type ONUFlows struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ONUUnis struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ONUTechProfile struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ONUImages struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ONUImageFailure struct {
+	Args struct {
+		OnuSn   OnuSnString
+		Failure string `description:"none, bad_crc or timeout"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ONUAdd struct {
+	SerialNumber string `short:"s" long:"sn" description:"The serial number of the ONU, generated from the SN pattern if not set"`
+	STag         int32  `long:"stag" description:"The S-Tag of the ONU, the one of the OLT if not set"`
+	CTag         int32  `long:"ctag" description:"The C-Tag of the first UNI, the next available one if not set"`
+	Args         struct {
+		PonPortID int32
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ONURemove struct {
+	Args struct {
+		OnuSn OnuSnString
+	} `positional-args:"yes" required:"yes"`
+}
+
+// TcontRow and GemPortRow flatten the tech profile for the tables
+type TcontRow struct {
+	UniId        uint32
+	PortNo       uint32
+	Direction    string
+	AllocId      uint32
+	AdditionalBw string
+	Priority     uint32
+	Weight       uint32
+	SchedPolicy  string
+}
+
+type GemPortRow struct {
+	UniId       uint32
+	PortNo      uint32
+	Direction   string
+	GemportId   uint32
+	PbitMap     string
+	Priority    uint32
+	Weight      uint32
+	SchedPolicy string
+}
+
 type ONUOptions struct {
 	List         ONUList         `command:"list"`
 	Get          ONUGet          `command:"get"`
@@ -74,6 +148,13 @@ type ONUOptions struct {
 	PowerOn      ONUPowerOn      `command:"poweron"`
 	RestartEapol ONUEapolRestart `command:"auth_restart"`
 	RestartDchp  ONUDhcpRestart  `command:"dhcp_restart"`
+	Flows        ONUFlows        `command:"flows"`
+	Unis         ONUUnis         `command:"unis"`
+	TechProfile  ONUTechProfile  `command:"tech_profile"`
+	Add          ONUAdd          `command:"add"`
+	Remove       ONURemove       `command:"remove"`
+	Images       ONUImages       `command:"images"`
+	ImageFailure ONUImageFailure `command:"image_failure"`
 }
 
 func RegisterONUCommands(parser *flags.Parser) {
@@ -99,7 +180,7 @@ func getONUs() *pb.ONUs {
 	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
 	defer cancel()
 
-	onus, err := client.GetONUs(ctx, &pb.Empty{})
+	onus, err := client.GetONUs(ctx, &pb.OltRequest{OltID: config.GlobalOptions.Olt})
 	if err != nil {
 		log.Fatalf("could not get OLT: %v", err)
 		return nil
@@ -127,6 +208,7 @@ func (options *ONUGet) Execute(args []string) error {
 	defer cancel()
 	req := pb.ONURequest{
 		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
 	}
 	res, err := client.GetONU(ctx, &req)
 
@@ -143,6 +225,134 @@ func (options *ONUGet) Execute(args []string) error {
 	return nil
 }
 
+func (options *ONUFlows) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.GetFlows(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot get flows for ONU %s: %v", options.Args.OnuSn, err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("ONU %s has %d flows", options.Args.OnuSn, res.FlowCount))
+	fmt.Println()
+
+	tableFormat := format.Format(DEFAULT_FLOW_HEADER_FORMAT)
+	if err := tableFormat.Execute(os.Stdout, true, res.Flows); err != nil {
+		log.Fatalf("Error while formatting flows table: %s", err)
+	}
+
+	return nil
+}
+
+func (options *ONUUnis) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.GetONU(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot get UNIs for ONU %s: %v", options.Args.OnuSn, err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("ONU %s has %d UNIs", options.Args.OnuSn, len(res.Unis)))
+	fmt.Println()
+
+	tableFormat := format.Format(DEFAULT_UNI_HEADER_FORMAT)
+	if err := tableFormat.Execute(os.Stdout, true, res.Unis); err != nil {
+		log.Fatalf("Error while formatting UNIs table: %s", err)
+	}
+
+	return nil
+}
+
+func (options *ONUTechProfile) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.GetTechProfile(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot get tech profile for ONU %s: %v", options.Args.OnuSn, err)
+		return err
+	}
+
+	tconts := []TcontRow{}
+	for _, ts := range res.TrafficSchedulers {
+		for _, sched := range ts.TrafficScheds {
+			row := TcontRow{
+				UniId:     ts.UniId,
+				PortNo:    ts.PortNo,
+				Direction: sched.Direction.String(),
+				AllocId:   sched.AllocId,
+			}
+			if sched.Scheduler != nil {
+				row.AdditionalBw = sched.Scheduler.AdditionalBw.String()
+				row.Priority = sched.Scheduler.Priority
+				row.Weight = sched.Scheduler.Weight
+				row.SchedPolicy = sched.Scheduler.SchedPolicy.String()
+			}
+			tconts = append(tconts, row)
+		}
+	}
+
+	gemPorts := []GemPortRow{}
+	for _, tq := range res.TrafficQueues {
+		for _, q := range tq.TrafficQueues {
+			gemPorts = append(gemPorts, GemPortRow{
+				UniId:       tq.UniId,
+				PortNo:      tq.PortNo,
+				Direction:   q.Direction.String(),
+				GemportId:   q.GemportId,
+				PbitMap:     q.PbitMap,
+				Priority:    q.Priority,
+				Weight:      q.Weight,
+				SchedPolicy: q.SchedPolicy.String(),
+			})
+		}
+	}
+
+	fmt.Println(fmt.Sprintf("ONU %s has %d T-CONTs", options.Args.OnuSn, len(tconts)))
+	fmt.Println()
+
+	tableFormat := format.Format(DEFAULT_TCONT_HEADER_FORMAT)
+	if err := tableFormat.Execute(os.Stdout, true, tconts); err != nil {
+		log.Fatalf("Error while formatting T-CONTs table: %s", err)
+	}
+
+	fmt.Println()
+	fmt.Println(fmt.Sprintf("ONU %s has %d GemPorts", options.Args.OnuSn, len(gemPorts)))
+	fmt.Println()
+
+	tableFormat = format.Format(DEFAULT_GEM_PORT_HEADER_FORMAT)
+	if err := tableFormat.Execute(os.Stdout, true, gemPorts); err != nil {
+		log.Fatalf("Error while formatting GemPorts table: %s", err)
+	}
+
+	return nil
+}
+
 func (options *ONUShutDown) Execute(args []string) error {
 
 	client, conn := connect()
@@ -152,6 +362,7 @@ func (options *ONUShutDown) Execute(args []string) error {
 	defer cancel()
 	req := pb.ONURequest{
 		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
 	}
 	res, err := client.ShutdownONU(ctx, &req)
 
@@ -173,6 +384,7 @@ func (options *ONUPowerOn) Execute(args []string) error {
 	defer cancel()
 	req := pb.ONURequest{
 		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
 	}
 	res, err := client.PoweronONU(ctx, &req)
 
@@ -194,6 +406,7 @@ func (options *ONUEapolRestart) Execute(args []string) error {
 	defer cancel()
 	req := pb.ONURequest{
 		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
 	}
 	res, err := client.RestartEapol(ctx, &req)
 
@@ -215,6 +428,7 @@ func (options *ONUDhcpRestart) Execute(args []string) error {
 	defer cancel()
 	req := pb.ONURequest{
 		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
 	}
 	res, err := client.RestartDhcp(ctx, &req)
 
@@ -235,7 +449,7 @@ func (onuSn *OnuSnString) Complete(match string) []flags.Completion {
 	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
 	defer cancel()
 
-	onus, err := client.GetONUs(ctx, &pb.Empty{})
+	onus, err := client.GetONUs(ctx, &pb.OltRequest{OltID: config.GlobalOptions.Olt})
 	if err != nil {
 		log.Fatalf("could not get ONUs: %v", err)
 		return nil
@@ -250,3 +464,115 @@ func (onuSn *OnuSnString) Complete(match string) []flags.Completion {
 
 	return list
 }
+
+func (options *ONUAdd) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.AddONURequest{
+		OltID:        config.GlobalOptions.Olt,
+		PonPortID:    options.Args.PonPortID,
+		SerialNumber: options.SerialNumber,
+		STag:         options.STag,
+		CTag:         options.CTag,
+	}
+	res, err := client.AddONU(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot add ONU to PON %d: %v", options.Args.PonPortID, err)
+		return err
+	}
+
+	tableFormat := format.Format(DEFAULT_ONU_DEVICE_HEADER_FORMAT)
+	if err := tableFormat.Execute(os.Stdout, true, []*pb.ONU{res}); err != nil {
+		log.Fatalf("Error while formatting ONUs table: %s", err)
+	}
+
+	return nil
+}
+
+func (options *ONURemove) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.RemoveONU(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot remove ONU %s: %v", options.Args.OnuSn, err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("[Status: %d] %s", res.StatusCode, res.Message))
+
+	return nil
+}
+
+func (options *ONUImages) Execute(args []string) error {
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ONURequest{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+	}
+	res, err := client.GetSoftwareImages(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot get software images for ONU %s: %v", options.Args.OnuSn, err)
+		return err
+	}
+
+	tableFormat := format.Format(DEFAULT_IMAGE_HEADER_FORMAT)
+	if err := tableFormat.Execute(os.Stdout, true, res.Items); err != nil {
+		log.Fatalf("Error while formatting software images table: %s", err)
+	}
+
+	fmt.Println()
+	if d := res.Download; d != nil {
+		fmt.Println(fmt.Sprintf("Download to image %d %s: %d/%d bytes, window of %d sections",
+			d.Instance, d.State, d.ReceivedBytes, d.ImageSize, d.WindowSize))
+	} else {
+		fmt.Println("No software download")
+	}
+	fmt.Println(fmt.Sprintf("Injected failure: %s", res.Failure))
+
+	return nil
+}
+
+func (options *ONUImageFailure) Execute(args []string) error {
+	failure, ok := pb.ImageDownloadFailure_Failure_value[strings.ToUpper(options.Args.Failure)]
+	if !ok {
+		log.Fatalf("Unknown image download failure %s, it has to be one of none, bad_crc or timeout", options.Args.Failure)
+	}
+
+	client, conn := connect()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GlobalConfig.Grpc.Timeout)
+	defer cancel()
+	req := pb.ImageDownloadFailure{
+		SerialNumber: string(options.Args.OnuSn),
+		OltID:        config.GlobalOptions.Olt,
+		Failure:      pb.ImageDownloadFailure_Failure(failure),
+	}
+	res, err := client.SetImageDownloadFailure(ctx, &req)
+
+	if err != nil {
+		log.Fatalf("Cannot set the image download failure of ONU %s: %v", options.Args.OnuSn, err)
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("[Status: %d] %s", res.StatusCode, res.Message))
+
+	return nil
+}
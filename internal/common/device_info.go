@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gopkg.in/yaml.v2"
+)
+
+// IdRange is an inclusive range of IDs, eg: the AllocIds VOLTHA can use
+type IdRange struct {
+	Start uint32 `yaml:"start"`
+	End   uint32 `yaml:"end"`
+}
+
+func (r IdRange) Contains(id uint32) bool {
+	return id >= r.Start && id <= r.End
+}
+
+func (r IdRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseIdRange parses a range in the "start-end" format
+func ParseIdRange(s string) (IdRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return IdRange{}, fmt.Errorf("invalid-range-%s-expected-start-end", s)
+	}
+	start, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return IdRange{}, fmt.Errorf("invalid-range-start-%s", parts[0])
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return IdRange{}, fmt.Errorf("invalid-range-end-%s", parts[1])
+	}
+	return IdRange{Start: uint32(start), End: uint32(end)}, nil
+}
+
+// PoolOptions describes a pool of IDs, Type and Sharing use the names
+// defined in openolt.proto, eg: ALLOC_ID and DEDICATED_PER_INTF
+type PoolOptions struct {
+	Type    string `yaml:"type"`
+	Sharing string `yaml:"sharing"`
+	Start   uint32 `yaml:"start"`
+	End     uint32 `yaml:"end"`
+}
+
+// ResourceRangesOptions are the pools used by a set of PON ports,
+// an empty IntfIds list means all the PON ports
+type ResourceRangesOptions struct {
+	IntfIds    []uint32      `yaml:"intfIds"`
+	Technology string        `yaml:"technology"`
+	Pools      []PoolOptions `yaml:"pools"`
+}
+
+// DeviceInfoOptions is what the OLT reports to VOLTHA in GetDeviceInfo
+type DeviceInfoOptions struct {
+	Vendor          string                  `yaml:"vendor"`
+	Model           string                  `yaml:"model"`
+	HardwareVersion string                  `yaml:"hardwareVersion"`
+	FirmwareVersion string                  `yaml:"firmwareVersion"`
+	Technology      string                  `yaml:"technology"`
+	OnuIdRange      IdRange                 `yaml:"onuIdRange"`
+	AllocIdRange    IdRange                 `yaml:"allocIdRange"`
+	GemportIdRange  IdRange                 `yaml:"gemportIdRange"`
+	FlowIdRange     IdRange                 `yaml:"flowIdRange"`
+	Ranges          []ResourceRangesOptions `yaml:"ranges"`
+}
+
+// BBSimConfigFile is the format of the file passed with the -config flag
+type BBSimConfigFile struct {
+	DeviceInfo DeviceInfoOptions `yaml:"deviceInfo"`
+}
+
+func DefaultDeviceInfo() DeviceInfoOptions {
+	return DeviceInfoOptions{
+		Vendor:          "BBSim",
+		Model:           "asfvolt16",
+		HardwareVersion: "emulated",
+		FirmwareVersion: "",
+		Technology:      "xgspon",
+		OnuIdRange:      IdRange{Start: 1, End: 255},
+		AllocIdRange:    IdRange{Start: 1024, End: 16383},
+		GemportIdRange:  IdRange{Start: 1024, End: 65535},
+		FlowIdRange:     IdRange{Start: 1, End: 16383},
+	}
+}
+
+// LoadConfigFile reads a YAML config file,
+// the values that are not in the file keep their default
+func LoadConfigFile(path string) (*BBSimConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &BBSimConfigFile{
+		DeviceInfo: DefaultDeviceInfo(),
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("cannot-parse-config-file-%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// GetRange returns the range of a given pool type for a PON port,
+// a pool defined in Ranges takes precedence over the device wide range
+func (d DeviceInfoOptions) GetRange(poolType openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType, intfId uint32) IdRange {
+	for _, r := range d.Ranges {
+		if !r.includes(intfId) {
+			continue
+		}
+		for _, pool := range r.Pools {
+			if pool.Type == poolType.String() {
+				return IdRange{Start: pool.Start, End: pool.End}
+			}
+		}
+	}
+
+	switch poolType {
+	case openolt.DeviceInfo_DeviceResourceRanges_Pool_ONU_ID:
+		return d.OnuIdRange
+	case openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID:
+		return d.AllocIdRange
+	case openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID:
+		return d.GemportIdRange
+	default:
+		return d.FlowIdRange
+	}
+}
+
+// IsShared returns true if the pool used by a PON port for a given type is shared with other PON ports,
+// in that case the IDs have to be unique across all of them
+func (d DeviceInfoOptions) IsShared(poolType openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType, intfId uint32) bool {
+	for _, r := range d.Ranges {
+		if !r.includes(intfId) {
+			continue
+		}
+		for _, pool := range r.Pools {
+			if pool.Type == poolType.String() {
+				return pool.Sharing != openolt.DeviceInfo_DeviceResourceRanges_Pool_DEDICATED_PER_INTF.String()
+			}
+		}
+	}
+	return false
+}
+
+func (r ResourceRangesOptions) includes(intfId uint32) bool {
+	if len(r.IntfIds) == 0 {
+		return true
+	}
+	for _, id := range r.IntfIds {
+		if id == intfId {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the ranges make sense for an OLT with numPon PON ports
+func (d DeviceInfoOptions) Validate(numPon int) error {
+	ranges := map[string]IdRange{
+		"onu-id":     d.OnuIdRange,
+		"alloc-id":   d.AllocIdRange,
+		"gemport-id": d.GemportIdRange,
+		"flow-id":    d.FlowIdRange,
+	}
+	for name, r := range ranges {
+		if r.Start > r.End {
+			return fmt.Errorf("invalid-%s-range-%s", name, r)
+		}
+	}
+
+	seen := map[uint32]bool{}
+	for _, r := range d.Ranges {
+		for _, id := range r.IntfIds {
+			if id >= uint32(numPon) {
+				return fmt.Errorf("ranges-reference-non-existing-pon-%d", id)
+			}
+			if seen[id] {
+				return fmt.Errorf("pon-%d-is-in-multiple-ranges", id)
+			}
+			seen[id] = true
+		}
+
+		for _, pool := range r.Pools {
+			if _, ok := openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType_value[pool.Type]; !ok {
+				return fmt.Errorf("invalid-pool-type-%s", pool.Type)
+			}
+			if _, ok := openolt.DeviceInfo_DeviceResourceRanges_Pool_SharingType_value[pool.Sharing]; !ok {
+				return fmt.Errorf("invalid-pool-sharing-%s", pool.Sharing)
+			}
+			if pool.Start > pool.End {
+				return fmt.Errorf("invalid-%s-pool-range-%d-%d", pool.Type, pool.Start, pool.End)
+			}
+		}
+	}
+	return nil
+}
+
+// RangesToProto converts the Ranges in the format expected by VOLTHA
+func (d DeviceInfoOptions) RangesToProto() []*openolt.DeviceInfo_DeviceResourceRanges {
+	res := []*openolt.DeviceInfo_DeviceResourceRanges{}
+	for _, r := range d.Ranges {
+		technology := r.Technology
+		if technology == "" {
+			technology = d.Technology
+		}
+		pr := &openolt.DeviceInfo_DeviceResourceRanges{
+			IntfIds:    r.IntfIds,
+			Technology: technology,
+		}
+		for _, pool := range r.Pools {
+			pr.Pools = append(pr.Pools, &openolt.DeviceInfo_DeviceResourceRanges_Pool{
+				Type:    openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType(openolt.DeviceInfo_DeviceResourceRanges_Pool_PoolType_value[pool.Type]),
+				Sharing: openolt.DeviceInfo_DeviceResourceRanges_Pool_SharingType(openolt.DeviceInfo_DeviceResourceRanges_Pool_SharingType_value[pool.Sharing]),
+				Start:   pool.Start,
+				End:     pool.End,
+			})
+		}
+		res = append(res, pr)
+	}
+	return res
+}
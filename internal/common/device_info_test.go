@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testConfig = `
+deviceInfo:
+  vendor: Foo
+  model: bar
+  allocIdRange:
+    start: 1024
+    end: 2047
+  ranges:
+    - intfIds: [0, 1]
+      pools:
+        - type: ALLOC_ID
+          sharing: SHARED_BY_ALL_INTF_ALL_TECH
+          start: 2048
+          end: 2559
+    - intfIds: [2]
+      technology: gpon
+      pools:
+        - type: GEMPORT_ID
+          sharing: DEDICATED_PER_INTF
+          start: 4096
+          end: 4607
+`
+
+func Test_ParseIdRange(t *testing.T) {
+	r, err := common.ParseIdRange("1024-16383")
+	assert.NilError(t, err)
+	assert.Equal(t, r, common.IdRange{Start: 1024, End: 16383})
+	assert.Equal(t, r.String(), "1024-16383")
+
+	_, err = common.ParseIdRange("1024")
+	assert.Error(t, err, "invalid-range-1024-expected-start-end")
+
+	_, err = common.ParseIdRange("foo-16383")
+	assert.Error(t, err, "invalid-range-start-foo")
+}
+
+func Test_LoadConfigFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbsim-config")
+	assert.NilError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(testConfig)
+	assert.NilError(t, err)
+	f.Close()
+
+	config, err := common.LoadConfigFile(f.Name())
+	assert.NilError(t, err)
+
+	info := config.DeviceInfo
+	assert.Equal(t, info.Vendor, "Foo")
+	assert.Equal(t, info.Model, "bar")
+	// values that are not in the file keep their default
+	assert.Equal(t, info.Technology, "xgspon")
+	assert.Equal(t, info.GemportIdRange, common.DefaultDeviceInfo().GemportIdRange)
+	assert.NilError(t, info.Validate(4))
+
+	allocId := openolt.DeviceInfo_DeviceResourceRanges_Pool_ALLOC_ID
+	gemportId := openolt.DeviceInfo_DeviceResourceRanges_Pool_GEMPORT_ID
+	assert.Equal(t, info.GetRange(allocId, 1), common.IdRange{Start: 2048, End: 2559})
+	assert.Equal(t, info.GetRange(allocId, 2), common.IdRange{Start: 1024, End: 2047})
+	assert.Equal(t, info.GetRange(gemportId, 2), common.IdRange{Start: 4096, End: 4607})
+	assert.Equal(t, info.IsShared(allocId, 0), true)
+	assert.Equal(t, info.IsShared(gemportId, 2), false)
+	assert.Equal(t, info.IsShared(allocId, 3), false)
+
+	ranges := info.RangesToProto()
+	assert.Equal(t, len(ranges), 2)
+	assert.Equal(t, ranges[0].Technology, "xgspon")
+	assert.Equal(t, ranges[1].Technology, "gpon")
+	assert.Equal(t, ranges[0].Pools[0].Sharing, openolt.DeviceInfo_DeviceResourceRanges_Pool_SHARED_BY_ALL_INTF_ALL_TECH)
+}
+
+func Test_DeviceInfo_Validate(t *testing.T) {
+	info := common.DefaultDeviceInfo()
+	assert.NilError(t, info.Validate(1))
+
+	info.OnuIdRange = common.IdRange{Start: 10, End: 1}
+	assert.Error(t, info.Validate(1), "invalid-onu-id-range-10-1")
+
+	info = common.DefaultDeviceInfo()
+	info.Ranges = []common.ResourceRangesOptions{{IntfIds: []uint32{2}}}
+	assert.Error(t, info.Validate(2), "ranges-reference-non-existing-pon-2")
+
+	info.Ranges = []common.ResourceRangesOptions{{IntfIds: []uint32{0}}, {IntfIds: []uint32{0}}}
+	assert.Error(t, info.Validate(2), "pon-0-is-in-multiple-ranges")
+
+	info.Ranges = []common.ResourceRangesOptions{{Pools: []common.PoolOptions{{Type: "FOO", Sharing: "DEDICATED_PER_INTF"}}}}
+	assert.Error(t, info.Validate(2), "invalid-pool-type-FOO")
+}
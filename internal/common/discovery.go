@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	DiscoveryOrdered  = "ordered"
+	DiscoveryShuffled = "shuffled"
+)
+
+// DiscoveryOptions control how the ONUs on a PON are discovered once the OLT is enabled,
+// the zero value discovers all of them at once, in order
+type DiscoveryOptions struct {
+	// Delay is the time between the discovery of two ONUs on the same PON
+	Delay time.Duration
+	// Jitter is the maximum random time added to Delay
+	Jitter time.Duration
+	// Rate is the maximum number of ONUs discovered per second on a PON, 0 means no limit
+	Rate float64
+	// Order is either DiscoveryOrdered (by ONU ID) or DiscoveryShuffled
+	Order string
+}
+
+func (d DiscoveryOptions) Validate() error {
+	if d.Delay < 0 {
+		return fmt.Errorf("discovery-delay-%s-is-negative", d.Delay)
+	}
+	if d.Jitter < 0 {
+		return fmt.Errorf("discovery-jitter-%s-is-negative", d.Jitter)
+	}
+	if d.Rate < 0 {
+		return fmt.Errorf("discovery-rate-%g-is-negative", d.Rate)
+	}
+	if d.Order != "" && d.Order != DiscoveryOrdered && d.Order != DiscoveryShuffled {
+		return fmt.Errorf("unknown-discovery-order-%s", d.Order)
+	}
+	return nil
+}
+
+// Paced returns true if the ONUs are not all discovered at once
+func (d DiscoveryOptions) Paced() bool {
+	return d.Delay > 0 || d.Jitter > 0 || d.Rate > 0
+}
+
+// Interval returns the time to wait before discovering the next ONU on a PON,
+// rnd is not safe for concurrent use so each PON has its own
+func (d DiscoveryOptions) Interval(rnd *rand.Rand) time.Duration {
+	interval := d.Delay + d.InitialDelay(rnd)
+	if d.Rate > 0 {
+		// NOTE the rate is a cap, it does not shorten a longer delay
+		if min := time.Duration(float64(time.Second) / d.Rate); interval < min {
+			interval = min
+		}
+	}
+	return interval
+}
+
+// InitialDelay returns the time to wait before discovering the first ONU on a PON,
+// it is a random time up to Jitter so that the PONs don't all start at the same time
+func (d DiscoveryOptions) InitialDelay(rnd *rand.Rand) time.Duration {
+	if d.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(d.Jitter) + 1))
+}
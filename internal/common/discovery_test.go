@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/opencord/bbsim/internal/common"
+	"gotest.tools/assert"
+)
+
+func Test_DiscoveryOptions_Validate(t *testing.T) {
+	assert.NilError(t, common.DiscoveryOptions{}.Validate())
+	assert.NilError(t, common.DiscoveryOptions{Delay: time.Second, Rate: 10, Order: common.DiscoveryShuffled}.Validate())
+
+	assert.Error(t, common.DiscoveryOptions{Delay: -time.Second}.Validate(), "discovery-delay--1s-is-negative")
+	assert.Error(t, common.DiscoveryOptions{Rate: -1}.Validate(), "discovery-rate--1-is-negative")
+	assert.Error(t, common.DiscoveryOptions{Order: "random"}.Validate(), "unknown-discovery-order-random")
+}
+
+func Test_DiscoveryOptions_Interval(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	assert.Equal(t, common.DiscoveryOptions{}.Paced(), false)
+	assert.Equal(t, common.DiscoveryOptions{}.Interval(rnd), time.Duration(0))
+
+	d := common.DiscoveryOptions{Delay: 100 * time.Millisecond}
+	assert.Equal(t, d.Paced(), true)
+	assert.Equal(t, d.InitialDelay(rnd), time.Duration(0))
+	assert.Equal(t, d.Interval(rnd), 100*time.Millisecond)
+
+	// the rate limits the delay, but it does not shorten it
+	assert.Equal(t, common.DiscoveryOptions{Delay: 100 * time.Millisecond, Rate: 5}.Interval(rnd), 200*time.Millisecond)
+	assert.Equal(t, common.DiscoveryOptions{Delay: 100 * time.Millisecond, Rate: 20}.Interval(rnd), 100*time.Millisecond)
+
+	d = common.DiscoveryOptions{Delay: 100 * time.Millisecond, Jitter: 50 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		initial := d.InitialDelay(rnd)
+		assert.Assert(t, initial >= 0 && initial <= 50*time.Millisecond)
+		interval := d.Interval(rnd)
+		assert.Assert(t, interval >= 100*time.Millisecond && interval <= 150*time.Millisecond)
+	}
+}
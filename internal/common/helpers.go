@@ -17,7 +17,10 @@
 package common
 
 import (
+	"encoding/hex"
+	"fmt"
 	"github.com/opencord/voltha-protos/go/openolt"
+	"net"
 	"strconv"
 )
 
@@ -28,3 +31,52 @@ func OnuSnToString(sn *openolt.SerialNumber) string {
 	}
 	return s
 }
+
+// OnuSnFromString parses a serial number in the format returned by OnuSnToString, eg: "BBSM00000101"
+func OnuSnFromString(s string) (*openolt.SerialNumber, error) {
+	if len(s) != 12 {
+		return nil, fmt.Errorf("invalid-serial-number-%s", s)
+	}
+	vendorSpecific, err := hex.DecodeString(s[4:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid-serial-number-%s", s)
+	}
+	return &openolt.SerialNumber{
+		VendorId:       []byte(s[:4]),
+		VendorSpecific: vendorSpecific,
+	}, nil
+}
+
+// ListenerAddress returns the address a listener is bound to, keeping the host that was requested,
+// eg: "0.0.0.0:0" becomes "0.0.0.0:41235" once the OS has chosen the port
+func ListenerAddress(requested string, lis net.Listener) string {
+	host, _, err := net.SplitHostPort(requested)
+	if err != nil {
+		return lis.Addr().String()
+	}
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	if err != nil {
+		return lis.Addr().String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// AddressWithPortOffset adds offset to the port of an address, it is used to give each OLT its own port.
+// Addresses with port 0 are returned as they are, the OS chooses a port for each of them anyway
+func AddressWithPortOffset(address string, offset int) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	if p == 0 {
+		return address, nil
+	}
+	if p+offset > 65535 {
+		return "", fmt.Errorf("port-%d-plus-%d-is-out-of-range", p, offset)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+offset)), nil
+}
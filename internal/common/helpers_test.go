@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"github.com/opencord/bbsim/internal/common"
+	"gotest.tools/assert"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_ListenerAddress(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer lis.Close()
+
+	address := common.ListenerAddress("127.0.0.1:0", lis)
+
+	assert.Assert(t, strings.HasPrefix(address, "127.0.0.1:"))
+	assert.Assert(t, address != "127.0.0.1:0")
+	assert.Equal(t, address, lis.Addr().String())
+}
+
+func Test_AddressWithPortOffset(t *testing.T) {
+	address, err := common.AddressWithPortOffset("0.0.0.0:50060", 2)
+	assert.NilError(t, err)
+	assert.Equal(t, address, "0.0.0.0:50062")
+
+	// the OS chooses the port for each OLT
+	address, err = common.AddressWithPortOffset("127.0.0.1:0", 2)
+	assert.NilError(t, err)
+	assert.Equal(t, address, "127.0.0.1:0")
+
+	_, err = common.AddressWithPortOffset("0.0.0.0:65535", 1)
+	assert.Error(t, err, "port-65535-plus-1-is-out-of-range")
+
+	_, err = common.AddressWithPortOffset("50060", 1)
+	assert.Assert(t, err != nil)
+}
+
+func Test_OnuSnFromString(t *testing.T) {
+	sn, err := common.OnuSnFromString("ABCD0102fe0a")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sn.VendorId, []byte("ABCD"))
+	assert.DeepEqual(t, sn.VendorSpecific, []byte{0x01, 0x02, 0xfe, 0x0a})
+	assert.Equal(t, common.OnuSnToString(sn), "ABCD0102fe0a")
+
+	_, err = common.OnuSnFromString("ABCD0102fe")
+	assert.Error(t, err, "invalid-serial-number-ABCD0102fe")
+	_, err = common.OnuSnFromString("ABCD0102fexx")
+	assert.Error(t, err, "invalid-serial-number-ABCD0102fexx")
+}
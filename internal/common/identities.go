@@ -0,0 +1,250 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/opencord/voltha-protos/go/openolt"
+)
+
+const (
+	DefaultVendorId = "BBSM"
+	// the default patterns generate the same serial numbers and MAC addresses as previous versions of BBSim
+	DefaultSnPattern  = "00{olt:2}{pon:2}{onu:2}"
+	DefaultMacPattern = "2e:6{olt:1}:7{uni:1}:13:{pon:2}:{onu:2}"
+
+	snDigits  = 8
+	macDigits = 12
+)
+
+// DefaultOnuIdentities is used when the identities are not configured, eg: by BBR and in the tests
+var DefaultOnuIdentities = mustOnuIdentities(DefaultVendorId, DefaultSnPattern, DefaultMacPattern)
+
+// identityField is either a sequence of literal hex digits or a placeholder for an ID
+type identityField struct {
+	name   string // empty for the literal digits
+	digits string
+	width  int
+}
+
+// identityPattern describes how the OLT, PON, ONU and UNI IDs are mapped to the hex digits of an identity,
+// eg: "00{olt:2}{pon:2}{onu:2}". The ':', '-' and '.' separators are ignored
+type identityPattern struct {
+	pattern string
+	fields  []identityField
+}
+
+func parseIdentityPattern(kind string, pattern string, digits int, names []string) (identityPattern, error) {
+	p := identityPattern{pattern: pattern}
+	total := 0
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == ':' || c == '-' || c == '.':
+			continue
+		case c == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return p, fmt.Errorf("unterminated-placeholder-in-%s-pattern-%s", kind, pattern)
+			}
+			parts := strings.Split(pattern[i+1:i+end], ":")
+			if len(parts) != 2 {
+				return p, fmt.Errorf("invalid-placeholder-%s-in-%s-pattern-%s", pattern[i:i+end+1], kind, pattern)
+			}
+			width, err := strconv.Atoi(parts[1])
+			if err != nil || width < 1 {
+				return p, fmt.Errorf("invalid-placeholder-%s-in-%s-pattern-%s", pattern[i:i+end+1], kind, pattern)
+			}
+			p.fields = append(p.fields, identityField{name: parts[0], width: width})
+			total += width
+			i += end
+		case strings.IndexByte("0123456789abcdefABCDEF", c) >= 0:
+			p.fields = append(p.fields, identityField{digits: string(c), width: 1})
+			total++
+		default:
+			return p, fmt.Errorf("invalid-character-%c-in-%s-pattern-%s", c, kind, pattern)
+		}
+	}
+
+	if total != digits {
+		return p, fmt.Errorf("%s-pattern-%s-has-%d-digits-expected-%d", kind, pattern, total, digits)
+	}
+
+	// NOTE the identities are unique only if every ID is part of them, once
+	for _, name := range names {
+		found := 0
+		for _, f := range p.fields {
+			if f.name == name {
+				found++
+			}
+		}
+		if found != 1 {
+			return p, fmt.Errorf("%s-pattern-%s-must-contain-the-%s-placeholder-once", kind, pattern, name)
+		}
+	}
+	for _, f := range p.fields {
+		if f.name != "" && !containsString(names, f.name) {
+			return p, fmt.Errorf("unknown-placeholder-%s-in-%s-pattern-%s", f.name, kind, pattern)
+		}
+	}
+	return p, nil
+}
+
+// maxValue returns the highest ID that fits in the placeholder
+func (p identityPattern) maxValue(name string) uint64 {
+	for _, f := range p.fields {
+		if f.name == name {
+			// NOTE the patterns are at most 12 digits long, so this doesn't overflow
+			return 1<<(4*uint(f.width)) - 1
+		}
+	}
+	return 0
+}
+
+func (p identityPattern) format(kind string, values map[string]uint64) ([]byte, error) {
+	s := ""
+	for _, f := range p.fields {
+		if f.name == "" {
+			s += f.digits
+			continue
+		}
+		v := values[f.name]
+		if v > p.maxValue(f.name) {
+			return nil, fmt.Errorf("%s-id-%d-does-not-fit-in-%s-pattern-%s", f.name, v, kind, p.pattern)
+		}
+		s += fmt.Sprintf("%0*x", f.width, v)
+	}
+	return hex.DecodeString(s)
+}
+
+// OnuIdentities generates the serial numbers and the MAC addresses of the ONUs from the OLT, PON, ONU and UNI IDs,
+// they are unique (across BBSim instances too, as long as the OLT IDs are) if the IDs fit in the patterns.
+// NOTE the ONU ID is the one the ONU is created with, not the one VOLTHA assigns
+type OnuIdentities struct {
+	VendorId string
+	sn       identityPattern
+	mac      identityPattern
+}
+
+func NewOnuIdentities(vendorId string, snPattern string, macPattern string) (*OnuIdentities, error) {
+	if len(vendorId) != 4 {
+		return nil, fmt.Errorf("vendor-id-%s-must-be-4-characters-long", vendorId)
+	}
+
+	sn, err := parseIdentityPattern("sn", snPattern, snDigits, []string{"olt", "pon", "onu"})
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := parseIdentityPattern("mac", macPattern, macDigits, []string{"olt", "pon", "onu", "uni"})
+	if err != nil {
+		return nil, err
+	}
+	first := mac.fields[0:2]
+	if first[0].name != "" || first[1].name != "" {
+		return nil, fmt.Errorf("mac-pattern-%s-must-start-with-a-fixed-octet", macPattern)
+	}
+	if octet, _ := strconv.ParseUint(first[0].digits+first[1].digits, 16, 8); octet&1 == 1 {
+		return nil, fmt.Errorf("mac-pattern-%s-generates-multicast-addresses", macPattern)
+	}
+
+	return &OnuIdentities{VendorId: vendorId, sn: sn, mac: mac}, nil
+}
+
+func mustOnuIdentities(vendorId string, snPattern string, macPattern string) *OnuIdentities {
+	ids, err := NewOnuIdentities(vendorId, snPattern, macPattern)
+	if err != nil {
+		panic(err)
+	}
+	return ids
+}
+
+// Validate checks that the OLTs up to maxOltId, with numPon PON ports, numOnu ONUs per PON and numUni UNIs per ONU
+// get unique identities, as two IDs that don't fit in a placeholder would generate the same identity
+func (i *OnuIdentities) Validate(maxOltId int, numPon int, numOnu int, numUni int) error {
+	// NOTE the ONU IDs start from 1
+	max := map[string]uint64{
+		"olt": uint64(maxOltId),
+		"pon": uint64(numPon - 1),
+		"onu": uint64(numOnu),
+		"uni": uint64(numUni - 1),
+	}
+	patterns := []struct {
+		kind    string
+		pattern identityPattern
+	}{
+		{"sn", i.sn},
+		{"mac", i.mac},
+	}
+
+	for _, p := range patterns {
+		for _, name := range []string{"olt", "pon", "onu", "uni"} {
+			if p.kind == "sn" && name == "uni" {
+				continue
+			}
+			if max[name] > p.pattern.maxValue(name) {
+				return fmt.Errorf("%s-id-%d-does-not-fit-in-%s-pattern-%s", name, max[name], p.kind, p.pattern.pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// SerialNumber returns the serial number of an ONU
+func (i *OnuIdentities) SerialNumber(oltId int, ponId uint32, onuId uint32) (*openolt.SerialNumber, error) {
+	vendorSpecific, err := i.sn.format("sn", map[string]uint64{
+		"olt": uint64(oltId),
+		"pon": uint64(ponId),
+		"onu": uint64(onuId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &openolt.SerialNumber{
+		VendorId:       []byte(i.VendorId),
+		VendorSpecific: vendorSpecific,
+	}, nil
+}
+
+// MacAddress returns the MAC address of an UNI, the one of the first UNI is the MAC address of the ONU
+func (i *OnuIdentities) MacAddress(oltId int, ponId uint32, onuId uint32, uniId uint32) (net.HardwareAddr, error) {
+	mac, err := i.mac.format("mac", map[string]uint64{
+		"olt": uint64(oltId),
+		"pon": uint64(ponId),
+		"onu": uint64(onuId),
+		"uni": uint64(uniId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return net.HardwareAddr(mac), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/opencord/bbsim/internal/common"
+	"gotest.tools/assert"
+)
+
+func Test_OnuIdentities_Default(t *testing.T) {
+	ids := common.DefaultOnuIdentities
+
+	sn, err := ids.SerialNumber(1, 3, 12)
+	assert.NilError(t, err)
+	assert.Equal(t, common.OnuSnToString(sn), "BBSM0001030c")
+
+	mac, err := ids.MacAddress(1, 3, 12, 2)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mac, net.HardwareAddr{0x2e, 0x61, 0x72, 0x13, 0x03, 0x0c})
+
+	// the first OLT gets the same identities as previous versions of BBSim
+	mac, err = ids.MacAddress(0, 3, 12, 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mac, net.HardwareAddr{0x2e, 0x60, 0x70, 0x13, 0x03, 0x0c})
+
+	_, err = ids.SerialNumber(0, 0, 256)
+	assert.Error(t, err, "onu-id-256-does-not-fit-in-sn-pattern-00{olt:2}{pon:2}{onu:2}")
+}
+
+func Test_OnuIdentities_Custom(t *testing.T) {
+	ids, err := common.NewOnuIdentities("ABCD", "{olt:2}{pon:2}{onu:4}", "0a-{olt:3}-{pon:2}-{onu:4}{uni:1}")
+	assert.NilError(t, err)
+
+	sn, err := ids.SerialNumber(300%256, 15, 1000)
+	assert.NilError(t, err)
+	assert.Equal(t, common.OnuSnToString(sn), "ABCD2c0f03e8")
+
+	mac, err := ids.MacAddress(300, 15, 1000, 3)
+	assert.NilError(t, err)
+	assert.Equal(t, mac.String(), "0a:12:c0:f0:3e:83")
+}
+
+func Test_OnuIdentities_Validate(t *testing.T) {
+	ids := common.DefaultOnuIdentities
+
+	assert.NilError(t, ids.Validate(15, 16, 255, 16))
+	assert.Error(t, ids.Validate(16, 1, 1, 1), "olt-id-16-does-not-fit-in-mac-pattern-2e:6{olt:1}:7{uni:1}:13:{pon:2}:{onu:2}")
+	assert.Error(t, ids.Validate(0, 1, 256, 1), "onu-id-256-does-not-fit-in-sn-pattern-00{olt:2}{pon:2}{onu:2}")
+	assert.Error(t, ids.Validate(0, 257, 1, 1), "pon-id-256-does-not-fit-in-sn-pattern-00{olt:2}{pon:2}{onu:2}")
+	assert.Error(t, ids.Validate(0, 1, 1, 17), "uni-id-16-does-not-fit-in-mac-pattern-2e:6{olt:1}:7{uni:1}:13:{pon:2}:{onu:2}")
+
+	ids, err := common.NewOnuIdentities("BBSM", "{olt:2}{pon:2}{onu:4}", "2e:60:{olt:2}:{pon:2}:{onu:3}{uni:1}")
+	assert.NilError(t, err)
+	assert.NilError(t, ids.Validate(255, 16, 256, 16))
+}
+
+func Test_OnuIdentities_Invalid(t *testing.T) {
+	tests := []struct {
+		vendorId   string
+		snPattern  string
+		macPattern string
+		err        string
+	}{
+		{"BBSIM", common.DefaultSnPattern, common.DefaultMacPattern, "vendor-id-BBSIM-must-be-4-characters-long"},
+		{"BBSM", "{olt:2}{pon:2}{onu:2}", common.DefaultMacPattern, "sn-pattern-{olt:2}{pon:2}{onu:2}-has-6-digits-expected-8"},
+		{"BBSM", "0000{pon:2}{onu:2}", common.DefaultMacPattern, "sn-pattern-0000{pon:2}{onu:2}-must-contain-the-olt-placeholder-once"},
+		{"BBSM", "0{olt:2}{pon:2}{onu:2}{uni:1}", common.DefaultMacPattern, "unknown-placeholder-uni-in-sn-pattern-0{olt:2}{pon:2}{onu:2}{uni:1}"},
+		{"BBSM", "00{olt:2}{pon:2}{onu}", common.DefaultMacPattern, "invalid-placeholder-{onu}-in-sn-pattern-00{olt:2}{pon:2}{onu}"},
+		{"BBSM", "00{olt:2}{pon:2}xx", common.DefaultMacPattern, "invalid-character-x-in-sn-pattern-00{olt:2}{pon:2}xx"},
+		{"BBSM", common.DefaultSnPattern, "2e:60:{olt:2}:{pon:2}:{onu:4}", "mac-pattern-2e:60:{olt:2}:{pon:2}:{onu:4}-must-contain-the-uni-placeholder-once"},
+		{"BBSM", common.DefaultSnPattern, "{olt:2}:60:7{uni:1}:13:{pon:2}:{onu:2}", "mac-pattern-{olt:2}:60:7{uni:1}:13:{pon:2}:{onu:2}-must-start-with-a-fixed-octet"},
+		{"BBSM", common.DefaultSnPattern, "01:6{olt:1}:7{uni:1}:13:{pon:2}:{onu:2}", "mac-pattern-01:6{olt:1}:7{uni:1}:13:{pon:2}:{onu:2}-generates-multicast-addresses"},
+	}
+
+	for _, test := range tests {
+		_, err := common.NewOnuIdentities(test.vendorId, test.snPattern, test.macPattern)
+		assert.Error(t, err, test.err)
+	}
+}
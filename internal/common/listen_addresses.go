@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ListenAddresses collects the addresses the servers listen on and, once all of them are listening,
+// writes them to a YAML file, so that the ports the OS chose can be found without parsing the logs
+type ListenAddresses struct {
+	lock      sync.Mutex
+	file      string
+	expected  int
+	addresses map[string]string
+}
+
+// NewListenAddresses creates the collector of the addresses of a number of servers,
+// if file is empty the addresses are not written anywhere
+func NewListenAddresses(file string, expected int) *ListenAddresses {
+	return &ListenAddresses{
+		file:      file,
+		expected:  expected,
+		addresses: make(map[string]string),
+	}
+}
+
+// Add records the address a server listens on, the file is written when the last server is added
+// and every time a server comes back on a different address (eg: after an OLT reboot)
+func (l *ListenAddresses) Add(server string, address string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.addresses[server] == address {
+		return
+	}
+	l.addresses[server] = address
+	if l.file == "" || len(l.addresses) < l.expected {
+		return
+	}
+	if err := l.write(); err != nil {
+		log.WithFields(log.Fields{
+			"File":  l.file,
+			"Error": err,
+		}).Error("Can't write the listen addresses")
+	}
+}
+
+// write replaces the file in one go, so that it's never read half written
+func (l *ListenAddresses) write() error {
+	data, err := yaml.Marshal(l.addresses)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.file), filepath.Base(l.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.file)
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"github.com/opencord/bbsim/internal/common"
+	"gopkg.in/yaml.v2"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ListenAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbsim-addresses")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "addresses.yaml")
+
+	addresses := common.NewListenAddresses(file, 2)
+	addresses.Add("olt0", "127.0.0.1:41089")
+
+	// the file is written only when all the servers are listening
+	_, err = os.Stat(file)
+	assert.Assert(t, os.IsNotExist(err))
+
+	addresses.Add("api", "127.0.0.1:37259")
+	data, err := ioutil.ReadFile(file)
+	assert.NilError(t, err)
+	written := map[string]string{}
+	assert.NilError(t, yaml.Unmarshal(data, &written))
+	assert.DeepEqual(t, written, map[string]string{
+		"olt0": "127.0.0.1:41089",
+		"api":  "127.0.0.1:37259",
+	})
+
+	// a server that comes back on another address replaces the file, leaving nothing behind
+	addresses.Add("olt0", "127.0.0.1:41090")
+	data, err = ioutil.ReadFile(file)
+	assert.NilError(t, err)
+	assert.NilError(t, yaml.Unmarshal(data, &written))
+	assert.Equal(t, written["olt0"], "127.0.0.1:41090")
+	files, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 1)
+}
+
+func Test_ListenAddresses_NoFile(t *testing.T) {
+	addresses := common.NewListenAddresses("", 1)
+	// nothing to write, the address is only recorded
+	addresses.Add("api", "127.0.0.1:37259")
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// the sizes of the MIB attributes the templates set
+	equipmentIdLength = 20
+	versionLength     = 14
+
+	maxSoftwareImages = 2
+	// NOTE these are the defaults of the MIB the ONUs report
+	defaultTconts         = 8
+	defaultPriorityQueues = 8
+	// the circuit pack of the ANI reports the number of upstream priority queues on a single byte
+	maxPriorityQueues = 255
+)
+
+// OnuRef identifies an ONU by the IDs it is created with
+type OnuRef struct {
+	Olt int    `yaml:"olt"`
+	Pon uint32 `yaml:"pon"`
+	Onu uint32 `yaml:"onu"`
+}
+
+// SerialNumberRange is an inclusive range of serial numbers, Start and End are the 8 hex digits
+// of the vendor specific part, so that the vendor ID of the template does not change the ONUs it matches
+type SerialNumberRange struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+// MibTemplate describes the MIB an ONU model reports via OMCI,
+// the zero values are replaced by the defaults (eg: the -uni and -uniType flags)
+type MibTemplate struct {
+	Name string `yaml:"name"`
+	// VendorId replaces the vendor ID of the serial numbers BBSim generates
+	VendorId    string `yaml:"vendorId"`
+	EquipmentId string `yaml:"equipmentId"`
+	Version     string `yaml:"version"`
+	// SoftwareImages are the versions of the active and standby images
+	SoftwareImages []string `yaml:"softwareImages"`
+	Unis           int      `yaml:"unis"`
+	UniType        string   `yaml:"uniType"`
+	Tconts         int      `yaml:"tconts"`
+	// PriorityQueues is the number of priority queues of each T-CONT and UNI
+	PriorityQueues int `yaml:"priorityQueues"`
+
+	// Onus and SerialNumbers are the ONUs the template is assigned to
+	Onus          []OnuRef            `yaml:"onus"`
+	SerialNumbers []SerialNumberRange `yaml:"serialNumbers"`
+}
+
+// MibTemplates is the format of the file passed with the -mibTemplates flag,
+// the ONUs that don't match any template report the default MIB
+type MibTemplates struct {
+	Templates []MibTemplate `yaml:"templates"`
+}
+
+// LoadMibTemplates reads a YAML (or JSON) file with the MIB templates
+func LoadMibTemplates(path string) (*MibTemplates, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := &MibTemplates{}
+	if err := yaml.UnmarshalStrict(data, templates); err != nil {
+		return nil, fmt.Errorf("cannot-parse-mib-templates-file-%s: %v", path, err)
+	}
+	if err := templates.Validate(); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// priorityQueues returns the number of priority queues per port of the template
+func (t MibTemplate) priorityQueues() int {
+	if t.PriorityQueues == 0 {
+		return defaultPriorityQueues
+	}
+	return t.PriorityQueues
+}
+
+func (t MibTemplate) validate() error {
+	if t.VendorId != "" && len(t.VendorId) != 4 {
+		return fmt.Errorf("vendor-id-%s-has-to-be-4-characters", t.VendorId)
+	}
+	if len(t.EquipmentId) > equipmentIdLength {
+		return fmt.Errorf("equipment-id-%s-is-longer-than-%d-characters", t.EquipmentId, equipmentIdLength)
+	}
+	if len(t.Version) > versionLength {
+		return fmt.Errorf("version-%s-is-longer-than-%d-characters", t.Version, versionLength)
+	}
+	if len(t.SoftwareImages) > maxSoftwareImages {
+		return fmt.Errorf("at-most-%d-software-images-are-supported", maxSoftwareImages)
+	}
+	for _, image := range t.SoftwareImages {
+		if len(image) > versionLength {
+			return fmt.Errorf("software-image-%s-is-longer-than-%d-characters", image, versionLength)
+		}
+	}
+	if t.Unis < 0 || t.Unis > MaxUniPerOnu {
+		return fmt.Errorf("invalid-number-of-unis-%d-the-maximum-is-%d", t.Unis, MaxUniPerOnu)
+	}
+	if t.UniType != "" && t.UniType != UniTypePptp && t.UniType != UniTypeVeip {
+		return fmt.Errorf("unknown-uni-type-%s", t.UniType)
+	}
+	if t.Tconts < 0 || t.PriorityQueues < 0 {
+		return fmt.Errorf("the-number-of-tconts-and-priority-queues-cannot-be-negative")
+	}
+	tconts, queues := t.Tconts, t.priorityQueues()
+	if tconts == 0 {
+		tconts = defaultTconts
+	}
+	if tconts*queues > maxPriorityQueues {
+		return fmt.Errorf("too-many-priority-queues-%d-tconts-with-%d-queues-each", tconts, queues)
+	}
+	// NOTE the UNI circuit pack reports the queues of all the UNIs, the templates without UNIs are checked by CheckUnis
+	if t.Unis*queues > maxPriorityQueues {
+		return fmt.Errorf("too-many-priority-queues-%d-unis-with-%d-queues-each", t.Unis, queues)
+	}
+	for _, r := range t.SerialNumbers {
+		start, end, err := r.parse()
+		if err != nil {
+			return err
+		}
+		if start > end {
+			return fmt.Errorf("invalid-serial-number-range-%s-%s", r.Start, r.End)
+		}
+	}
+	return nil
+}
+
+// Validate checks the templates, the errors include the name of the template
+func (m *MibTemplates) Validate() error {
+	names := map[string]bool{}
+	for i, t := range m.Templates {
+		if t.Name == "" {
+			return fmt.Errorf("mib-template-%d-has-no-name", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate-mib-template-%s", t.Name)
+		}
+		names[t.Name] = true
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("invalid-mib-template-%s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// CheckUnis checks that the templates that don't set the number of UNIs can have the default one
+func (m *MibTemplates) CheckUnis(defaultUnis int) error {
+	if m == nil {
+		return nil
+	}
+	for _, t := range m.Templates {
+		if t.Unis == 0 && defaultUnis*t.priorityQueues() > maxPriorityQueues {
+			return fmt.Errorf("invalid-mib-template-%s: too-many-priority-queues-%d-unis-with-%d-queues-each",
+				t.Name, defaultUnis, t.priorityQueues())
+		}
+	}
+	return nil
+}
+
+// MaxUnis returns the highest number of UNIs an ONU can have, given the default one
+func (m *MibTemplates) MaxUnis(defaultUnis int) int {
+	max := defaultUnis
+	if m == nil {
+		return max
+	}
+	for _, t := range m.Templates {
+		if t.Unis > max {
+			max = t.Unis
+		}
+	}
+	return max
+}
+
+// ForOnu returns the template assigned to an ONU, or nil if the ONU uses the default MIB.
+// The templates assigned to the ONU by ID take precedence over the serial number ranges,
+// if more than one template matches the first one in the file is used
+func (m *MibTemplates) ForOnu(oltId int, ponId uint32, onuId uint32, sn *openolt.SerialNumber) *MibTemplate {
+	if m == nil {
+		return nil
+	}
+	for i, t := range m.Templates {
+		for _, onu := range t.Onus {
+			if onu.Olt == oltId && onu.Pon == ponId && onu.Onu == onuId {
+				return &m.Templates[i]
+			}
+		}
+	}
+	if sn == nil || len(sn.VendorSpecific) != 4 {
+		return nil
+	}
+	specific := binary.BigEndian.Uint32(sn.VendorSpecific)
+	for i, t := range m.Templates {
+		for _, r := range t.SerialNumbers {
+			// NOTE the ranges are validated when the templates are loaded
+			if start, end, err := r.parse(); err == nil && specific >= start && specific <= end {
+				return &m.Templates[i]
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyVendorId replaces the vendor ID of a serial number with the one of the template, if it has one
+func (t *MibTemplate) ApplyVendorId(sn *openolt.SerialNumber) *openolt.SerialNumber {
+	if t == nil || t.VendorId == "" {
+		return sn
+	}
+	return &openolt.SerialNumber{
+		VendorId:       []byte(t.VendorId),
+		VendorSpecific: sn.VendorSpecific,
+	}
+}
+
+func (r SerialNumberRange) parse() (uint32, uint32, error) {
+	start, err := parseVendorSpecific(r.Start)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseVendorSpecific(r.End)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseVendorSpecific(s string) (uint32, error) {
+	if len(s) != snDigits {
+		return 0, fmt.Errorf("serial-number-%s-has-to-be-%d-hex-digits", s, snDigits)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("serial-number-%s-has-to-be-%d-hex-digits", s, snDigits)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencord/bbsim/internal/common"
+	"github.com/opencord/voltha-protos/go/openolt"
+	"gotest.tools/assert"
+)
+
+const testMibTemplates = `
+templates:
+  - name: alpha
+    vendorId: ALPH
+    equipmentId: ALPHA_SFU
+    softwareImages: [ALPHA_IMG_0001]
+    unis: 4
+    serialNumbers:
+      - start: "00000001"
+        end: "000000ff"
+  - name: beta
+    uniType: veip
+    onus:
+      - olt: 0
+        pon: 1
+        onu: 3
+`
+
+const testMibTemplatesJson = `{"templates": [{"name": "gamma", "unis": 2, "tconts": 4}]}`
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "bbsim-mib-templates")
+	assert.NilError(t, err)
+	_, err = f.WriteString(content)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+	return f.Name()
+}
+
+func Test_LoadMibTemplates(t *testing.T) {
+	path := writeTempFile(t, testMibTemplates)
+	defer os.Remove(path)
+
+	templates, err := common.LoadMibTemplates(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(templates.Templates), 2)
+	assert.Equal(t, templates.Templates[0].EquipmentId, "ALPHA_SFU")
+	assert.DeepEqual(t, templates.Templates[1].Onus, []common.OnuRef{{Olt: 0, Pon: 1, Onu: 3}})
+	assert.Equal(t, templates.MaxUnis(1), 4)
+
+	path = writeTempFile(t, testMibTemplatesJson)
+	defer os.Remove(path)
+
+	templates, err = common.LoadMibTemplates(path)
+	assert.NilError(t, err)
+	assert.Equal(t, templates.Templates[0].Name, "gamma")
+	assert.Equal(t, templates.Templates[0].Tconts, 4)
+	assert.Equal(t, templates.MaxUnis(8), 8)
+
+	path = writeTempFile(t, "templates:\n  - name: delta\n    uniCount: 2\n")
+	defer os.Remove(path)
+	_, err = common.LoadMibTemplates(path)
+	assert.Assert(t, err != nil)
+}
+
+func Test_MibTemplates_Validate(t *testing.T) {
+	cases := []struct {
+		template common.MibTemplate
+		err      string
+	}{
+		{common.MibTemplate{}, "mib-template-0-has-no-name"},
+		{common.MibTemplate{Name: "a", VendorId: "ABC"}, "invalid-mib-template-a: vendor-id-ABC-has-to-be-4-characters"},
+		{common.MibTemplate{Name: "a", Version: "A_VERY_LONG_VERSION"}, "invalid-mib-template-a: version-A_VERY_LONG_VERSION-is-longer-than-14-characters"},
+		{common.MibTemplate{Name: "a", SoftwareImages: []string{"1", "2", "3"}}, "invalid-mib-template-a: at-most-2-software-images-are-supported"},
+		{common.MibTemplate{Name: "a", Unis: 17}, "invalid-mib-template-a: invalid-number-of-unis-17-the-maximum-is-16"},
+		{common.MibTemplate{Name: "a", UniType: "pots"}, "invalid-mib-template-a: unknown-uni-type-pots"},
+		{common.MibTemplate{Name: "a", Tconts: 64}, "invalid-mib-template-a: too-many-priority-queues-64-tconts-with-8-queues-each"},
+		{common.MibTemplate{Name: "a", Unis: 16, PriorityQueues: 16}, "invalid-mib-template-a: too-many-priority-queues-16-unis-with-16-queues-each"},
+		{common.MibTemplate{Name: "a", SerialNumbers: []common.SerialNumberRange{{Start: "0000ff", End: "000100"}}},
+			"invalid-mib-template-a: serial-number-0000ff-has-to-be-8-hex-digits"},
+		{common.MibTemplate{Name: "a", SerialNumbers: []common.SerialNumberRange{{Start: "00000100", End: "000000ff"}}},
+			"invalid-mib-template-a: invalid-serial-number-range-00000100-000000ff"},
+	}
+	for _, c := range cases {
+		templates := common.MibTemplates{Templates: []common.MibTemplate{c.template}}
+		assert.Error(t, templates.Validate(), c.err)
+	}
+
+	templates := common.MibTemplates{Templates: []common.MibTemplate{{Name: "a"}, {Name: "a"}}}
+	assert.Error(t, templates.Validate(), "duplicate-mib-template-a")
+}
+
+func Test_MibTemplates_CheckUnis(t *testing.T) {
+	templates := &common.MibTemplates{Templates: []common.MibTemplate{
+		{Name: "a", Unis: 4, PriorityQueues: 16},
+		{Name: "b", PriorityQueues: 16},
+	}}
+	assert.NilError(t, templates.Validate())
+
+	// the template without UNIs gets the default number of UNIs
+	assert.NilError(t, templates.CheckUnis(8))
+	assert.Error(t, templates.CheckUnis(16), "invalid-mib-template-b: too-many-priority-queues-16-unis-with-16-queues-each")
+
+	assert.NilError(t, (*common.MibTemplates)(nil).CheckUnis(16))
+}
+
+func Test_MibTemplates_ForOnu(t *testing.T) {
+	path := writeTempFile(t, testMibTemplates)
+	defer os.Remove(path)
+	templates, err := common.LoadMibTemplates(path)
+	assert.NilError(t, err)
+
+	sn := func(specific ...byte) *openolt.SerialNumber {
+		return &openolt.SerialNumber{VendorId: []byte("BBSM"), VendorSpecific: specific}
+	}
+
+	assert.Equal(t, templates.ForOnu(0, 0, 1, sn(0x00, 0x00, 0x00, 0x01)).Name, "alpha")
+	assert.Equal(t, templates.ForOnu(0, 0, 1, sn(0x00, 0x00, 0x01, 0x00)), (*common.MibTemplate)(nil))
+
+	// the ONUs assigned by ID take precedence over the serial number ranges
+	assert.Equal(t, templates.ForOnu(0, 1, 3, sn(0x00, 0x00, 0x00, 0x01)).Name, "beta")
+	assert.Equal(t, templates.ForOnu(1, 1, 3, sn(0x00, 0x01, 0x01, 0x03)), (*common.MibTemplate)(nil))
+
+	// the vendor ID of the template replaces the one of the serial number
+	alpha := templates.ForOnu(0, 0, 1, sn(0x00, 0x00, 0x00, 0x01))
+	assert.Equal(t, common.OnuSnToString(alpha.ApplyVendorId(sn(0x00, 0x00, 0x00, 0x01))), "ALPH00000001")
+	beta := templates.ForOnu(0, 1, 3, nil)
+	assert.Equal(t, common.OnuSnToString(beta.ApplyVendorId(sn(0x00, 0x01, 0x01, 0x03))), "BBSM00010103")
+
+	// without templates all the ONUs report the default MIB
+	var none *common.MibTemplates
+	assert.Equal(t, none.ForOnu(0, 0, 1, sn(0x00, 0x00, 0x00, 0x01)), (*common.MibTemplate)(nil))
+	assert.Equal(t, none.MaxUnis(2), 2)
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/cboling/omci"
 	me "github.com/cboling/omci/generated"
 	"github.com/google/gopacket"
-	omcisim "github.com/opencord/omci-sim"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -80,31 +79,7 @@ func DecodeOmci(payload []byte) (omci.MessageType, gopacket.Packet) {
 		return omciObj.MessageType, packet
 	}
 
-	// FIXME
-	// if we can't properly decode the packet, try using shad helper method
-	// most likely this won't be necessary once we move omci-sim to use cboling/omci
-	// to generate packets
-	_, _, msgType, _, _, _, err := omcisim.ParsePkt(payload)
-	if err != nil {
-		return 0, nil
-	}
-	if msgType == omcisim.MibReset {
-		return omci.MibResetResponseType, nil
-	}
-	if msgType == omcisim.MibUpload {
-		return omci.MibUploadResponseType, nil
-	}
-	if msgType == omcisim.MibUploadNext {
-		return omci.MibUploadNextResponseType, nil
-	}
-	if msgType == omcisim.Create {
-		return omci.CreateResponseType, nil
-	}
-	if msgType == omcisim.Set {
-		return omci.SetResponseType, nil
-	}
-
-	omciLogger.Warnf("omci-sim returns msgType: %d", msgType)
+	omciLogger.WithField("omciPacket", payload).Warn("Cannot decode the OMCI message")
 
 	return 0, nil
 }
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	me "github.com/cboling/omci/generated"
+)
+
+const (
+	OmciDelayFixed       = "fixed"
+	OmciDelayUniform     = "uniform"
+	OmciDelayExponential = "exponential"
+)
+
+// OmciFaults describes the faults injected in the OMCI exchanges of the ONUs, to test how VOLTHA
+// retries and times out. The zero value answers every request immediately and successfully
+type OmciFaults struct {
+	// DropRate is the fraction of the requests the ONUs lose: they are neither applied nor answered
+	DropRate float64
+	// Delay is the time the responses are delayed by: the fixed delay, the minimum of the uniform
+	// distribution or the mean of the exponential one
+	Delay time.Duration
+	// MaxDelay is the maximum of the uniform distribution, it caps the exponential one if set
+	MaxDelay time.Duration
+	// Distribution is either OmciDelayFixed (the default), OmciDelayUniform or OmciDelayExponential
+	Distribution string
+	// ErrorRate is the fraction of the requests answered with Result, without being applied
+	ErrorRate float64
+	Result    me.Results
+	// DuplicateRate is the fraction of the responses that are sent twice
+	DuplicateRate float64
+	// ReorderRate is the fraction of the responses held back and sent after the next one,
+	// so that VOLTHA receives the TIDs out of order
+	ReorderRate float64
+	// Silent makes the ONUs stop answering OMCI altogether
+	Silent bool
+}
+
+func (f OmciFaults) Validate() error {
+	rates := []struct {
+		name string
+		rate float64
+	}{
+		{"drop", f.DropRate},
+		{"error", f.ErrorRate},
+		{"duplicate", f.DuplicateRate},
+		{"reorder", f.ReorderRate},
+	}
+	for _, r := range rates {
+		if r.rate < 0 || r.rate > 1 {
+			return fmt.Errorf("omci-%s-rate-%g-is-not-between-0-and-1", r.name, r.rate)
+		}
+	}
+	if f.Delay < 0 {
+		return fmt.Errorf("omci-delay-%s-is-negative", f.Delay)
+	}
+	if f.MaxDelay < 0 {
+		return fmt.Errorf("omci-max-delay-%s-is-negative", f.MaxDelay)
+	}
+	switch f.Distribution {
+	case "", OmciDelayFixed, OmciDelayExponential:
+	case OmciDelayUniform:
+		if f.MaxDelay < f.Delay {
+			return fmt.Errorf("omci-max-delay-%s-is-shorter-than-the-delay-%s", f.MaxDelay, f.Delay)
+		}
+	default:
+		return fmt.Errorf("unknown-omci-delay-distribution-%s", f.Distribution)
+	}
+	if f.ErrorRate > 0 && f.Result == me.Success {
+		return fmt.Errorf("omci-error-rate-%g-needs-an-error-result", f.ErrorRate)
+	}
+	return nil
+}
+
+// Enabled returns true if any fault is injected
+func (f OmciFaults) Enabled() bool {
+	return f != OmciFaults{}
+}
+
+// ResponseDelay returns the time to wait before sending a response,
+// rnd is not safe for concurrent use so each ONU has its own
+func (f OmciFaults) ResponseDelay(rnd *rand.Rand) time.Duration {
+	var delay time.Duration
+	switch f.Distribution {
+	case OmciDelayUniform:
+		delay = f.Delay + time.Duration(rnd.Int63n(int64(f.MaxDelay-f.Delay)+1))
+	case OmciDelayExponential:
+		delay = time.Duration(rnd.ExpFloat64() * float64(f.Delay))
+		if f.MaxDelay > 0 && delay > f.MaxDelay {
+			delay = f.MaxDelay
+		}
+	default:
+		delay = f.Delay
+	}
+	return delay
+}
+
+// Happens returns true with the probability given by rate, eg: f.Happens(rnd, f.DropRate),
+// rnd is not used if rate is 0 so it can be nil if no fault is enabled
+func (f OmciFaults) Happens(rnd *rand.Rand, rate float64) bool {
+	return rate > 0 && rnd.Float64() < rate
+}
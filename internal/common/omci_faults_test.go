@@ -0,0 +1,63 @@
+/*
+ * Copyright 2018-present Open Networking Foundation
+
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+
+ * http://www.apache.org/licenses/LICENSE-2.0
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	me "github.com/cboling/omci/generated"
+	"github.com/opencord/bbsim/internal/common"
+	"gotest.tools/assert"
+)
+
+func Test_OmciFaults_Validate(t *testing.T) {
+	assert.NilError(t, common.OmciFaults{}.Validate())
+	assert.NilError(t, common.OmciFaults{DropRate: 1, ErrorRate: 0.5, Result: me.ParameterError}.Validate())
+	assert.NilError(t, common.OmciFaults{Delay: time.Second, MaxDelay: 2 * time.Second, Distribution: common.OmciDelayUniform}.Validate())
+
+	assert.Error(t, common.OmciFaults{DropRate: 1.5}.Validate(), "omci-drop-rate-1.5-is-not-between-0-and-1")
+	assert.Error(t, common.OmciFaults{ReorderRate: -0.1}.Validate(), "omci-reorder-rate--0.1-is-not-between-0-and-1")
+	assert.Error(t, common.OmciFaults{Delay: -time.Second}.Validate(), "omci-delay--1s-is-negative")
+	assert.Error(t, common.OmciFaults{Delay: time.Second, Distribution: common.OmciDelayUniform}.Validate(),
+		"omci-max-delay-0s-is-shorter-than-the-delay-1s")
+	assert.Error(t, common.OmciFaults{Distribution: "normal"}.Validate(), "unknown-omci-delay-distribution-normal")
+	assert.Error(t, common.OmciFaults{ErrorRate: 0.1}.Validate(), "omci-error-rate-0.1-needs-an-error-result")
+}
+
+func Test_OmciFaults_ResponseDelay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	assert.Equal(t, common.OmciFaults{}.Enabled(), false)
+	assert.Equal(t, common.OmciFaults{}.ResponseDelay(rnd), time.Duration(0))
+	assert.Equal(t, common.OmciFaults{Delay: time.Second}.ResponseDelay(rnd), time.Second)
+
+	uniform := common.OmciFaults{Delay: 100 * time.Millisecond, MaxDelay: 200 * time.Millisecond, Distribution: common.OmciDelayUniform}
+	exponential := common.OmciFaults{Delay: 100 * time.Millisecond, MaxDelay: time.Second, Distribution: common.OmciDelayExponential}
+	assert.Equal(t, uniform.Enabled(), true)
+	for i := 0; i < 100; i++ {
+		delay := uniform.ResponseDelay(rnd)
+		assert.Assert(t, delay >= 100*time.Millisecond && delay <= 200*time.Millisecond)
+		delay = exponential.ResponseDelay(rnd)
+		assert.Assert(t, delay >= 0 && delay <= time.Second)
+	}
+
+	f := common.OmciFaults{DropRate: 1}
+	assert.Equal(t, f.Happens(rnd, f.DropRate), true)
+	assert.Equal(t, f.Happens(rnd, f.ErrorRate), false)
+}
@@ -16,13 +16,31 @@
 
 package common
 
-import "flag"
+import (
+	"flag"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	UniTypePptp = "pptp"
+	UniTypeVeip = "veip"
+
+	// MaxUniPerOnu is the number of UNIs VOLTHA can address on an ONU
+	MaxUniPerOnu = 16
+
+	DefaultOnuWorkers = 64
+)
 
 type BBSimCliOptions struct {
 	OltID        int
+	NumOlts      int
 	NumNniPerOlt int
 	NumPonPerOlt int
 	NumOnuPerPon int
+	NumUniPerOnu int
+	UniType      string
 	STag         int
 	CTagInit     int
 	Auth         bool
@@ -30,6 +48,27 @@ type BBSimCliOptions struct {
 	ProfileCpu   *string
 	LogLevel     string
 	LogCaller    bool
+	RebootDelay  int
+	StrictFlows  bool
+	OnuWorkers   int
+	DeviceInfo   DeviceInfoOptions
+	// OnuIdentities generates the ONU serial numbers and MAC addresses, if nil the default ones are used
+	OnuIdentities *OnuIdentities
+	Discovery     DiscoveryOptions
+	// MibTemplates describe the MIBs the ONUs report, if nil all the ONUs report the default one
+	MibTemplates *MibTemplates
+	// OnuRebootDelay is the time an ONU takes to come back after a reboot requested via OMCI
+	OnuRebootDelay time.Duration
+	// PmInterval is the length of the OMCI PM intervals, it is shortened to test the PM history data
+	PmInterval time.Duration
+	// listen addresses in the host:port format, if the port is 0 the OS chooses one
+	OltAddress           string
+	ApiAddress           string
+	RestApiAddress       string
+	LegacyApiAddress     string
+	LegacyRestApiAddress string
+	// AddressesFile is where the addresses the servers listen on are written, once all of them are listening
+	AddressesFile string
 }
 
 type BBRCliOptions struct {
@@ -42,30 +81,71 @@ type BBRCliOptions struct {
 
 func GetBBSimOpts() *BBSimCliOptions {
 
-	olt_id := flag.Int("olt_id", 0, "Number of OLT devices to be emulated")
+	olt_id := flag.Int("olt_id", 0, "ID of the first OLT device, the other OLT devices get the following IDs")
+	olts := flag.Int("olts", 1, "Number of OLT devices to be emulated, each one listens on the port that follows the one of the previous OLT")
 	nni := flag.Int("nni", 1, "Number of NNI ports per OLT device to be emulated")
 	pon := flag.Int("pon", 1, "Number of PON ports per OLT device to be emulated")
 	onu := flag.Int("onu", 1, "Number of ONU devices per PON port to be emulated")
+	uni := flag.Int("uni", 1, "Number of UNI ports per ONU device to be emulated, each one gets its own MAC address and C-Tag")
+	uniType := flag.String("uniType", UniTypePptp, "Type of the UNI ports reported in the OMCI MIB (pptp, veip)")
 
 	auth := flag.Bool("auth", false, "Set this flag if you want authentication to start automatically")
 	dhcp := flag.Bool("dhcp", false, "Set this flag if you want DHCP to start automatically")
 
 	s_tag := flag.Int("s_tag", 900, "S-Tag value")
-	c_tag_init := flag.Int("c_tag", 900, "C-Tag starting value, each ONU will get a sequential one (targeting 1024 ONUs per BBSim instance the range is big enough)")
+	c_tag_init := flag.Int("c_tag", 900, "C-Tag starting value, each UNI will get a sequential one (targeting 1024 UNIs per BBSim instance the range is big enough)")
 
 	profileCpu := flag.String("cpuprofile", "", "write cpu profile to file")
 
 	logLevel := flag.String("logLevel", "debug", "Set the log level (trace, debug, info, warn, error)")
 	logCaller := flag.Bool("logCaller", false, "Whether to print the caller filename or not")
 
+	rebootDelay := flag.Int("rebootDelay", 10, "Time (in seconds) the OLT takes to come back after a reboot")
+	onuRebootDelay := flag.Duration("onuRebootDelay", 5*time.Second, "Time the ONUs take to come back after a reboot requested via OMCI, eg: to activate a software image")
+	pmInterval := flag.Duration("pmInterval", 15*time.Minute, "Length of the intervals of the OMCI PM history data, eg: 1m to get the counters quickly")
+	strictFlows := flag.Bool("strictFlows", false, "Reject the flows a real OLT would reject, eg: flows for ONUs that are not active")
+	onuWorkers := flag.Int("onuWorkers", DefaultOnuWorkers, "Number of goroutines processing the messages of all the ONUs")
+
+	discoveryDelay := flag.Duration("discoveryDelay", 0, "Time between the discovery of two ONUs on the same PON, eg: 100ms")
+	discoveryJitter := flag.Duration("discoveryJitter", 0, "Maximum random time added to the discovery delay of each ONU")
+	discoveryRate := flag.Float64("discoveryRate", 0, "Maximum number of ONUs discovered per second on each PON, 0 means no limit")
+	discoveryOrder := flag.String("discoveryOrder", DiscoveryOrdered, "Order in which the ONUs on a PON are discovered (ordered, shuffled)")
+
+	vendorId := flag.String("onuVendorId", DefaultVendorId, "Vendor ID of the ONU serial numbers (4 characters)")
+	snPattern := flag.String("snPattern", DefaultSnPattern, "Hex digits of the ONU serial numbers, the {olt}, {pon} and {onu} placeholders are replaced by the IDs")
+	macPattern := flag.String("macPattern", DefaultMacPattern, "Hex digits of the UNI MAC addresses, the {olt}, {pon}, {onu} and {uni} placeholders are replaced by the IDs")
+	mibTemplates := flag.String("mibTemplates", "", "YAML or JSON file with the MIB templates of the ONU models, assigned per ONU or per serial number range")
+
+	oltAddress := flag.String("oltAddress", "0.0.0.0:50060", "Address the OLT gRPC server (VOLTHA) listens on, use port 0 to let the OS choose it")
+	apiAddress := flag.String("apiAddress", "0.0.0.0:50070", "Address the BBSim API gRPC server listens on, use port 0 to let the OS choose it")
+	restApiAddress := flag.String("restApiAddress", "0.0.0.0:50071", "Address the BBSim API REST server listens on, use port 0 to let the OS choose it")
+	legacyApiAddress := flag.String("legacyApiAddress", "0.0.0.0:50072", "Address the legacy API gRPC server listens on, use port 0 to let the OS choose it")
+	legacyRestApiAddress := flag.String("legacyRestApiAddress", "0.0.0.0:50073", "Address the legacy API REST server listens on, use port 0 to let the OS choose it")
+	addressesFile := flag.String("addressesFile", "", "YAML file the addresses the servers listen on are written to once all of them are listening, eg: to find the ports the OS chose")
+
+	defaults := DefaultDeviceInfo()
+	configFile := flag.String("config", "", "YAML file with the OLT DeviceInfo, the command line flags take precedence over it")
+	vendor := flag.String("oltVendor", defaults.Vendor, "OLT vendor reported to VOLTHA")
+	model := flag.String("oltModel", defaults.Model, "OLT model reported to VOLTHA")
+	hwVersion := flag.String("oltHwVersion", defaults.HardwareVersion, "OLT hardware version reported to VOLTHA")
+	fwVersion := flag.String("oltFwVersion", defaults.FirmwareVersion, "OLT firmware version reported to VOLTHA")
+	technology := flag.String("technology", defaults.Technology, "PON technology reported to VOLTHA")
+	flag.String("onuIdRange", defaults.OnuIdRange.String(), "Range of ONU IDs VOLTHA can use")
+	flag.String("allocIdRange", defaults.AllocIdRange.String(), "Range of Alloc IDs VOLTHA can use")
+	flag.String("gemportIdRange", defaults.GemportIdRange.String(), "Range of GemPort IDs VOLTHA can use")
+	flag.String("flowIdRange", defaults.FlowIdRange.String(), "Range of Flow IDs VOLTHA can use")
+
 	flag.Parse()
 
 	o := new(BBSimCliOptions)
 
 	o.OltID = int(*olt_id)
+	o.NumOlts = int(*olts)
 	o.NumNniPerOlt = int(*nni)
 	o.NumPonPerOlt = int(*pon)
 	o.NumOnuPerPon = int(*onu)
+	o.NumUniPerOnu = int(*uni)
+	o.UniType = *uniType
 	o.STag = int(*s_tag)
 	o.CTagInit = int(*c_tag_init)
 	o.ProfileCpu = profileCpu
@@ -73,6 +153,109 @@ func GetBBSimOpts() *BBSimCliOptions {
 	o.LogCaller = *logCaller
 	o.Auth = *auth
 	o.Dhcp = *dhcp
+	o.RebootDelay = *rebootDelay
+	o.OnuRebootDelay = *onuRebootDelay
+	o.PmInterval = *pmInterval
+	o.StrictFlows = *strictFlows
+	o.OnuWorkers = *onuWorkers
+	o.Discovery = DiscoveryOptions{
+		Delay:  *discoveryDelay,
+		Jitter: *discoveryJitter,
+		Rate:   *discoveryRate,
+		Order:  *discoveryOrder,
+	}
+	o.OltAddress = *oltAddress
+	o.ApiAddress = *apiAddress
+	o.RestApiAddress = *restApiAddress
+	o.LegacyApiAddress = *legacyApiAddress
+	o.LegacyRestApiAddress = *legacyRestApiAddress
+	o.AddressesFile = *addressesFile
+
+	o.DeviceInfo = defaults
+	if *configFile != "" {
+		config, err := LoadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("Cannot load the config file: %v", err)
+		}
+		o.DeviceInfo = config.DeviceInfo
+	}
+
+	// NOTE only the flags that have been set override the config file
+	ranges := map[string]*IdRange{
+		"onuIdRange":     &o.DeviceInfo.OnuIdRange,
+		"allocIdRange":   &o.DeviceInfo.AllocIdRange,
+		"gemportIdRange": &o.DeviceInfo.GemportIdRange,
+		"flowIdRange":    &o.DeviceInfo.FlowIdRange,
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "oltVendor":
+			o.DeviceInfo.Vendor = *vendor
+		case "oltModel":
+			o.DeviceInfo.Model = *model
+		case "oltHwVersion":
+			o.DeviceInfo.HardwareVersion = *hwVersion
+		case "oltFwVersion":
+			o.DeviceInfo.FirmwareVersion = *fwVersion
+		case "technology":
+			o.DeviceInfo.Technology = *technology
+		case "onuIdRange", "allocIdRange", "gemportIdRange", "flowIdRange":
+			r, err := ParseIdRange(f.Value.String())
+			if err != nil {
+				log.Fatalf("Invalid value for -%s: %v", f.Name, err)
+			}
+			*ranges[f.Name] = r
+		}
+	})
+
+	if o.NumOlts < 1 || o.OltID < 0 {
+		log.Fatalf("Invalid OLT configuration: at least one OLT is needed and the OLT IDs can't be negative")
+	}
+
+	if o.NumUniPerOnu < 1 || o.NumUniPerOnu > MaxUniPerOnu {
+		log.Fatalf("Invalid UNI configuration: the number of UNIs per ONU has to be between 1 and %d", MaxUniPerOnu)
+	}
+
+	if o.UniType != UniTypePptp && o.UniType != UniTypeVeip {
+		log.Fatalf("Invalid UNI configuration: unknown UNI type %s", o.UniType)
+	}
+
+	if o.OnuWorkers < 1 {
+		log.Fatalf("Invalid ONU workers configuration: at least one worker is needed")
+	}
+
+	if o.PmInterval <= 0 {
+		log.Fatalf("Invalid PM configuration: the PM interval has to be longer than 0")
+	}
+
+	if err := o.Discovery.Validate(); err != nil {
+		log.Fatalf("Invalid discovery configuration: %v", err)
+	}
+
+	if err := o.DeviceInfo.Validate(o.NumPonPerOlt); err != nil {
+		log.Fatalf("Invalid DeviceInfo configuration: %v", err)
+	}
+
+	if *mibTemplates != "" {
+		templates, err := LoadMibTemplates(*mibTemplates)
+		if err != nil {
+			log.Fatalf("Cannot load the MIB templates: %v", err)
+		}
+		if err := templates.CheckUnis(o.NumUniPerOnu); err != nil {
+			log.Fatalf("Cannot load the MIB templates: %v", err)
+		}
+		o.MibTemplates = templates
+	}
+
+	identities, err := NewOnuIdentities(*vendorId, *snPattern, *macPattern)
+	if err != nil {
+		log.Fatalf("Invalid ONU identities configuration: %v", err)
+	}
+	// NOTE two ONUs would get the same serial number or MAC address if one of the IDs doesn't fit in the patterns
+	if err := identities.Validate(o.OltID+o.NumOlts-1, o.NumPonPerOlt, o.NumOnuPerPon, o.MibTemplates.MaxUnis(o.NumUniPerOnu)); err != nil {
+		log.Fatalf("Invalid ONU identities configuration: %v", err)
+	}
+	o.OnuIdentities = identities
 
 	return o
 }